@@ -3,11 +3,11 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"sync"
 	"syscall/js"
 
+	"github.com/shiv248/kolabpad/internal/otutil"
 	ot "github.com/shiv248/operational-transformation-go"
 )
 
@@ -143,6 +143,21 @@ func wrapOpSeq(op *ot.OperationSeq) js.Value {
 		return op.TargetLen()
 	})
 
+	// clone() - independent deep copy
+	obj["clone"] = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		return wrapOpSeq(otutil.Clone(op))
+	})
+
+	// inserted_text() - concatenation of all inserted text
+	obj["inserted_text"] = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		return otutil.InsertedText(op)
+	})
+
+	// deleted_len() - number of characters deleted
+	obj["deleted_len"] = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		return otutil.DeletedLen(op)
+	})
+
 	// transform_index(position) - transform cursor position
 	obj["transform_index"] = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
 		if len(args) == 0 {
@@ -154,9 +169,9 @@ func wrapOpSeq(op *ot.OperationSeq) js.Value {
 		return newPos
 	})
 
-	// to_string() - serialize to JSON
+	// to_string() - serialize to versioned JSON ({"v":1,"ops":[...]})
 	obj["to_string"] = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-		data, err := json.Marshal(op)
+		data, err := otutil.MarshalVersioned(op)
 		if err != nil {
 			return "{}"
 		}
@@ -227,17 +242,16 @@ func main() {
 		return wrapOpSeq(ot.NewOperationSeq())
 	})
 
-	// OpSeq.from_str(json) - deserialize from JSON
+	// OpSeq.from_str(json) - deserialize from versioned or legacy JSON
 	opseqConstructor["from_str"] = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
 		if len(args) == 0 {
 			return nil
 		}
-		jsonStr := args[0].String()
-		var op ot.OperationSeq
-		if err := json.Unmarshal([]byte(jsonStr), &op); err != nil {
+		op, err := otutil.UnmarshalVersioned([]byte(args[0].String()))
+		if err != nil {
 			return nil
 		}
-		return wrapOpSeq(&op)
+		return wrapOpSeq(op)
 	})
 
 	// OpSeq.with_capacity(n) - create with capacity
@@ -249,6 +263,27 @@ func main() {
 		return wrapOpSeq(ot.WithCapacity(capacity))
 	})
 
+	// OpSeq.compose_all(ops) - fold an array of operations into one
+	opseqConstructor["compose_all"] = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) == 0 || args[0].Type() != js.TypeObject {
+			fmt.Println("compose_all error: expected an array of operations")
+			return nil
+		}
+		ops := make([]*ot.OperationSeq, args[0].Length())
+		for i := range ops {
+			if ops[i] = unwrapOpSeq(args[0].Index(i)); ops[i] == nil {
+				fmt.Printf("compose_all error: failed to unwrap operation %d\n", i)
+				return nil
+			}
+		}
+		result, err := otutil.ComposeAll(ops)
+		if err != nil {
+			fmt.Printf("compose_all error: %v\n", err)
+			return nil
+		}
+		return wrapOpSeq(result)
+	})
+
 	// Export OpSeq to global scope
 	js.Global().Set("OpSeq", js.ValueOf(opseqConstructor))
 
@@ -0,0 +1,571 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"nhooyr.io/websocket"
+
+	"github.com/shiv248/kolabpad/internal/protocol"
+	"github.com/shiv248/kolabpad/pkg/logger"
+	"github.com/shiv248/kolabpad/pkg/server"
+)
+
+// wsCompressionModes maps WS_COMPRESSION values to permessage-deflate modes.
+var wsCompressionModes = map[string]websocket.CompressionMode{
+	"disabled":          websocket.CompressionDisabled,
+	"contextTakeover":   websocket.CompressionContextTakeover,
+	"noContextTakeover": websocket.CompressionNoContextTakeover,
+}
+
+// Config holds all server configuration
+type Config struct {
+	Port                string
+	ExpiryDays          int
+	SQLiteURI           string
+	CleanupInterval     time.Duration
+	IntegrityInterval   time.Duration
+	IntegrityUnready    bool
+	PresenceInterval    time.Duration
+	IdleUnload          time.Duration
+	MaxDocumentSize     int
+	MaxDocumentSizeCap  int
+	MaxStoredDocuments  int
+	PersistDebounce     time.Duration
+	SnapshotInterval    time.Duration
+	SnapshotRetention   int
+	WSReadTimeout       time.Duration
+	WSWriteTimeout      time.Duration
+	WSWriteThroughput   int
+	WSHeartbeatInterval time.Duration
+	WSCompression       string
+	ServerTimeInterval  time.Duration
+	ShutdownGrace       time.Duration
+	BroadcastBufferSize int
+	SaturationWindow    time.Duration
+	SaturationUnready   bool
+	AllowedLanguages    []string
+	AllowedMessages     []string
+	DisabledNotice      bool
+	SuggestLanguage     bool
+	DedupUserNames      bool
+	HuePalette          []uint32
+	NormalizeNewlines   bool
+	DefaultContent      string
+	DefaultLanguage     *string
+	CoalesceWindow      time.Duration
+	NotifyWindow        time.Duration
+	MaxHistoryOps       int
+	MaxRevisionLag      int
+	MaxHistoryFrameSize int
+	MaxLines            int
+	MaxLineLength       int
+	MaxCursorsPerUser   int
+	MaxRemoteCursors    int
+	RecentChangeOps     int
+	InitialCacheWindow  time.Duration
+	CursorInterval      time.Duration
+	LanguageRateLimit   int
+	SavedCursors        int
+	MaxRequestBodySize  int
+	MaxHeaderSize       int
+	ReadHeaderTimeout   time.Duration
+	IdleTimeout         time.Duration
+	MaxDocumentIDLength int
+	DocumentNamespaces  bool
+	DocumentOwners      bool
+	CreateOnConnect     bool
+	AccessLog           bool
+	EventLog            bool
+	TrustedProxies      []netip.Prefix
+	AdminToken          string
+}
+
+// envReader parses typed values from the environment, collecting every
+// malformed variable so they can all be reported at once.
+type envReader struct {
+	getenv func(string) string
+	errs   []error
+}
+
+func (e *envReader) string(key, defaultValue string) string {
+	if value := e.getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func (e *envReader) int(key string, defaultValue int) int {
+	value := e.getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	i, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		e.errs = append(e.errs, fmt.Errorf("%s: %q is not an integer", key, value))
+		return defaultValue
+	}
+	return i
+}
+
+// bool parses a feature flag using strconv.ParseBool (1/0, true/false, ...).
+func (e *envReader) bool(key string, defaultValue bool) bool {
+	value := e.getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		e.errs = append(e.errs, fmt.Errorf("%s: %q is not a boolean", key, value))
+		return defaultValue
+	}
+	return b
+}
+
+// list parses a comma-separated list, ignoring blank entries.
+// Returns nil if the variable is unset or empty.
+func (e *envReader) list(key string) []string {
+	var list []string
+	for _, item := range strings.Split(e.getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// file returns the contents of the file named by the variable, or "" if unset.
+func (e *envReader) file(key string) string {
+	path := e.getenv(key)
+	if path == "" {
+		return ""
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Errorf("%s: %w", key, err))
+		return ""
+	}
+	return string(data)
+}
+
+// positive records an error unless value > 0.
+func (e *envReader) positive(key string, value int) {
+	if value <= 0 {
+		e.errs = append(e.errs, fmt.Errorf("%s: must be greater than 0, got %d", key, value))
+	}
+}
+
+// nonNegative records an error if value < 0.
+func (e *envReader) nonNegative(key string, value int) {
+	if value < 0 {
+		e.errs = append(e.errs, fmt.Errorf("%s: must not be negative, got %d", key, value))
+	}
+}
+
+// loadConfig reads configuration using getenv (os.Getenv in production) and
+// validates it. All invalid values are reported together in the returned error.
+func loadConfig(getenv func(string) string) (Config, error) {
+	env := &envReader{getenv: getenv}
+
+	port := env.string("PORT", "3030")
+	expiryDays := env.int("EXPIRY_DAYS", 7)
+	cleanupHours := env.int("CLEANUP_INTERVAL_HOURS", 1)
+	integrityHours := env.int("INTEGRITY_CHECK_HOURS", 0)
+	maxDocKB := env.int("MAX_DOCUMENT_SIZE_KB", 256)
+	maxDocCapKB := env.int("MAX_DOCUMENT_SIZE_CAP_KB", 1024)
+	maxStored := env.int("MAX_STORED_DOCUMENTS", 0)
+	snapshotMin := env.int("SNAPSHOT_INTERVAL_MINUTES", 0)
+	snapshotRetention := env.int("SNAPSHOT_RETENTION", 24)
+	readTimeoutMin := env.int("WS_READ_TIMEOUT_MINUTES", 30)
+	writeTimeoutSec := env.int("WS_WRITE_TIMEOUT_SECONDS", 10)
+	heartbeatSec := env.int("WS_HEARTBEAT_INTERVAL_SECONDS", 60)
+	throughputKB := env.int("WS_WRITE_THROUGHPUT_KB", 64)
+	serverTimeSec := env.int("SERVER_TIME_INTERVAL_SECONDS", 0)
+	shutdownGraceMs := env.int("SHUTDOWN_GRACE_MS", 1000)
+	presenceSec := env.int("PRESENCE_INTERVAL_SECONDS", 300)
+	idleUnloadMin := env.int("IDLE_UNLOAD_MINUTES", 0)
+	bufferSize := env.int("BROADCAST_BUFFER_SIZE", 16)
+	saturationSec := env.int("BROADCAST_SATURATION_SECONDS", 10)
+	coalesceMs := env.int("COALESCE_WINDOW_MS", 0)
+	notifyMs := env.int("NOTIFY_WINDOW_MS", 0)
+	maxHistoryOps := env.int("MAX_HISTORY_OPS", 0)
+	historyFrameKB := env.int("MAX_HISTORY_FRAME_KB", 1024)
+	maxRevisionLag := env.int("MAX_REVISION_LAG", 10000)
+	maxLines := env.int("MAX_LINES", 0)
+	maxLineLength := env.int("MAX_LINE_LENGTH", 0)
+	maxCursors := env.int("MAX_CURSORS_PER_USER", 64)
+	maxRemoteCursors := env.int("MAX_REMOTE_CURSORS", 0)
+	recentChangeOps := env.int("RECENT_CHANGE_OPS", 0)
+	initialCacheMs := env.int("INITIAL_CACHE_MS", 2000)
+	cursorIntervalMs := env.int("CURSOR_INTERVAL_MS", 50)
+	languageRate := env.int("LANGUAGE_CHANGES_PER_MINUTE", 30)
+	savedCursors := env.int("SAVED_CURSORS", 0)
+	maxBodyKB := env.int("MAX_REQUEST_BODY_KB", 64)
+	maxHeaderKB := env.int("MAX_HEADER_SIZE_KB", 1024)
+	headerTimeoutSec := env.int("READ_HEADER_TIMEOUT_SECONDS", 10)
+	idleTimeoutSec := env.int("IDLE_TIMEOUT_SECONDS", 120)
+	maxIDLength := env.int("MAX_DOCUMENT_ID_LENGTH", 256)
+	persistDebounceMs := env.int("PERSIST_DEBOUNCE_MS", 2000)
+
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		env.errs = append(env.errs, fmt.Errorf("PORT: %q is not a valid port (1-65535)", port))
+	}
+	env.positive("EXPIRY_DAYS", expiryDays)
+	env.positive("CLEANUP_INTERVAL_HOURS", cleanupHours)
+	env.nonNegative("INTEGRITY_CHECK_HOURS", integrityHours)
+	env.positive("MAX_DOCUMENT_SIZE_KB", maxDocKB)
+	env.positive("MAX_DOCUMENT_SIZE_CAP_KB", maxDocCapKB)
+	env.nonNegative("MAX_STORED_DOCUMENTS", maxStored)
+	env.nonNegative("SNAPSHOT_INTERVAL_MINUTES", snapshotMin)
+	env.nonNegative("PERSIST_DEBOUNCE_MS", persistDebounceMs)
+	env.positive("SNAPSHOT_RETENTION", snapshotRetention)
+	env.positive("WS_READ_TIMEOUT_MINUTES", readTimeoutMin)
+	env.positive("WS_WRITE_TIMEOUT_SECONDS", writeTimeoutSec)
+	env.positive("WS_HEARTBEAT_INTERVAL_SECONDS", heartbeatSec)
+	env.nonNegative("WS_WRITE_THROUGHPUT_KB", throughputKB)
+	env.nonNegative("SERVER_TIME_INTERVAL_SECONDS", serverTimeSec)
+	env.nonNegative("SHUTDOWN_GRACE_MS", shutdownGraceMs)
+	env.nonNegative("PRESENCE_INTERVAL_SECONDS", presenceSec)
+	env.nonNegative("IDLE_UNLOAD_MINUTES", idleUnloadMin)
+	env.positive("BROADCAST_BUFFER_SIZE", bufferSize)
+	env.nonNegative("BROADCAST_SATURATION_SECONDS", saturationSec)
+	env.nonNegative("COALESCE_WINDOW_MS", coalesceMs)
+	env.nonNegative("NOTIFY_WINDOW_MS", notifyMs)
+	env.nonNegative("MAX_HISTORY_OPS", maxHistoryOps)
+	env.nonNegative("MAX_HISTORY_FRAME_KB", historyFrameKB)
+	env.nonNegative("MAX_REVISION_LAG", maxRevisionLag)
+	env.nonNegative("MAX_LINES", maxLines)
+	env.nonNegative("MAX_LINE_LENGTH", maxLineLength)
+	env.nonNegative("MAX_CURSORS_PER_USER", maxCursors)
+	env.nonNegative("MAX_REMOTE_CURSORS", maxRemoteCursors)
+	env.nonNegative("RECENT_CHANGE_OPS", recentChangeOps)
+	env.nonNegative("INITIAL_CACHE_MS", initialCacheMs)
+	env.nonNegative("CURSOR_INTERVAL_MS", cursorIntervalMs)
+	env.nonNegative("LANGUAGE_CHANGES_PER_MINUTE", languageRate)
+	env.nonNegative("SAVED_CURSORS", savedCursors)
+	env.positive("MAX_REQUEST_BODY_KB", maxBodyKB)
+	env.positive("MAX_HEADER_SIZE_KB", maxHeaderKB)
+	env.nonNegative("READ_HEADER_TIMEOUT_SECONDS", headerTimeoutSec)
+	env.nonNegative("IDLE_TIMEOUT_SECONDS", idleTimeoutSec)
+	env.nonNegative("MAX_DOCUMENT_ID_LENGTH", maxIDLength)
+
+	wsCompression := env.string("WS_COMPRESSION", "disabled")
+	if _, ok := wsCompressionModes[wsCompression]; !ok {
+		env.errs = append(env.errs, fmt.Errorf("WS_COMPRESSION: %q must be disabled, contextTakeover or noContextTakeover", wsCompression))
+	}
+
+	// Bare addresses are accepted as single-host ranges
+	var trustedProxies []netip.Prefix
+	for _, item := range env.list("TRUSTED_PROXIES") {
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(item)
+			if addrErr != nil {
+				env.errs = append(env.errs, fmt.Errorf("TRUSTED_PROXIES: %q is not an IP address or CIDR range", item))
+				continue
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		trustedProxies = append(trustedProxies, prefix.Masked())
+	}
+
+	var huePalette []uint32
+	for _, item := range env.list("HUE_PALETTE") {
+		hue, err := strconv.ParseUint(item, 10, 32)
+		if err != nil || hue > 359 {
+			env.errs = append(env.errs, fmt.Errorf("HUE_PALETTE: %q is not a hue (0-359)", item))
+			continue
+		}
+		huePalette = append(huePalette, uint32(hue))
+	}
+
+	// Admin tokens are sent on every admin request; refuse guessable ones
+	adminToken := env.string("ADMIN_TOKEN", "")
+	if adminToken != "" && len(adminToken) < 16 {
+		env.errs = append(env.errs, fmt.Errorf("ADMIN_TOKEN: must be at least 16 characters, got %d", len(adminToken)))
+	}
+
+	defaultContent := env.file("DEFAULT_CONTENT_FILE")
+	if len(defaultContent) > maxDocKB*1024 {
+		env.errs = append(env.errs, fmt.Errorf("DEFAULT_CONTENT_FILE: %d bytes exceeds MAX_DOCUMENT_SIZE_KB", len(defaultContent)))
+	}
+	allowedMessages := env.list("ALLOWED_MESSAGES")
+	for _, typ := range allowedMessages {
+		if !slices.Contains(protocol.ClientMsgTypes, typ) {
+			env.errs = append(env.errs, fmt.Errorf("ALLOWED_MESSAGES: %q is not a client message type (%s)", typ, strings.Join(protocol.ClientMsgTypes, ", ")))
+		}
+	}
+
+	allowedLanguages := env.list("ALLOWED_LANGUAGES")
+	var defaultLanguage *string
+	if lang := env.string("DEFAULT_LANGUAGE", ""); lang != "" {
+		defaultLanguage = &lang
+		allowed := allowedLanguages
+		if len(allowed) == 0 {
+			allowed = server.DefaultLanguages
+		}
+		if !slices.Contains(allowed, lang) {
+			env.errs = append(env.errs, fmt.Errorf("DEFAULT_LANGUAGE: %q is not an allowed language", lang))
+		}
+	}
+
+	config := Config{
+		Port:                port,
+		ExpiryDays:          expiryDays,
+		SQLiteURI:           getenv("SQLITE_URI"),
+		CleanupInterval:     time.Duration(cleanupHours) * time.Hour,
+		IntegrityInterval:   time.Duration(integrityHours) * time.Hour,
+		IntegrityUnready:    env.bool("INTEGRITY_CHECK_UNREADY", false),
+		PresenceInterval:    time.Duration(presenceSec) * time.Second,
+		IdleUnload:          time.Duration(idleUnloadMin) * time.Minute,
+		MaxDocumentSize:     maxDocKB * 1024, // Convert KB to bytes
+		MaxDocumentSizeCap:  maxDocCapKB * 1024,
+		MaxStoredDocuments:  maxStored,
+		PersistDebounce:     time.Duration(persistDebounceMs) * time.Millisecond,
+		SnapshotInterval:    time.Duration(snapshotMin) * time.Minute,
+		SnapshotRetention:   snapshotRetention,
+		WSReadTimeout:       time.Duration(readTimeoutMin) * time.Minute,
+		WSWriteTimeout:      time.Duration(writeTimeoutSec) * time.Second,
+		WSWriteThroughput:   throughputKB * 1024, // Convert KB/s to bytes/s
+		WSHeartbeatInterval: time.Duration(heartbeatSec) * time.Second,
+		WSCompression:       wsCompression,
+		ServerTimeInterval:  time.Duration(serverTimeSec) * time.Second,
+		ShutdownGrace:       time.Duration(shutdownGraceMs) * time.Millisecond,
+		BroadcastBufferSize: bufferSize,
+		SaturationWindow:    time.Duration(saturationSec) * time.Second,
+		SaturationUnready:   env.bool("BROADCAST_SATURATION_UNREADY", false),
+		AllowedLanguages:    allowedLanguages,
+		AllowedMessages:     allowedMessages,
+		DisabledNotice:      env.bool("DISABLED_MESSAGE_NOTICE", false),
+		SuggestLanguage:     env.bool("SUGGEST_LANGUAGE", false),
+		DedupUserNames:      env.bool("DEDUP_USER_NAMES", false),
+		HuePalette:          huePalette,
+		NormalizeNewlines:   env.bool("NORMALIZE_NEWLINES", false),
+		DefaultContent:      defaultContent,
+		DefaultLanguage:     defaultLanguage,
+		CoalesceWindow:      time.Duration(coalesceMs) * time.Millisecond,
+		NotifyWindow:        time.Duration(notifyMs) * time.Millisecond,
+		MaxHistoryOps:       maxHistoryOps,
+		MaxRevisionLag:      maxRevisionLag,
+		MaxHistoryFrameSize: historyFrameKB * 1024,
+		MaxLines:            maxLines,
+		MaxLineLength:       maxLineLength,
+		MaxCursorsPerUser:   maxCursors,
+		MaxRemoteCursors:    maxRemoteCursors,
+		RecentChangeOps:     recentChangeOps,
+		InitialCacheWindow:  time.Duration(initialCacheMs) * time.Millisecond,
+		CursorInterval:      time.Duration(cursorIntervalMs) * time.Millisecond,
+		LanguageRateLimit:   languageRate,
+		SavedCursors:        savedCursors,
+		MaxRequestBodySize:  maxBodyKB * 1024,
+		MaxHeaderSize:       maxHeaderKB * 1024,
+		ReadHeaderTimeout:   time.Duration(headerTimeoutSec) * time.Second,
+		IdleTimeout:         time.Duration(idleTimeoutSec) * time.Second,
+		MaxDocumentIDLength: maxIDLength,
+		DocumentNamespaces:  env.bool("DOCUMENT_NAMESPACES", false),
+		DocumentOwners:      env.bool("DOCUMENT_OWNERS", false),
+		CreateOnConnect:     env.bool("CREATE_ON_CONNECT", true),
+		AccessLog:           env.bool("ACCESS_LOG", false),
+		EventLog:            env.bool("EVENT_LOG", false),
+		TrustedProxies:      trustedProxies,
+		AdminToken:          adminToken,
+	}
+
+	if len(env.errs) > 0 {
+		return Config{}, fmt.Errorf("invalid configuration:\n%w", errors.Join(env.errs...))
+	}
+	return config, nil
+}
+
+// serverConfig returns the document/connection settings for the server package.
+func (c Config) serverConfig() server.Config {
+	var observer server.EventObserver
+	if c.EventLog {
+		observer = server.LogObserver{}
+	}
+	return server.Config{
+		MaxDocumentSize:     c.MaxDocumentSize,
+		MaxDocumentSizeCap:  c.MaxDocumentSizeCap,
+		BroadcastBufferSize: c.BroadcastBufferSize,
+		SaturationWindow:    c.SaturationWindow,
+		SaturationUnready:   c.SaturationUnready,
+		WSReadTimeout:       c.WSReadTimeout,
+		WSWriteTimeout:      c.WSWriteTimeout,
+		WSWriteThroughput:   c.WSWriteThroughput,
+		WSHeartbeatInterval: c.WSHeartbeatInterval,
+		WSCompression:       wsCompressionModes[c.WSCompression],
+		ServerTimeInterval:  c.ServerTimeInterval,
+		ShutdownGrace:       c.ShutdownGrace,
+		AllowedLanguages:    c.AllowedLanguages,
+		AllowedMessages:     c.AllowedMessages,
+		DisabledNotice:      c.DisabledNotice,
+		SuggestLanguage:     c.SuggestLanguage,
+		DedupUserNames:      c.DedupUserNames,
+		HuePalette:          c.HuePalette,
+		NormalizeNewlines:   c.NormalizeNewlines,
+		DefaultContent:      c.DefaultContent,
+		DefaultLanguage:     c.DefaultLanguage,
+		CoalesceWindow:      c.CoalesceWindow,
+		NotifyWindow:        c.NotifyWindow,
+		MaxHistoryOps:       c.MaxHistoryOps,
+		MaxRevisionLag:      c.MaxRevisionLag,
+		MaxHistoryFrameSize: c.MaxHistoryFrameSize,
+		MaxLines:            c.MaxLines,
+		MaxLineLength:       c.MaxLineLength,
+		MaxCursorsPerUser:   c.MaxCursorsPerUser,
+		MaxRemoteCursors:    c.MaxRemoteCursors,
+		RecentChangeOps:     c.RecentChangeOps,
+		InitialCacheWindow:  c.InitialCacheWindow,
+		CursorInterval:      c.CursorInterval,
+		LanguageRateLimit:   c.LanguageRateLimit,
+		SavedCursors:        c.SavedCursors,
+		MaxRequestBodySize:  c.MaxRequestBodySize,
+		MaxHeaderSize:       c.MaxHeaderSize,
+		ReadHeaderTimeout:   c.ReadHeaderTimeout,
+		IdleTimeout:         c.IdleTimeout,
+		MaxDocumentIDLength: c.MaxDocumentIDLength,
+		MaxStoredDocuments:  c.MaxStoredDocuments,
+		PersistDebounce:     c.PersistDebounce,
+		SnapshotInterval:    c.SnapshotInterval,
+		SnapshotRetention:   c.SnapshotRetention,
+		IntegrityInterval:   c.IntegrityInterval,
+		IntegrityUnready:    c.IntegrityUnready,
+		DocumentNamespaces:  c.DocumentNamespaces,
+		DocumentOwners:      c.DocumentOwners,
+		CreateOnConnect:     c.CreateOnConnect,
+		AccessLog:           c.AccessLog,
+		TrustedProxies:      c.TrustedProxies,
+		AdminToken:          c.AdminToken,
+		Observer:            observer,
+	}
+}
+
+// log prints the effective configuration at startup.
+func (c Config) log() {
+	logger.Info("Port: %s", c.Port)
+	logger.Info("Document expiry: %d days (cleanup every %v)", c.ExpiryDays, c.CleanupInterval)
+	if c.IdleUnload > 0 {
+		logger.Info("Idle document unload: after %v without connections", c.IdleUnload)
+	}
+	logger.Info("Max document size: %d KB (per-document limits up to %d KB)", c.MaxDocumentSize/1024, max(c.MaxDocumentSizeCap, c.MaxDocumentSize)/1024)
+	if c.MaxStoredDocuments > 0 {
+		logger.Info("Max stored documents: %d", c.MaxStoredDocuments)
+	}
+	logger.Info("Persist debounce after OTP changes: %v", c.PersistDebounce)
+	if c.SnapshotInterval > 0 {
+		logger.Info("Document snapshots: every %v, keeping %d", c.SnapshotInterval, c.SnapshotRetention)
+	}
+	if c.IntegrityInterval > 0 {
+		logger.Info("Database integrity check: every %v (not ready on failure: %v)", c.IntegrityInterval, c.IntegrityUnready)
+	}
+	logger.Info("WebSocket timeouts: read=%v write=%v (+1s per %d KB) heartbeat=%v",
+		c.WSReadTimeout, c.WSWriteTimeout, c.WSWriteThroughput/1024, c.WSHeartbeatInterval)
+	logger.Info("WebSocket compression: %s", c.WSCompression)
+	logger.Info("Broadcast buffer size: %d", c.BroadcastBufferSize)
+	if c.SaturationWindow > 0 {
+		logger.Info("Broadcast saturation check: %v window (not ready when saturated: %v)", c.SaturationWindow, c.SaturationUnready)
+	}
+	logger.Info("Max request size: body=%d KB headers=%d KB", c.MaxRequestBodySize/1024, c.MaxHeaderSize/1024)
+	logger.Info("HTTP timeouts: headers=%v idle=%v", c.ReadHeaderTimeout, c.IdleTimeout)
+	logger.Info("Access log: %v", c.AccessLog)
+	logger.Info("Event log: %v", c.EventLog)
+	if len(c.TrustedProxies) > 0 {
+		proxies := make([]string, len(c.TrustedProxies))
+		for i, prefix := range c.TrustedProxies {
+			proxies[i] = prefix.String()
+		}
+		logger.Info("Trusted proxies: %s", strings.Join(proxies, ", "))
+	}
+	if c.AdminToken != "" {
+		logger.Info("Admin endpoints: enabled")
+	}
+	if c.MaxLines > 0 {
+		logger.Info("Max lines per document: %d", c.MaxLines)
+	}
+	if c.MaxLineLength > 0 {
+		logger.Info("Max line length: %d characters", c.MaxLineLength)
+	}
+	if c.MaxCursorsPerUser > 0 {
+		logger.Info("Max cursors per user: %d", c.MaxCursorsPerUser)
+	}
+	if c.MaxRemoteCursors > 0 {
+		logger.Info("Remote cursors shown per client: %d most recent", c.MaxRemoteCursors)
+	}
+	if c.RecentChangeOps > 0 {
+		logger.Info("Recent change highlights: last %d edits", c.RecentChangeOps)
+	}
+	logger.Info("Metadata limits: cursor updates every %v, %d language changes/min (0 = unlimited)", c.CursorInterval, c.LanguageRateLimit)
+	if c.SavedCursors > 0 {
+		logger.Info("Saved cursors: up to %d per document", c.SavedCursors)
+	}
+	if c.DefaultContent != "" || c.DefaultLanguage != nil {
+		lang := "none"
+		if c.DefaultLanguage != nil {
+			lang = *c.DefaultLanguage
+		}
+		logger.Info("New document template: %d bytes, language=%s", len(c.DefaultContent), lang)
+	}
+	if c.SuggestLanguage {
+		logger.Info("Language suggestions: enabled")
+	}
+	if c.DedupUserNames {
+		logger.Info("Display name deduplication: enabled")
+	}
+	if len(c.HuePalette) > 0 {
+		logger.Info("User color palette: %v", c.HuePalette)
+	}
+	if c.NormalizeNewlines {
+		logger.Info("Line ending normalization: enabled")
+	}
+	if c.DocumentNamespaces {
+		logger.Info("Document namespaces: enabled")
+	}
+	if c.DocumentOwners {
+		logger.Info("Document owners: enabled")
+	}
+	if !c.CreateOnConnect {
+		logger.Info("Create on connect: disabled (new documents need POST /api/document/new)")
+	}
+	if c.MaxDocumentIDLength > 0 {
+		logger.Info("Max document ID length: %d bytes", c.MaxDocumentIDLength)
+	}
+	if c.PresenceInterval > 0 {
+		logger.Info("Presence snapshot: every %v", c.PresenceInterval)
+	}
+	if c.ServerTimeInterval > 0 {
+		logger.Info("Server clock resync: every %v", c.ServerTimeInterval)
+	}
+	logger.Info("Shutdown grace period: %v", c.ShutdownGrace)
+	if c.CoalesceWindow > 0 {
+		logger.Info("Edit coalescing: %v window", c.CoalesceWindow)
+	}
+	if c.NotifyWindow > 0 {
+		logger.Info("Broadcast batching: %v window", c.NotifyWindow)
+	}
+	if c.InitialCacheWindow > 0 {
+		logger.Info("Initial history cache: %v window", c.InitialCacheWindow)
+	}
+	if c.MaxHistoryOps > 0 {
+		logger.Info("History cap: %d operations per document", c.MaxHistoryOps)
+	}
+	if c.MaxHistoryFrameSize > 0 {
+		logger.Info("History frame size: %d KB", c.MaxHistoryFrameSize/1024)
+	}
+	if c.MaxRevisionLag > 0 {
+		logger.Info("Revision lag limit: %d revisions", c.MaxRevisionLag)
+	}
+	if len(c.AllowedMessages) > 0 {
+		logger.Info("Allowed client messages: %s (notice when disabled: %v)", strings.Join(c.AllowedMessages, ", "), c.DisabledNotice)
+	}
+	if len(c.AllowedLanguages) > 0 {
+		logger.Info("Allowed languages: %s", strings.Join(c.AllowedLanguages, ", "))
+	} else {
+		logger.Info("Allowed languages: default set")
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+
+	"github.com/shiv248/kolabpad/pkg/server"
+)
+
+// envMap returns a getenv function backed by a map.
+func envMap(vars map[string]string) func(string) string {
+	return func(key string) string { return vars[key] }
+}
+
+// TestLoadConfigDefaults tests that an empty environment yields the documented defaults.
+func TestLoadConfigDefaults(t *testing.T) {
+	config, err := loadConfig(envMap(nil))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if config.Port != "3030" {
+		t.Errorf("Expected port 3030, got %s", config.Port)
+	}
+	if config.ExpiryDays != 7 {
+		t.Errorf("Expected 7 expiry days, got %d", config.ExpiryDays)
+	}
+	if config.MaxDocumentSize != 256*1024 {
+		t.Errorf("Expected max document size %d, got %d", 256*1024, config.MaxDocumentSize)
+	}
+	if config.MaxDocumentSizeCap != 1024*1024 {
+		t.Errorf("Expected max document size cap %d, got %d", 1024*1024, config.MaxDocumentSizeCap)
+	}
+	if config.WSWriteTimeout != 10*time.Second {
+		t.Errorf("Expected write timeout 10s, got %v", config.WSWriteTimeout)
+	}
+	if config.WSWriteThroughput != 64*1024 {
+		t.Errorf("Expected write throughput %d, got %d", 64*1024, config.WSWriteThroughput)
+	}
+	if config.MaxRequestBodySize != 64*1024 || config.MaxHeaderSize != 1024*1024 {
+		t.Errorf("Unexpected request limits: body=%d headers=%d", config.MaxRequestBodySize, config.MaxHeaderSize)
+	}
+	if config.ReadHeaderTimeout != 10*time.Second || config.IdleTimeout != 2*time.Minute {
+		t.Errorf("Unexpected HTTP timeouts: headers=%v idle=%v", config.ReadHeaderTimeout, config.IdleTimeout)
+	}
+	if config.BroadcastBufferSize != 16 {
+		t.Errorf("Expected broadcast buffer 16, got %d", config.BroadcastBufferSize)
+	}
+	if config.ShutdownGrace != time.Second {
+		t.Errorf("Expected shutdown grace period 1s, got %v", config.ShutdownGrace)
+	}
+	if config.AllowedLanguages != nil {
+		t.Errorf("Expected no language override, got %v", config.AllowedLanguages)
+	}
+	if config.MaxCursorsPerUser != 64 {
+		t.Errorf("Expected cursor cap 64, got %d", config.MaxCursorsPerUser)
+	}
+	if config.RecentChangeOps != 0 {
+		t.Errorf("Expected recent change highlights disabled, got %d", config.RecentChangeOps)
+	}
+	if config.SaturationWindow != 10*time.Second || config.SaturationUnready {
+		t.Errorf("Expected a 10s saturation window that leaves readiness alone, got %v (unready %v)", config.SaturationWindow, config.SaturationUnready)
+	}
+	if config.InitialCacheWindow != 2*time.Second {
+		t.Errorf("Expected initial history cache window 2s, got %v", config.InitialCacheWindow)
+	}
+	if config.CursorInterval != 50*time.Millisecond || config.LanguageRateLimit != 30 {
+		t.Errorf("Expected 50ms cursor interval and 30 language changes/min, got %v and %d", config.CursorInterval, config.LanguageRateLimit)
+	}
+	if config.SavedCursors != 0 {
+		t.Errorf("Expected saved cursors disabled, got %d", config.SavedCursors)
+	}
+	if config.MaxStoredDocuments != 0 {
+		t.Errorf("Expected stored documents unlimited, got %d", config.MaxStoredDocuments)
+	}
+	if config.IntegrityInterval != 0 || config.IntegrityUnready {
+		t.Errorf("Expected integrity checks disabled, got %v (unready %v)", config.IntegrityInterval, config.IntegrityUnready)
+	}
+	if config.SnapshotInterval != 0 || config.SnapshotRetention != 24 {
+		t.Errorf("Expected snapshots disabled with retention 24, got %v and %d", config.SnapshotInterval, config.SnapshotRetention)
+	}
+	if config.MaxLines != 0 || config.MaxLineLength != 0 {
+		t.Errorf("Expected line limits disabled, got %d lines of %d", config.MaxLines, config.MaxLineLength)
+	}
+	if config.MaxHistoryFrameSize != 1024*1024 {
+		t.Errorf("Expected history frames of 1 MB, got %d", config.MaxHistoryFrameSize)
+	}
+	if config.MaxRevisionLag != 10000 {
+		t.Errorf("Expected revision lag limit 10000, got %d", config.MaxRevisionLag)
+	}
+	if config.WSCompression != "disabled" {
+		t.Errorf("Expected compression disabled, got %q", config.WSCompression)
+	}
+	if config.PresenceInterval != 5*time.Minute {
+		t.Errorf("Expected presence interval 5m, got %v", config.PresenceInterval)
+	}
+	if config.IdleUnload != 0 {
+		t.Errorf("Expected idle unload disabled, got %v", config.IdleUnload)
+	}
+	if config.TrustedProxies != nil {
+		t.Errorf("Expected no trusted proxies, got %v", config.TrustedProxies)
+	}
+	if config.AdminToken != "" {
+		t.Error("Expected admin endpoints disabled by default")
+	}
+	if config.serverConfig().Observer != nil {
+		t.Error("Expected no event observer by default")
+	}
+	if config.MaxDocumentIDLength != 256 || config.DocumentNamespaces {
+		t.Errorf("Unexpected document ID rules: length=%d namespaces=%v", config.MaxDocumentIDLength, config.DocumentNamespaces)
+	}
+	if config.DocumentOwners {
+		t.Error("Expected document owners disabled by default")
+	}
+	if !config.serverConfig().CreateOnConnect {
+		t.Error("Expected connecting to create documents by default")
+	}
+}
+
+// TestLoadConfigOverrides tests that valid environment values are parsed and converted.
+func TestLoadConfigOverrides(t *testing.T) {
+	config, err := loadConfig(envMap(map[string]string{
+		"PORT":                         "8080",
+		"SQLITE_URI":                   "/data/kolabpad.db",
+		"MAX_DOCUMENT_SIZE_KB":         "512",
+		"MAX_DOCUMENT_SIZE_CAP_KB":     "2048",
+		"WS_READ_TIMEOUT_MINUTES":      "5",
+		"CLEANUP_INTERVAL_HOURS":       "2",
+		"INTEGRITY_CHECK_HOURS":        "24",
+		"INTEGRITY_CHECK_UNREADY":      "true",
+		"BROADCAST_BUFFER_SIZE":        "64",
+		"ALLOWED_LANGUAGES":            " go, python ,,",
+		"WS_WRITE_TIMEOUT_SECONDS":     "3",
+		"COALESCE_WINDOW_MS":           "500",
+		"NOTIFY_WINDOW_MS":             "15",
+		"ACCESS_LOG":                   "true",
+		"EVENT_LOG":                    "true",
+		"SERVER_TIME_INTERVAL_SECONDS": "30",
+		"SHUTDOWN_GRACE_MS":            "5000",
+		"PRESENCE_INTERVAL_SECONDS":    "0",
+		"IDLE_UNLOAD_MINUTES":          "15",
+		"MAX_HISTORY_OPS":              "1000",
+		"MAX_HISTORY_FRAME_KB":         "0",
+		"MAX_REVISION_LAG":             "0",
+		"MAX_CURSORS_PER_USER":         "8",
+		"MAX_REMOTE_CURSORS":           "10",
+		"RECENT_CHANGE_OPS":            "20",
+		"INITIAL_CACHE_MS":             "0",
+		"BROADCAST_SATURATION_SECONDS": "30",
+		"BROADCAST_SATURATION_UNREADY": "true",
+		"CURSOR_INTERVAL_MS":           "0",
+		"LANGUAGE_CHANGES_PER_MINUTE":  "5",
+		"SAVED_CURSORS":                "10",
+		"MAX_LINES":                    "10000",
+		"MAX_LINE_LENGTH":              "2000",
+		"MAX_STORED_DOCUMENTS":         "5000",
+		"SNAPSHOT_INTERVAL_MINUTES":    "60",
+		"PERSIST_DEBOUNCE_MS":          "500",
+		"SNAPSHOT_RETENTION":           "48",
+		"READ_HEADER_TIMEOUT_SECONDS":  "5",
+		"IDLE_TIMEOUT_SECONDS":         "0",
+		"SUGGEST_LANGUAGE":             "1",
+		"DEDUP_USER_NAMES":             "true",
+		"HUE_PALETTE":                  "0, 120,240",
+		"NORMALIZE_NEWLINES":           "true",
+		"WS_COMPRESSION":               "noContextTakeover",
+		"TRUSTED_PROXIES":              "10.0.0.0/8, 192.168.1.7,::1",
+		"ADMIN_TOKEN":                  "0123456789abcdef",
+		"MAX_DOCUMENT_ID_LENGTH":       "64",
+		"DOCUMENT_NAMESPACES":          "true",
+		"DOCUMENT_OWNERS":              "true",
+		"CREATE_ON_CONNECT":            "false",
+	}))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if config.Port != "8080" || config.SQLiteURI != "/data/kolabpad.db" {
+		t.Errorf("Unexpected port/uri: %s %s", config.Port, config.SQLiteURI)
+	}
+	if config.MaxDocumentSize != 512*1024 {
+		t.Errorf("Expected max document size %d, got %d", 512*1024, config.MaxDocumentSize)
+	}
+	if config.MaxDocumentSizeCap != 2048*1024 {
+		t.Errorf("Expected max document size cap %d, got %d", 2048*1024, config.MaxDocumentSizeCap)
+	}
+	if config.WSReadTimeout != 5*time.Minute || config.WSWriteTimeout != 3*time.Second {
+		t.Errorf("Unexpected timeouts: read=%v write=%v", config.WSReadTimeout, config.WSWriteTimeout)
+	}
+	if config.CleanupInterval != 2*time.Hour {
+		t.Errorf("Expected cleanup interval 2h, got %v", config.CleanupInterval)
+	}
+	if sc := config.serverConfig(); sc.IntegrityInterval != 24*time.Hour || !sc.IntegrityUnready {
+		t.Errorf("Expected daily integrity checks that flip readiness, got %v (unready %v)", sc.IntegrityInterval, sc.IntegrityUnready)
+	}
+	if config.CoalesceWindow != 500*time.Millisecond {
+		t.Errorf("Expected coalesce window 500ms, got %v", config.CoalesceWindow)
+	}
+	if config.serverConfig().NotifyWindow != 15*time.Millisecond {
+		t.Errorf("Expected notify window 15ms, got %v", config.NotifyWindow)
+	}
+	if !config.AccessLog {
+		t.Error("Expected access log to be enabled")
+	}
+	if _, ok := config.serverConfig().Observer.(server.LogObserver); !ok {
+		t.Error("Expected the event log to install a LogObserver")
+	}
+	if !config.SuggestLanguage {
+		t.Error("Expected language suggestions to be enabled")
+	}
+	if !slices.Equal(config.HuePalette, []uint32{0, 120, 240}) {
+		t.Errorf("Expected hue palette [0 120 240], got %v", config.HuePalette)
+	}
+	if !config.DedupUserNames {
+		t.Error("Expected display name deduplication to be enabled")
+	}
+	if !config.serverConfig().NormalizeNewlines {
+		t.Error("Expected line ending normalization to be enabled")
+	}
+	if mode := config.serverConfig().WSCompression; mode != websocket.CompressionNoContextTakeover {
+		t.Errorf("Expected no-context-takeover compression, got %v", mode)
+	}
+	if got := fmt.Sprint(config.TrustedProxies); got != "[10.0.0.0/8 192.168.1.7/32 ::1/128]" {
+		t.Errorf("Expected trusted proxies [10.0.0.0/8 192.168.1.7/32 ::1/128], got %s", got)
+	}
+	if config.serverConfig().AdminToken != "0123456789abcdef" {
+		t.Error("Expected admin token to reach the server config")
+	}
+	if config.MaxHistoryOps != 1000 {
+		t.Errorf("Expected history cap 1000, got %d", config.MaxHistoryOps)
+	}
+	if config.MaxHistoryFrameSize != 0 {
+		t.Errorf("Expected unlimited history frames, got %d", config.MaxHistoryFrameSize)
+	}
+	if config.serverConfig().MaxRevisionLag != 0 {
+		t.Errorf("Expected unlimited revision lag, got %d", config.MaxRevisionLag)
+	}
+	if config.MaxCursorsPerUser != 8 {
+		t.Errorf("Expected cursor cap 8, got %d", config.MaxCursorsPerUser)
+	}
+	if config.serverConfig().MaxRemoteCursors != 10 {
+		t.Errorf("Expected remote cursor cap 10, got %d", config.MaxRemoteCursors)
+	}
+	if config.serverConfig().RecentChangeOps != 20 {
+		t.Errorf("Expected recent changes from the last 20 edits, got %d", config.RecentChangeOps)
+	}
+	if sc := config.serverConfig(); sc.SaturationWindow != 30*time.Second || !sc.SaturationUnready {
+		t.Errorf("Expected a 30s saturation window that flips readiness, got %v (unready %v)", sc.SaturationWindow, sc.SaturationUnready)
+	}
+	if config.serverConfig().InitialCacheWindow != 0 {
+		t.Errorf("Expected initial history cache disabled, got %v", config.InitialCacheWindow)
+	}
+	if sc := config.serverConfig(); sc.CursorInterval != 0 || sc.LanguageRateLimit != 5 {
+		t.Errorf("Expected unthrottled cursors and 5 language changes/min, got %v and %d", sc.CursorInterval, sc.LanguageRateLimit)
+	}
+	if config.serverConfig().SavedCursors != 10 {
+		t.Errorf("Expected 10 saved cursors, got %d", config.SavedCursors)
+	}
+	if sc := config.serverConfig(); sc.MaxLines != 10000 || sc.MaxLineLength != 2000 {
+		t.Errorf("Expected 10000 lines of 2000 characters, got %d of %d", sc.MaxLines, sc.MaxLineLength)
+	}
+	if config.serverConfig().MaxStoredDocuments != 5000 {
+		t.Errorf("Expected stored document cap 5000, got %d", config.MaxStoredDocuments)
+	}
+	if sc := config.serverConfig(); sc.SnapshotInterval != time.Hour || sc.SnapshotRetention != 48 {
+		t.Errorf("Expected hourly snapshots keeping 48, got %v keeping %d", sc.SnapshotInterval, sc.SnapshotRetention)
+	}
+	if sc := config.serverConfig(); sc.ReadHeaderTimeout != 5*time.Second || sc.IdleTimeout != 0 {
+		t.Errorf("Expected 5s header timeout and no idle timeout, got %v and %v", sc.ReadHeaderTimeout, sc.IdleTimeout)
+	}
+	if config.PresenceInterval != 0 {
+		t.Errorf("Expected presence snapshots disabled, got %v", config.PresenceInterval)
+	}
+	if config.IdleUnload != 15*time.Minute {
+		t.Errorf("Expected idle unload 15m, got %v", config.IdleUnload)
+	}
+	if config.ServerTimeInterval != 30*time.Second {
+		t.Errorf("Expected server time interval 30s, got %v", config.ServerTimeInterval)
+	}
+	if config.serverConfig().ShutdownGrace != 5*time.Second {
+		t.Errorf("Expected shutdown grace period 5s, got %v", config.ShutdownGrace)
+	}
+	if config.BroadcastBufferSize != 64 {
+		t.Errorf("Expected broadcast buffer 64, got %d", config.BroadcastBufferSize)
+	}
+	if len(config.AllowedLanguages) != 2 || config.AllowedLanguages[0] != "go" || config.AllowedLanguages[1] != "python" {
+		t.Errorf("Expected [go python], got %v", config.AllowedLanguages)
+	}
+	if config.MaxDocumentIDLength != 64 || !config.DocumentNamespaces {
+		t.Errorf("Unexpected document ID rules: length=%d namespaces=%v", config.MaxDocumentIDLength, config.DocumentNamespaces)
+	}
+	if !config.serverConfig().DocumentOwners {
+		t.Error("Expected document owners enabled")
+	}
+	if config.serverConfig().CreateOnConnect {
+		t.Error("Expected create on connect disabled")
+	}
+	if config.serverConfig().PersistDebounce != 500*time.Millisecond {
+		t.Errorf("Expected persist debounce 500ms, got %v", config.PersistDebounce)
+	}
+}
+
+// TestLoadConfigInvalid tests that malformed or out-of-range values are rejected.
+func TestLoadConfigInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{"non-numeric size", map[string]string{"MAX_DOCUMENT_SIZE_KB": "abc"}, "MAX_DOCUMENT_SIZE_KB"},
+		{"zero size cap", map[string]string{"MAX_DOCUMENT_SIZE_CAP_KB": "0"}, "MAX_DOCUMENT_SIZE_CAP_KB"},
+		{"port out of range", map[string]string{"PORT": "70000"}, "PORT"},
+		{"port not a number", map[string]string{"PORT": "http"}, "PORT"},
+		{"zero timeout", map[string]string{"WS_WRITE_TIMEOUT_SECONDS": "0"}, "WS_WRITE_TIMEOUT_SECONDS"},
+		{"negative heartbeat", map[string]string{"WS_HEARTBEAT_INTERVAL_SECONDS": "-5"}, "WS_HEARTBEAT_INTERVAL_SECONDS"},
+		{"zero buffer", map[string]string{"BROADCAST_BUFFER_SIZE": "0"}, "BROADCAST_BUFFER_SIZE"},
+		{"non-boolean flag", map[string]string{"ACCESS_LOG": "sometimes"}, "ACCESS_LOG"},
+		{"negative throughput", map[string]string{"WS_WRITE_THROUGHPUT_KB": "-64"}, "WS_WRITE_THROUGHPUT_KB"},
+		{"negative coalesce window", map[string]string{"COALESCE_WINDOW_MS": "-1"}, "COALESCE_WINDOW_MS"},
+		{"negative notify window", map[string]string{"NOTIFY_WINDOW_MS": "-1"}, "NOTIFY_WINDOW_MS"},
+		{"zero body limit", map[string]string{"MAX_REQUEST_BODY_KB": "0"}, "MAX_REQUEST_BODY_KB"},
+		{"negative header timeout", map[string]string{"READ_HEADER_TIMEOUT_SECONDS": "-1"}, "READ_HEADER_TIMEOUT_SECONDS"},
+		{"negative idle timeout", map[string]string{"IDLE_TIMEOUT_SECONDS": "-1"}, "IDLE_TIMEOUT_SECONDS"},
+		{"negative history cap", map[string]string{"MAX_HISTORY_OPS": "-1"}, "MAX_HISTORY_OPS"},
+		{"negative history frame size", map[string]string{"MAX_HISTORY_FRAME_KB": "-1"}, "MAX_HISTORY_FRAME_KB"},
+		{"negative revision lag", map[string]string{"MAX_REVISION_LAG": "-1"}, "MAX_REVISION_LAG"},
+		{"negative stored document cap", map[string]string{"MAX_STORED_DOCUMENTS": "-1"}, "MAX_STORED_DOCUMENTS"},
+		{"negative snapshot interval", map[string]string{"SNAPSHOT_INTERVAL_MINUTES": "-1"}, "SNAPSHOT_INTERVAL_MINUTES"},
+		{"zero snapshot retention", map[string]string{"SNAPSHOT_RETENTION": "0"}, "SNAPSHOT_RETENTION"},
+		{"negative line cap", map[string]string{"MAX_LINES": "-1"}, "MAX_LINES"},
+		{"negative line length", map[string]string{"MAX_LINE_LENGTH": "-1"}, "MAX_LINE_LENGTH"},
+		{"negative cursor cap", map[string]string{"MAX_CURSORS_PER_USER": "-1"}, "MAX_CURSORS_PER_USER"},
+		{"negative remote cursor cap", map[string]string{"MAX_REMOTE_CURSORS": "-1"}, "MAX_REMOTE_CURSORS"},
+		{"negative integrity interval", map[string]string{"INTEGRITY_CHECK_HOURS": "-1"}, "INTEGRITY_CHECK_HOURS"},
+		{"negative recent changes", map[string]string{"RECENT_CHANGE_OPS": "-1"}, "RECENT_CHANGE_OPS"},
+		{"negative initial cache window", map[string]string{"INITIAL_CACHE_MS": "-1"}, "INITIAL_CACHE_MS"},
+		{"negative saturation window", map[string]string{"BROADCAST_SATURATION_SECONDS": "-1"}, "BROADCAST_SATURATION_SECONDS"},
+		{"negative cursor interval", map[string]string{"CURSOR_INTERVAL_MS": "-1"}, "CURSOR_INTERVAL_MS"},
+		{"negative language rate", map[string]string{"LANGUAGE_CHANGES_PER_MINUTE": "-5"}, "LANGUAGE_CHANGES_PER_MINUTE"},
+		{"negative saved cursors", map[string]string{"SAVED_CURSORS": "-1"}, "SAVED_CURSORS"},
+		{"unknown compression mode", map[string]string{"WS_COMPRESSION": "gzip"}, "WS_COMPRESSION"},
+		{"negative server time interval", map[string]string{"SERVER_TIME_INTERVAL_SECONDS": "-1"}, "SERVER_TIME_INTERVAL_SECONDS"},
+		{"negative shutdown grace period", map[string]string{"SHUTDOWN_GRACE_MS": "-1"}, "SHUTDOWN_GRACE_MS"},
+		{"short admin token", map[string]string{"ADMIN_TOKEN": "secret"}, "ADMIN_TOKEN"},
+		{"malformed trusted proxy", map[string]string{"TRUSTED_PROXIES": "10.0.0.0/8,proxy.local"}, "TRUSTED_PROXIES"},
+		{"negative idle unload", map[string]string{"IDLE_UNLOAD_MINUTES": "-1"}, "IDLE_UNLOAD_MINUTES"},
+		{"negative presence interval", map[string]string{"PRESENCE_INTERVAL_SECONDS": "-1"}, "PRESENCE_INTERVAL_SECONDS"},
+		{"negative document ID length", map[string]string{"MAX_DOCUMENT_ID_LENGTH": "-1"}, "MAX_DOCUMENT_ID_LENGTH"},
+		{"negative persist debounce", map[string]string{"PERSIST_DEBOUNCE_MS": "-1"}, "PERSIST_DEBOUNCE_MS"},
+		{"hue out of range", map[string]string{"HUE_PALETTE": "0,360"}, "HUE_PALETTE"},
+		{"non-numeric hue", map[string]string{"HUE_PALETTE": "red"}, "HUE_PALETTE"},
+		{"unknown message type", map[string]string{"ALLOWED_MESSAGES": "Edit,Chat"}, "ALLOWED_MESSAGES"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfig(envMap(tt.env))
+			if err == nil {
+				t.Fatal("Expected error, got nil")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Expected error mentioning %s, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+// TestLoadConfigReportsAllErrors tests that every invalid variable is reported at once.
+func TestLoadConfigReportsAllErrors(t *testing.T) {
+	_, err := loadConfig(envMap(map[string]string{
+		"EXPIRY_DAYS":           "soon",
+		"BROADCAST_BUFFER_SIZE": "-1",
+	}))
+	if err == nil {
+		t.Fatal("Expected error, got nil")
+	}
+	for _, key := range []string{"EXPIRY_DAYS", "BROADCAST_BUFFER_SIZE"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("Expected error to mention %s, got %v", key, err)
+		}
+	}
+}
+
+// TestEnvReaderBool tests feature flag parsing.
+func TestEnvReaderBool(t *testing.T) {
+	env := &envReader{getenv: envMap(map[string]string{"ON": "true", "OFF": "0", "BAD": "yes please"})}
+
+	if !env.bool("ON", false) {
+		t.Error("Expected ON to be true")
+	}
+	if env.bool("OFF", true) {
+		t.Error("Expected OFF to be false")
+	}
+	if !env.bool("UNSET", true) {
+		t.Error("Expected UNSET to use default")
+	}
+	if len(env.errs) != 0 {
+		t.Fatalf("Unexpected errors: %v", env.errs)
+	}
+
+	env.bool("BAD", false)
+	if len(env.errs) != 1 {
+		t.Errorf("Expected 1 error for BAD, got %v", env.errs)
+	}
+}
+
+// TestLoadConfigDefaultContent tests loading the new-document template.
+func TestLoadConfigDefaultContent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "welcome.md")
+	if err := os.WriteFile(path, []byte("# Welcome\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write template: %v", err)
+	}
+
+	config, err := loadConfig(envMap(map[string]string{
+		"DEFAULT_CONTENT_FILE": path,
+		"DEFAULT_LANGUAGE":     "markdown",
+	}))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.DefaultContent != "# Welcome\n" {
+		t.Errorf("Expected template content, got %q", config.DefaultContent)
+	}
+	if config.DefaultLanguage == nil || *config.DefaultLanguage != "markdown" {
+		t.Errorf("Expected default language markdown, got %v", config.DefaultLanguage)
+	}
+
+	_, err = loadConfig(envMap(map[string]string{
+		"DEFAULT_CONTENT_FILE": filepath.Join(t.TempDir(), "missing.md"),
+		"ALLOWED_LANGUAGES":    "go",
+		"DEFAULT_LANGUAGE":     "markdown",
+	}))
+	if err == nil || !strings.Contains(err.Error(), "DEFAULT_CONTENT_FILE") || !strings.Contains(err.Error(), "DEFAULT_LANGUAGE") {
+		t.Errorf("Expected missing file and disallowed language errors, got %v", err)
+	}
+}
@@ -16,6 +16,9 @@ export const WEBSOCKET = {
 
   /** Multiplier for failure reset interval (failures reset after RECONNECT_INTERVAL * this value) */
   FAILURE_RESET_MULTIPLIER: 15,
+
+  /** Close code sent when the share link used to connect is revoked */
+  CLOSE_ACCESS_REVOKED: 4006,
 } as const;
 
 /**
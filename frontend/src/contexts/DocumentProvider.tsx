@@ -32,6 +32,21 @@ interface DocumentContextValue {
 
 const DocumentContext = createContext<DocumentContextValue | undefined>(undefined);
 
+/**
+ * Per-tab token sent on every (re)connect so the server can hand back the same
+ * user ID and drop the stale connection instead of showing a ghost user.
+ */
+function getReconnectToken(): string {
+  const key = "kolabpad-reconnect-token";
+  let token = sessionStorage.getItem(key);
+  if (!token) {
+    const bytes = crypto.getRandomValues(new Uint8Array(16));
+    token = Array.from(bytes, (b) => b.toString(16).padStart(2, "0")).join("");
+    sessionStorage.setItem(key, token);
+  }
+  return token;
+}
+
 function getWsUri(id: string) {
   let url = new URL(`api/socket/${id}`, window.location.href);
   url.protocol = url.protocol == "https:" ? "wss:" : "ws:";
@@ -42,6 +57,8 @@ function getWsUri(id: string) {
     url.searchParams.set('otp', otp);
   }
 
+  url.searchParams.set('token', getReconnectToken());
+
   return url.href;
 }
 
@@ -121,6 +138,15 @@ export function DocumentProvider({
       onChangeOTP: (otp, userId, userName) => {
         setOtpBroadcast({ otp, userId, userName });
       },
+      onAnnouncement: (message) => {
+        toast({
+          title: "Announcement",
+          description: message,
+          status: "info",
+          duration: null,
+          isClosable: true,
+        });
+      },
     });
 
     return () => {
@@ -32,6 +32,7 @@ export type KolabpadOptions = {
   readonly onChangeUsers?: (users: Record<number, UserInfo>) => void;
   readonly onAuthError?: () => void;
   readonly onChangeOTP?: (otp: string | null, userId: number, userName: string) => void;
+  readonly onAnnouncement?: (message: string) => void;
   readonly reconnectInterval?: number;
 };
 
@@ -185,7 +186,11 @@ class Kolabpad {
       if (this.ws) {
         this.ws = undefined;
         this.options.onDisconnected?.();
-        if (++this.recentFailures >= WEBSOCKET.MAX_FAILURES) {
+        if (event.code === WEBSOCKET.CLOSE_ACCESS_REVOKED) {
+          // Reconnecting with the revoked link would only be refused
+          this.dispose();
+          this.options.onAuthError?.();
+        } else if (++this.recentFailures >= WEBSOCKET.MAX_FAILURES) {
           // If we disconnect MAX_FAILURES times within FAILURE_RESET_MULTIPLIER reconnection intervals,
           // then the client is likely desynchronized and needs to refresh.
           this.dispose();
@@ -219,6 +224,8 @@ class Kolabpad {
     if (msg.Identity !== undefined) {
       this.me = msg.Identity;
       logger.debug("[Identity] Assigned ID:", this.me);
+      // Editable until an Access message says otherwise
+      this.options.editor.updateOptions({ readOnly: false });
       this.options.onIdentity?.(this.me);
     } else if (msg.History !== undefined) {
       const { start, operations } = msg.History;
@@ -260,6 +267,22 @@ class Kolabpad {
         this.updateCursors();
         this.options.onChangeUsers?.(this.users);
       }
+    } else if (msg.Presence !== undefined) {
+      const users: Record<number, UserInfo> = {};
+      for (const { id, info } of msg.Presence.users) {
+        if (id !== this.me && info) {
+          users[id] = info;
+        }
+      }
+      for (const id of Object.keys(this.userCursors)) {
+        if (!(Number(id) in users)) {
+          delete this.userCursors[Number(id)];
+        }
+      }
+      logger.debug(`[Presence] ${Object.keys(users).length} other user(s)`);
+      this.users = users;
+      this.updateCursors();
+      this.options.onChangeUsers?.(this.users);
     } else if (msg.UserCursor !== undefined) {
       const { id, data } = msg.UserCursor;
       if (id !== this.me) {
@@ -271,6 +294,13 @@ class Kolabpad {
       const { otp, user_id, user_name } = msg.OTP;
       logger.debug(`[OTP] Changed to: ${otp || 'disabled'} by user ${user_id} (${user_name})`);
       this.options.onChangeOTP?.(otp, user_id, user_name);
+    } else if (msg.Announcement !== undefined) {
+      logger.info(`[Announcement] ${msg.Announcement.message}`);
+      this.options.onAnnouncement?.(msg.Announcement.message);
+    } else if (msg.Access !== undefined) {
+      const { role, label } = msg.Access;
+      logger.info(`[Access] Connected with share link "${label}" as ${role}`);
+      this.options.editor.updateOptions({ readOnly: role === "viewer" });
     }
   }
 
@@ -283,7 +313,7 @@ class Kolabpad {
     this.outstanding = this.buffer;
     this.buffer = undefined;
     if (this.outstanding) {
-      logger.debug(`[ServerAck] Sending buffered operation:`, this.formatOperation(JSON.parse(this.outstanding.to_string())));
+      logger.debug(`[ServerAck] Sending buffered operation:`, this.formatOperation(parseOps(this.outstanding.to_string())));
       this.sendOperation(this.outstanding);
     }
   }
@@ -327,7 +357,7 @@ class Kolabpad {
   }
 
   private applyClient(operation: IOpSeq) {
-    const opDetails = this.formatOperation(JSON.parse(operation.to_string()));
+    const opDetails = this.formatOperation(parseOps(operation.to_string()));
     if (!this.outstanding) {
       logger.debug(`[ApplyClient] Sending operation (no outstanding):`, opDetails);
       this.sendOperation(operation);
@@ -347,7 +377,7 @@ class Kolabpad {
 
   private sendOperation(operation: IOpSeq) {
     const op = operation.to_string();
-    logger.debug(`[SendOperation] Sending at revision ${this.revision}:`, this.formatOperation(JSON.parse(op)));
+    logger.debug(`[SendOperation] Sending at revision ${this.revision}:`, this.formatOperation(parseOps(op)));
     this.ws?.send(`{"Edit":{"revision":${this.revision},"operation":${op}}}`);
   }
 
@@ -367,7 +397,7 @@ class Kolabpad {
     if (operation.is_noop()) return;
 
     this.ignoreChanges = true;
-    const ops: (string | number)[] = JSON.parse(operation.to_string());
+    const ops = parseOps(operation.to_string());
     let index = 0;
 
     for (const op of ops) {
@@ -593,6 +623,15 @@ class Kolabpad {
 // Type definitions now imported from ../types
 // UserOperation, CursorData, ServerMsg are all centralized
 
+/**
+ * Extract the raw op array from serialized OpSeq JSON.
+ * Accepts both the versioned envelope ({"v":1,"ops":[...]}) and legacy bare arrays.
+ */
+function parseOps(json: string): (string | number)[] {
+  const parsed = JSON.parse(json);
+  return Array.isArray(parsed) ? parsed : parsed.ops;
+}
+
 /** Returns the number of Unicode codepoints in a string. */
 function unicodeLength(str: string): number {
   let length = 0;
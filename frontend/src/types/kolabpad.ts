@@ -6,6 +6,8 @@
 export type UserInfo = {
   readonly name: string;
   readonly hue: number;
+  /** Opaque seed for generating an avatar, e.g. a hashed client identifier */
+  readonly avatar_seed?: string;
 };
 
 /** Cursor and selection data for a user */
@@ -18,6 +20,10 @@ export type CursorData = {
 export type UserOperation = {
   id: number;
   operation: any;
+  /** Characters inserted by the operation (absent when 0) */
+  inserted?: number;
+  /** Characters deleted by the operation (absent when 0) */
+  deleted?: number;
 };
 
 /** Server message types */
@@ -45,4 +51,41 @@ export type ServerMsg = {
     user_id: number;
     user_name: string;
   };
+  /** Server clock in Unix milliseconds */
+  ServerTime?: number;
+  /** Language detected from content; only applied if a client sends SetLanguage */
+  LanguageSuggestion?: {
+    language: string;
+  };
+  /** Periodic snapshot of all registered users; replaces the user list */
+  Presence?: {
+    users: { id: number; info: UserInfo | null }[];
+  };
+  /** Operator notice for all connected clients, shown as a banner */
+  Announcement?: {
+    message: string;
+  };
+  /** Sent after connecting with a share link: the link's role and label */
+  Access?: {
+    role: "editor" | "viewer";
+    label: string;
+  };
+  /** Answer to a Request sent by this client; exactly one of result and error is set */
+  Response?: {
+    id: number;
+    result?: unknown;
+    error?: { code: string; message: string };
+  };
+  /** Sent after History when enabled: where the latest edits landed, oldest first */
+  RecentChanges?: {
+    ranges: { id: number; start: number; end: number }[];
+  };
+  /** Sent only to a user who was made the document's owner */
+  Ownership?: {
+    owner_key: string;
+  };
+  /** The document moved to a new ID; reconnect there with the same OTP */
+  Renamed?: {
+    id: string;
+  };
 };
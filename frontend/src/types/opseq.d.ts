@@ -119,6 +119,29 @@ export interface IOpSeq {
    */
   target_len(): number;
 
+  /**
+   * Create an independent deep copy of this operation.
+   *
+   * Mutating the copy (insert/delete/retain) doesn't affect this operation.
+   *
+   * @returns A new OpSeq with the same components
+   */
+  clone(): IOpSeq;
+
+  /**
+   * Get the concatenation of all text inserted by this operation.
+   *
+   * @returns The inserted text (empty if the operation inserts nothing)
+   */
+  inserted_text(): string;
+
+  /**
+   * Get the number of characters deleted by this operation.
+   *
+   * @returns The total deleted length
+   */
+  deleted_len(): number;
+
   /**
    * Transform a cursor/selection position through this operation.
    *
@@ -132,7 +155,7 @@ export interface IOpSeq {
   /**
    * Serialize this operation to a JSON string.
    *
-   * @returns JSON representation of the operation
+   * @returns Versioned JSON representation, e.g. `{"v":1,"ops":[5,"hi",-2]}`
    */
   to_string(): string;
 }
@@ -153,7 +176,7 @@ export interface IOpSeqConstructor {
   /**
    * Deserialize an operation from JSON.
    *
-   * @param json - JSON string representation of an operation
+   * @param json - Versioned (`{"v":1,"ops":[...]}`) or legacy (`[...]`) JSON
    * @returns Deserialized OpSeq instance, or null if parsing fails
    */
   from_str(json: string): IOpSeq | null;
@@ -165,6 +188,17 @@ export interface IOpSeqConstructor {
    * @returns A new OpSeq instance with the specified capacity
    */
   with_capacity(capacity: number): IOpSeq;
+
+  /**
+   * Compose a run of sequential operations into one.
+   *
+   * Folds left to right with compose(); the result has the same effect as
+   * applying each operation in order.
+   *
+   * @param ops - Operations to compose, each based on the previous one's target
+   * @returns The composed operation, or null if the array is empty or a pair doesn't line up
+   */
+  compose_all(ops: IOpSeq[]): IOpSeq | null;
 }
 
 /**
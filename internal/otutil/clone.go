@@ -0,0 +1,23 @@
+package otutil
+
+import (
+	ot "github.com/shiv248/operational-transformation-go"
+)
+
+// Clone returns an independent deep copy of op. Mutating the copy (e.g. with
+// Insert or Retain) never affects the original's ops slice.
+func Clone(op *ot.OperationSeq) *ot.OperationSeq {
+	ops := op.Ops()
+	clone := ot.WithCapacity(len(ops))
+	for _, o := range ops {
+		switch v := o.(type) {
+		case ot.Retain:
+			clone.Retain(v.N)
+		case ot.Delete:
+			clone.Delete(v.N)
+		case ot.Insert:
+			clone.Insert(v.Text)
+		}
+	}
+	return clone
+}
@@ -0,0 +1,33 @@
+package otutil
+
+import (
+	"testing"
+
+	ot "github.com/shiv248/operational-transformation-go"
+)
+
+// TestClone tests that mutating a clone doesn't affect the original.
+func TestClone(t *testing.T) {
+	op := ot.NewOperationSeq()
+	op.Retain(2)
+	op.Insert("hé")
+	op.Delete(3)
+
+	clone := Clone(op)
+	if clone.String() != op.String() || clone.BaseLen() != op.BaseLen() || clone.TargetLen() != op.TargetLen() {
+		t.Fatalf("Clone %s differs from original %s", clone, op)
+	}
+
+	clone.Retain(4)
+	clone.Insert("!")
+
+	if got := op.String(); got != `[2,"hé",-3]` {
+		t.Errorf("Original changed after mutating clone: %s", got)
+	}
+	if op.BaseLen() != 5 || op.TargetLen() != 4 {
+		t.Errorf("Original lengths changed: base=%d target=%d", op.BaseLen(), op.TargetLen())
+	}
+	if got := clone.String(); got != `[2,"hé",-3,4,"!"]` {
+		t.Errorf("Unexpected clone after mutation: %s", got)
+	}
+}
@@ -0,0 +1,35 @@
+package otutil
+
+import (
+	"errors"
+	"fmt"
+
+	ot "github.com/shiv248/operational-transformation-go"
+)
+
+// ErrNoOperations is returned by ComposeAll for an empty slice, whose base
+// length is unknown.
+var ErrNoOperations = errors.New("no operations to compose")
+
+// ComposeAll folds ops left to right with Compose, returning one operation
+// with the same effect as applying them in sequence. If a pair doesn't line
+// up, the error names the first operation that couldn't be composed onto
+// the ones before it and wraps ot.ErrIncompatibleLengths.
+//
+// The result never shares memory with ops, even for a single operation.
+func ComposeAll(ops []*ot.OperationSeq) (*ot.OperationSeq, error) {
+	if len(ops) == 0 {
+		return nil, ErrNoOperations
+	}
+
+	result := Clone(ops[0])
+	for i, op := range ops[1:] {
+		composed, err := result.Compose(op)
+		if err != nil {
+			return nil, fmt.Errorf("compose operation %d onto operations 0-%d (target length %d, base length %d): %w",
+				i+1, i, result.TargetLen(), op.BaseLen(), err)
+		}
+		result = composed
+	}
+	return result, nil
+}
@@ -0,0 +1,69 @@
+package otutil
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/shiv248/kolabpad/internal/otutil/ottest"
+	ot "github.com/shiv248/operational-transformation-go"
+)
+
+// TestComposeAll tests that composing a long run of random operations gives
+// the same document as applying them one at a time.
+func TestComposeAll(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	base := ottest.RandomText(rng, 20)
+
+	text := base
+	ops := make([]*ot.OperationSeq, 200)
+	for i := range ops {
+		ops[i] = ottest.RandomOperation(rng, utf8.RuneCountInString(text))
+		var err error
+		if text, err = ops[i].Apply(text); err != nil {
+			t.Fatalf("Apply of operation %d failed: %v", i, err)
+		}
+	}
+
+	composed, err := ComposeAll(ops)
+	if err != nil {
+		t.Fatalf("ComposeAll failed: %v", err)
+	}
+	got, err := composed.Apply(base)
+	if err != nil {
+		t.Fatalf("Apply of composed operation failed: %v", err)
+	}
+	if got != text {
+		t.Errorf("Composed operation gave %q, sequential apply gave %q", got, text)
+	}
+
+	single, err := ComposeAll(ops[:1])
+	if err != nil || single == ops[0] || single.String() != ops[0].String() {
+		t.Errorf("Expected a copy of a single operation, got %v (err %v)", single, err)
+	}
+}
+
+// TestComposeAllErrors tests that mismatched runs name the failing pair.
+func TestComposeAllErrors(t *testing.T) {
+	if _, err := ComposeAll(nil); !errors.Is(err, ErrNoOperations) {
+		t.Errorf("Expected ErrNoOperations for an empty slice, got %v", err)
+	}
+
+	a := ot.NewOperationSeq()
+	a.Insert("abc")
+	b := ot.NewOperationSeq()
+	b.Retain(3)
+	b.Insert("d")
+	c := ot.NewOperationSeq()
+	c.Retain(2) // Document is 4 characters long by now
+
+	_, err := ComposeAll([]*ot.OperationSeq{a, b, c})
+	if !errors.Is(err, ot.ErrIncompatibleLengths) {
+		t.Fatalf("Expected ErrIncompatibleLengths, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "operation 2 onto operations 0-1") {
+		t.Errorf("Expected the error to name operation 2, got %q", err)
+	}
+}
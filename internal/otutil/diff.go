@@ -0,0 +1,158 @@
+package otutil
+
+import (
+	ot "github.com/shiv248/operational-transformation-go"
+)
+
+// maxDiffEdits bounds the Myers search. Past this many edits the changed
+// region is replaced wholesale, which keeps Diff's time and memory bounded
+// for unrelated texts at the cost of a less minimal operation.
+const maxDiffEdits = 2048
+
+// Diff returns an operation transforming old into new that retains unchanged
+// regions, so applying it moves cursors only where the text actually changed.
+// Lengths are in runes, matching the ot library.
+//
+// The common prefix and suffix are retained directly; the middle is diffed
+// with Myers' O(ND) algorithm, falling back to delete+insert when the texts
+// differ by more than maxDiffEdits runes.
+func Diff(old, new string) *ot.OperationSeq {
+	a, b := []rune(old), []rune(new)
+
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	op := ot.NewOperationSeq()
+	op.Retain(uint64(prefix))
+	diffMiddle(op, a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])
+	op.Retain(uint64(suffix))
+	return op
+}
+
+// diffMiddle appends the edits turning a into b to op.
+func diffMiddle(op *ot.OperationSeq, a, b []rune) {
+	script, ok := myers(a, b)
+	if !ok {
+		op.Delete(uint64(len(a)))
+		op.Insert(string(b))
+		return
+	}
+
+	// Batch runs so the library doesn't concatenate inserts rune by rune
+	x, y := 0, 0
+	for i := 0; i < len(script); {
+		kind := script[i]
+		j := i
+		for j < len(script) && script[j] == kind {
+			j++
+		}
+		n := j - i
+		switch kind {
+		case editEqual:
+			op.Retain(uint64(n))
+			x += n
+			y += n
+		case editDelete:
+			op.Delete(uint64(n))
+			x += n
+		case editInsert:
+			op.Insert(string(b[y : y+n]))
+			y += n
+		}
+		i = j
+	}
+}
+
+// editKind is one step of an edit script.
+type editKind byte
+
+const (
+	editEqual editKind = iota
+	editDelete
+	editInsert
+)
+
+// myers computes a shortest edit script from a to b, one step per rune.
+// It reports false if the script would need more than maxDiffEdits edits.
+func myers(a, b []rune) ([]editKind, bool) {
+	n, m := len(a), len(b)
+	limit := min(n+m, maxDiffEdits)
+
+	// v[offset+k] is the furthest x reached on diagonal k. trace[d] keeps the
+	// band -d..d of v after round d for backtracking, so memory is O(D²).
+	offset := limit + 1
+	v := make([]int, 2*offset+1)
+	var trace [][]int
+
+	for d := 0; d <= limit; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1] // Down: insert
+			} else {
+				x = v[offset+k-1] + 1 // Right: delete
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+
+			if x >= n && y >= m {
+				trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+				return backtrack(trace, n, m), true
+			}
+		}
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+	}
+	return nil, false
+}
+
+// backtrack walks the recorded rounds from (n, m) back to the origin and
+// returns the edit script in forward order.
+func backtrack(trace [][]int, n, m int) []editKind {
+	// at returns the furthest x on diagonal k after round d
+	at := func(d, k int) int { return trace[d][k+d] }
+
+	var script []editKind
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(d-1, k-1) < at(d-1, k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := at(d-1, prevK)
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			script = append(script, editEqual)
+			x--
+			y--
+		}
+		if x == prevX {
+			script = append(script, editInsert)
+			y--
+		} else {
+			script = append(script, editDelete)
+			x--
+		}
+	}
+	for ; x > 0; x-- {
+		script = append(script, editEqual) // Leading snake of round 0
+	}
+
+	for i, j := 0, len(script)-1; i < j; i, j = i+1, j-1 {
+		script[i], script[j] = script[j], script[i]
+	}
+	return script
+}
@@ -0,0 +1,124 @@
+package otutil
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/shiv248/kolabpad/internal/otutil/ottest"
+)
+
+// TestDiffApply tests that Diff(a, b) applied to a yields b.
+func TestDiffApply(t *testing.T) {
+	cases := []struct{ old, new string }{
+		{"", ""},
+		{"", "hello"},
+		{"hello", ""},
+		{"hello", "hello"},
+		{"hello world", "hello there world"},
+		{"abcdef", "azced"},
+		{"héllo 世界", "hello 世界!"},
+		{"😀😀\n😀", "😀\n😀😀"},
+		{"line one\nline two\nline three\n", "line one\nline 2\nline three\nline four\n"},
+	}
+
+	for _, tc := range cases {
+		op := Diff(tc.old, tc.new)
+		got, err := op.Apply(tc.old)
+		if err != nil {
+			t.Errorf("Diff(%q, %q) = %s failed to apply: %v", tc.old, tc.new, op, err)
+			continue
+		}
+		if got != tc.new {
+			t.Errorf("Diff(%q, %q) = %s applied to %q, want %q", tc.old, tc.new, op, got, tc.new)
+		}
+	}
+}
+
+// TestDiffRandom tests Diff on random multibyte texts, including ones derived
+// from each other by small edits.
+func TestDiffRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		old := ottest.RandomText(rng, 40)
+		new := ottest.RandomText(rng, 40)
+		if i%2 == 0 {
+			// Mostly-shared texts exercise the snakes, not just the edits
+			if edited, err := ottest.RandomOperation(rng, utf8.RuneCountInString(old)).Apply(old); err == nil {
+				new = edited
+			}
+		}
+
+		got, err := Diff(old, new).Apply(old)
+		if err != nil || got != new {
+			t.Fatalf("Diff(%q, %q) applied to %q (err %v)", old, new, got, err)
+		}
+	}
+}
+
+// TestDiffMinimal tests that unchanged regions are retained rather than rewritten.
+func TestDiffMinimal(t *testing.T) {
+	op := Diff("the quick brown fox", "the quick fox")
+	if got := DeletedLen(op); got != 6 {
+		t.Errorf("Expected 6 deleted characters, got %d (%s)", got, op)
+	}
+	if got := InsertedText(op); got != "" {
+		t.Errorf("Expected nothing inserted, got %q (%s)", got, op)
+	}
+
+	op = Diff("brown", "red")
+	if got := InsertedText(op); got != "ed" {
+		t.Errorf("Expected the shared 'r' to be retained, got %q inserted (%s)", got, op)
+	}
+
+	op = Diff("a-b-c", "a+b+c")
+	if got := DeletedLen(op); got != 2 {
+		t.Errorf("Expected 2 deleted characters, got %d (%s)", got, op)
+	}
+}
+
+// TestDiffFallback tests that texts too different for the edit budget still
+// produce a correct operation.
+func TestDiffFallback(t *testing.T) {
+	old := strings.Repeat("a", maxDiffEdits)
+	new := strings.Repeat("b", maxDiffEdits)
+
+	op := Diff(old, new)
+	if got, err := op.Apply(old); err != nil || got != new {
+		t.Fatalf("Fallback diff failed to apply (err %v)", err)
+	}
+	if got := DeletedLen(op); got != maxDiffEdits {
+		t.Errorf("Expected whole-text delete, got %d deleted", got)
+	}
+}
+
+// BenchmarkDiff measures Diff on a large document with scattered edits.
+func BenchmarkDiff(b *testing.B) {
+	rng := rand.New(rand.NewSource(1))
+	lines := make([]string, 5000)
+	for i := range lines {
+		lines[i] = ottest.RandomText(rng, 30)
+	}
+	old := strings.Join(lines, "\n")
+	for i := 0; i < len(lines); i += 100 {
+		lines[i] = ottest.RandomText(rng, 30)
+	}
+	new := strings.Join(lines, "\n")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Diff(old, new)
+	}
+}
+
+// BenchmarkDiffUnrelated measures the fallback path on texts with nothing in common.
+func BenchmarkDiffUnrelated(b *testing.B) {
+	old := strings.Repeat("ab", 50000)
+	new := strings.Repeat("cd", 50000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Diff(old, new)
+	}
+}
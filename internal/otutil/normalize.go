@@ -0,0 +1,32 @@
+package otutil
+
+import (
+	"strings"
+
+	ot "github.com/shiv248/operational-transformation-go"
+)
+
+// NormalizeLineEndings returns an operation on text deleting the carriage
+// return of every CRLF, so all its line endings become LF, or nil if text
+// has none. Lone carriage returns are left alone.
+func NormalizeLineEndings(text string) *ot.OperationSeq {
+	if !strings.Contains(text, "\r\n") {
+		return nil
+	}
+
+	op := ot.NewOperationSeq()
+	var run uint64 // Runes retained since the last deletion
+	prevCR := false
+	for _, r := range text {
+		if prevCR && r == '\n' {
+			// The CR was counted as retained; delete it instead
+			op.Retain(run - 1)
+			op.Delete(1)
+			run = 0
+		}
+		run++
+		prevCR = r == '\r'
+	}
+	op.Retain(run)
+	return op
+}
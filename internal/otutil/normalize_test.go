@@ -0,0 +1,37 @@
+package otutil
+
+import "testing"
+
+// TestNormalizeLineEndings tests that CRLFs become LFs, lone CRs stay, and
+// text without CRLF needs no operation.
+func TestNormalizeLineEndings(t *testing.T) {
+	tests := []struct {
+		text, want string
+	}{
+		{"a\r\nb\r\n", "a\nb\n"},
+		{"\r\n\r\n", "\n\n"},
+		{"é\r\r\n👋\r\nx", "é\r\n👋\nx"},
+		{"old mac\rline", "old mac\rline"},
+		{"unix\n", "unix\n"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		op := NormalizeLineEndings(tt.text)
+		if tt.want == tt.text {
+			if op != nil {
+				t.Errorf("%q: expected no operation, got %v", tt.text, op)
+			}
+			continue
+		}
+		if op == nil {
+			t.Fatalf("%q: expected an operation", tt.text)
+		}
+		got, err := op.Apply(tt.text)
+		if err != nil {
+			t.Fatalf("%q: apply failed: %v", tt.text, err)
+		}
+		if got != tt.want {
+			t.Errorf("%q: expected %q, got %q", tt.text, tt.want, got)
+		}
+	}
+}
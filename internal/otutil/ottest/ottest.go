@@ -0,0 +1,121 @@
+// Package ottest provides helpers for property tests of operations: a random
+// operation generator and assertions of the laws transform and compose must
+// obey. Like httptest, it is meant for tests only.
+package ottest
+
+import (
+	"math/rand"
+	"testing"
+
+	ot "github.com/shiv248/operational-transformation-go"
+)
+
+// alphabet mixes ASCII with multi-byte and astral runes so operations
+// straddle the byte/rune boundaries the server and WASM bridge must agree on.
+var alphabet = []rune("ab \né世😀")
+
+// RandomText returns up to maxLen runes, possibly none, drawn from a small
+// alphabet of one- to four-byte runes, including newlines.
+func RandomText(rng *rand.Rand, maxLen int) string {
+	runes := make([]rune, rng.Intn(maxLen+1))
+	for i := range runes {
+		runes[i] = alphabet[rng.Intn(len(alphabet))]
+	}
+	return string(runes)
+}
+
+// RandomOperation builds a random operation over a document of baseLen runes,
+// including empty operations and runs of consecutive inserts or deletes. The
+// result always has base length baseLen, so it applies to any such document.
+func RandomOperation(rng *rand.Rand, baseLen int) *ot.OperationSeq {
+	op := ot.NewOperationSeq()
+	for remaining := baseLen; remaining > 0; {
+		n := uint64(1 + rng.Intn(remaining))
+		switch rng.Intn(3) {
+		case 0:
+			op.Retain(n)
+			remaining -= int(n)
+		case 1:
+			op.Delete(n)
+			remaining -= int(n)
+		default:
+			op.Insert(RandomText(rng, 4))
+		}
+	}
+	if rng.Intn(2) == 0 {
+		op.Insert(RandomText(rng, 4))
+	}
+	return op
+}
+
+// AssertTP1 checks the TP1 property for concurrent a and b over base: with
+// a', b' = a.Transform(b), a∘b' and b∘a' must produce the same document.
+// Failures are reported with t.Errorf; it returns whether the property held.
+func AssertTP1(t testing.TB, base string, a, b *ot.OperationSeq) bool {
+	t.Helper()
+
+	aPrime, bPrime, err := a.Transform(b)
+	if err != nil {
+		t.Errorf("Transform(%s, %s) failed: %v", a, b, err)
+		return false
+	}
+	left, ok := applyComposed(t, base, a, bPrime)
+	if !ok {
+		return false
+	}
+	right, ok := applyComposed(t, base, b, aPrime)
+	if !ok {
+		return false
+	}
+	if left != right {
+		t.Errorf("TP1 violated on %q\na=%s b=%s\na'=%s b'=%s\na∘b' -> %q\nb∘a' -> %q",
+			base, a, b, aPrime, bPrime, left, right)
+		return false
+	}
+	return true
+}
+
+// AssertComposeApply checks that a∘b applied to base gives the same document
+// as applying a and then b. Failures are reported with t.Errorf; it returns
+// whether they agreed.
+func AssertComposeApply(t testing.TB, base string, a, b *ot.OperationSeq) bool {
+	t.Helper()
+
+	composed, ok := applyComposed(t, base, a, b)
+	if !ok {
+		return false
+	}
+	afterA, err := a.Apply(base)
+	if err != nil {
+		t.Errorf("Apply(%s) failed on %q: %v", a, base, err)
+		return false
+	}
+	sequential, err := b.Apply(afterA)
+	if err != nil {
+		t.Errorf("Apply(%s) failed on %q: %v", b, afterA, err)
+		return false
+	}
+	if composed != sequential {
+		t.Errorf("Compose diverges from sequential apply on %q\na=%s b=%s\na∘b -> %q\nsequential -> %q",
+			base, a, b, composed, sequential)
+		return false
+	}
+	return true
+}
+
+// applyComposed applies a∘b to base, reporting failures with t.Errorf.
+func applyComposed(t testing.TB, base string, a, b *ot.OperationSeq) (string, bool) {
+	t.Helper()
+
+	composed, err := a.Compose(b)
+	if err != nil {
+		t.Errorf("Compose(%s, %s) failed: %v", a, b, err)
+		return "", false
+	}
+	text, err := composed.Apply(base)
+	if err != nil {
+		t.Errorf("Apply(%s∘%s) failed on %q: %v", a, b, base, err)
+		return "", false
+	}
+	return text, true
+}
@@ -0,0 +1,100 @@
+package ottest
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"unicode/utf8"
+
+	ot "github.com/shiv248/operational-transformation-go"
+)
+
+// TestRandomOperation tests that generated operations fit the base length
+// they were made for and apply to any text of that length.
+func TestRandomOperation(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		base := RandomText(rng, 20)
+		if n := utf8.RuneCountInString(base); n > 20 {
+			t.Fatalf("RandomText(20) returned %d runes", n)
+		}
+		baseLen := utf8.RuneCountInString(base)
+
+		op := RandomOperation(rng, baseLen)
+		if op.BaseLen() != baseLen {
+			t.Fatalf("RandomOperation(%d) has base length %d: %s", baseLen, op.BaseLen(), op)
+		}
+		text, err := op.Apply(base)
+		if err != nil {
+			t.Fatalf("Apply(%s) failed on %q: %v", op, base, err)
+		}
+		if n := utf8.RuneCountInString(text); n != op.TargetLen() {
+			t.Fatalf("Apply(%s) gave %d runes, target length is %d", op, n, op.TargetLen())
+		}
+	}
+}
+
+// TestAssertTP1 shows a property test of transform: concurrent random edits
+// of the same text converge in either order.
+func TestAssertTP1(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	for i := 0; i < 500; i++ {
+		base := RandomText(rng, 20)
+		baseLen := utf8.RuneCountInString(base)
+		if !AssertTP1(t, base, RandomOperation(rng, baseLen), RandomOperation(rng, baseLen)) {
+			return
+		}
+	}
+}
+
+// TestAssertComposeApply shows a property test of compose: an edit followed
+// by another composes into one with the same effect.
+func TestAssertComposeApply(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	for i := 0; i < 500; i++ {
+		base := RandomText(rng, 20)
+		a := RandomOperation(rng, utf8.RuneCountInString(base))
+		b := RandomOperation(rng, a.TargetLen())
+		if !AssertComposeApply(t, base, a, b) {
+			return
+		}
+	}
+}
+
+// recorder is a testing.TB that records errors instead of failing the test.
+type recorder struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...any) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+// TestAssertionsReportFailures tests that the assertions report operations
+// that don't fit the text or each other rather than passing them.
+func TestAssertionsReportFailures(t *testing.T) {
+	a := ot.NewOperationSeq()
+	a.Retain(2)
+	a.Insert("!")
+	b := ot.NewOperationSeq()
+	b.Retain(5)
+	c := ot.NewOperationSeq()
+	c.Retain(3)
+
+	var rec recorder
+	if AssertTP1(&rec, "ab", a, b) {
+		t.Error("Expected AssertTP1 to fail for operations over different base lengths")
+	}
+	if AssertComposeApply(&rec, "ab", a, b) {
+		t.Error("Expected AssertComposeApply to fail when b doesn't follow a")
+	}
+	if AssertComposeApply(&rec, "abc", a, c) {
+		t.Error("Expected AssertComposeApply to fail when a doesn't fit the text")
+	}
+	if len(rec.errors) != 3 {
+		t.Errorf("Expected 3 reported errors, got %d: %q", len(rec.errors), rec.errors)
+	}
+}
@@ -0,0 +1,70 @@
+// Package otutil provides helpers on top of the operational-transformation-go
+// library that Kolabpad needs but the library itself doesn't provide.
+package otutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	ot "github.com/shiv248/operational-transformation-go"
+)
+
+// SchemaVersion is the current version of the serialized operation format.
+//
+// Version 1 wraps the ot library's op array in an envelope:
+//
+//	{"v":1,"ops":[5,"hello",-3]}
+//
+// Payloads without an envelope (a bare op array) are legacy and parsed as version 1.
+const SchemaVersion = 1
+
+// ErrUnsupportedVersion is returned when a payload declares an unknown schema version.
+var ErrUnsupportedVersion = errors.New("unsupported operation schema version")
+
+// versionedOperation is the wire envelope for a serialized operation.
+type versionedOperation struct {
+	V   int             `json:"v"`
+	Ops json.RawMessage `json:"ops"`
+}
+
+// MarshalVersioned serializes an operation with an explicit schema version tag.
+func MarshalVersioned(op *ot.OperationSeq) ([]byte, error) {
+	ops, err := json.Marshal(op)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(versionedOperation{V: SchemaVersion, Ops: ops})
+}
+
+// UnmarshalVersioned parses an operation in either versioned or legacy form.
+func UnmarshalVersioned(data []byte) (*ot.OperationSeq, error) {
+	data = bytes.TrimSpace(data)
+
+	// Legacy: bare op array
+	if len(data) > 0 && data[0] == '[' {
+		var op ot.OperationSeq
+		if err := json.Unmarshal(data, &op); err != nil {
+			return nil, err
+		}
+		return &op, nil
+	}
+
+	var envelope versionedOperation
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, err
+	}
+	if envelope.V != SchemaVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, envelope.V)
+	}
+	if envelope.Ops == nil {
+		return nil, errors.New("versioned operation missing ops")
+	}
+
+	var op ot.OperationSeq
+	if err := json.Unmarshal(envelope.Ops, &op); err != nil {
+		return nil, err
+	}
+	return &op, nil
+}
@@ -0,0 +1,87 @@
+package otutil
+
+import (
+	"errors"
+	"testing"
+
+	ot "github.com/shiv248/operational-transformation-go"
+)
+
+// TestMarshalVersioned tests that operations are serialized with a version envelope.
+func TestMarshalVersioned(t *testing.T) {
+	op := ot.NewOperationSeq()
+	op.Retain(5)
+	op.Insert("hello")
+	op.Delete(3)
+
+	data, err := MarshalVersioned(op)
+	if err != nil {
+		t.Fatalf("MarshalVersioned failed: %v", err)
+	}
+	if want := `{"v":1,"ops":[5,"hello",-3]}`; string(data) != want {
+		t.Errorf("Expected %s, got %s", want, data)
+	}
+}
+
+// TestUnmarshalVersionedRoundTrip tests that versioned payloads parse back to the same operation.
+func TestUnmarshalVersionedRoundTrip(t *testing.T) {
+	op := ot.NewOperationSeq()
+	op.Retain(2)
+	op.Insert("héllo 👋")
+	op.Delete(4)
+	op.Retain(1)
+
+	data, err := MarshalVersioned(op)
+	if err != nil {
+		t.Fatalf("MarshalVersioned failed: %v", err)
+	}
+
+	parsed, err := UnmarshalVersioned(data)
+	if err != nil {
+		t.Fatalf("UnmarshalVersioned failed: %v", err)
+	}
+	if parsed.String() != op.String() {
+		t.Errorf("Round trip mismatch: expected %s, got %s", op, parsed)
+	}
+	if parsed.BaseLen() != op.BaseLen() || parsed.TargetLen() != op.TargetLen() {
+		t.Errorf("Length mismatch: expected %d/%d, got %d/%d",
+			op.BaseLen(), op.TargetLen(), parsed.BaseLen(), parsed.TargetLen())
+	}
+}
+
+// TestUnmarshalVersionedLegacy tests that bare op arrays are still accepted.
+func TestUnmarshalVersionedLegacy(t *testing.T) {
+	parsed, err := UnmarshalVersioned([]byte(` [5, "hello", -3] `))
+	if err != nil {
+		t.Fatalf("UnmarshalVersioned failed on legacy payload: %v", err)
+	}
+	if parsed.BaseLen() != 8 || parsed.TargetLen() != 10 {
+		t.Errorf("Expected base=8 target=10, got base=%d target=%d", parsed.BaseLen(), parsed.TargetLen())
+	}
+}
+
+// TestUnmarshalVersionedErrors tests that malformed or unknown payloads are rejected.
+func TestUnmarshalVersionedErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"unknown version", `{"v":2,"ops":[1]}`},
+		{"missing version", `{"ops":[1]}`},
+		{"missing ops", `{"v":1}`},
+		{"invalid op", `{"v":1,"ops":[true]}`},
+		{"not json", `nope`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := UnmarshalVersioned([]byte(tt.data)); err == nil {
+				t.Errorf("Expected error for %s", tt.data)
+			}
+		})
+	}
+
+	if _, err := UnmarshalVersioned([]byte(`{"v":2,"ops":[]}`)); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("Expected ErrUnsupportedVersion, got %v", err)
+	}
+}
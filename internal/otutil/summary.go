@@ -0,0 +1,59 @@
+package otutil
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	ot "github.com/shiv248/operational-transformation-go"
+)
+
+// InsertedText returns the concatenation of all text inserted by op.
+func InsertedText(op *ot.OperationSeq) string {
+	var sb strings.Builder
+	for _, o := range op.Ops() {
+		if ins, ok := o.(ot.Insert); ok {
+			sb.WriteString(ins.Text)
+		}
+	}
+	return sb.String()
+}
+
+// DeletedLen returns the number of characters (runes) deleted by op.
+func DeletedLen(op *ot.OperationSeq) uint64 {
+	var n uint64
+	for _, o := range op.Ops() {
+		if del, ok := o.(ot.Delete); ok {
+			n += del.N
+		}
+	}
+	return n
+}
+
+// ChangedRanges returns the rune ranges [start, end) of the text op produces
+// that it inserted, in order. A deletion with no insert beside it gives an
+// empty range where the text was removed; touching ranges are merged.
+func ChangedRanges(op *ot.OperationSeq) [][2]uint32 {
+	var ranges [][2]uint32
+	add := func(start, end uint32) {
+		if n := len(ranges); n > 0 && ranges[n-1][1] == start {
+			ranges[n-1][1] = end
+			return
+		}
+		ranges = append(ranges, [2]uint32{start, end})
+	}
+
+	var pos uint32
+	for _, o := range op.Ops() {
+		switch v := o.(type) {
+		case ot.Retain:
+			pos += uint32(v.N)
+		case ot.Insert:
+			end := pos + uint32(utf8.RuneCountInString(v.Text))
+			add(pos, end)
+			pos = end
+		case ot.Delete:
+			add(pos, pos)
+		}
+	}
+	return ranges
+}
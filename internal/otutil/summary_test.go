@@ -0,0 +1,59 @@
+package otutil
+
+import (
+	"slices"
+	"testing"
+
+	ot "github.com/shiv248/operational-transformation-go"
+)
+
+// TestInsertedTextAndDeletedLen tests the insert/delete summaries of an operation.
+func TestInsertedTextAndDeletedLen(t *testing.T) {
+	op := ot.NewOperationSeq()
+	op.Retain(3)
+	op.Insert("héllo")
+	op.Delete(2)
+	op.Retain(1)
+	op.Insert(" 👋")
+	op.Delete(4)
+
+	if got := InsertedText(op); got != "héllo 👋" {
+		t.Errorf("Expected inserted text %q, got %q", "héllo 👋", got)
+	}
+	if got := DeletedLen(op); got != 6 {
+		t.Errorf("Expected 6 deleted characters, got %d", got)
+	}
+
+	empty := ot.NewOperationSeq()
+	empty.Retain(10)
+	if got := InsertedText(empty); got != "" {
+		t.Errorf("Expected no inserted text, got %q", got)
+	}
+	if got := DeletedLen(empty); got != 0 {
+		t.Errorf("Expected 0 deleted characters, got %d", got)
+	}
+}
+
+// TestChangedRanges tests that inserts and deletions map to ranges of the
+// resulting text, with touching ranges merged.
+func TestChangedRanges(t *testing.T) {
+	op := ot.NewOperationSeq()
+	op.Retain(3)
+	op.Insert("héllo")
+	op.Delete(2)
+	op.Retain(1)
+	op.Delete(4)
+	op.Retain(2)
+	op.Insert("👋")
+
+	want := [][2]uint32{{3, 8}, {9, 9}, {11, 12}}
+	if got := ChangedRanges(op); !slices.Equal(got, want) {
+		t.Errorf("Expected ranges %v, got %v", want, got)
+	}
+
+	retain := ot.NewOperationSeq()
+	retain.Retain(10)
+	if got := ChangedRanges(retain); len(got) != 0 {
+		t.Errorf("Expected no ranges for a retain, got %v", got)
+	}
+}
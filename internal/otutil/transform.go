@@ -0,0 +1,247 @@
+package otutil
+
+import (
+	"sync"
+	"unicode/utf8"
+
+	ot "github.com/shiv248/operational-transformation-go"
+)
+
+// component is an operation held unboxed: storing a Retain or Delete in an
+// ot.Operation interface allocates for most lengths, once per step of every
+// transform.
+type component struct {
+	kind componentKind
+	n    uint64 // Retain and Delete length
+	text string // Insert text
+}
+
+type componentKind uint8
+
+const (
+	retainKind componentKind = iota + 1
+	deleteKind
+	insertKind
+)
+
+// toComponent unboxes o (nil gives the zero component).
+func toComponent(o ot.Operation) component {
+	switch v := o.(type) {
+	case ot.Retain:
+		return component{kind: retainKind, n: v.N}
+	case ot.Delete:
+		return component{kind: deleteKind, n: v.N}
+	case ot.Insert:
+		return component{kind: insertKind, text: v.Text}
+	}
+	return component{}
+}
+
+// seqBuffer is a reusable stand-in for ot.OperationSeq. The library type
+// can't be reset, so transient transform results live here instead and are
+// only copied into a real OperationSeq once, at the end. Retain, Delete and
+// Insert merge adjacent operations exactly like the library, so transforms
+// over a seqBuffer produce the same operations.
+type seqBuffer struct {
+	ops       []component
+	baseLen   int
+	targetLen int
+}
+
+// reset empties b, keeping its capacity. Old operations are cleared so the
+// pool doesn't pin inserted text.
+func (b *seqBuffer) reset() {
+	clear(b.ops)
+	b.ops = b.ops[:0]
+	b.baseLen = 0
+	b.targetLen = 0
+}
+
+func (b *seqBuffer) retain(n uint64) {
+	if n == 0 {
+		return
+	}
+	b.baseLen += int(n)
+	b.targetLen += int(n)
+	if last := len(b.ops) - 1; last >= 0 && b.ops[last].kind == retainKind {
+		b.ops[last].n += n
+		return
+	}
+	b.ops = append(b.ops, component{kind: retainKind, n: n})
+}
+
+func (b *seqBuffer) delete(n uint64) {
+	if n == 0 {
+		return
+	}
+	b.baseLen += int(n)
+	if last := len(b.ops) - 1; last >= 0 && b.ops[last].kind == deleteKind {
+		b.ops[last].n += n
+		return
+	}
+	b.ops = append(b.ops, component{kind: deleteKind, n: n})
+}
+
+func (b *seqBuffer) insert(s string) {
+	if s == "" {
+		return
+	}
+	b.targetLen += utf8.RuneCountInString(s)
+
+	n := len(b.ops)
+	if n == 0 {
+		b.ops = append(b.ops, component{kind: insertKind, text: s})
+		return
+	}
+	switch b.ops[n-1].kind {
+	case insertKind:
+		b.ops[n-1].text += s
+		return
+	case deleteKind:
+		// Inserts go before a trailing delete, merging with an insert before it
+		if n >= 2 && b.ops[n-2].kind == insertKind {
+			b.ops[n-2].text += s
+			return
+		}
+		del := b.ops[n-1]
+		b.ops[n-1] = component{kind: insertKind, text: s}
+		b.ops = append(b.ops, del)
+		return
+	}
+	b.ops = append(b.ops, component{kind: insertKind, text: s})
+}
+
+// Transformer transforms one operation against a series of concurrent ones
+// without allocating an OperationSeq per step. Get one with NewTransformer
+// and return it with Release.
+type Transformer struct {
+	cur, next seqBuffer
+}
+
+var transformers = sync.Pool{
+	New: func() any { return new(Transformer) },
+}
+
+// NewTransformer returns a pooled Transformer holding a copy of op.
+func NewTransformer(op *ot.OperationSeq) *Transformer {
+	t := transformers.Get().(*Transformer)
+	t.cur.reset()
+	for _, o := range op.Ops() {
+		t.cur.ops = append(t.cur.ops, toComponent(o))
+	}
+	t.cur.baseLen = op.BaseLen()
+	t.cur.targetLen = op.TargetLen()
+	return t
+}
+
+// Transform replaces the held operation a with a', where a and b are
+// concurrent and a' applies after b. It agrees with the first result of
+// ot.OperationSeq.Transform; on error the held operation is unchanged.
+func (t *Transformer) Transform(b *ot.OperationSeq) error {
+	if t.cur.baseLen != b.BaseLen() {
+		return ot.ErrIncompatibleLengths
+	}
+
+	out := &t.next
+	out.reset()
+
+	// op1 and op2 are the current components of each side, with what's been
+	// consumed of a retain or delete taken off; the zero component once a
+	// side runs out
+	ops1, ops2 := t.cur.ops, b.Ops()
+	i, j := 0, 0
+	var op1, op2 component
+	if len(ops1) > 0 {
+		op1, i = ops1[0], 1
+	}
+	if len(ops2) > 0 {
+		op2, j = toComponent(ops2[0]), 1
+	}
+	next1 := func() {
+		op1 = component{}
+		if i < len(ops1) {
+			op1 = ops1[i]
+			i++
+		}
+	}
+	next2 := func() {
+		op2 = component{}
+		if j < len(ops2) {
+			op2 = toComponent(ops2[j])
+			j++
+		}
+	}
+
+	for op1.kind != 0 || op2.kind != 0 {
+		switch {
+		case op1.kind == insertKind && op2.kind == insertKind:
+			// Tie-break on text, as the library does
+			if op1.text < op2.text {
+				out.insert(op1.text)
+				next1()
+			} else if op1.text == op2.text {
+				out.insert(op1.text)
+				out.retain(uint64(utf8.RuneCountInString(op1.text)))
+				next1()
+				next2()
+			} else {
+				out.retain(uint64(utf8.RuneCountInString(op2.text)))
+				next2()
+			}
+			continue
+		case op1.kind == insertKind:
+			out.insert(op1.text)
+			next1()
+			continue
+		case op2.kind == insertKind:
+			out.retain(uint64(utf8.RuneCountInString(op2.text)))
+			next2()
+			continue
+		case op1.kind == 0 || op2.kind == 0:
+			return ot.ErrIncompatibleLengths
+		}
+
+		// Both are retains or deletes: a' retains what both retain and
+		// deletes what only a deletes
+		n := min(op1.n, op2.n)
+		switch {
+		case op1.kind == retainKind && op2.kind == retainKind:
+			out.retain(n)
+		case op1.kind == deleteKind && op2.kind == retainKind:
+			out.delete(n)
+		}
+		if op1.n -= n; op1.n == 0 {
+			next1()
+		}
+		if op2.n -= n; op2.n == 0 {
+			next2()
+		}
+	}
+
+	t.cur, t.next = t.next, t.cur
+	return nil
+}
+
+// Result returns the held operation as a new OperationSeq that shares no
+// memory with the Transformer, so it's safe to keep after Release.
+func (t *Transformer) Result() *ot.OperationSeq {
+	op := ot.WithCapacity(len(t.cur.ops))
+	for _, c := range t.cur.ops {
+		switch c.kind {
+		case retainKind:
+			op.Retain(c.n)
+		case deleteKind:
+			op.Delete(c.n)
+		case insertKind:
+			op.Insert(c.text)
+		}
+	}
+	return op
+}
+
+// Release returns t to the pool. t must not be used afterwards.
+func (t *Transformer) Release() {
+	t.cur.reset()
+	t.next.reset()
+	transformers.Put(t)
+}
@@ -0,0 +1,70 @@
+package otutil
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/shiv248/kolabpad/internal/otutil/ottest"
+)
+
+// FuzzTransformConvergence checks the TP1 property: for concurrent a and b
+// over the same base, a∘b' and b∘a' must produce the same document.
+//
+// Run with: go test ./internal/otutil -fuzz FuzzTransformConvergence
+func FuzzTransformConvergence(f *testing.F) {
+	f.Add("", int64(0))
+	f.Add("hello", int64(1))
+	f.Add("héllo 世界", int64(2))
+	f.Add("😀😀\n😀", int64(3))
+
+	f.Fuzz(func(t *testing.T, base string, seed int64) {
+		// Apply works in runes; normalize so every byte is a real character
+		base = strings.ToValidUTF8(base, "?")
+		if utf8.RuneCountInString(base) > 64 {
+			base = string([]rune(base)[:64])
+		}
+		baseLen := utf8.RuneCountInString(base)
+
+		rng := rand.New(rand.NewSource(seed))
+		a := ottest.RandomOperation(rng, baseLen)
+		b := ottest.RandomOperation(rng, baseLen)
+		if !ottest.AssertTP1(t, base, a, b) {
+			return
+		}
+
+		aPrime, bPrime, err := a.Transform(b)
+		if err != nil {
+			t.Fatalf("Transform(%s, %s) failed: %v", a, b, err)
+		}
+
+		// The pooled transformer must agree with the library
+		transformer := NewTransformer(a)
+		if err := transformer.Transform(b); err != nil {
+			t.Fatalf("Transformer failed on %s against %s: %v", a, b, err)
+		}
+		if got := transformer.Result(); got.String() != aPrime.String() {
+			t.Fatalf("Transformer gave %s, library gave %s", got, aPrime)
+		}
+		transformer.Release()
+
+		// Composition must agree with applying the operations one at a time
+		if !ottest.AssertComposeApply(t, base, a, bPrime) {
+			return
+		}
+
+		// ByteLen must predict the size of the result without applying
+		ab, err := a.Compose(bPrime)
+		if err != nil {
+			t.Fatalf("Compose(%s, %s) failed: %v", a, bPrime, err)
+		}
+		result, err := ab.Apply(base)
+		if err != nil {
+			t.Fatalf("Apply(a∘b') failed on %q: %v", base, err)
+		}
+		if n, err := ByteLen(ab, base); err != nil || n != len(result) {
+			t.Fatalf("ByteLen(a∘b') on %q = %d, %v; result is %d bytes", base, n, err, len(result))
+		}
+	})
+}
@@ -0,0 +1,147 @@
+package otutil
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/shiv248/kolabpad/internal/otutil/ottest"
+	ot "github.com/shiv248/operational-transformation-go"
+)
+
+// TestTransformerMatchesLibrary tests that Transformer produces exactly the
+// operations the library's Transform does, step after step.
+func TestTransformerMatchesLibrary(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		base := ottest.RandomText(rng, 20)
+		op := ottest.RandomOperation(rng, len([]rune(base)))
+
+		// A chain of concurrent edits, each applying after the previous one
+		want := op
+		transformer := NewTransformer(op)
+		doc := base
+		for step := 0; step < 4; step++ {
+			concurrent := ottest.RandomOperation(rng, len([]rune(doc)))
+
+			aPrime, _, err := want.Transform(concurrent)
+			if err != nil {
+				t.Fatalf("Library Transform failed: %v", err)
+			}
+			if err := transformer.Transform(concurrent); err != nil {
+				t.Fatalf("Transformer failed where the library didn't: %v", err)
+			}
+			want = aPrime
+
+			if doc, err = concurrent.Apply(doc); err != nil {
+				t.Fatalf("Apply failed: %v", err)
+			}
+		}
+
+		got := transformer.Result()
+		transformer.Release()
+		if got.String() != want.String() || got.BaseLen() != want.BaseLen() || got.TargetLen() != want.TargetLen() {
+			t.Fatalf("Transformer gave %s (%d->%d), library gave %s (%d->%d)",
+				got, got.BaseLen(), got.TargetLen(), want, want.BaseLen(), want.TargetLen())
+		}
+	}
+}
+
+// TestTransformerIncompatible tests that mismatched lengths are rejected and
+// leave the held operation untouched.
+func TestTransformerIncompatible(t *testing.T) {
+	op := ot.NewOperationSeq()
+	op.Retain(3)
+	op.Insert("x")
+
+	other := ot.NewOperationSeq()
+	other.Retain(5)
+
+	transformer := NewTransformer(op)
+	defer transformer.Release()
+	if err := transformer.Transform(other); err != ot.ErrIncompatibleLengths {
+		t.Errorf("Expected ErrIncompatibleLengths, got %v", err)
+	}
+	if got := transformer.Result(); got.String() != op.String() {
+		t.Errorf("Expected held operation %s to survive the error, got %s", op, got)
+	}
+}
+
+// TestTransformerResultIndependent tests that results stay intact when the
+// Transformer is released and reused, and that the input is never modified.
+func TestTransformerResultIndependent(t *testing.T) {
+	op := ot.NewOperationSeq()
+	op.Retain(2)
+	op.Insert("ab")
+	before := op.String()
+
+	concurrent := ot.NewOperationSeq()
+	concurrent.Insert("zz")
+	concurrent.Retain(2)
+
+	transformer := NewTransformer(op)
+	if err := transformer.Transform(concurrent); err != nil {
+		t.Fatalf("Transform failed: %v", err)
+	}
+	result := transformer.Result()
+	want := result.String()
+	transformer.Release()
+
+	// Churn the pool so a reused buffer would overwrite shared memory
+	for i := 0; i < 10; i++ {
+		other := NewTransformer(concurrent)
+		other.Transform(concurrent)
+		other.Release()
+	}
+
+	if got := result.String(); got != want {
+		t.Errorf("Result changed after Release: %s -> %s", want, got)
+	}
+	if got := op.String(); got != before {
+		t.Errorf("Input changed: %s -> %s", before, got)
+	}
+}
+
+// chainBenchmark returns an edit at revision 0 and 100 later single-character
+// edits it must be transformed against.
+func chainBenchmark() (*ot.OperationSeq, []*ot.OperationSeq) {
+	op := ot.NewOperationSeq()
+	op.Retain(500)
+	op.Insert("x")
+	op.Retain(500)
+
+	history := make([]*ot.OperationSeq, 100)
+	for i := range history {
+		h := ot.NewOperationSeq()
+		h.Retain(uint64(i * 7))
+		h.Insert("y")
+		h.Retain(uint64(1000 + i - i*7))
+		history[i] = h
+	}
+	return op, history
+}
+
+// BenchmarkTransformChainLibrary transforms against history with the library.
+func BenchmarkTransformChainLibrary(b *testing.B) {
+	op, history := chainBenchmark()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		cur := op
+		for _, h := range history {
+			cur, _, _ = cur.Transform(h)
+		}
+	}
+}
+
+// BenchmarkTransformChainPooled transforms against history with a Transformer.
+func BenchmarkTransformChainPooled(b *testing.B) {
+	op, history := chainBenchmark()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		transformer := NewTransformer(op)
+		for _, h := range history {
+			transformer.Transform(h)
+		}
+		transformer.Result()
+		transformer.Release()
+	}
+}
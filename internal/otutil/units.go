@@ -0,0 +1,117 @@
+package otutil
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	ot "github.com/shiv248/operational-transformation-go"
+)
+
+// Operations count Unicode code points (runes): Retain and Delete lengths,
+// BaseLen and TargetLen are all in runes, whatever the text's UTF-8 byte or
+// UTF-16 (JavaScript) length, and Transform and Compose only ever combine
+// those counts. A length in runes can't end inside a character, so the only
+// way an operation splits one is if the text isn't valid UTF-8 to begin
+// with, where Apply would silently turn stray bytes into U+FFFD. The helpers
+// here check for that and convert to bytes, the unit storage and size limits
+// measure.
+
+// ErrInvalidUTF8 is returned for text that isn't valid UTF-8.
+var ErrInvalidUTF8 = errors.New("invalid UTF-8")
+
+// RuneLen returns the length of s in the unit operations count in.
+func RuneLen(s string) int {
+	return utf8.RuneCountInString(s)
+}
+
+// ByteLen returns the UTF-8 size of the text op produces from base, without
+// building it. It fails with ErrInvalidUTF8 if base or an insert isn't valid
+// UTF-8, and with ot.ErrIncompatibleLengths if op's base length isn't the
+// length of base in runes, rather than letting Apply corrupt the text.
+func ByteLen(op *ot.OperationSeq, base string) (int, error) {
+	if RuneLen(base) != op.BaseLen() {
+		return 0, fmt.Errorf("%w: operation expects %d characters, text has %d", ot.ErrIncompatibleLengths, op.BaseLen(), RuneLen(base))
+	}
+
+	size, pos := 0, 0 // pos is a byte offset into base
+	ops := op.Ops()
+	for i, o := range ops {
+		switch v := o.(type) {
+		case ot.Retain:
+			if i == len(ops)-1 {
+				// The rest of base, which the length check says is v.N
+				// runes; copied whole, it can't split a character
+				size += len(base) - pos
+				break
+			}
+			n, err := skipRunes(base[pos:], v.N)
+			if err != nil {
+				return 0, err
+			}
+			size += n
+			pos += n
+		case ot.Delete:
+			n, err := skipRunes(base[pos:], v.N)
+			if err != nil {
+				return 0, err
+			}
+			pos += n
+		case ot.Insert:
+			if !utf8.ValidString(v.Text) {
+				return 0, fmt.Errorf("%w in inserted text", ErrInvalidUTF8)
+			}
+			size += len(v.Text)
+		}
+	}
+	return size, nil
+}
+
+// Apply is op.Apply for base, once ByteLen has validated op against it and
+// measured the result as size bytes. Instead of converting base to runes and
+// copying it a character at a time, it copies each retained span in one go
+// into a result allocated once, so an edit to a large document costs a scan
+// and a copy rather than rebuilding the text.
+func Apply(op *ot.OperationSeq, base string, size int) string {
+	var b strings.Builder
+	b.Grow(size)
+	pos := 0 // Byte offset into base
+	ops := op.Ops()
+	for i, o := range ops {
+		switch v := o.(type) {
+		case ot.Retain:
+			if i == len(ops)-1 {
+				b.WriteString(base[pos:]) // The rest, as in ByteLen
+				break
+			}
+			n, _ := skipRunes(base[pos:], v.N)
+			b.WriteString(base[pos : pos+n])
+			pos += n
+		case ot.Delete:
+			n, _ := skipRunes(base[pos:], v.N)
+			pos += n
+		case ot.Insert:
+			b.WriteString(v.Text)
+		}
+	}
+	return b.String()
+}
+
+// skipRunes returns the byte length of the first n runes of s, failing if
+// any of them is an invalid byte. The caller has checked s is long enough.
+func skipRunes(s string, n uint64) (int, error) {
+	pos := 0
+	for ; n > 0; n-- {
+		if s[pos] < utf8.RuneSelf {
+			pos++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[pos:])
+		if r == utf8.RuneError && size <= 1 {
+			return 0, fmt.Errorf("%w at byte %d of the text", ErrInvalidUTF8, pos)
+		}
+		pos += size
+	}
+	return pos, nil
+}
@@ -0,0 +1,108 @@
+package otutil
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/shiv248/kolabpad/internal/otutil/ottest"
+	ot "github.com/shiv248/operational-transformation-go"
+)
+
+// TestByteLen tests that ByteLen predicts the UTF-8 size of Apply's result
+// for retains, deletes and inserts over multibyte text, and that Apply
+// matches the library's.
+func TestByteLen(t *testing.T) {
+	cases := []struct {
+		name string
+		base string
+		op   func(*ot.OperationSeq)
+	}{
+		{"ascii", "hello", func(op *ot.OperationSeq) { op.Retain(2); op.Delete(1); op.Insert("y"); op.Retain(2) }},
+		{"retain multibyte", "héllo 世界", func(op *ot.OperationSeq) { op.Retain(8); op.Insert("!") }},
+		{"delete multibyte", "héllo 世界", func(op *ot.OperationSeq) { op.Retain(1); op.Delete(1); op.Retain(3); op.Delete(2); op.Retain(1) }},
+		{"astral", "a😀b", func(op *ot.OperationSeq) { op.Delete(1); op.Retain(1); op.Insert("🎉é"); op.Retain(1) }},
+		{"empty", "", func(op *ot.OperationSeq) { op.Insert("世") }},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			op := ot.NewOperationSeq()
+			tc.op(op)
+			want, err := op.Apply(tc.base)
+			if err != nil {
+				t.Fatalf("Apply failed: %v", err)
+			}
+			got, err := ByteLen(op, tc.base)
+			if err != nil {
+				t.Fatalf("ByteLen failed: %v", err)
+			}
+			if got != len(want) {
+				t.Errorf("Expected %d bytes (%q), got %d", len(want), want, got)
+			}
+			if text := Apply(op, tc.base, got); text != want {
+				t.Errorf("Expected Apply to give %q, got %q", want, text)
+			}
+		})
+	}
+}
+
+// TestApplyRandom tests that Apply matches the library's Apply over random
+// operations on multibyte text.
+func TestApplyRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		base := ottest.RandomText(rng, 40)
+		op := ottest.RandomOperation(rng, utf8.RuneCountInString(base))
+		want, err := op.Apply(base)
+		if err != nil {
+			t.Fatalf("Apply failed: %v", err)
+		}
+		size, err := ByteLen(op, base)
+		if err != nil {
+			t.Fatalf("ByteLen failed: %v", err)
+		}
+		if got := Apply(op, base, size); got != want {
+			t.Fatalf("Apply of %v to %q gave %q, want %q", op, base, got, want)
+		}
+	}
+}
+
+// TestByteLenRejectsSplitCharacters tests that operations which would split
+// a multibyte character, or were counted in another unit, are errors rather
+// than corrupted text.
+func TestByteLenRejectsSplitCharacters(t *testing.T) {
+	cases := []struct {
+		name string
+		base string
+		op   func(*ot.OperationSeq)
+		want error
+	}{
+		// "héllo" is 5 characters but 6 bytes
+		{"counted in bytes", "héllo", func(op *ot.OperationSeq) { op.Retain(2); op.Delete(1); op.Retain(3) }, ot.ErrIncompatibleLengths},
+		// JavaScript counts 😀 as 2 UTF-16 units
+		{"counted in UTF-16", "a😀", func(op *ot.OperationSeq) { op.Retain(3); op.Insert("b") }, ot.ErrIncompatibleLengths},
+		// The text was cut after the first byte of "é"
+		{"retain into split character", "h\xc3", func(op *ot.OperationSeq) { op.Retain(2); op.Insert("!") }, ErrInvalidUTF8},
+		{"delete split character", "h\xc3llo", func(op *ot.OperationSeq) { op.Retain(1); op.Delete(1); op.Retain(3) }, ErrInvalidUTF8},
+		{"insert split character", "hi", func(op *ot.OperationSeq) { op.Retain(2); op.Insert("\xe4\xb8") }, ErrInvalidUTF8},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			op := ot.NewOperationSeq()
+			tc.op(op)
+			if _, err := ByteLen(op, tc.base); !errors.Is(err, tc.want) {
+				t.Errorf("Expected %v, got %v", tc.want, err)
+			}
+		})
+	}
+
+	// Left to Apply, a split character silently becomes U+FFFD
+	op := ot.NewOperationSeq()
+	op.Retain(2)
+	if got, err := op.Apply("h\xc3"); err != nil || got == "h\xc3" {
+		t.Errorf("Expected Apply to rewrite the split character, got %q (%v)", got, err)
+	}
+}
@@ -2,7 +2,144 @@
 package protocol
 
 const (
+	// Version is the WebSocket protocol revision, reported by /api/version.
+	// Bump it when a change would break existing clients.
+	Version = 1
+
 	// SystemUserID is the user ID used for system-generated operations and initial state.
 	// Set to max uint64 (^uint64(0)) to avoid conflicts with real user IDs (0, 1, 2, ...).
 	SystemUserID = ^uint64(0) // 18446744073709551615
 )
+
+// Client message types: the ClientMsg field names, as returned by
+// ClientMsg.Type.
+const (
+	MsgEdit        = "Edit"
+	MsgSetLanguage = "SetLanguage"
+	MsgClientInfo  = "ClientInfo"
+	MsgCursorData  = "CursorData"
+	MsgPointer     = "Pointer"
+	MsgRequest     = "Request"
+)
+
+// ClientMsgTypes lists every client message type.
+var ClientMsgTypes = []string{MsgEdit, MsgSetLanguage, MsgClientInfo, MsgCursorData, MsgPointer, MsgRequest}
+
+// Error codes sent in ErrorMsg.
+const (
+	// ErrorCodeUnsupportedLanguage means SetLanguage named a language outside the server's allowlist.
+	ErrorCodeUnsupportedLanguage = "unsupported_language"
+
+	// ErrorCodePersistenceDegraded means the server can't save the document;
+	// edits are kept in memory and writes are retried with backoff.
+	ErrorCodePersistenceDegraded = "persistence_degraded"
+
+	// ErrorCodeStorageFull means the document can't be saved because the
+	// server's database holds as many documents as it allows. Edits are kept
+	// only in memory, so they don't survive an unload or restart. Also sent in
+	// a Response to a protect Request that would have stored the document.
+	ErrorCodeStorageFull = "storage_full"
+
+	// ErrorCodePersistenceRestored clears ErrorCodePersistenceDegraded or
+	// ErrorCodeStorageFull.
+	ErrorCodePersistenceRestored = "persistence_restored"
+
+	// ErrorCodeDraining means an edit was dropped because the server is
+	// shutting down; the document was saved as of the previous edit.
+	ErrorCodeDraining = "draining"
+
+	// ErrorCodeMalformedMessage means a client message wasn't valid JSON or
+	// didn't match the protocol. It was ignored; the connection stays open.
+	ErrorCodeMalformedMessage = "malformed_message"
+
+	// ErrorCodeReadOnly means an Edit or SetLanguage came from a viewer and
+	// was dropped. The client should reload, since its edit never applied.
+	ErrorCodeReadOnly = "read_only"
+
+	// ErrorCodeLineLimit means an Edit would have exceeded the server's
+	// line count or line length limit and was dropped. The client should
+	// reload, since its edit never applied.
+	ErrorCodeLineLimit = "line_limit"
+
+	// ErrorCodeRateLimited means a SetLanguage came faster than the server
+	// allows and was dropped; the language is unchanged. The connection stays
+	// open.
+	ErrorCodeRateLimited = "rate_limited"
+
+	// ErrorCodeDisabled means the server doesn't accept this type of
+	// message and ignored it. Sent only if the server is configured to say
+	// so, except for a Request, whose Response always carries it.
+	ErrorCodeDisabled = "disabled"
+
+	// ErrorCodeUnknownMethod means a Request named a method the server
+	// doesn't implement. Only sent in a Response.
+	ErrorCodeUnknownMethod = "unknown_method"
+
+	// ErrorCodeForbidden means the connection may not invoke a Request's
+	// method, e.g. a share link holder asking to protect the document.
+	// Only sent in a Response.
+	ErrorCodeForbidden = "forbidden"
+
+	// ErrorCodeUnavailable means a Request needs a feature the server runs
+	// without, such as the database. Only sent in a Response.
+	ErrorCodeUnavailable = "unavailable"
+
+	// ErrorCodeInternal means the server failed to carry out a Request;
+	// retrying may succeed. Only sent in a Response.
+	ErrorCodeInternal = "internal_error"
+)
+
+// Methods a client can invoke with a Request.
+const (
+	// MethodProtect enables OTP protection, or regenerates the OTP of a
+	// protected document. Params are optional: {"owner_key": string}, needed
+	// when the server enforces document owners and the document has one. The
+	// result is {"otp": string}, plus "owner_key" if the call made the user
+	// the document's owner.
+	MethodProtect = "protect"
+
+	// MethodStats returns server statistics, like GET /api/stats. Takes no params.
+	MethodStats = "stats"
+)
+
+// WebSocket close codes for application errors, in the 4000-4999 range
+// reserved for applications. Clients use them to decide whether to reconnect.
+const (
+	// CloseInvalidRevision means the client's revision is ahead of the server
+	// or older than retained history. Reconnect to reload the document.
+	CloseInvalidRevision = 4000
+
+	// CloseInvalidOperation means an edit didn't apply to the document it
+	// claimed to be based on. The client is out of sync; reconnect to reload.
+	CloseInvalidOperation = 4001
+
+	// CloseDocumentTooLarge means an edit would have grown the document past
+	// the server's size limit. Reconnecting and resending it will fail again.
+	CloseDocumentTooLarge = 4002
+
+	// CloseRateLimited means the client sent messages faster than allowed.
+	// Reconnect after a backoff.
+	CloseRateLimited = 4003
+
+	// CloseSlowConsumer means the client fell too far behind reading
+	// broadcasts. Reconnect to reload.
+	CloseSlowConsumer = 4004
+
+	// CloseDocumentKilled means the document was closed on the server
+	// (eviction or shutdown). The preceding Shutdown message says whether to reconnect.
+	CloseDocumentKilled = 4005
+
+	// CloseAccessRevoked means the share link the client connected with was
+	// revoked. Reconnecting with it will be refused.
+	CloseAccessRevoked = 4006
+)
+
+// Roles granted by share links (see AccessMsg).
+const (
+	// RoleEditor may edit the document, like a holder of the document OTP.
+	RoleEditor = "editor"
+
+	// RoleViewer may read the document and share a cursor, but not edit it
+	// or change its language.
+	RoleViewer = "viewer"
+)
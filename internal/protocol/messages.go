@@ -3,8 +3,14 @@
 package protocol
 
 import (
+	"bytes"
 	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
 
+	"github.com/shiv248/kolabpad/internal/otutil"
 	ot "github.com/shiv248/operational-transformation-go"
 )
 
@@ -12,8 +18,17 @@ import (
 type UserInfo struct {
 	Name string `json:"name"` // Display name
 	Hue  uint32 `json:"hue"`  // Color hue (0-359)
+
+	// AvatarSeed is an opaque, stable value clients derive an avatar from,
+	// typically a hash of a client identifier. Empty means none; at most
+	// MaxAvatarSeedLength bytes.
+	AvatarSeed string `json:"avatar_seed,omitempty"`
 }
 
+// MaxAvatarSeedLength caps UserInfo.AvatarSeed, in bytes. It fits a
+// hex-encoded SHA-512.
+const MaxAvatarSeedLength = 128
+
 // CursorData represents a user's cursor positions and selections.
 type CursorData struct {
 	Cursors    []uint32    `json:"cursors"`    // Cursor positions (Unicode codepoint offsets)
@@ -22,17 +37,33 @@ type CursorData struct {
 
 // UserOperation represents an operation with the user ID who created it.
 type UserOperation struct {
-	ID        uint64           `json:"id"`        // User ID
-	Operation *ot.OperationSeq `json:"operation"` // The OT operation
+	ID        uint64           `json:"id"`                 // User ID
+	Operation *ot.OperationSeq `json:"operation"`          // The OT operation
+	Inserted  uint64           `json:"inserted,omitempty"` // Characters inserted by Operation
+	Deleted   uint64           `json:"deleted,omitempty"`  // Characters deleted by Operation
+}
+
+// NewUserOperation creates a history entry for op, deriving its insert/delete stats.
+func NewUserOperation(id uint64, op *ot.OperationSeq) UserOperation {
+	return UserOperation{
+		ID:        id,
+		Operation: op,
+		Inserted:  uint64(utf8.RuneCountInString(otutil.InsertedText(op))),
+		Deleted:   otutil.DeletedLen(op),
+	}
 }
 
 // ClientMsg represents messages sent from client to server.
-// Only one field should be set per message (tagged union pattern).
+// Only one field should be set per message (tagged union pattern), except
+// that Edit may come with CursorData: the cursor as the edit left it,
+// applied together with the edit.
 type ClientMsg struct {
 	Edit        *EditMsg    `json:"Edit,omitempty"`
 	SetLanguage *string     `json:"SetLanguage,omitempty"`
 	ClientInfo  *UserInfo   `json:"ClientInfo,omitempty"`
 	CursorData  *CursorData `json:"CursorData,omitempty"`
+	Request     *RequestMsg `json:"Request,omitempty"`
+	Pointer     *PointerMsg `json:"Pointer,omitempty"`
 }
 
 // EditMsg represents a text edit operation from the client.
@@ -41,6 +72,20 @@ type EditMsg struct {
 	Operation *ot.OperationSeq `json:"operation"` // The edit operation
 }
 
+// PointerMsg places a transient "look here" marker at a position in the
+// document. Unlike CursorData it isn't kept: others see it once and fade it.
+type PointerMsg struct {
+	Position uint32 `json:"position"` // Codepoint offset into the current text
+}
+
+// RequestMsg invokes a server action (see Method* constants) on behalf of the
+// connection's user. The server answers with a Response carrying the same ID.
+type RequestMsg struct {
+	ID     uint64          `json:"id"`               // Chosen by the client to match the Response
+	Method string          `json:"method"`           // Action to invoke
+	Params json.RawMessage `json:"params,omitempty"` // Method-specific arguments, if any
+}
+
 // ServerMsg represents messages sent from server to client.
 // Only one field should be set per message (tagged union pattern).
 type ServerMsg struct {
@@ -50,6 +95,19 @@ type ServerMsg struct {
 	UserInfo   *UserInfoMsg   `json:"UserInfo,omitempty"`
 	UserCursor *UserCursorMsg `json:"UserCursor,omitempty"`
 	OTP        *OTPMsg        `json:"OTP,omitempty"`
+	Shutdown   *ShutdownMsg   `json:"Shutdown,omitempty"`
+	Error      *ErrorMsg      `json:"Error,omitempty"`
+	ServerTime *int64         `json:"ServerTime,omitempty"`
+
+	LanguageSuggestion *LanguageSuggestionMsg `json:"LanguageSuggestion,omitempty"`
+	Presence           *PresenceMsg           `json:"Presence,omitempty"`
+	Announcement       *AnnouncementMsg       `json:"Announcement,omitempty"`
+	Access             *AccessMsg             `json:"Access,omitempty"`
+	Response           *ResponseMsg           `json:"Response,omitempty"`
+	RecentChanges      *RecentChangesMsg      `json:"RecentChanges,omitempty"`
+	Ownership          *OwnershipMsg          `json:"Ownership,omitempty"`
+	Pointer            *UserPointerMsg        `json:"Pointer,omitempty"`
+	Renamed            *RenamedMsg            `json:"Renamed,omitempty"`
 }
 
 // HistoryMsg sends a batch of operations to the client.
@@ -70,6 +128,15 @@ type UserCursorMsg struct {
 	Data CursorData `json:"data"` // Cursor positions
 }
 
+// UserPointerMsg broadcasts a user's Pointer. Position refers to the text
+// at Revision; a client that hasn't applied History up to Revision yet
+// transforms it through those operations when they arrive.
+type UserPointerMsg struct {
+	ID       uint64 `json:"id"`       // User ID
+	Position uint32 `json:"position"` // Codepoint offset
+	Revision int    `json:"revision"` // Revision the position refers to
+}
+
 // LanguageMsg broadcasts language changes to all clients.
 type LanguageMsg struct {
 	Language string `json:"language"`  // New language
@@ -84,27 +151,230 @@ type OTPMsg struct {
 	UserName string  `json:"user_name"` // User's display name
 }
 
+// LanguageSuggestionMsg proposes a language detected from the document's content.
+// It is non-authoritative: the language only changes if a client sends SetLanguage.
+type LanguageSuggestionMsg struct {
+	Language string `json:"language"` // Detected language
+}
+
+// PresenceMsg is a periodic snapshot of every registered user. Clients replace
+// their user list with it, dropping anyone missing, to recover from missed
+// UserInfo broadcasts.
+type PresenceMsg struct {
+	Users []UserInfoMsg `json:"users"` // All registered users, sorted by ID
+}
+
+// AnnouncementMsg carries an operator notice (e.g. planned maintenance) sent
+// to every connected client on every document. Clients show it as a banner.
+type AnnouncementMsg struct {
+	Message string `json:"message"` // Notice text
+}
+
+// AccessMsg tells a client that connected with a share link which role the
+// link grants. It follows Identity; clients that connected with the document
+// OTP (or to an unprotected document) don't receive it and have full access.
+type AccessMsg struct {
+	Role  string `json:"role"`  // RoleEditor or RoleViewer
+	Label string `json:"label"` // The share link's label, e.g. "reviewers"
+}
+
+// RecentChangesMsg lists where the document's latest edits landed, so a
+// client that just joined can briefly highlight them. It follows the initial
+// History and is purely decorative; clients may ignore it.
+type RecentChangesMsg struct {
+	Ranges []ChangeRange `json:"ranges"` // Oldest edit first
+}
+
+// ChangeRange is text a user inserted, as codepoint offsets [start, end) into
+// the current document. An empty range marks where text was deleted.
+type ChangeRange struct {
+	ID    uint64 `json:"id"`    // User who made the edit
+	Start uint32 `json:"start"` // First changed codepoint
+	End   uint32 `json:"end"`   // Codepoint after the change
+}
+
+// OwnershipMsg hands a client the owner key of its document, when the
+// server enforces document ownership and the previous owner transferred it.
+// It is sent only to the new owner, who must present the key to change the
+// document's protection.
+type OwnershipMsg struct {
+	OwnerKey string `json:"owner_key"` // Secret identifying the owner
+}
+
+// ResponseMsg answers a client's Request. Exactly one of Result and Error is set.
+type ResponseMsg struct {
+	ID     uint64          `json:"id"`               // The Request's ID
+	Result json.RawMessage `json:"result,omitempty"` // Method-specific result
+	Error  *ErrorMsg       `json:"error,omitempty"`  // Why the request failed
+}
+
+// RenamedMsg tells clients the document moved to a new ID. The server closes
+// their connections shortly after; they reconnect at the new ID with the same
+// OTP and update their URL. The old ID no longer refers to the document.
+type RenamedMsg struct {
+	ID string `json:"id"` // The document's new ID
+}
+
+// ShutdownMsg tells clients the document is being closed by the server.
+type ShutdownMsg struct {
+	Reason    string `json:"reason"`    // Human-readable reason (e.g. "evicted", "server shutting down")
+	Reconnect bool   `json:"reconnect"` // Whether the client should automatically reconnect
+}
+
+// ErrorMsg reports a recoverable problem with a client request.
+// The connection stays open; the client decides how to surface it.
+type ErrorMsg struct {
+	Code    string `json:"code"`    // Machine-readable error code (see ErrorCode* constants)
+	Message string `json:"message"` // Human-readable description
+}
+
+// encodeBuffers recycles scratch buffers for ServerMsg.MarshalJSON, which
+// runs for every message sent to every client.
+var encodeBuffers = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
 // MarshalJSON implements custom JSON marshaling for ServerMsg.
-// We need to ensure only one field is present in the JSON output.
+// We need to ensure only one field is present in the JSON output, so the
+// first non-nil field is written as {"Field":value} directly, without
+// building an intermediate map. The output matches encoding/json exactly.
 func (m *ServerMsg) MarshalJSON() ([]byte, error) {
-	// Create a map with only the non-nil field
-	result := make(map[string]interface{})
+	buf := encodeBuffers.Get().(*bytes.Buffer)
+	defer encodeBuffers.Put(buf)
+	buf.Reset()
 
+	var err error
 	if m.Identity != nil {
-		result["Identity"] = *m.Identity
+		writeUint(buf, "Identity", *m.Identity)
 	} else if m.History != nil {
-		result["History"] = m.History
+		err = writeField(buf, "History", m.History)
 	} else if m.Language != nil {
-		result["Language"] = m.Language
+		err = writeField(buf, "Language", m.Language)
 	} else if m.UserInfo != nil {
-		result["UserInfo"] = m.UserInfo
+		err = writeField(buf, "UserInfo", m.UserInfo)
 	} else if m.UserCursor != nil {
-		result["UserCursor"] = m.UserCursor
+		writeUserCursor(buf, m.UserCursor)
 	} else if m.OTP != nil {
-		result["OTP"] = m.OTP
+		err = writeField(buf, "OTP", m.OTP)
+	} else if m.Shutdown != nil {
+		err = writeField(buf, "Shutdown", m.Shutdown)
+	} else if m.Error != nil {
+		err = writeField(buf, "Error", m.Error)
+	} else if m.ServerTime != nil {
+		buf.WriteString(`{"ServerTime":`)
+		buf.Write(strconv.AppendInt(buf.AvailableBuffer(), *m.ServerTime, 10))
+		buf.WriteByte('}')
+	} else if m.LanguageSuggestion != nil {
+		err = writeField(buf, "LanguageSuggestion", m.LanguageSuggestion)
+	} else if m.Presence != nil {
+		err = writeField(buf, "Presence", m.Presence)
+	} else if m.Announcement != nil {
+		err = writeField(buf, "Announcement", m.Announcement)
+	} else if m.Access != nil {
+		err = writeField(buf, "Access", m.Access)
+	} else if m.Response != nil {
+		err = writeField(buf, "Response", m.Response)
+	} else if m.RecentChanges != nil {
+		err = writeField(buf, "RecentChanges", m.RecentChanges)
+	} else if m.Ownership != nil {
+		err = writeField(buf, "Ownership", m.Ownership)
+	} else if m.Pointer != nil {
+		err = writeField(buf, "Pointer", m.Pointer)
+	} else if m.Renamed != nil {
+		err = writeField(buf, "Renamed", m.Renamed)
+	} else {
+		buf.WriteString("{}")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The buffer goes back to the pool, so hand out a copy
+	return bytes.Clone(buf.Bytes()), nil
+}
+
+// writeField writes {"key":value}, encoding value with encoding/json.
+func writeField(buf *bytes.Buffer, key string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	buf.WriteString(`{"`)
+	buf.WriteString(key)
+	buf.WriteString(`":`)
+	buf.Write(data)
+	buf.WriteByte('}')
+	return nil
+}
+
+// writeUint writes {"key":n}.
+func writeUint(buf *bytes.Buffer, key string, n uint64) {
+	buf.WriteString(`{"`)
+	buf.WriteString(key)
+	buf.WriteString(`":`)
+	buf.Write(strconv.AppendUint(buf.AvailableBuffer(), n, 10))
+	buf.WriteByte('}')
+}
+
+// writeUserCursor encodes the highest-volume broadcast by hand. nil slices
+// are written as null, as encoding/json does.
+func writeUserCursor(buf *bytes.Buffer, msg *UserCursorMsg) {
+	buf.WriteString(`{"UserCursor":{"id":`)
+	buf.Write(strconv.AppendUint(buf.AvailableBuffer(), msg.ID, 10))
+
+	buf.WriteString(`,"data":{"cursors":`)
+	if msg.Data.Cursors == nil {
+		buf.WriteString("null")
+	} else {
+		buf.WriteByte('[')
+		for i, c := range msg.Data.Cursors {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.Write(strconv.AppendUint(buf.AvailableBuffer(), uint64(c), 10))
+		}
+		buf.WriteByte(']')
 	}
 
-	return json.Marshal(result)
+	buf.WriteString(`,"selections":`)
+	if msg.Data.Selections == nil {
+		buf.WriteString("null")
+	} else {
+		buf.WriteByte('[')
+		for i, sel := range msg.Data.Selections {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteByte('[')
+			buf.Write(strconv.AppendUint(buf.AvailableBuffer(), uint64(sel[0]), 10))
+			buf.WriteByte(',')
+			buf.Write(strconv.AppendUint(buf.AvailableBuffer(), uint64(sel[1]), 10))
+			buf.WriteByte(']')
+		}
+		buf.WriteByte(']')
+	}
+	buf.WriteString("}}}")
+}
+
+// Type returns the ClientMsgType of m: the field that's set, with Edit
+// taking precedence over the CursorData that may accompany it. It's empty
+// for a message with no field set.
+func (m *ClientMsg) Type() string {
+	switch {
+	case m.Edit != nil:
+		return MsgEdit
+	case m.SetLanguage != nil:
+		return MsgSetLanguage
+	case m.ClientInfo != nil:
+		return MsgClientInfo
+	case m.CursorData != nil:
+		return MsgCursorData
+	case m.Pointer != nil:
+		return MsgPointer
+	case m.Request != nil:
+		return MsgRequest
+	}
+	return ""
 }
 
 // UnmarshalJSON implements custom JSON unmarshaling for ClientMsg.
@@ -147,6 +417,72 @@ func (m *ClientMsg) UnmarshalJSON(data []byte) error {
 		m.CursorData = &cursor
 	}
 
+	if requestData, ok := raw["Request"]; ok {
+		var request RequestMsg
+		if err := json.Unmarshal(requestData, &request); err != nil {
+			return err
+		}
+		m.Request = &request
+	}
+
+	if pointerData, ok := raw["Pointer"]; ok {
+		var pointer PointerMsg
+		if err := json.Unmarshal(pointerData, &pointer); err != nil {
+			return err
+		}
+		m.Pointer = &pointer
+	}
+
+	return nil
+}
+
+// UnmarshalJSON accepts the operation in either versioned or legacy form.
+func (m *EditMsg) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Revision  int             `json:"revision"`
+		Operation json.RawMessage `json:"operation"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	m.Revision = raw.Revision
+	if raw.Operation == nil {
+		return nil
+	}
+
+	op, err := otutil.UnmarshalVersioned(raw.Operation)
+	if err != nil {
+		return err
+	}
+	m.Operation = op
+	return nil
+}
+
+// UnmarshalJSON accepts the operation in either versioned or legacy form.
+func (u *UserOperation) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		ID        uint64          `json:"id"`
+		Operation json.RawMessage `json:"operation"`
+		Inserted  uint64          `json:"inserted"`
+		Deleted   uint64          `json:"deleted"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	u.ID = raw.ID
+	u.Inserted = raw.Inserted
+	u.Deleted = raw.Deleted
+	if raw.Operation == nil {
+		return nil
+	}
+
+	op, err := otutil.UnmarshalVersioned(raw.Operation)
+	if err != nil {
+		return err
+	}
+	u.Operation = op
 	return nil
 }
 
@@ -172,6 +508,11 @@ func NewUserInfoMsg(id uint64, info *UserInfo) *ServerMsg {
 	return &ServerMsg{UserInfo: &UserInfoMsg{ID: id, Info: info}}
 }
 
+// NewPointerMsg creates a Pointer server message.
+func NewPointerMsg(id uint64, position uint32, revision int) *ServerMsg {
+	return &ServerMsg{Pointer: &UserPointerMsg{ID: id, Position: position, Revision: revision}}
+}
+
 // NewUserCursorMsg creates a UserCursor server message.
 func NewUserCursorMsg(id uint64, data CursorData) *ServerMsg {
 	return &ServerMsg{UserCursor: &UserCursorMsg{ID: id, Data: data}}
@@ -181,3 +522,64 @@ func NewUserCursorMsg(id uint64, data CursorData) *ServerMsg {
 func NewOTPMsg(otp *string, userID uint64, userName string) *ServerMsg {
 	return &ServerMsg{OTP: &OTPMsg{OTP: otp, UserID: userID, UserName: userName}}
 }
+
+// NewLanguageSuggestionMsg creates a LanguageSuggestion server message.
+func NewLanguageSuggestionMsg(lang string) *ServerMsg {
+	return &ServerMsg{LanguageSuggestion: &LanguageSuggestionMsg{Language: lang}}
+}
+
+// NewPresenceMsg creates a Presence server message.
+func NewPresenceMsg(users []UserInfoMsg) *ServerMsg {
+	return &ServerMsg{Presence: &PresenceMsg{Users: users}}
+}
+
+// NewAnnouncementMsg creates an Announcement server message.
+func NewAnnouncementMsg(message string) *ServerMsg {
+	return &ServerMsg{Announcement: &AnnouncementMsg{Message: message}}
+}
+
+// NewAccessMsg creates an Access server message.
+func NewAccessMsg(role, label string) *ServerMsg {
+	return &ServerMsg{Access: &AccessMsg{Role: role, Label: label}}
+}
+
+// NewRecentChangesMsg creates a RecentChanges server message.
+func NewRecentChangesMsg(ranges []ChangeRange) *ServerMsg {
+	return &ServerMsg{RecentChanges: &RecentChangesMsg{Ranges: ranges}}
+}
+
+// NewOwnershipMsg creates an Ownership server message.
+func NewOwnershipMsg(ownerKey string) *ServerMsg {
+	return &ServerMsg{Ownership: &OwnershipMsg{OwnerKey: ownerKey}}
+}
+
+// NewResponseMsg creates a successful Response server message.
+func NewResponseMsg(id uint64, result json.RawMessage) *ServerMsg {
+	return &ServerMsg{Response: &ResponseMsg{ID: id, Result: result}}
+}
+
+// NewResponseErrorMsg creates a failed Response server message.
+func NewResponseErrorMsg(id uint64, code, message string) *ServerMsg {
+	return &ServerMsg{Response: &ResponseMsg{ID: id, Error: &ErrorMsg{Code: code, Message: message}}}
+}
+
+// NewRenamedMsg creates a Renamed server message.
+func NewRenamedMsg(id string) *ServerMsg {
+	return &ServerMsg{Renamed: &RenamedMsg{ID: id}}
+}
+
+// NewShutdownMsg creates a Shutdown server message.
+func NewShutdownMsg(reason string, reconnect bool) *ServerMsg {
+	return &ServerMsg{Shutdown: &ShutdownMsg{Reason: reason, Reconnect: reconnect}}
+}
+
+// NewErrorMsg creates an Error server message.
+func NewErrorMsg(code, message string) *ServerMsg {
+	return &ServerMsg{Error: &ErrorMsg{Code: code, Message: message}}
+}
+
+// NewServerTimeMsg creates a ServerTime server message carrying t as Unix milliseconds.
+func NewServerTimeMsg(t time.Time) *ServerMsg {
+	ms := t.UnixMilli()
+	return &ServerMsg{ServerTime: &ms}
+}
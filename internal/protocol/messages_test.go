@@ -0,0 +1,202 @@
+package protocol
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	ot "github.com/shiv248/operational-transformation-go"
+)
+
+// TestClientMsgEditVersions tests that Edit accepts both versioned and legacy operations.
+func TestClientMsgEditVersions(t *testing.T) {
+	payloads := map[string]string{
+		"legacy":    `{"Edit":{"revision":3,"operation":[2,"hi",-1]}}`,
+		"versioned": `{"Edit":{"revision":3,"operation":{"v":1,"ops":[2,"hi",-1]}}}`,
+	}
+
+	for name, payload := range payloads {
+		t.Run(name, func(t *testing.T) {
+			var msg ClientMsg
+			if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+				t.Fatalf("Unmarshal failed: %v", err)
+			}
+			if msg.Edit == nil || msg.Edit.Operation == nil {
+				t.Fatalf("Expected Edit with operation, got %+v", msg)
+			}
+			if msg.Edit.Revision != 3 {
+				t.Errorf("Expected revision 3, got %d", msg.Edit.Revision)
+			}
+			if got := msg.Edit.Operation.String(); got != `[2,"hi",-1]` {
+				t.Errorf("Expected [2,\"hi\",-1], got %s", got)
+			}
+		})
+	}
+}
+
+// TestClientMsgEditUnknownVersion tests that unknown operation versions are rejected.
+func TestClientMsgEditUnknownVersion(t *testing.T) {
+	var msg ClientMsg
+	err := json.Unmarshal([]byte(`{"Edit":{"revision":0,"operation":{"v":99,"ops":[]}}}`), &msg)
+	if err == nil {
+		t.Fatal("Expected error for unknown operation version")
+	}
+}
+
+// TestClientMsgRequest tests that a Request keeps its params undecoded for
+// the method to interpret.
+func TestClientMsgRequest(t *testing.T) {
+	var msg ClientMsg
+	if err := json.Unmarshal([]byte(`{"Request":{"id":9,"method":"stats","params":{"a":[1,2]}}}`), &msg); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if msg.Request == nil || msg.Request.ID != 9 || msg.Request.Method != MethodStats {
+		t.Fatalf("Expected stats Request 9, got %+v", msg.Request)
+	}
+	if got := string(msg.Request.Params); got != `{"a":[1,2]}` {
+		t.Errorf("Expected raw params, got %s", got)
+	}
+
+	if err := json.Unmarshal([]byte(`{"Request":{"id":"nine","method":"stats"}}`), &ClientMsg{}); err == nil {
+		t.Error("Expected error for a non-numeric request ID")
+	}
+}
+
+// TestClientMsgType tests that a message's type is the field that's set, and
+// that an Edit carrying CursorData is an Edit.
+func TestClientMsgType(t *testing.T) {
+	tests := map[string]string{
+		`{"Edit":{"revision":0,"operation":[]},"CursorData":{"cursors":[],"selections":[]}}`: MsgEdit,
+		`{"SetLanguage":"go"}`:                           MsgSetLanguage,
+		`{"ClientInfo":{"name":"Alice","hue":10}}`:       MsgClientInfo,
+		`{"CursorData":{"cursors":[1],"selections":[]}}`: MsgCursorData,
+		`{"Pointer":{"position":3}}`:                     MsgPointer,
+		`{"Request":{"id":1,"method":"stats"}}`:          MsgRequest,
+		`{}`:                                             "",
+	}
+	for data, want := range tests {
+		var msg ClientMsg
+		if err := json.Unmarshal([]byte(data), &msg); err != nil {
+			t.Fatalf("Unmarshal %s failed: %v", data, err)
+		}
+		if got := msg.Type(); got != want {
+			t.Errorf("Expected %s to be type %q, got %q", data, want, got)
+		}
+	}
+}
+
+// TestUserOperationStats tests that history entries carry insert/delete stats
+// and omit them when zero.
+func TestUserOperationStats(t *testing.T) {
+	op := ot.NewOperationSeq()
+	op.Retain(1)
+	op.Insert("hé😀")
+	op.Delete(2)
+
+	entry := NewUserOperation(7, op)
+	if entry.Inserted != 3 || entry.Deleted != 2 {
+		t.Errorf("Expected inserted=3 deleted=2, got inserted=%d deleted=%d", entry.Inserted, entry.Deleted)
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	var decoded UserOperation
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if decoded.Inserted != 3 || decoded.Deleted != 2 {
+		t.Errorf("Stats lost in round trip: %s", data)
+	}
+
+	retain := ot.NewOperationSeq()
+	retain.Retain(3)
+	data, _ = json.Marshal(NewUserOperation(7, retain))
+	if strings.Contains(string(data), "inserted") || strings.Contains(string(data), "deleted") {
+		t.Errorf("Expected zero stats to be omitted, got %s", data)
+	}
+}
+
+// TestServerMsgWireFormat tests the exact JSON encoding of every server message.
+func TestServerMsgWireFormat(t *testing.T) {
+	op := ot.NewOperationSeq()
+	op.Retain(2)
+	op.Insert("<é>")
+	otp := "secret"
+	info := UserInfo{Name: "Ann \"A\"", Hue: 120}
+
+	cases := []struct {
+		name string
+		msg  *ServerMsg
+		want string
+	}{
+		{"empty", &ServerMsg{}, `{}`},
+		{"Identity", NewIdentityMsg(7), `{"Identity":7}`},
+		{"History", NewHistoryMsg(3, []UserOperation{NewUserOperation(1, op)}),
+			`{"History":{"start":3,"operations":[{"id":1,"operation":[2,"\u003cé\u003e"],"inserted":3}]}}`},
+		{"HistoryEmpty", NewHistoryMsg(0, nil), `{"History":{"start":0,"operations":null}}`},
+		{"Language", NewLanguageMsg("go", 1, "Ann"), `{"Language":{"language":"go","user_id":1,"user_name":"Ann"}}`},
+		{"UserInfo", NewUserInfoMsg(2, &info), `{"UserInfo":{"id":2,"info":{"name":"Ann \"A\"","hue":120}}}`},
+		{"UserInfoRemoved", NewUserInfoMsg(2, nil), `{"UserInfo":{"id":2}}`},
+		{"UserCursor", NewUserCursorMsg(3, CursorData{Cursors: []uint32{4, 5}, Selections: [][2]uint32{{1, 2}, {6, 9}}}),
+			`{"UserCursor":{"id":3,"data":{"cursors":[4,5],"selections":[[1,2],[6,9]]}}}`},
+		{"UserCursorEmpty", NewUserCursorMsg(3, CursorData{Cursors: []uint32{}}),
+			`{"UserCursor":{"id":3,"data":{"cursors":[],"selections":null}}}`},
+		{"OTP", NewOTPMsg(&otp, 1, "Ann"), `{"OTP":{"otp":"secret","user_id":1,"user_name":"Ann"}}`},
+		{"OTPDisabled", NewOTPMsg(nil, 1, "Ann"), `{"OTP":{"otp":null,"user_id":1,"user_name":"Ann"}}`},
+		{"Shutdown", NewShutdownMsg("bye", true), `{"Shutdown":{"reason":"bye","reconnect":true}}`},
+		{"Error", NewErrorMsg(ErrorCodeUnsupportedLanguage, "nope"), `{"Error":{"code":"` + ErrorCodeUnsupportedLanguage + `","message":"nope"}}`},
+		{"ServerTime", &ServerMsg{ServerTime: func() *int64 { v := int64(-5); return &v }()}, `{"ServerTime":-5}`},
+		{"LanguageSuggestion", NewLanguageSuggestionMsg("rust"), `{"LanguageSuggestion":{"language":"rust"}}`},
+		{"Presence", NewPresenceMsg([]UserInfoMsg{{ID: 2, Info: &info}}), `{"Presence":{"users":[{"id":2,"info":{"name":"Ann \"A\"","hue":120}}]}}`},
+		{"Announcement", NewAnnouncementMsg("restart <soon>"), `{"Announcement":{"message":"restart \u003csoon\u003e"}}`},
+		{"Access", NewAccessMsg(RoleViewer, "reviewers"), `{"Access":{"role":"viewer","label":"reviewers"}}`},
+		{"Response", NewResponseMsg(4, json.RawMessage(`{"otp":"secret"}`)), `{"Response":{"id":4,"result":{"otp":"secret"}}}`},
+		{"ResponseError", NewResponseErrorMsg(5, ErrorCodeUnknownMethod, "nope"), `{"Response":{"id":5,"error":{"code":"` + ErrorCodeUnknownMethod + `","message":"nope"}}}`},
+		{"RecentChanges", NewRecentChangesMsg([]ChangeRange{{ID: 2, Start: 3, End: 8}}), `{"RecentChanges":{"ranges":[{"id":2,"start":3,"end":8}]}}`},
+		{"Ownership", NewOwnershipMsg("k3y"), `{"Ownership":{"owner_key":"k3y"}}`},
+		{"Pointer", NewPointerMsg(2, 17, 40), `{"Pointer":{"id":2,"position":17,"revision":40}}`},
+		{"Renamed", NewRenamedMsg("meeting-notes"), `{"Renamed":{"id":"meeting-notes"}}`},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := json.Marshal(tc.msg)
+			if err != nil {
+				t.Fatalf("Marshal failed: %v", err)
+			}
+			if string(got) != tc.want {
+				t.Errorf("Expected %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+// BenchmarkMarshalUserCursor measures encoding the most frequent broadcast.
+func BenchmarkMarshalUserCursor(b *testing.B) {
+	msg := NewUserCursorMsg(42, CursorData{Cursors: []uint32{1024}, Selections: [][2]uint32{{1000, 1024}}})
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := json.Marshal(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkMarshalHistory measures encoding a single-edit History broadcast.
+func BenchmarkMarshalHistory(b *testing.B) {
+	op := ot.NewOperationSeq()
+	op.Retain(100)
+	op.Insert("x")
+	op.Retain(100)
+	msg := NewHistoryMsg(10, []UserOperation{NewUserOperation(1, op)})
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := json.Marshal(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -2,18 +2,58 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
 // PersistedDocument represents a document stored in the database.
 type PersistedDocument struct {
-	ID       string
-	Text     string
-	Language *string
-	OTP      *string
+	ID         string
+	Text       string
+	Language   *string
+	OTP        *string
+	ExpiryDays *int // Expiry override: nil = server default, 0 = never expire
+	MaxSize    *int // Size limit override in bytes: nil = server default
+
+	// PasswordHash is the salted hash of the document password, nil if none
+	PasswordHash *string
+
+	// OwnerKey is the secret held by the document's owner, nil if it has none
+	OwnerKey *string
+
+	// Revision is the revision Text was last stored at by StoreIfNewer (0 if
+	// only ever written by Store). Load fills it in; Store ignores it.
+	Revision int64
+}
+
+// ShareLink is a named access token for a document, granting a role.
+type ShareLink struct {
+	Token     string
+	Label     string
+	Role      string
+	CreatedAt int64 // Unix timestamp
+}
+
+// Snapshot is a point-in-time copy of a document's text. Snapshots returns
+// them without Text; LoadSnapshot fills it in.
+type Snapshot struct {
+	CreatedAt int64 // Unix timestamp; unique per document
+	Text      string
+	Language  *string
+	Size      int // UTF-8 size of Text
+}
+
+// SavedCursor is a user's last known cursor in a document.
+type SavedCursor struct {
+	UserKey string // Identifies the user across connections
+	Data    string // Opaque to the database
 }
 
 // Database wraps a SQLite connection.
@@ -42,22 +82,101 @@ func (d *Database) Close() error {
 	return d.db.Close()
 }
 
+// Ping verifies the database connection is still usable.
+func (d *Database) Ping() error {
+	if err := d.db.Ping(); err != nil {
+		return fmt.Errorf("ping: %w", err)
+	}
+	return nil
+}
+
+// querier is what the ctx-bound methods run statements on: the pool, or a
+// connection from it with a bounded busy timeout (see Database.conn).
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// conn returns where to run a statement bounded by ctx, and a function to
+// call once it's done. SQLite doesn't interrupt a wait for another
+// connection's lock when ctx ends, only when its busy timeout runs out, so
+// with a deadline the statement runs on a connection whose busy timeout ends
+// there too, restored afterwards. Contexts without one use the pool as is.
+func (d *Database) conn(ctx context.Context) (querier, func(), error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return d.db, func() {}, nil
+	}
+
+	conn, err := d.db.Conn(ctx)
+	if err != nil {
+		return nil, nil, busyErr(ctx, err)
+	}
+	var busyTimeout int64
+	if err := conn.QueryRowContext(ctx, "PRAGMA busy_timeout").Scan(&busyTimeout); err != nil {
+		conn.Close()
+		return nil, nil, busyErr(ctx, err)
+	}
+	// Rounded up, so a wait that runs out finds ctx ended
+	bounded := min(time.Until(deadline).Milliseconds()+1, busyTimeout)
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf("PRAGMA busy_timeout = %d", max(bounded, 1))); err != nil {
+		conn.Close()
+		return nil, nil, busyErr(ctx, err)
+	}
+	return conn, func() {
+		// Connections go back to the pool, so restore the timeout; one that
+		// can't be restored is discarded instead
+		_, err := conn.ExecContext(context.Background(), fmt.Sprintf("PRAGMA busy_timeout = %d", busyTimeout))
+		if err != nil {
+			conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+		conn.Close()
+	}, nil
+}
+
+// busyErr reports err, from a statement bounded by ctx, as ctx's error if it
+// means the database was busy, or the statement was interrupted, and ctx has
+// ended meanwhile (see conn).
+func busyErr(ctx context.Context, err error) error {
+	var sqliteErr sqlite3.Error
+	interrupted := errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrInterrupt
+	if ctxErr := ctx.Err(); ctxErr != nil && (IsTransient(err) || interrupted) {
+		return fmt.Errorf("%w: %w", ctxErr, err)
+	}
+	return err
+}
+
 // Load retrieves a document from the database.
 func (d *Database) Load(id string) (*PersistedDocument, error) {
+	return d.LoadCtx(context.Background(), id)
+}
+
+// LoadCtx is Load, bounded by ctx.
+func (d *Database) LoadCtx(ctx context.Context, id string) (*PersistedDocument, error) {
+	q, release, err := d.conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	defer release()
+
 	var doc PersistedDocument
 	var language sql.NullString
 	var otp sql.NullString
+	var expiryDays sql.NullInt64
+	var maxSize sql.NullInt64
+	var passwordHash sql.NullString
 
-	err := d.db.QueryRow(
-		"SELECT id, text, language, otp FROM document WHERE id = ?",
+	err = q.QueryRowContext(ctx,
+		"SELECT id, text, language, otp, expiry_days, max_size, password_hash, revision FROM document WHERE id = ?",
 		id,
-	).Scan(&doc.ID, &doc.Text, &language, &otp)
+	).Scan(&doc.ID, &doc.Text, &language, &otp, &expiryDays, &maxSize, &passwordHash, &doc.Revision)
 
 	if err == sql.ErrNoRows {
 		return nil, nil // Document doesn't exist
 	}
 	if err != nil {
-		return nil, fmt.Errorf("query: %w", err)
+		return nil, fmt.Errorf("query: %w", busyErr(ctx, err))
 	}
 
 	if language.Valid {
@@ -68,28 +187,136 @@ func (d *Database) Load(id string) (*PersistedDocument, error) {
 		doc.OTP = &otp.String
 	}
 
+	if expiryDays.Valid {
+		days := int(expiryDays.Int64)
+		doc.ExpiryDays = &days
+	}
+
+	if maxSize.Valid {
+		size := int(maxSize.Int64)
+		doc.MaxSize = &size
+	}
+
+	if passwordHash.Valid {
+		doc.PasswordHash = &passwordHash.String
+	}
+
 	return &doc, nil
 }
 
+// Exists reports whether a document is stored, without reading its text.
+func (d *Database) Exists(id string) (bool, error) {
+	return d.ExistsCtx(context.Background(), id)
+}
+
+// ExistsCtx is Exists, bounded by ctx.
+func (d *Database) ExistsCtx(ctx context.Context, id string) (bool, error) {
+	q, release, err := d.conn(ctx)
+	if err != nil {
+		return false, fmt.Errorf("exists: %w", err)
+	}
+	defer release()
+
+	var exists bool
+	err = q.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM document WHERE id = ?)", id).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("exists: %w", busyErr(ctx, err))
+	}
+	return exists, nil
+}
+
+// GetOTP retrieves only a document's OTP, for authorizing access without
+// reading its text. found is false if the document doesn't exist.
+func (d *Database) GetOTP(id string) (otp *string, found bool, err error) {
+	return d.GetOTPCtx(context.Background(), id)
+}
+
+// GetOTPCtx is GetOTP, bounded by ctx.
+func (d *Database) GetOTPCtx(ctx context.Context, id string) (otp *string, found bool, err error) {
+	q, release, err := d.conn(ctx)
+	if err != nil {
+		return nil, false, fmt.Errorf("get otp: %w", err)
+	}
+	defer release()
+
+	var value sql.NullString
+	err = q.QueryRowContext(ctx, "SELECT otp FROM document WHERE id = ?", id).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("get otp: %w", busyErr(ctx, err))
+	}
+
+	if value.Valid {
+		otp = &value.String
+	}
+	return otp, true, nil
+}
+
+// GetPasswordHash retrieves only a document's password hash, for
+// authorizing access without reading its text. It returns nil if the
+// document doesn't exist or has no password.
+func (d *Database) GetPasswordHash(id string) (*string, error) {
+	return d.GetPasswordHashCtx(context.Background(), id)
+}
+
+// GetPasswordHashCtx is GetPasswordHash, bounded by ctx.
+func (d *Database) GetPasswordHashCtx(ctx context.Context, id string) (*string, error) {
+	q, release, err := d.conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get password hash: %w", err)
+	}
+	defer release()
+
+	var value sql.NullString
+	err = q.QueryRowContext(ctx, "SELECT password_hash FROM document WHERE id = ?", id).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get password hash: %w", busyErr(ctx, err))
+	}
+
+	if !value.Valid {
+		return nil, nil
+	}
+	return &value.String, nil
+}
+
 // Store saves a document to the database (INSERT or UPDATE).
+// ExpiryDays, MaxSize, PasswordHash and OwnerKey are only written on insert;
+// use UpdateExpiry, UpdateMaxSize, UpdatePassword and SwapOwnerKey to change
+// them later.
 func (d *Database) Store(doc *PersistedDocument) error {
+	return d.StoreCtx(context.Background(), doc)
+}
+
+// StoreCtx is Store, bounded by ctx.
+func (d *Database) StoreCtx(ctx context.Context, doc *PersistedDocument) error {
+	q, release, err := d.conn(ctx)
+	if err != nil {
+		return fmt.Errorf("exec: %w", err)
+	}
+	defer release()
+
 	query := `
-	INSERT INTO document (id, text, language, otp)
-	VALUES (?, ?, ?, ?)
+	INSERT INTO document (id, text, language, otp, expiry_days, max_size, password_hash, owner_key)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)
 	ON CONFLICT(id) DO UPDATE SET
 		text = excluded.text,
 		language = excluded.language,
 		otp = excluded.otp
 	`
 
-	result, err := d.db.Exec(query, doc.ID, doc.Text, doc.Language, doc.OTP)
+	result, err := q.ExecContext(ctx, query, doc.ID, doc.Text, doc.Language, doc.OTP, doc.ExpiryDays, doc.MaxSize, doc.PasswordHash, doc.OwnerKey)
 	if err != nil {
-		return fmt.Errorf("exec: %w", err)
+		return fmt.Errorf("exec: %w", busyErr(ctx, err))
 	}
 
 	rows, err := result.RowsAffected()
 	if err != nil {
-		return fmt.Errorf("rows affected: %w", err)
+		return fmt.Errorf("rows affected: %w", busyErr(ctx, err))
 	}
 
 	if rows != 1 {
@@ -99,22 +326,211 @@ func (d *Database) Store(doc *PersistedDocument) error {
 	return nil
 }
 
+// StoreIfNewer is StoreCtx for a document at revision: an existing document
+// is only updated if revision is at least the one it was stored at, so a
+// slow write of an older state can't overwrite a newer one. stored is false
+// if the write was skipped for that reason.
+func (d *Database) StoreIfNewer(ctx context.Context, doc *PersistedDocument, revision int64) (stored bool, err error) {
+	q, release, err := d.conn(ctx)
+	if err != nil {
+		return false, fmt.Errorf("exec: %w", err)
+	}
+	defer release()
+
+	query := `
+	INSERT INTO document (id, text, language, otp, expiry_days, max_size, password_hash, owner_key, revision)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(id) DO UPDATE SET
+		text = excluded.text,
+		language = excluded.language,
+		otp = excluded.otp,
+		revision = excluded.revision
+	WHERE excluded.revision >= document.revision
+	`
+
+	result, err := q.ExecContext(ctx, query, doc.ID, doc.Text, doc.Language, doc.OTP, doc.ExpiryDays, doc.MaxSize, doc.PasswordHash, doc.OwnerKey, revision)
+	if err != nil {
+		return false, fmt.Errorf("exec: %w", busyErr(ctx, err))
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("rows affected: %w", busyErr(ctx, err))
+	}
+	return rows == 1, nil
+}
+
 // Count returns the total number of documents in the database.
 func (d *Database) Count() (int, error) {
-	var count int
-	err := d.db.QueryRow("SELECT COUNT(*) FROM document").Scan(&count)
+	return d.CountCtx(context.Background())
+}
+
+// CountCtx is Count, bounded by ctx.
+func (d *Database) CountCtx(ctx context.Context) (int, error) {
+	q, release, err := d.conn(ctx)
 	if err != nil {
 		return 0, fmt.Errorf("count: %w", err)
 	}
+	defer release()
+
+	var count int
+	err = q.QueryRowContext(ctx, "SELECT COUNT(*) FROM document").Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("count: %w", busyErr(ctx, err))
+	}
 	return count, nil
 }
 
-// Delete removes a document from the database.
+// Summary describes the stored documents as a whole.
+type Summary struct {
+	Documents int            // Stored documents
+	TextBytes int64          // Total UTF-8 size of their text
+	Languages map[string]int // Documents per language; "" counts those without one
+}
+
+// Summary returns totals over all stored documents, without reading their text.
+func (d *Database) Summary() (Summary, error) {
+	rows, err := d.db.Query("SELECT COALESCE(language, ''), COUNT(*), COALESCE(SUM(LENGTH(CAST(text AS BLOB))), 0) FROM document GROUP BY 1")
+	if err != nil {
+		return Summary{}, fmt.Errorf("summary: %w", err)
+	}
+	defer rows.Close()
+
+	summary := Summary{Languages: make(map[string]int)}
+	for rows.Next() {
+		var language string
+		var count int
+		var bytes int64
+		if err := rows.Scan(&language, &count, &bytes); err != nil {
+			return Summary{}, fmt.Errorf("summary: %w", err)
+		}
+		summary.Documents += count
+		summary.TextBytes += bytes
+		summary.Languages[language] = count
+	}
+	if err := rows.Err(); err != nil {
+		return Summary{}, fmt.Errorf("summary: %w", err)
+	}
+	return summary, nil
+}
+
+// IsTransient reports whether err is a failure worth retrying as is: the
+// database was busy or locked by another connection. Constraint violations,
+// corruption and the like are not.
+func IsTransient(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked)
+}
+
+// ErrCorrupt is returned by IntegrityCheck when SQLite finds problems.
+var ErrCorrupt = errors.New("database integrity check failed")
+
+// maxIntegrityProblems caps the problems IntegrityCheck reports.
+const maxIntegrityProblems = 10
+
+// IntegrityCheck runs PRAGMA integrity_check, failing with ErrCorrupt and the
+// first problems SQLite reports. It reads the entire database, so it can
+// take a while and a lot of I/O on large ones.
+func (d *Database) IntegrityCheck() error {
+	rows, err := d.db.Query(fmt.Sprintf("PRAGMA integrity_check(%d)", maxIntegrityProblems))
+	if err != nil {
+		return fmt.Errorf("integrity check: %w", err)
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return fmt.Errorf("scan integrity check: %w", err)
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("integrity check: %w", err)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrCorrupt, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Delete removes a document, its share links and its snapshots from the database.
 func (d *Database) Delete(id string) error {
-	_, err := d.db.Exec("DELETE FROM document WHERE id = ?", id)
+	return d.DeleteCtx(context.Background(), id)
+}
+
+// DeleteCtx is Delete, bounded by ctx.
+func (d *Database) DeleteCtx(ctx context.Context, id string) error {
+	q, release, err := d.conn(ctx)
 	if err != nil {
 		return fmt.Errorf("delete: %w", err)
 	}
+	defer release()
+
+	tx, err := q.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("delete: %w", busyErr(ctx, err))
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM share_link WHERE document_id = ?", id); err != nil {
+		return fmt.Errorf("delete share links: %w", busyErr(ctx, err))
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM document_snapshot WHERE document_id = ?", id); err != nil {
+		return fmt.Errorf("delete snapshots: %w", busyErr(ctx, err))
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM document_cursor WHERE document_id = ?", id); err != nil {
+		return fmt.Errorf("delete cursors: %w", busyErr(ctx, err))
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM document WHERE id = ?", id); err != nil {
+		return fmt.Errorf("delete: %w", busyErr(ctx, err))
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("delete: %w", busyErr(ctx, err))
+	}
+	return nil
+}
+
+// ErrExists is returned by Rename when the new ID is already taken.
+var ErrExists = errors.New("document already exists")
+
+// Rename moves a document, with its share links, snapshots and saved cursors,
+// to newID in one transaction, failing with ErrExists if a document is stored
+// there. Renaming a missing document is not an error.
+func (d *Database) Rename(id, newID string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+	defer tx.Rollback()
+
+	var taken bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM document WHERE id = ?)", newID).Scan(&taken); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+	if taken {
+		return ErrExists
+	}
+
+	// Rows left under newID by a document that no longer exists would clash
+	// with the ones moving in
+	for _, table := range []string{"share_link", "document_snapshot", "document_cursor"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE document_id = ?", newID); err != nil {
+			return fmt.Errorf("rename %s: %w", table, err)
+		}
+		if _, err := tx.Exec("UPDATE "+table+" SET document_id = ? WHERE document_id = ?", newID, id); err != nil {
+			return fmt.Errorf("rename %s: %w", table, err)
+		}
+	}
+	if _, err := tx.Exec("UPDATE document SET id = ? WHERE id = ?", newID, id); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
 	return nil
 }
 
@@ -126,3 +542,275 @@ func (d *Database) UpdateOTP(id string, otp *string) error {
 	}
 	return nil
 }
+
+// UpdateExpiry updates the expiry override for a document (nil = server default).
+func (d *Database) UpdateExpiry(id string, days *int) error {
+	_, err := d.db.Exec("UPDATE document SET expiry_days = ? WHERE id = ?", days, id)
+	if err != nil {
+		return fmt.Errorf("update expiry: %w", err)
+	}
+	return nil
+}
+
+// UpdateMaxSize updates the size limit override for a document in bytes (nil = server default).
+func (d *Database) UpdateMaxSize(id string, size *int) error {
+	_, err := d.db.Exec("UPDATE document SET max_size = ? WHERE id = ?", size, id)
+	if err != nil {
+		return fmt.Errorf("update max size: %w", err)
+	}
+	return nil
+}
+
+// UpdatePassword updates the password hash for a document (nil removes the password).
+func (d *Database) UpdatePassword(id string, hash *string) error {
+	_, err := d.db.Exec("UPDATE document SET password_hash = ? WHERE id = ?", hash, id)
+	if err != nil {
+		return fmt.Errorf("update password: %w", err)
+	}
+	return nil
+}
+
+// UpdateOTPAsOwner sets the OTP of a document on behalf of the holder of
+// ownerKey. A document without an owner accepts any key and, unless claim is
+// empty, takes claim as its owner key. ok is false, and nothing changes, if
+// the document has a different owner or doesn't exist.
+func (d *Database) UpdateOTPAsOwner(id string, otp *string, ownerKey, claim string) (ok, claimed bool, err error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return false, false, fmt.Errorf("update otp: %w", err)
+	}
+	defer tx.Rollback()
+
+	var owner sql.NullString
+	err = tx.QueryRow("SELECT owner_key FROM document WHERE id = ?", id).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, fmt.Errorf("get owner key: %w", err)
+	}
+	if owner.Valid && owner.String != ownerKey {
+		return false, false, nil
+	}
+
+	claimed = !owner.Valid && claim != ""
+	if claimed {
+		_, err = tx.Exec("UPDATE document SET otp = ?, owner_key = ? WHERE id = ?", otp, claim, id)
+	} else {
+		_, err = tx.Exec("UPDATE document SET otp = ? WHERE id = ?", otp, id)
+	}
+	if err != nil {
+		return false, false, fmt.Errorf("update otp: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, false, fmt.Errorf("update otp: %w", err)
+	}
+	return true, claimed, nil
+}
+
+// SwapOwnerKey replaces a document's owner key with newKey (nil removes the
+// owner) if it is currently oldKey. swapped is false if it isn't.
+func (d *Database) SwapOwnerKey(id, oldKey string, newKey *string) (swapped bool, err error) {
+	result, err := d.db.Exec("UPDATE document SET owner_key = ? WHERE id = ? AND owner_key = ?", newKey, id, oldKey)
+	if err != nil {
+		return false, fmt.Errorf("swap owner key: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("rows affected: %w", err)
+	}
+	return rows > 0, nil
+}
+
+// CreateShareLink adds a share link to a document.
+func (d *Database) CreateShareLink(id string, link ShareLink) error {
+	_, err := d.db.Exec(
+		"INSERT INTO share_link (token, document_id, label, role, created_at) VALUES (?, ?, ?, ?, ?)",
+		link.Token, id, link.Label, link.Role, link.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("create share link: %w", err)
+	}
+	return nil
+}
+
+// ShareLinks returns a document's share links, oldest first.
+func (d *Database) ShareLinks(id string) ([]ShareLink, error) {
+	rows, err := d.db.Query(
+		"SELECT token, label, role, created_at FROM share_link WHERE document_id = ? ORDER BY created_at, rowid",
+		id,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query share links: %w", err)
+	}
+	defer rows.Close()
+
+	var links []ShareLink
+	for rows.Next() {
+		var link ShareLink
+		if err := rows.Scan(&link.Token, &link.Label, &link.Role, &link.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan share link: %w", err)
+		}
+		links = append(links, link)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query share links: %w", err)
+	}
+	return links, nil
+}
+
+// FindShareLink returns the document's share link with the given token, or
+// nil if there is none.
+func (d *Database) FindShareLink(id, token string) (*ShareLink, error) {
+	var link ShareLink
+	err := d.db.QueryRow(
+		"SELECT token, label, role, created_at FROM share_link WHERE token = ? AND document_id = ?",
+		token, id,
+	).Scan(&link.Token, &link.Label, &link.Role, &link.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("find share link: %w", err)
+	}
+	return &link, nil
+}
+
+// RevokeShareLink deletes a document's share link. found is false if the
+// document had no link with that token.
+func (d *Database) RevokeShareLink(id, token string) (found bool, err error) {
+	result, err := d.db.Exec("DELETE FROM share_link WHERE token = ? AND document_id = ?", token, id)
+	if err != nil {
+		return false, fmt.Errorf("revoke share link: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("rows affected: %w", err)
+	}
+	return rows > 0, nil
+}
+
+// StoreSnapshot saves a snapshot of a document, replacing one taken in the
+// same second, and deletes all but the newest keep snapshots of it.
+func (d *Database) StoreSnapshot(id string, snap Snapshot, keep int) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("store snapshot: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		"INSERT OR REPLACE INTO document_snapshot (document_id, created_at, text, language) VALUES (?, ?, ?, ?)",
+		id, snap.CreatedAt, snap.Text, snap.Language,
+	); err != nil {
+		return fmt.Errorf("store snapshot: %w", err)
+	}
+	if _, err := tx.Exec(
+		`DELETE FROM document_snapshot WHERE document_id = ? AND created_at NOT IN (
+			SELECT created_at FROM document_snapshot WHERE document_id = ? ORDER BY created_at DESC LIMIT ?
+		)`,
+		id, id, keep,
+	); err != nil {
+		return fmt.Errorf("prune snapshots: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("store snapshot: %w", err)
+	}
+	return nil
+}
+
+// Snapshots returns a document's snapshots, newest first, without their text.
+func (d *Database) Snapshots(id string) ([]Snapshot, error) {
+	rows, err := d.db.Query(
+		"SELECT created_at, language, LENGTH(CAST(text AS BLOB)) FROM document_snapshot WHERE document_id = ? ORDER BY created_at DESC",
+		id,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query snapshots: %w", err)
+	}
+	defer rows.Close()
+
+	var snaps []Snapshot
+	for rows.Next() {
+		var snap Snapshot
+		if err := rows.Scan(&snap.CreatedAt, &snap.Language, &snap.Size); err != nil {
+			return nil, fmt.Errorf("scan snapshot: %w", err)
+		}
+		snaps = append(snaps, snap)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query snapshots: %w", err)
+	}
+	return snaps, nil
+}
+
+// LoadSnapshot returns the document's snapshot taken at createdAt, or nil if
+// there is none.
+func (d *Database) LoadSnapshot(id string, createdAt int64) (*Snapshot, error) {
+	snap := Snapshot{CreatedAt: createdAt}
+	err := d.db.QueryRow(
+		"SELECT text, language FROM document_snapshot WHERE document_id = ? AND created_at = ?",
+		id, createdAt,
+	).Scan(&snap.Text, &snap.Language)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load snapshot: %w", err)
+	}
+	snap.Size = len(snap.Text)
+	return &snap, nil
+}
+
+// StoreCursors replaces a document's saved cursors with cursors.
+func (d *Database) StoreCursors(ctx context.Context, id string, cursors []SavedCursor) error {
+	q, release, err := d.conn(ctx)
+	if err != nil {
+		return fmt.Errorf("store cursors: %w", err)
+	}
+	defer release()
+
+	tx, err := q.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("store cursors: %w", busyErr(ctx, err))
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM document_cursor WHERE document_id = ?", id); err != nil {
+		return fmt.Errorf("store cursors: %w", busyErr(ctx, err))
+	}
+	for _, cursor := range cursors {
+		if _, err := tx.ExecContext(ctx,
+			"INSERT INTO document_cursor (document_id, user_key, data) VALUES (?, ?, ?)",
+			id, cursor.UserKey, cursor.Data,
+		); err != nil {
+			return fmt.Errorf("store cursors: %w", busyErr(ctx, err))
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("store cursors: %w", busyErr(ctx, err))
+	}
+	return nil
+}
+
+// LoadCursors returns a document's saved cursors.
+func (d *Database) LoadCursors(id string) ([]SavedCursor, error) {
+	rows, err := d.db.Query("SELECT user_key, data FROM document_cursor WHERE document_id = ?", id)
+	if err != nil {
+		return nil, fmt.Errorf("query cursors: %w", err)
+	}
+	defer rows.Close()
+
+	var cursors []SavedCursor
+	for rows.Next() {
+		var cursor SavedCursor
+		if err := rows.Scan(&cursor.UserKey, &cursor.Data); err != nil {
+			return nil, fmt.Errorf("scan cursor: %w", err)
+		}
+		cursors = append(cursors, cursor)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query cursors: %w", err)
+	}
+	return cursors, nil
+}
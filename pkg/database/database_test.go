@@ -0,0 +1,58 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestWritesCancelledWhileLocked tests that writes blocked by another
+// connection's write lock give up when their context ends, rather than
+// waiting out SQLite's busy timeout.
+func TestWritesCancelledWhileLocked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kolabpad.db")
+	db, err := New(path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	// A second connection takes the write lock and keeps it
+	other, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Failed to open second connection: %v", err)
+	}
+	defer other.Close()
+	conn, err := other.Conn(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to get connection: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(context.Background(), "BEGIN IMMEDIATE"); err != nil {
+		t.Fatalf("Failed to take write lock: %v", err)
+	}
+	defer conn.ExecContext(context.Background(), "ROLLBACK")
+
+	doc := &PersistedDocument{ID: "locked", Text: "text"}
+	for name, write := range map[string]func(context.Context) error{
+		"StoreCtx": func(ctx context.Context) error { return db.StoreCtx(ctx, doc) },
+		"StoreIfNewer": func(ctx context.Context) error {
+			_, err := db.StoreIfNewer(ctx, doc, 1)
+			return err
+		},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		start := time.Now()
+		err := write(ctx)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s: expected context.DeadlineExceeded, got %v", name, err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("%s: expected to give up with its context, took %v", name, elapsed)
+		}
+	}
+}
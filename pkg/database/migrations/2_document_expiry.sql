@@ -0,0 +1,3 @@
+-- Per-document expiry override
+-- NULL = use the server's EXPIRY_DAYS, 0 = never expire, N > 0 = expire after N days
+ALTER TABLE document ADD COLUMN expiry_days INTEGER;
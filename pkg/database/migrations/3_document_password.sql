@@ -0,0 +1,3 @@
+-- Per-document password, distinct from the shareable OTP
+-- NULL = no password; otherwise a salted hash (never the plaintext)
+ALTER TABLE document ADD COLUMN password_hash TEXT;
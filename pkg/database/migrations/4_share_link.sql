@@ -0,0 +1,11 @@
+-- Named share links: extra access tokens for a document, each granting a role
+-- and revocable on its own without changing the document OTP
+CREATE TABLE IF NOT EXISTS share_link (
+    token TEXT PRIMARY KEY,
+    document_id TEXT NOT NULL,
+    label TEXT NOT NULL,
+    role TEXT NOT NULL,      -- 'editor' or 'viewer'
+    created_at INTEGER NOT NULL  -- Unix timestamp
+);
+
+CREATE INDEX IF NOT EXISTS share_link_document ON share_link (document_id);
@@ -0,0 +1,9 @@
+-- Point-in-time copies of document text, taken periodically by the persister
+-- so a document can be rolled back. Only the newest few per document are kept.
+CREATE TABLE IF NOT EXISTS document_snapshot (
+    document_id TEXT NOT NULL,
+    created_at INTEGER NOT NULL,  -- Unix timestamp
+    text TEXT NOT NULL,
+    language TEXT,
+    PRIMARY KEY (document_id, created_at)
+);
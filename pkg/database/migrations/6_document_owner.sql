@@ -0,0 +1,3 @@
+-- Optional document owner: the holder of owner_key is the only one who may
+-- change OTP protection, when the server enables ownership
+ALTER TABLE document ADD COLUMN owner_key TEXT;
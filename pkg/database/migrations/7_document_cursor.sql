@@ -0,0 +1,8 @@
+-- Last known cursor of each returning user of a document, so reopening it
+-- puts them back where they were. Only written when SAVED_CURSORS is set.
+CREATE TABLE IF NOT EXISTS document_cursor (
+    document_id TEXT NOT NULL,
+    user_key TEXT NOT NULL,  -- Hash of the user's reconnect token
+    data TEXT NOT NULL,      -- Cursor data as JSON
+    PRIMARY KEY (document_id, user_key)
+);
@@ -0,0 +1,3 @@
+-- Revision the stored text was written at, so a slow write of an older
+-- state can't overwrite a newer one (see StoreIfNewer)
+ALTER TABLE document ADD COLUMN revision INTEGER NOT NULL DEFAULT 0;
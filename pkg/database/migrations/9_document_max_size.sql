@@ -0,0 +1,3 @@
+-- Per-document size limit override in bytes
+-- NULL = use the server's MAX_DOCUMENT_SIZE_KB
+ALTER TABLE document ADD COLUMN max_size INTEGER;
@@ -14,6 +14,7 @@ const (
 	LevelWarn
 	LevelInfo
 	LevelDebug
+	LevelTrace // Debug plus the content of every edit; never for production
 )
 
 var currentLevel LogLevel = LevelInfo
@@ -22,6 +23,8 @@ var currentLevel LogLevel = LevelInfo
 func Init() {
 	levelStr := strings.ToLower(os.Getenv("LOG_LEVEL"))
 	switch levelStr {
+	case "trace":
+		currentLevel = LevelTrace
 	case "debug":
 		currentLevel = LevelDebug
 	case "info":
@@ -33,6 +36,28 @@ func Init() {
 	default:
 		currentLevel = LevelInfo
 	}
+	if currentLevel == LevelTrace {
+		Warn("LOG_LEVEL=trace logs the operations of every edit, including the text they insert")
+	}
+}
+
+// SetLevel sets the logging level, overriding LOG_LEVEL
+func SetLevel(level LogLevel) {
+	currentLevel = level
+}
+
+// TraceEnabled reports whether Trace logs anything, so callers can skip
+// building expensive arguments
+func TraceEnabled() bool {
+	return currentLevel >= LevelTrace
+}
+
+// Trace logs a trace message (only if LOG_LEVEL=trace). Trace output may
+// include document content.
+func Trace(format string, v ...interface{}) {
+	if currentLevel >= LevelTrace {
+		log.Printf("[TRACE] "+format, v...)
+	}
 }
 
 // Debug logs a debug message (only if LOG_LEVEL=debug)
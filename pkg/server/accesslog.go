@@ -0,0 +1,114 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/shiv248/kolabpad/pkg/logger"
+)
+
+// accessLogWriter records the status code and body size written by a handler.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *accessLogWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// serveWithAccessLog serves an /api/ request and writes an Apache-style access
+// log line for it. WebSocket upgrades are skipped: they're long-lived, so a
+// duration and byte count aren't meaningful, and connects are already logged.
+func (s *Server) serveWithAccessLog(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/api/") || strings.HasPrefix(r.URL.Path, "/api/socket/") {
+		s.mux.ServeHTTP(w, r)
+		return
+	}
+
+	start := time.Now()
+	lw := &accessLogWriter{ResponseWriter: w}
+	s.mux.ServeHTTP(lw, r)
+
+	status := lw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	logger.Info("%s %q %d %d %v", s.clientIP(r), r.Method+" "+r.URL.Path+" "+r.Proto, status, lw.bytes, time.Since(start))
+}
+
+// clientIP returns the address of the client that made r. Forwarding headers
+// are only believed when the immediate peer is a trusted proxy; otherwise
+// anyone could spoof them. X-Forwarded-For is walked from the right, skipping
+// trusted proxies, so only hops our proxies appended are used.
+func (s *Server) clientIP(r *http.Request) string {
+	peer := remoteHost(r)
+	trusted := s.state.config.TrustedProxies
+	if len(trusted) == 0 || !s.trustedProxy(peer) {
+		return peer
+	}
+
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if _, err := netip.ParseAddr(hop); err != nil {
+				return peer // Malformed chain: don't trust any of it
+			}
+			if i == 0 || !s.trustedProxy(hop) {
+				return hop
+			}
+		}
+	}
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); realIP != "" {
+		if _, err := netip.ParseAddr(realIP); err == nil {
+			return realIP
+		}
+	}
+	return peer
+}
+
+// trustedProxy reports whether ip is in one of the configured proxy ranges.
+func (s *Server) trustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range s.state.config.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteHost returns the host part of the request's remote address.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
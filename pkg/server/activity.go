@@ -0,0 +1,56 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// activity tracks when a document last changed, for the persister's write
+// triggers. It's safe for concurrent use.
+//
+// Edits (text and language changes) are what the persister saves, so they
+// reset its idle timer; cursor and user info changes aren't saved and leave
+// it alone. Critical writes (OTP changes) are stored directly by their HTTP
+// handler before they reach memory, so the persister holds off for a short
+// debounce window after one rather than racing that write with a stale OTP.
+type activity struct {
+	lastEdit     atomic.Int64 // Unix nanoseconds of the last edit (0 = never)
+	lastCritical atomic.Int64 // Unix nanoseconds of the last critical write (0 = never)
+}
+
+// edited records an edit at now.
+func (a *activity) edited(now time.Time) {
+	a.lastEdit.Store(now.UnixNano())
+}
+
+// criticalWrite records a critical write at now.
+func (a *activity) criticalWrite(now time.Time) {
+	a.lastCritical.Store(now.UnixNano())
+}
+
+// lastEditTime returns the time of the last edit, or the zero time if there
+// was none.
+func (a *activity) lastEditTime() time.Time {
+	nanos := a.lastEdit.Load()
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// lastEditUnix returns the Unix time of the last edit in seconds, or 0 if
+// there was none.
+func (a *activity) lastEditUnix() int64 {
+	return a.lastEdit.Load() / int64(time.Second)
+}
+
+// debouncing reports whether a critical write happened less than window
+// before now, and how long ago it was. A zero window never debounces.
+func (a *activity) debouncing(now time.Time, window time.Duration) (time.Duration, bool) {
+	last := a.lastCritical.Load()
+	if last == 0 || window <= 0 {
+		return 0, false
+	}
+	since := now.Sub(time.Unix(0, last))
+	return since, since < window
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/shiv248/kolabpad/pkg/logger"
+)
+
+// maxAnnouncementLength caps announcement text, in characters. Announcements
+// are banners, not documents.
+const maxAnnouncementLength = 1000
+
+// authorizeAdmin checks the request's "Authorization: Bearer" token against
+// Config.AdminToken, writing an error response and returning false if it
+// doesn't match. Admin endpoints are disabled (404) when no token is configured.
+func (s *Server) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	want := s.state.config.AdminToken
+	if want == "" {
+		http.NotFound(w, r)
+		return false
+	}
+
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+		logger.Info("Rejected admin request to %s from %s", r.URL.Path, s.clientIP(r))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// Announce sends message to every client connected to any resident document
+// and returns the number of documents it reached.
+func (s *Server) Announce(message string) int {
+	count := 0
+	s.state.documents.Range(func(key, value interface{}) bool {
+		value.(*Document).Kolabpad.BroadcastAnnouncement(message)
+		count++
+		return true
+	})
+	return count
+}
+
+// handleAnnounce broadcasts an operator notice to all connected clients.
+// Route: POST /api/announce (admin token required)
+func (s *Server) handleAnnounce(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, int64(s.state.config.MaxRequestBodySize))
+	var reqBody struct {
+		Message string `json:"message"`
+	}
+	if !decodeRequestBody(w, r, &reqBody) {
+		return
+	}
+
+	message := strings.TrimSpace(reqBody.Message)
+	if message == "" || utf8.RuneCountInString(message) > maxAnnouncementLength {
+		http.Error(w, "message must be 1-1000 characters", http.StatusBadRequest)
+		return
+	}
+
+	documents := s.Announce(message)
+	logger.Info("Announcement sent to %d document(s) by %s: %q", documents, s.clientIP(r), message)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{
+		"documents": documents,
+	})
+}
+
+// handleDocumentDebug dumps a resident document's internal state for
+// diagnosing stuck documents (see Kolabpad.Diagnostics). ?text=true adds the
+// full text. Documents that aren't in memory are not loaded: 404.
+// Route: GET /api/document/{id}/debug (admin token required)
+func (s *Server) handleDocumentDebug(w http.ResponseWriter, r *http.Request, docID string) {
+	if !s.authorizeAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	val, ok := s.state.documents.Load(docID)
+	if !ok {
+		http.Error(w, "document not loaded", http.StatusNotFound)
+		return
+	}
+	withText := r.URL.Query().Get("text") == "true"
+	logger.Info("Debug dump of document %s requested by %s (text=%v)", docID, s.clientIP(r), withText)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(val.(*Document).debug(withText))
+}
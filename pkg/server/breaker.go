@@ -0,0 +1,48 @@
+package server
+
+import "time"
+
+// Persistence circuit breaker settings. After persistFailureThreshold
+// consecutive failed writes the persister stops retrying on every tick and
+// backs off exponentially from persistBaseBackoff up to persistMaxBackoff.
+const (
+	persistFailureThreshold = 3
+	persistBaseBackoff      = 30 * time.Second
+	persistMaxBackoff       = 10 * time.Minute
+)
+
+// storeBreaker tracks consecutive persistence failures for one document.
+// It is owned by the document's persister goroutine and is not safe for
+// concurrent use.
+type storeBreaker struct {
+	failures int       // Consecutive failed writes
+	retryAt  time.Time // Earliest next scheduled write while open
+}
+
+// open reports whether persistence is considered degraded.
+func (b *storeBreaker) open() bool {
+	return b.failures >= persistFailureThreshold
+}
+
+// allow reports whether a scheduled write may be attempted at now.
+// On-demand flushes bypass the breaker.
+func (b *storeBreaker) allow(now time.Time) bool {
+	return !b.open() || !now.Before(b.retryAt)
+}
+
+// record updates the breaker with the result of a write and reports whether
+// it changed state, i.e. tripped open or recovered.
+func (b *storeBreaker) record(err error, now time.Time) bool {
+	wasOpen := b.open()
+	if err == nil {
+		b.failures = 0
+		return wasOpen
+	}
+
+	b.failures++
+	if b.open() {
+		backoff := persistBaseBackoff << min(b.failures-persistFailureThreshold, 5)
+		b.retryAt = now.Add(min(backoff, persistMaxBackoff))
+	}
+	return !wasOpen && b.open()
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"nhooyr.io/websocket"
+)
+
+// Config holds the tunable settings for a Server and the documents it hosts.
+type Config struct {
+	MaxDocumentSize     int                       // Maximum document size in bytes
+	MaxDocumentSizeCap  int                       // Largest per-document size limit that may be set, in bytes (below MaxDocumentSize = MaxDocumentSize)
+	BroadcastBufferSize int                       // Buffer size for metadata broadcast channels
+	SaturationWindow    time.Duration             // Window over which a document's broadcasts finding buffers full are counted; half or more logs a warning (0 disables)
+	SaturationUnready   bool                      // Report not ready on /api/ready while any document's broadcast buffers are saturated
+	WSReadTimeout       time.Duration             // Idle time before an inactive client is disconnected
+	WSWriteTimeout      time.Duration             // Base time allowed for a single WebSocket write
+	WSWriteThroughput   int                       // Bytes/sec a client is assumed to sustain; extends the write timeout for large messages (0 = fixed)
+	WSHeartbeatInterval time.Duration             // Interval between ping frames (0 disables heartbeat)
+	WSCompression       websocket.CompressionMode // permessage-deflate negotiation (zero value = disabled)
+	ServerTimeInterval  time.Duration             // Interval between ServerTime clock resyncs (0 = only on connect)
+	ShutdownGrace       time.Duration             // Time clients get between the shutdown notice and disconnect to save local state (at least 250ms)
+	AllowedLanguages    []string                  // Accepted SetLanguage values (empty = DefaultLanguages)
+	AllowedMessages     []string                  // Client message types handled (protocol.Msg*); others are ignored (empty = all)
+	DisabledNotice      bool                      // Answer ignored message types with a "disabled" Error instead of silently
+	SuggestLanguage     bool                      // Broadcast a detected language for documents with none set
+	DedupUserNames      bool                      // Suffix display names already used by another user ("Alice (2)")
+	HuePalette          []uint32                  // Hues assigned to users round-robin, overriding the hue clients ask for (empty = client's choice)
+	DefaultContent      string                    // Initial text of brand-new documents
+	DefaultLanguage     *string                   // Initial language of brand-new documents (nil = none)
+	CoalesceWindow      time.Duration             // Merge same-user edits this close together in history (0 disables)
+	NotifyWindow        time.Duration             // Wake connections once per window during a burst of edits, not per edit (0 = per edit)
+	MaxHistoryOps       int                       // History entries kept per document before the oldest fold into a snapshot (0 = unlimited)
+	MaxHistoryFrameSize int                       // Encoded operation bytes per History message; longer histories are split (0 = unlimited)
+	MaxRevisionLag      int                       // Revisions an edit may trail the document by; clients further behind must resync (0 = unlimited)
+	MaxLines            int                       // Lines an edit may leave in a document; edits past it are rejected (0 = unlimited)
+	MaxLineLength       int                       // Characters per line an edit may leave in a document (0 = unlimited)
+	MaxCursorsPerUser   int                       // Cursors, and separately selections, kept per user; extras are dropped (0 = unlimited)
+	MaxRemoteCursors    int                       // Other users' cursors each client is shown, the most recently moved ones (0 = all)
+	RecentChangeOps     int                       // Latest edits whose ranges new clients get for highlighting in a RecentChanges message (0 disables)
+	InitialCacheWindow  time.Duration             // Time the History encoded for a joining client is kept for others joining the unchanged document (0 disables)
+	CursorInterval      time.Duration             // Minimum time between a user's cursor broadcasts; faster updates are coalesced (0 = unlimited)
+	LanguageRateLimit   int                       // SetLanguage messages a connection may send per minute; extras are rejected (0 = unlimited)
+	SavedCursors        int                       // Cursors of users with reconnect tokens saved per document, restored when they reopen it (0 disables)
+	NormalizeNewlines   bool                      // Follow edits inserting CRLF with a System edit turning them into LF
+	AccessLog           bool                      // Log one line per /api/ request (WebSocket upgrades excluded)
+	TrustedProxies      []netip.Prefix            // Peers whose X-Forwarded-For/X-Real-IP headers are believed (empty = none)
+	AdminToken          string                    // Bearer token for admin endpoints such as /api/announce (empty disables them)
+	MaxRequestBodySize  int                       // Maximum REST request body size in bytes (larger bodies get 413)
+	MaxHeaderSize       int                       // Maximum request header size in bytes (0 = net/http default of 1 MB)
+	ReadHeaderTimeout   time.Duration             // Time allowed to send request headers, against slowloris (0 = unlimited)
+	IdleTimeout         time.Duration             // Time an idle keep-alive connection is kept open (0 = unlimited); upgraded WebSockets are unaffected
+	MaxDocumentIDLength int                       // Maximum document ID length in bytes, namespace included (0 = unlimited)
+	MaxStoredDocuments  int                       // Documents the database may hold; new ones past it are only kept in memory (0 = unlimited)
+	PersistDebounce     time.Duration             // Time after an OTP change the persister holds off scheduled writes, so they don't race its own store (0 disables)
+	SnapshotInterval    time.Duration             // Time between point-in-time snapshots of a changed document (0 disables)
+	SnapshotRetention   int                       // Snapshots kept per document; older ones are pruned
+	IntegrityInterval   time.Duration             // Time between database integrity checks, run by StartCleaner (0 disables; each check reads the whole database)
+	IntegrityUnready    bool                      // Report not ready on /api/ready while the last integrity check failed
+	DocumentNamespaces  bool                      // Accept IDs with one namespace prefix ("team/doc")
+	DocumentOwners      bool                      // Only the user who first protects a document may later change its protection
+	CreateOnConnect     bool                      // Connecting to an unknown document creates it; false rejects it with 404, leaving creation to POST /api/document/new
+	Observer            EventObserver             // Receives server events for external metrics (nil = NopObserver)
+
+	// CanCreateDocument, if set, is asked before a connection creates a
+	// document that is neither resident nor stored; returning false rejects
+	// it with 403. Existing documents are unaffected. It's called from the
+	// request's goroutine and must be safe for concurrent use.
+	CanCreateDocument func(id string, r *http.Request) bool
+}
+
+// DefaultConfig returns the configuration used when no overrides are provided.
+func DefaultConfig() Config {
+	return Config{
+		MaxDocumentSize:     256 * 1024,
+		MaxDocumentSizeCap:  1024 * 1024,
+		BroadcastBufferSize: 16,
+		SaturationWindow:    10 * time.Second,
+		WSReadTimeout:       30 * time.Minute,
+		WSWriteTimeout:      10 * time.Second,
+		WSWriteThroughput:   64 * 1024,
+		WSHeartbeatInterval: 60 * time.Second,
+		MaxRequestBodySize:  64 * 1024,
+		ReadHeaderTimeout:   10 * time.Second,
+		IdleTimeout:         2 * time.Minute,
+		MaxCursorsPerUser:   64,
+		MaxDocumentIDLength: 256,
+		MaxHistoryFrameSize: 1024 * 1024,
+		MaxRevisionLag:      10000,
+		PersistDebounce:     2 * time.Second,
+		SnapshotRetention:   24,
+		CursorInterval:      50 * time.Millisecond,
+		LanguageRateLimit:   30,
+		ShutdownGrace:       time.Second,
+		InitialCacheWindow:  2 * time.Second,
+		CreateOnConnect:     true,
+	}
+}
+
+// DefaultLanguages is the built-in language allowlist.
+// It matches the syntax modes offered by the frontend (frontend/src/languages.json).
+var DefaultLanguages = []string{
+	"abap", "aes", "apex", "azcli", "bat", "bicep", "c", "cameligo", "clojure",
+	"coffeescript", "cpp", "csharp", "csp", "css", "dart", "dockerfile", "ecl",
+	"elixir", "flow9", "fsharp", "go", "graphql", "handlebars", "hcl", "html",
+	"ini", "java", "javascript", "json", "julia", "kotlin", "less", "lexon",
+	"liquid", "lua", "m3", "markdown", "mips", "msdax", "mysql", "objective-c",
+	"pascal", "pascaligo", "perl", "pgsql", "php", "pla", "plaintext", "postiats",
+	"powerquery", "powershell", "proto", "pug", "python", "qsharp", "r", "razor",
+	"redis", "redshift", "restructuredtext", "ruby", "rust", "sb", "scala",
+	"scheme", "scss", "shell", "sol", "sparql", "sql", "st", "swift",
+	"systemverilog", "tcl", "twig", "typescript", "vb", "verilog", "xml", "yaml",
+}
+
+// languageAllowed reports whether lang is an accepted syntax highlighting language.
+func (c *Config) languageAllowed(lang string) bool {
+	if len(c.AllowedLanguages) == 0 {
+		return slices.Contains(DefaultLanguages, lang)
+	}
+	return slices.Contains(c.AllowedLanguages, lang)
+}
+
+// messageAllowed reports whether client messages of type typ (see
+// protocol.ClientMsg.Type) are handled.
+func (c *Config) messageAllowed(typ string) bool {
+	return len(c.AllowedMessages) == 0 || slices.Contains(c.AllowedMessages, typ)
+}
+
+// maxSizeCap returns the largest per-document size limit that may be set.
+func (c *Config) maxSizeCap() int {
+	return max(c.MaxDocumentSizeCap, c.MaxDocumentSize)
+}
+
+// observer returns the configured EventObserver, or NopObserver if none is set.
+func (c *Config) observer() EventObserver {
+	if c.Observer == nil {
+		return NopObserver{}
+	}
+	return c.Observer
+}
+
+// canCreate reports whether r may create document id, per CanCreateDocument.
+func (c *Config) canCreate(id string, r *http.Request) bool {
+	return c.CanCreateDocument == nil || c.CanCreateDocument(id, r)
+}
+
+// checkLines checks text against MaxLines and MaxLineLength, returning an
+// ErrLineLimit error if it exceeds either. Line length counts characters,
+// not bytes, as editors do.
+func (c *Config) checkLines(text string) error {
+	if c.MaxLines <= 0 && c.MaxLineLength <= 0 {
+		return nil
+	}
+	lines := 1
+	for {
+		line, rest, more := strings.Cut(text, "\n")
+		if c.MaxLineLength > 0 && len(line) > c.MaxLineLength {
+			if n := utf8.RuneCountInString(line); n > c.MaxLineLength {
+				return fmt.Errorf("%w: line %d has %d characters, maximum is %d", ErrLineLimit, lines, n, c.MaxLineLength)
+			}
+		}
+		if !more {
+			return nil
+		}
+		lines++
+		if c.MaxLines > 0 && lines > c.MaxLines {
+			return fmt.Errorf("%w: more than %d lines", ErrLineLimit, c.MaxLines)
+		}
+		text = rest
+	}
+}
+
+// validateDocumentID checks a document ID against the length limit and, if
+// namespaces are enabled, the "namespace/name" form. IDs are otherwise
+// unrestricted, so existing documents stay reachable.
+func (c *Config) validateDocumentID(id string) error {
+	if id == "" {
+		return errors.New("document ID required")
+	}
+	if c.MaxDocumentIDLength > 0 && len(id) > c.MaxDocumentIDLength {
+		return fmt.Errorf("document ID longer than %d bytes", c.MaxDocumentIDLength)
+	}
+
+	namespace, name, namespaced := strings.Cut(id, "/")
+	if !namespaced {
+		return nil
+	}
+	if !c.DocumentNamespaces {
+		return errors.New("document ID must not contain '/'")
+	}
+	if namespace == "" || name == "" || strings.Contains(name, "/") {
+		return errors.New("document ID must be name or namespace/name")
+	}
+	return nil
+}
@@ -3,60 +3,177 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"nhooyr.io/websocket"
-	"nhooyr.io/websocket/wsjson"
 
 	"github.com/shiv248/kolabpad/internal/protocol"
+	"github.com/shiv248/kolabpad/pkg/database"
 	"github.com/shiv248/kolabpad/pkg/logger"
 )
 
+// writeQueueSize is the number of outbound messages buffered per connection.
+// A client that falls this far behind is considered a slow consumer and is disconnected.
+const writeQueueSize = 256
+
+// pointerRateLimit is the number of Pointer messages a connection may send
+// per minute. Each is broadcast to every client, and pointing is occasional,
+// so faster ones are dropped.
+const pointerRateLimit = 60
+
+// messageOverhead is what a client message may need beyond the document's
+// size limit, for JSON encoding of the operation.
+const messageOverhead = 64 * 1024
+
+// maxMessageSize is the WebSocket read limit for a document limited to
+// documentSize bytes.
+func maxMessageSize(documentSize int) int64 {
+	return int64(documentSize + messageOverhead)
+}
+
+// errSlowConsumer is returned by send when the outbound queue is full.
+var errSlowConsumer = errors.New("outbound queue full (slow consumer)")
+
+// errInitialTimeout is returned by sendInitial when the client doesn't read
+// its initial state within the write timeout.
+var errInitialTimeout = errors.New("initial state not read in time (slow consumer)")
+
+// errConnectionClosed is returned by send after the outbound queue has been closed.
+var errConnectionClosed = errors.New("connection closed")
+
+// errDocumentKilled ends Handle when the document is killed under the connection.
+var errDocumentKilled = errors.New("document killed")
+
+// errAccessRevoked is the cancel cause for connections whose share link was
+// revoked (see Kolabpad.RevokeAccess).
+var errAccessRevoked = errors.New("share link revoked")
+
+// ErrReadOnly rejects an Edit or SetLanguage from a client that connected
+// with a viewer share link.
+var ErrReadOnly = errors.New("view-only share link")
+
+// ErrRateLimited rejects a message sent faster than its rate limit allows
+// (see Config.LanguageRateLimit).
+var ErrRateLimited = errors.New("rate limited")
+
 // readResult represents the result of a WebSocket read operation.
 type readResult struct {
-	msg protocol.ClientMsg
-	err error
+	msg       protocol.ClientMsg
+	err       error // Transport failure; the connection is unusable
+	decodeErr error // The frame arrived but wasn't a valid ClientMsg
 }
 
 // Connection represents a single client WebSocket connection.
 type Connection struct {
+	docID             string
 	userID            uint64
 	kolabpad          *Kolabpad
 	conn              *websocket.Conn
 	ctx               context.Context
-	cancel            context.CancelFunc
-	sendMu            sync.Mutex
+	cancel            context.CancelCauseFunc // Cause, if any, picks the close code (see closeStatus)
+	sendMu            sync.Mutex              // Protects queue and queueClosed
+	queue             chan []byte             // Outbound messages, drained in order by writer
+	queueClosed       bool                    // Set once cleanup has closed the queue
+	writerDone        chan struct{}           // Closed when the writer goroutine exits
+	initialSent       chan struct{}           // Closed once the writer has delivered the initial state
 	readTimeout       time.Duration
-	writeTimeout      time.Duration
+	writeTimeout      time.Duration // Base timeout for any single write
+	writeThroughput   int           // Assumed minimum client throughput in bytes/sec (0 = fixed timeout)
 	heartbeatInterval time.Duration
+	clockInterval     time.Duration         // Interval between ServerTime resyncs (0 = only on connect)
+	revisionOffset    int                   // Edits coalesced before this client joined (client revision + offset = server revision)
+	resumeFrom        int                   // Client revision the client already holds, to resume history from (-1 = none; see resumeAt)
+	historyFrameSize  int                   // Encoded operation bytes per History message (0 = unlimited)
+	recentChangeOps   int                   // Latest edits described in RecentChanges on connect (0 = none)
+	access            *protocol.AccessMsg   // Role granted by the share link the client connected with (nil = full access)
+	cursors           cursorThrottle        // Holds back cursor updates sent faster than Config.CursorInterval
+	languageChanges   tokenBucket           // Limits SetLanguage to Config.LanguageRateLimit
+	pointers          tokenBucket           // Limits Pointer to pointerRateLimit
+	requests          requestHandler        // Answers Request messages (nil = every method is unknown)
+	messageAllowed    func(typ string) bool // Whether a client message type is handled (see Config.AllowedMessages)
+	disabledNotice    bool                  // Tell the client when its message type is disabled
+	observer          EventObserver
+	sent              sendMetrics  // What was sent to this client
+	sends             *sendMetrics // Server-wide totals sent is added to (see Kolabpad.sends)
+	slow              atomic.Bool  // Logged as a slow consumer
 }
 
-// NewConnection creates a new client connection handler.
-func NewConnection(kolabpad *Kolabpad, conn *websocket.Conn, readTimeout, writeTimeout, heartbeatInterval time.Duration) *Connection {
-	ctx, cancel := context.WithCancel(context.Background())
-	return &Connection{
-		userID:            kolabpad.NextUserID(),
+// NewConnection creates a new client connection handler using the timeouts in config.
+// If reconnectToken is non-empty the client resumes the user ID it last held
+// with that token (see Kolabpad.ResumeUserID).
+func NewConnection(docID string, kolabpad *Kolabpad, conn *websocket.Conn, reconnectToken string, config *Config) *Connection {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	c := &Connection{
+		docID:             docID,
 		kolabpad:          kolabpad,
 		conn:              conn,
 		ctx:               ctx,
 		cancel:            cancel,
-		readTimeout:       readTimeout,
-		writeTimeout:      writeTimeout,
-		heartbeatInterval: heartbeatInterval,
+		queue:             make(chan []byte, writeQueueSize),
+		writerDone:        make(chan struct{}),
+		initialSent:       make(chan struct{}),
+		readTimeout:       config.WSReadTimeout,
+		writeTimeout:      config.WSWriteTimeout,
+		writeThroughput:   config.WSWriteThroughput,
+		heartbeatInterval: config.WSHeartbeatInterval,
+		clockInterval:     config.ServerTimeInterval,
+		historyFrameSize:  config.MaxHistoryFrameSize,
+		recentChangeOps:   config.RecentChangeOps,
+		resumeFrom:        -1,
+		cursors:           cursorThrottle{interval: config.CursorInterval},
+		languageChanges:   tokenBucket{perMinute: config.LanguageRateLimit},
+		pointers:          tokenBucket{perMinute: pointerRateLimit},
+		messageAllowed:    config.messageAllowed,
+		disabledNotice:    config.DisabledNotice,
+		observer:          config.observer(),
+		sends:             kolabpad.sends,
+	}
+
+	if reconnectToken != "" {
+		c.userID = kolabpad.ResumeUserID(reconnectToken, func() { cancel(nil) })
+	} else {
+		c.userID = kolabpad.NextUserID()
 	}
+	return c
+}
+
+// grantAccess limits the connection to the role of the share link it was
+// admitted with, and registers it to be disconnected if the link is revoked.
+// Call it before Handle.
+func (c *Connection) grantAccess(link *database.ShareLink) {
+	c.access = &protocol.AccessMsg{Role: link.Role, Label: link.Label}
+	c.kolabpad.GrantAccess(c.userID, link.Token, func() { c.cancel(errAccessRevoked) })
+}
+
+// resumeAt asks for history from revision, the last one the reconnecting
+// client holds, instead of from 0 (see Kolabpad.initialState). Call it
+// before Handle.
+func (c *Connection) resumeAt(revision int) {
+	c.resumeFrom = revision
+}
+
+// readOnly reports whether the client may only view the document.
+func (c *Connection) readOnly() bool {
+	return c.access != nil && c.access.Role == protocol.RoleViewer
 }
 
 // Handle manages the WebSocket connection lifecycle.
 func (c *Connection) Handle(ctx context.Context) error {
 	var handleErr error
 	defer func() {
+		c.cursors.stop()
 		c.cleanup(handleErr)
 	}()
 
 	logger.Info("User %d connected", c.userID)
 
+	// Start the single writer that owns all socket writes
+	go c.writer()
+
 	// Send initial state to client
 	revision, err := c.sendInitial()
 	if err != nil {
@@ -65,7 +182,7 @@ func (c *Connection) Handle(ctx context.Context) error {
 	}
 
 	// Subscribe to metadata updates
-	updates := c.kolabpad.Subscribe(c.userID)
+	updates := c.kolabpad.subscribe(c.userID, c.recordDrop)
 
 	// Start update broadcaster
 	updatesDone := make(chan struct{})
@@ -76,6 +193,15 @@ func (c *Connection) Handle(ctx context.Context) error {
 		go c.heartbeat(ctx)
 	}
 
+	// Periodically resend the server clock so clients can correct drift
+	if c.clockInterval > 0 {
+		go c.clockSync(ctx)
+	}
+
+	// Refuse messages larger than an edit of the whole document could need,
+	// following changes to the document's limit
+	defer c.kolabpad.watchMaxSize(c.userID, c.updateReadLimit)()
+
 	// Start first read
 	readChan := make(chan readResult, 1)
 	go c.readMessage(ctx, readChan)
@@ -87,12 +213,19 @@ func (c *Connection) Handle(ctx context.Context) error {
 
 		// Check if document has been killed
 		if c.kolabpad.Killed() {
-			return nil
+			// Let pending broadcasts (e.g. Shutdown) reach the queue before cleanup
+			<-updatesDone
+			handleErr = errDocumentKilled
+			return handleErr
 		}
 
 		// Check for new history to send
 		if c.kolabpad.Revision() > revision {
 			newRev, err := c.sendHistory(revision)
+			if errors.Is(err, ErrHistoryTrimmed) {
+				handleErr = c.resync(err)
+				return handleErr
+			}
 			if err != nil {
 				handleErr = fmt.Errorf("send history: %w", err)
 				return handleErr
@@ -105,10 +238,12 @@ func (c *Connection) Handle(ctx context.Context) error {
 			handleErr = ctx.Err()
 			return handleErr
 		case <-c.ctx.Done():
-			handleErr = c.ctx.Err()
+			handleErr = context.Cause(c.ctx)
 			return handleErr
 		case <-notified:
 			// Notify channel closed, new operation available - loop to check revision
+		case now := <-c.cursors.due():
+			c.kolabpad.SetCursorData(c.userID, *c.cursors.take(now))
 		case result := <-readChan:
 			if result.err != nil {
 				// Check if it's a normal close
@@ -120,8 +255,19 @@ func (c *Connection) Handle(ctx context.Context) error {
 				return handleErr
 			}
 
-			// Handle message
-			if err := c.handleMessage(&result.msg); err != nil {
+			// One bad frame doesn't poison the connection: report it and keep reading
+			err := result.decodeErr
+			if err != nil {
+				logger.Info("User %d sent a malformed message: %v", c.userID, err)
+				err = c.send(protocol.NewErrorMsg(protocol.ErrorCodeMalformedMessage, "message could not be decoded and was ignored"))
+			} else {
+				err = c.handleMessage(&result.msg)
+			}
+			if errors.Is(err, ErrHistoryTrimmed) || errors.Is(err, ErrRevisionLag) {
+				handleErr = c.resync(err)
+				return handleErr
+			}
+			if err != nil {
 				logger.Error("Error handling message from user %d: %v", c.userID, err)
 				handleErr = err
 				return handleErr
@@ -134,119 +280,346 @@ func (c *Connection) Handle(ctx context.Context) error {
 	}
 }
 
+// updateReadLimit sets the socket's read limit from the document's size limit.
+func (c *Connection) updateReadLimit() {
+	c.conn.SetReadLimit(maxMessageSize(c.kolabpad.maxDocumentSize()))
+}
+
 // readMessage reads a message from the WebSocket in a separate goroutine.
+// It decodes the frame itself rather than with wsjson.Read, which closes the
+// connection on invalid JSON, so decode errors can be told apart from
+// transport errors.
 func (c *Connection) readMessage(ctx context.Context, result chan<- readResult) {
 	readCtx, readCancel := context.WithTimeout(ctx, c.readTimeout)
 	defer readCancel()
 
-	var msg protocol.ClientMsg
-	err := wsjson.Read(readCtx, c.conn, &msg)
+	_, data, err := c.conn.Read(readCtx)
+	if err != nil {
+		result <- readResult{err: err}
+		return
+	}
 
-	if err == nil {
-		logger.Debug("User %d received message: Edit=%v, SetLanguage=%v, ClientInfo=%v, CursorData=%v",
-			c.userID,
-			msg.Edit != nil,
-			msg.SetLanguage != nil,
-			msg.ClientInfo != nil,
-			msg.CursorData != nil)
+	var msg protocol.ClientMsg
+	if err := json.Unmarshal(data, &msg); err != nil {
+		result <- readResult{decodeErr: err}
+		return
+	}
+	if msg.Edit != nil && msg.Edit.Operation == nil {
+		result <- readResult{decodeErr: errors.New("edit without an operation")}
+		return
 	}
 
-	result <- readResult{msg: msg, err: err}
+	logger.Debug("User %d received message: Edit=%v, SetLanguage=%v, ClientInfo=%v, CursorData=%v, Request=%v, Pointer=%v",
+		c.userID,
+		msg.Edit != nil,
+		msg.SetLanguage != nil,
+		msg.ClientInfo != nil,
+		msg.CursorData != nil,
+		msg.Request != nil,
+		msg.Pointer != nil)
+
+	result <- readResult{msg: msg}
 }
 
-// sendInitial sends the initial state to a newly connected client.
+// sendInitial sends the initial state to a newly connected client and waits
+// until it has been written. The whole burst must be delivered within the
+// write timeout, extended for its size (see writeTimeoutFor); a client that
+// connects but doesn't read is dropped as a slow consumer before it
+// subscribes to updates, so it never becomes a half-joined member.
 func (c *Connection) sendInitial() (int, error) {
-	// Send Identity
-	logger.Debug("User %d sending Identity", c.userID)
-	if err := c.send(protocol.NewIdentityMsg(c.userID)); err != nil {
+	// Send Identity, then the server clock so the client can compute its offset
+	msgs := []*protocol.ServerMsg{
+		protocol.NewIdentityMsg(c.userID),
+		protocol.NewServerTimeMsg(time.Now()),
+	}
+
+	// Tell share-link clients what they may do before they can try
+	if c.access != nil {
+		msgs = append(msgs, protocol.NewAccessMsg(c.access.Role, c.access.Label))
+	}
+	frames, err := encodeMsgs(msgs)
+	if err != nil {
 		return 0, err
 	}
 
 	// Get initial state
-	ops, lang, users, cursors := c.kolabpad.GetInitialState()
-
-	// Send operation history
-	if len(ops) > 0 {
-		logger.Debug("User %d sending History: %d operations from revision 0", c.userID, len(ops))
-		if err := c.send(protocol.NewHistoryMsg(0, ops)); err != nil {
-			return 0, err
+	state := c.kolabpad.initialState(c.userID, c.resumeFrom)
+	ops, revision, lang, users, cursors := state.ops, state.revision, state.lang, state.users, state.cursors
+	c.revisionOffset = revision - len(ops) - state.start
+
+	// Send operation history and recent changes. A client asking to resume
+	// always gets a History, even an empty one, whose start tells it whether
+	// it resumed or must reload from revision 0.
+	var history [][]byte
+	switch {
+	case state.resumed:
+		logger.Debug("User %d resuming History at revision %d: %d operations", c.userID, state.start, len(ops))
+		history, err = encodeMsgs(historyMsgs(state.start, ops, c.historyFrameSize))
+	case c.resumeFrom >= 0 && len(ops) == 0:
+		history, err = encodeMsgs([]*protocol.ServerMsg{protocol.NewHistoryMsg(0, ops)})
+	default:
+		if c.resumeFrom >= 0 {
+			logger.Debug("User %d can't resume at revision %d, sending full History", c.userID, c.resumeFrom)
 		}
+		history, err = c.initialHistory(ops, revision)
+	}
+	if err != nil {
+		return 0, err
 	}
+	frames = append(frames, history...)
 
 	// Send language (with system user ID for initial state)
+	msgs = msgs[:0]
 	if lang != nil {
 		logger.Debug("User %d sending Language: %s", c.userID, *lang)
-		if err := c.send(protocol.NewLanguageMsg(*lang, protocol.SystemUserID, "System")); err != nil {
-			return 0, err
-		}
+		msgs = append(msgs, protocol.NewLanguageMsg(*lang, protocol.SystemUserID, "System"))
 	}
 
 	// Send all users
 	logger.Debug("User %d sending %d user(s)", c.userID, len(users))
 	for id, info := range users {
 		infoCopy := info
-		if err := c.send(protocol.NewUserInfoMsg(id, &infoCopy)); err != nil {
-			return 0, err
-		}
+		msgs = append(msgs, protocol.NewUserInfoMsg(id, &infoCopy))
+	}
+
+	// Warn late joiners that their edits may not be saved
+	if c.kolabpad.PersistenceDegraded() {
+		msgs = append(msgs, persistenceNotice(true))
+	}
+	if c.kolabpad.StorageFull() {
+		msgs = append(msgs, storageNotice(true))
 	}
 
 	// Send all cursors
 	logger.Debug("User %d sending %d cursor(s)", c.userID, len(cursors))
 	for id, data := range cursors {
-		if err := c.send(protocol.NewUserCursorMsg(id, data)); err != nil {
-			return 0, err
+		msgs = append(msgs, protocol.NewUserCursorMsg(id, data))
+	}
+
+	rest, err := encodeMsgs(msgs)
+	if err != nil {
+		return 0, err
+	}
+	if err := c.sendBurst(append(frames, rest...)); err != nil {
+		return 0, err
+	}
+	return revision, nil
+}
+
+// initialHistory returns the encoded History messages bringing a new client
+// from revision 0 to revision, followed by RecentChanges if enabled. ops is
+// the history. A burst of clients joining the same revision share one
+// encoding (see Kolabpad.initialFrames).
+func (c *Connection) initialHistory(ops []protocol.UserOperation, revision int) ([][]byte, error) {
+	return c.kolabpad.initialFrames(revision, len(ops), func() ([][]byte, error) {
+		var msgs []*protocol.ServerMsg
+		if len(ops) > 0 {
+			msgs = historyMsgs(0, ops, c.historyFrameSize)
+			logger.Debug("User %d encoding History: %d operations from revision 0 in %d message(s)", c.userID, len(ops), len(msgs))
+		}
+
+		// Let late joiners highlight what just changed
+		if c.recentChangeOps > 0 {
+			if ranges := recentChanges(ops, c.recentChangeOps); len(ranges) > 0 {
+				msgs = append(msgs, protocol.NewRecentChangesMsg(ranges))
+			}
+		}
+		return encodeMsgs(msgs)
+	})
+}
+
+// encodeMsgs marshals msgs into frames for sendBurst.
+func encodeMsgs(msgs []*protocol.ServerMsg) ([][]byte, error) {
+	frames := make([][]byte, len(msgs))
+	for i, msg := range msgs {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return nil, fmt.Errorf("marshal: %w", err)
+		}
+		frames[i] = data
+	}
+	return frames, nil
+}
+
+// sendBurst queues frames, waiting for queue space rather than treating a
+// burst larger than the queue as a slow consumer, then waits for the writer
+// to deliver them. It must be called once, before anything else can send.
+func (c *Connection) sendBurst(frames [][]byte) error {
+	total := 0
+	for _, data := range frames {
+		total += len(data)
+	}
+
+	timeout := c.writeTimeoutFor(total)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	if c.enqueueBurst(frames, timer.C) {
+		select {
+		case <-c.initialSent:
+			return nil
+		case <-c.ctx.Done():
+			return context.Cause(c.ctx)
+		case <-timer.C:
 		}
+	} else if err := context.Cause(c.ctx); err != nil {
+		return err // The connection ended while queueing
 	}
 
-	return len(ops), nil
+	// Abort the write in progress so cleanup doesn't wait out the rest of the queue
+	err := fmt.Errorf("%w: %d messages, %d bytes, %v", errInitialTimeout, len(frames), total, timeout)
+	logger.Warn("User %d %v", c.userID, err)
+	c.cancel(err)
+	return err
 }
 
-// sendHistory sends operation history from a starting revision.
+// sendHistory sends operation history from a starting (server) revision.
 func (c *Connection) sendHistory(start int) (int, error) {
-	ops := c.kolabpad.GetHistory(start)
+	ops, err := c.kolabpad.GetHistory(start)
+	if err != nil {
+		return start, err
+	}
 	if len(ops) > 0 {
-		logger.Debug("User %d sending History: %d operations from revision %d", c.userID, len(ops), start)
-		if err := c.send(protocol.NewHistoryMsg(start, ops)); err != nil {
-			return start, err
+		history := historyMsgs(start-c.revisionOffset, ops, c.historyFrameSize)
+		logger.Debug("User %d sending History: %d operations from revision %d in %d message(s)", c.userID, len(ops), start, len(history))
+		for _, msg := range history {
+			if err := c.send(msg); err != nil {
+				return start, err
+			}
 		}
 	}
 	return start + len(ops), nil
 }
 
+// historyMsgs splits ops, the history from client revision start, into
+// consecutive History messages carrying at most maxBytes of encoded
+// operations each (0 = a single message). An operation larger than maxBytes
+// gets a message of its own. Clients apply them in order, so each message
+// starts where the previous one ended.
+func historyMsgs(start int, ops []protocol.UserOperation, maxBytes int) []*protocol.ServerMsg {
+	if maxBytes <= 0 {
+		return []*protocol.ServerMsg{protocol.NewHistoryMsg(start, ops)}
+	}
+
+	var msgs []*protocol.ServerMsg
+	first, size := 0, 0
+	for i := range ops {
+		n := maxBytes // Unencodable operations fail later, in send
+		if data, err := json.Marshal(&ops[i]); err == nil {
+			n = len(data) + 1 // Separating comma
+		}
+		if i > first && size+n > maxBytes {
+			msgs = append(msgs, protocol.NewHistoryMsg(start+first, ops[first:i]))
+			first, size = i, 0
+		}
+		size += n
+	}
+	return append(msgs, protocol.NewHistoryMsg(start+first, ops[first:]))
+}
+
+// resync tells the client its revision has been trimmed from history or is
+// too far behind to transform, and returns reason, so the connection closes
+// and the client reconnects and reloads from the snapshot.
+func (c *Connection) resync(reason error) error {
+	notice := "history trimmed, reconnect to resync"
+	if errors.Is(reason, ErrRevisionLag) {
+		notice = "too far behind, reconnect to resync"
+	}
+	logger.Info("User %d fell behind the document, forcing resync: %v", c.userID, reason)
+	if err := c.send(protocol.NewShutdownMsg(notice, true)); err != nil {
+		return fmt.Errorf("send resync notice: %w", err)
+	}
+	return reason
+}
+
 // handleMessage processes a message from the client.
 func (c *Connection) handleMessage(msg *protocol.ClientMsg) error {
+	if typ := msg.Type(); typ != "" && !c.messageAllowed(typ) {
+		logger.Debug("User %d sent a disabled %s message, ignoring it", c.userID, typ)
+		notice := typ + " messages are disabled on this server; the message was ignored"
+		if msg.Request != nil {
+			// The client waits for a Response, so it always gets one
+			return c.send(protocol.NewResponseErrorMsg(msg.Request.ID, protocol.ErrorCodeDisabled, notice))
+		}
+		if c.disabledNotice {
+			return c.send(protocol.NewErrorMsg(protocol.ErrorCodeDisabled, notice))
+		}
+		return nil
+	}
+	if msg.Edit != nil && msg.CursorData != nil && !c.messageAllowed(protocol.MsgCursorData) {
+		msg.CursorData = nil // Apply the edit without sharing the cursor
+	}
+
 	if msg.Edit != nil {
-		// Apply edit operation
-		logger.Debug("User %d applying Edit at revision %d (base=%d, target=%d)",
-			c.userID, msg.Edit.Revision, msg.Edit.Operation.BaseLen(), msg.Edit.Operation.TargetLen())
-		if err := c.kolabpad.ApplyEdit(c.userID, msg.Edit.Revision, msg.Edit.Operation); err != nil {
-			return fmt.Errorf("apply edit: %w", err)
+		if err := c.applyEdit(msg); err != nil {
+			return c.reject("Edit", err)
 		}
 		return nil
 	}
 
 	if msg.SetLanguage != nil {
-		userName := c.getUserName()
-		logger.Debug("User %d (%s) setting Language: %s", c.userID, userName, *msg.SetLanguage)
-		c.kolabpad.SetLanguage(*msg.SetLanguage, c.userID, userName)
+		if err := c.setLanguage(*msg.SetLanguage); err != nil {
+			return c.reject("SetLanguage", err)
+		}
 		return nil
 	}
 
 	if msg.ClientInfo != nil {
 		logger.Debug("User %d setting ClientInfo: name=%s, hue=%d", c.userID, msg.ClientInfo.Name, msg.ClientInfo.Hue)
+		if n := len(msg.ClientInfo.AvatarSeed); n > protocol.MaxAvatarSeedLength {
+			// Register the user anyway, just without an avatar
+			logger.Info("User %d sent a %d-byte avatar seed, dropping it", c.userID, n)
+			msg.ClientInfo.AvatarSeed = ""
+		}
 		c.kolabpad.SetUserInfo(c.userID, *msg.ClientInfo)
 		return nil
 	}
 
 	if msg.CursorData != nil {
 		logger.Debug("User %d setting CursorData: %d cursors, %d selections", c.userID, len(msg.CursorData.Cursors), len(msg.CursorData.Selections))
-		c.kolabpad.SetCursorData(c.userID, *msg.CursorData)
+		if data := c.cursors.offer(*msg.CursorData, time.Now()); data != nil {
+			c.kolabpad.SetCursorData(c.userID, *data)
+		}
 		return nil
 	}
 
+	if msg.Pointer != nil {
+		if !c.pointers.allow(time.Now()) {
+			logger.Debug("User %d sent pointers too quickly, dropping one", c.userID)
+			return nil
+		}
+		c.kolabpad.Pointer(c.userID, msg.Pointer.Position)
+		return nil
+	}
+
+	if msg.Request != nil {
+		return c.handleRequest(msg.Request)
+	}
+
 	return nil
 }
 
+// handleRequest answers a Request with a Response. It runs on the read loop,
+// so requests from one client are answered in order, and a failed request
+// is reported in its Response rather than closing the connection.
+func (c *Connection) handleRequest(req *protocol.RequestMsg) error {
+	logger.Debug("User %d sent Request %d: %s", c.userID, req.ID, req.Method)
+	if c.requests == nil {
+		return c.send(protocol.NewResponseErrorMsg(req.ID, protocol.ErrorCodeUnknownMethod, "requests are not supported"))
+	}
+
+	result, rpcErr := c.requests(c, req)
+	if rpcErr != nil {
+		return c.send(&protocol.ServerMsg{Response: &protocol.ResponseMsg{ID: req.ID, Error: rpcErr}})
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		logger.Error("Failed to encode %s result for user %d: %v", req.Method, c.userID, err)
+		return c.send(protocol.NewResponseErrorMsg(req.ID, protocol.ErrorCodeInternal, "internal error"))
+	}
+	return c.send(protocol.NewResponseMsg(req.ID, data))
+}
+
 // broadcastUpdates forwards metadata updates to this client.
 func (c *Connection) broadcastUpdates(updates <-chan *protocol.ServerMsg, done chan struct{}) {
 	defer close(done)
@@ -268,31 +641,156 @@ func (c *Connection) broadcastUpdates(updates <-chan *protocol.ServerMsg, done c
 				msgType = "UserInfo"
 			} else if msg.UserCursor != nil {
 				msgType = "UserCursor"
+			} else if msg.OTP != nil {
+				msgType = "OTP"
+			} else if msg.Shutdown != nil {
+				msgType = "Shutdown"
+			} else if msg.Error != nil {
+				msgType = "Error"
+			} else if msg.LanguageSuggestion != nil {
+				msgType = "LanguageSuggestion"
+			} else if msg.Presence != nil {
+				msgType = "Presence"
+			} else if msg.Announcement != nil {
+				msgType = "Announcement"
+			} else if msg.Pointer != nil {
+				msgType = "Pointer"
 			}
 			logger.Debug("User %d broadcasting %s", c.userID, msgType)
 
+			// Share links stand in for the OTP; their holders must not learn it
+			if msg.OTP != nil && c.access != nil {
+				continue
+			}
+
+			// Pointers carry a server revision; this client counts from its join
+			if msg.Pointer != nil && c.revisionOffset != 0 {
+				pointer := *msg.Pointer
+				pointer.Revision -= c.revisionOffset
+				msg = &protocol.ServerMsg{Pointer: &pointer}
+			}
+
 			if err := c.send(msg); err != nil {
 				logger.Error("Error broadcasting to user %d: %v", c.userID, err)
-				c.cancel()
+				c.cancel(err)
 				return
 			}
 		}
 	}
 }
 
-// send sends a message to the client (thread-safe).
+// send queues a message for delivery to the client (thread-safe, non-blocking).
+// If the outbound queue is full the client is too slow to keep up, so the
+// connection is cancelled rather than letting it stall the sender.
 func (c *Connection) send(msg *protocol.ServerMsg) error {
-	c.sendMu.Lock()
-	defer c.sendMu.Unlock()
-
 	data, err := json.Marshal(msg)
 	if err != nil {
 		return fmt.Errorf("marshal: %w", err)
 	}
 
-	writeCtx, writeCancel := context.WithTimeout(c.ctx, c.writeTimeout)
-	defer writeCancel()
-	return c.conn.Write(writeCtx, websocket.MessageText, data)
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	if c.queueClosed {
+		return errConnectionClosed
+	}
+
+	select {
+	case c.queue <- data:
+		return nil
+	default:
+		logger.Warn("User %d outbound queue full (%d messages), disconnecting slow consumer", c.userID, cap(c.queue))
+		c.cancel(errSlowConsumer)
+		return errSlowConsumer
+	}
+}
+
+// enqueueBurst queues frames followed by the nil end-of-burst marker (see
+// writer), blocking while the queue is full. It reports whether every frame
+// was queued before the connection ended or expired fired.
+func (c *Connection) enqueueBurst(frames [][]byte, expired <-chan time.Time) bool {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	for _, data := range append(frames, nil) {
+		select {
+		case c.queue <- data:
+		case <-c.ctx.Done():
+			return false
+		case <-expired:
+			return false
+		}
+	}
+	return true
+}
+
+// writer drains the outbound queue, writing messages to the socket in order.
+// It exits when the queue is closed and drained, or on the first write error.
+func (c *Connection) writer() {
+	defer close(c.writerDone)
+
+	for data := range c.queue {
+		if data == nil {
+			close(c.initialSent) // Queued by sendBurst after the initial state
+			continue
+		}
+
+		writeCtx, writeCancel := context.WithTimeout(c.ctx, c.writeTimeoutFor(len(data)))
+		err := c.conn.Write(writeCtx, websocket.MessageText, data)
+		timedOut := errors.Is(writeCtx.Err(), context.DeadlineExceeded)
+		writeCancel()
+
+		if err != nil {
+			if timedOut {
+				c.sent.writeTimeouts.Add(1)
+				c.sends.writeTimeouts.Add(1)
+			}
+			logger.Debug("User %d write failed: %v", c.userID, err)
+			c.cancel(nil)
+			return
+		}
+		c.sent.messages.Add(1)
+		c.sent.bytes.Add(uint64(len(data)))
+		c.sends.messages.Add(1)
+		c.sends.bytes.Add(uint64(len(data)))
+	}
+}
+
+// recordDrop counts a broadcast the client's buffer was too full to take,
+// and logs the client once as a slow consumer if it drops too many. It runs
+// under the document lock, so it only touches atomics.
+func (c *Connection) recordDrop() {
+	c.sent.drops.Add(1)
+	c.sends.drops.Add(1)
+	if c.sent.slowConsumer() && c.slow.CompareAndSwap(false, true) {
+		c.sends.slowConsumers.Add(1)
+		logger.Warn("User %d is a slow consumer: dropped %d of %d messages",
+			c.userID, c.sent.drops.Load(), c.sent.drops.Load()+c.sent.messages.Load())
+	}
+}
+
+// writeTimeoutFor returns the deadline for writing a message of size bytes.
+// Small messages (cursors, metadata) get the base write timeout; large ones
+// such as a History backfill get extra time for the client to receive them
+// at writeThroughput, so big documents don't trip the timeout.
+func (c *Connection) writeTimeoutFor(size int) time.Duration {
+	if c.writeThroughput <= 0 {
+		return c.writeTimeout
+	}
+	return c.writeTimeout + time.Duration(size)*time.Second/time.Duration(c.writeThroughput)
+}
+
+// closeQueue stops accepting new messages and waits for the writer to flush
+// whatever is already queued.
+func (c *Connection) closeQueue() {
+	c.sendMu.Lock()
+	if !c.queueClosed {
+		c.queueClosed = true
+		close(c.queue)
+	}
+	c.sendMu.Unlock()
+
+	<-c.writerDone
 }
 
 // cleanup removes the user from the session.
@@ -302,6 +800,8 @@ func (c *Connection) cleanup(err error) {
 		status := websocket.CloseStatus(err)
 		if status == websocket.StatusNormalClosure || status == websocket.StatusGoingAway {
 			logger.Info("User %d disconnected", c.userID)
+		} else if code, reason := closeStatus(err); code >= 4000 {
+			logger.Info("User %d disconnected: %s (%v)", c.userID, reason, err)
 		} else {
 			logger.Warn("User %d disconnected forcefully", c.userID)
 			logger.Error("Disconnect reason: %v", err)
@@ -310,7 +810,114 @@ func (c *Connection) cleanup(err error) {
 		logger.Info("User %d disconnected", c.userID)
 	}
 	c.kolabpad.RemoveUser(c.userID)
-	c.cancel()
+	c.closeQueue()
+	c.cancel(nil)
+}
+
+// applyEdit applies msg's Edit, with the cursor that came with it if any.
+func (c *Connection) applyEdit(msg *protocol.ClientMsg) error {
+	if c.readOnly() {
+		return ErrReadOnly
+	}
+	logger.Debug("User %d applying Edit at revision %d (base=%d, target=%d)",
+		c.userID, msg.Edit.Revision, msg.Edit.Operation.BaseLen(), msg.Edit.Operation.TargetLen())
+	var err error
+	if msg.CursorData != nil {
+		// The cursor is where the edit left it, so it goes with the edit
+		// rather than through the throttle
+		err = c.kolabpad.ApplyEditWithCursor(c.userID, msg.Edit.Revision+c.revisionOffset, msg.Edit.Operation, *msg.CursorData)
+	} else {
+		err = c.kolabpad.ApplyEdit(c.userID, msg.Edit.Revision+c.revisionOffset, msg.Edit.Operation)
+	}
+	if err != nil {
+		return err
+	}
+	if msg.CursorData != nil {
+		c.cursors.reset(time.Now()) // A held cursor predates this one
+	}
+	c.observer.OnEdit(c.docID, c.userID)
+	return nil
+}
+
+// setLanguage applies a SetLanguage from the client.
+func (c *Connection) setLanguage(lang string) error {
+	if c.readOnly() {
+		return ErrReadOnly
+	}
+	if !c.languageChanges.allow(time.Now()) {
+		return fmt.Errorf("%w: too many language changes", ErrRateLimited)
+	}
+	userName := c.getUserName()
+	logger.Debug("User %d (%s) setting Language: %s", c.userID, userName, lang)
+	if err := c.kolabpad.SetLanguage(lang, c.userID, userName); err != nil {
+		return fmt.Errorf("%w (%d bytes)", err, len(lang))
+	}
+	return nil
+}
+
+// reject handles err from applying a typ message. Errors that only cost the
+// message (see rejection) are reported to the client, keeping the
+// connection; others are returned, ending it with the close code closeStatus
+// picks, or a resync for ErrHistoryTrimmed and ErrRevisionLag.
+func (c *Connection) reject(typ string, err error) error {
+	if errors.Is(err, ErrKilled) {
+		// The main loop sees the kill and sends Shutdown; don't close first
+		logger.Debug("User %d sent %s after document was killed", c.userID, typ)
+		return nil
+	}
+	if notice := rejection(err); notice != nil {
+		logger.Info("User %d sent a rejected %s: %v", c.userID, typ, err)
+		return c.send(notice)
+	}
+	return fmt.Errorf("apply %s: %w", typ, err)
+}
+
+// rejection returns the Error telling a client its message was dropped, for
+// errors that leave the connection usable, or nil for ones that must close
+// it. Edits dropped this way leave the client's text ahead of the server's,
+// so it must reload.
+func rejection(err error) *protocol.ServerMsg {
+	switch {
+	case errors.Is(err, ErrReadOnly):
+		return protocol.NewErrorMsg(protocol.ErrorCodeReadOnly, "this share link is view-only; the change was not applied")
+	case errors.Is(err, ErrRateLimited):
+		return protocol.NewErrorMsg(protocol.ErrorCodeRateLimited, "too many language changes; the change was not applied")
+	case errors.Is(err, ErrDraining):
+		// Keep the connection so the client still sees the Shutdown notice
+		return protocol.NewErrorMsg(protocol.ErrorCodeDraining, "server is shutting down; this edit was not saved")
+	case errors.Is(err, ErrLineLimit):
+		return protocol.NewErrorMsg(protocol.ErrorCodeLineLimit, err.Error()+"; the edit was not applied")
+	case errors.Is(err, ErrUnsupportedLanguage):
+		return protocol.NewErrorMsg(protocol.ErrorCodeUnsupportedLanguage, ErrUnsupportedLanguage.Error())
+	default:
+		return nil
+	}
+}
+
+// closeStatus maps the error that ended Handle to the close frame sent to the
+// client, so it can tell reconnectable failures from ones that will recur.
+func closeStatus(err error) (websocket.StatusCode, string) {
+	switch {
+	case err == nil:
+		return websocket.StatusNormalClosure, ""
+	case errors.Is(err, ErrInvalidRevision), errors.Is(err, ErrHistoryTrimmed), errors.Is(err, ErrRevisionLag):
+		return protocol.CloseInvalidRevision, "invalid revision"
+	case errors.Is(err, ErrInvalidOperation):
+		return protocol.CloseInvalidOperation, "invalid operation"
+	case errors.Is(err, ErrDocumentTooLarge):
+		return protocol.CloseDocumentTooLarge, "document too large"
+	case errors.Is(err, errSlowConsumer), errors.Is(err, errInitialTimeout):
+		return protocol.CloseSlowConsumer, "slow consumer"
+	case errors.Is(err, errDocumentKilled):
+		return protocol.CloseDocumentKilled, "document closed"
+	case errors.Is(err, errAccessRevoked):
+		return protocol.CloseAccessRevoked, "access revoked"
+	case errors.Is(err, context.Canceled):
+		// Server shutting down the request, or the connection was replaced
+		return websocket.StatusGoingAway, ""
+	default:
+		return websocket.StatusInternalError, "internal error"
+	}
 }
 
 // getUserName returns the user's display name from the kolabpad state.
@@ -350,10 +957,30 @@ func (c *Connection) heartbeat(ctx context.Context) {
 
 			if err != nil {
 				logger.Debug("User %d heartbeat ping failed: %v", c.userID, err)
-				c.cancel() // Cancel connection context to trigger cleanup
+				c.cancel(nil) // Cancel connection context to trigger cleanup
 				return
 			}
 			logger.Debug("User %d heartbeat ping sent", c.userID)
 		}
 	}
 }
+
+// clockSync sends a ServerTime message every clockInterval until the connection closes.
+func (c *Connection) clockSync(ctx context.Context) {
+	ticker := time.NewTicker(c.clockInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.send(protocol.NewServerTimeMsg(time.Now())); err != nil {
+				logger.Debug("User %d clock sync failed: %v", c.userID, err)
+				return
+			}
+		}
+	}
+}
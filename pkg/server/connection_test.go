@@ -0,0 +1,428 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+
+	"github.com/shiv248/kolabpad/internal/protocol"
+	ot "github.com/shiv248/operational-transformation-go"
+)
+
+// TestSendQueueOverflowDisconnects tests that a full outbound queue cancels the connection.
+func TestSendQueueOverflowDisconnects(t *testing.T) {
+	kolabpad := testKolabpad()
+
+	// No writer is started, so nothing drains the queue (simulates a stalled socket)
+	ctx, cancel := context.WithCancelCause(context.Background())
+	c := &Connection{
+		userID:     kolabpad.NextUserID(),
+		kolabpad:   kolabpad,
+		ctx:        ctx,
+		cancel:     cancel,
+		queue:      make(chan []byte, 4),
+		writerDone: make(chan struct{}),
+	}
+
+	for i := 0; i < 4; i++ {
+		if err := c.send(protocol.NewIdentityMsg(uint64(i))); err != nil {
+			t.Fatalf("send %d failed before queue was full: %v", i, err)
+		}
+	}
+
+	// Queue is full: send must not block, and must disconnect the client
+	done := make(chan error, 1)
+	go func() {
+		done <- c.send(protocol.NewIdentityMsg(99))
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, errSlowConsumer) {
+			t.Fatalf("Expected errSlowConsumer, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("send blocked on a full queue")
+	}
+
+	select {
+	case <-c.ctx.Done():
+		if code, _ := closeStatus(context.Cause(c.ctx)); code != protocol.CloseSlowConsumer {
+			t.Errorf("Expected slow consumer close code, got %d", code)
+		}
+	default:
+		t.Error("Expected connection context to be cancelled on overflow")
+	}
+
+	// Messages queued before the overflow keep their order
+	for i := 0; i < 4; i++ {
+		data := <-c.queue
+		want := fmt.Sprintf(`{"Identity":%d}`, i)
+		if string(data) != want {
+			t.Errorf("Queue position %d: expected %s, got %s", i, want, data)
+		}
+	}
+}
+
+// TestSendAfterCloseQueue tests that sends after cleanup fail instead of panicking.
+func TestSendAfterCloseQueue(t *testing.T) {
+	kolabpad := testKolabpad()
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	c := &Connection{
+		userID:     kolabpad.NextUserID(),
+		kolabpad:   kolabpad,
+		ctx:        ctx,
+		cancel:     cancel,
+		queue:      make(chan []byte, 4),
+		writerDone: make(chan struct{}),
+	}
+	close(c.writerDone) // No writer running
+
+	c.closeQueue()
+	c.closeQueue() // Idempotent
+
+	if err := c.send(protocol.NewIdentityMsg(1)); !errors.Is(err, errConnectionClosed) {
+		t.Fatalf("Expected errConnectionClosed, got %v", err)
+	}
+}
+
+// TestBroadcastDropsCounted tests that broadcasts a slow reader's buffer
+// can't take are counted, and that it's flagged once as a slow consumer.
+func TestBroadcastDropsCounted(t *testing.T) {
+	config := testConfig()
+	config.BroadcastBufferSize = 4
+	kolabpad := NewKolabpad(&config)
+	c := NewConnection("drops", kolabpad, nil, "", &config)
+	defer c.cancel(nil)
+
+	// Nothing reads the updates, as if the client stopped reading
+	kolabpad.subscribe(c.userID, c.recordDrop)
+	const dropped = 30
+	for i := 0; i < config.BroadcastBufferSize+dropped; i++ {
+		kolabpad.BroadcastAnnouncement(fmt.Sprintf("notice %d", i))
+	}
+
+	if got := c.sent.drops.Load(); got != dropped {
+		t.Errorf("Expected %d drops on the connection, got %d", dropped, got)
+	}
+	stats := kolabpad.sends.snapshot()
+	if stats.BroadcastDrops != dropped {
+		t.Errorf("Expected %d drops in the totals, got %d", dropped, stats.BroadcastDrops)
+	}
+	if !c.slow.Load() || stats.SlowConsumers != 1 {
+		t.Errorf("Expected one slow consumer, got slow=%v count=%d", c.slow.Load(), stats.SlowConsumers)
+	}
+}
+
+// TestSlowReaderDoesNotBlockOthers tests that a client which stops reading
+// doesn't delay broadcasts to other clients.
+func TestSlowReaderDoesNotBlockOthers(t *testing.T) {
+	server := testServer(t)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	docID := "slow-reader"
+
+	// Slow client connects and never reads past Identity
+	slow := connectWebSocket(t, ts, docID, "")
+	readServerMsg(t, slow)
+
+	fast := connectWebSocket(t, ts, docID, "")
+	readServerMsg(t, fast)
+
+	// Fast client sends a stream of edits, waiting for each acknowledgement in order
+	const numEdits = 100
+	chunk := make([]byte, 1024)
+	for i := range chunk {
+		chunk[i] = 'x'
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for rev := 0; rev < numEdits; rev++ {
+		op := ot.NewOperationSeq()
+		op.Retain(uint64(rev * len(chunk)))
+		op.Insert(string(chunk))
+		sendClientMsg(t, fast, &protocol.ClientMsg{
+			Edit: &protocol.EditMsg{Revision: rev, Operation: op},
+		})
+
+		msg := readServerMsg(t, fast)
+		if msg.History == nil || msg.History.Start != rev {
+			t.Fatalf("Expected History starting at %d, got %+v", rev, msg)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Fast client stalled after %d edits", rev)
+		}
+	}
+
+	val, ok := server.state.documents.Load(docID)
+	if !ok {
+		t.Fatal("Document not found in server state")
+	}
+	if got := len(val.(*Document).Kolabpad.Text()); got != numEdits*len(chunk) {
+		t.Errorf("Expected text length %d, got %d", numEdits*len(chunk), got)
+	}
+}
+
+// TestWriteTimeoutScalesWithSize tests that large messages get a longer write deadline.
+func TestWriteTimeoutScalesWithSize(t *testing.T) {
+	c := &Connection{writeTimeout: time.Second, writeThroughput: 1024}
+
+	if got := c.writeTimeoutFor(0); got != time.Second {
+		t.Errorf("Expected base timeout for empty message, got %v", got)
+	}
+	if got := c.writeTimeoutFor(10 * 1024); got != 11*time.Second {
+		t.Errorf("Expected 11s for 10KB at 1KB/s, got %v", got)
+	}
+
+	c.writeThroughput = 0
+	if got := c.writeTimeoutFor(10 * 1024); got != time.Second {
+		t.Errorf("Expected fixed timeout when scaling is disabled, got %v", got)
+	}
+}
+
+// TestLargeHistoryGetsLongerWriteTimeout tests that a large History backfill is
+// given more write time than a cursor broadcast.
+func TestLargeHistoryGetsLongerWriteTimeout(t *testing.T) {
+	kolabpad := testKolabpad()
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	c := &Connection{
+		userID:          kolabpad.NextUserID(),
+		kolabpad:        kolabpad,
+		ctx:             ctx,
+		cancel:          cancel,
+		queue:           make(chan []byte, 4),
+		writerDone:      make(chan struct{}),
+		writeTimeout:    100 * time.Millisecond,
+		writeThroughput: 64 * 1024,
+	}
+
+	// A 1MB History and a tiny cursor update
+	chunk := strings.Repeat("x", 16*1024)
+	ops := make([]protocol.UserOperation, 64)
+	for i := range ops {
+		ops[i] = protocol.UserOperation{ID: 1, Operation: insertAt(i*len(chunk), i*len(chunk), chunk)}
+	}
+	if err := c.send(protocol.NewHistoryMsg(0, ops)); err != nil {
+		t.Fatalf("send History failed: %v", err)
+	}
+	if err := c.send(protocol.NewUserCursorMsg(1, protocol.CursorData{Cursors: []uint32{3}})); err != nil {
+		t.Fatalf("send UserCursor failed: %v", err)
+	}
+
+	history, cursor := <-c.queue, <-c.queue
+	if got := c.writeTimeoutFor(len(cursor)); got > c.writeTimeout+time.Millisecond {
+		t.Errorf("Expected cursor write timeout near %v, got %v", c.writeTimeout, got)
+	}
+	if got := c.writeTimeoutFor(len(history)); got < 16*time.Second {
+		t.Errorf("Expected at least 16s to write a %d byte History at 64KB/s, got %v", len(history), got)
+	}
+}
+
+// TestHistoryMsgs tests that histories are split at the frame size into
+// consecutive messages, with oversized operations in messages of their own.
+func TestHistoryMsgs(t *testing.T) {
+	ops := make([]protocol.UserOperation, 10)
+	for i := range ops {
+		ops[i] = protocol.UserOperation{ID: 1, Operation: insertAt(i*4, i*4, "abcd")}
+	}
+	ops[6].Operation = insertAt(24, 24, strings.Repeat("x", 500))
+
+	if msgs := historyMsgs(5, ops, 0); len(msgs) != 1 || msgs[0].History.Start != 5 || len(msgs[0].History.Operations) != 10 {
+		t.Errorf("Expected one message without a frame size, got %d", len(msgs))
+	}
+
+	msgs := historyMsgs(5, ops, 200)
+	if len(msgs) < 3 {
+		t.Fatalf("Expected the history split into at least 3 messages, got %d", len(msgs))
+	}
+	next := 5
+	for i, msg := range msgs {
+		if msg.History.Start != next {
+			t.Errorf("Message %d: expected start %d, got %d", i, next, msg.History.Start)
+		}
+		n := len(msg.History.Operations)
+		if n == 0 {
+			t.Errorf("Message %d is empty", i)
+		}
+		for j, op := range msg.History.Operations {
+			if op.Operation != ops[next-5+j].Operation {
+				t.Errorf("Message %d: operation %d out of order", i, j)
+			}
+			if n > 1 && op.Operation == ops[6].Operation {
+				t.Errorf("Message %d: expected the oversized operation alone", i)
+			}
+		}
+		next += len(msg.History.Operations)
+	}
+	if next != 15 {
+		t.Errorf("Expected messages to cover revisions 5-14, ended at %d", next)
+	}
+}
+
+// TestTokenBucket tests that the language limiter allows a burst of
+// perMinute events and refills at perMinute a minute.
+func TestTokenBucket(t *testing.T) {
+	b := tokenBucket{perMinute: 3}
+	now := time.Unix(1_700_000_000, 0)
+	for i := range 3 {
+		if !b.allow(now) {
+			t.Fatalf("Expected event %d of the burst allowed", i)
+		}
+	}
+	if b.allow(now) {
+		t.Error("Expected the fourth event rejected")
+	}
+	if b.allow(now.Add(10 * time.Second)) {
+		t.Error("Expected no token after 10s at 3 per minute")
+	}
+	if !b.allow(now.Add(20 * time.Second)) {
+		t.Error("Expected a token after 20s at 3 per minute")
+	}
+
+	unlimited := tokenBucket{}
+	for range 100 {
+		if !unlimited.allow(now) {
+			t.Fatal("Expected no limit with perMinute 0")
+		}
+	}
+}
+
+// TestInitialHistoryShared tests that clients joining an unchanged document
+// within the cache window share one encoding of its history, and that an
+// edit or the window ending makes the next client build a fresh one.
+func TestInitialHistoryShared(t *testing.T) {
+	config := testConfig()
+	config.InitialCacheWindow = 50 * time.Millisecond
+	kolabpad := NewKolabpad(&config)
+	user := kolabpad.NextUserID()
+	for rev := 0; rev < 10; rev++ {
+		if err := kolabpad.ApplyEdit(user, rev, insertAt(rev, rev, "x")); err != nil {
+			t.Fatalf("Edit %d failed: %v", rev, err)
+		}
+	}
+
+	join := func() [][]byte {
+		t.Helper()
+		c := NewConnection("burst", kolabpad, nil, "", &config)
+		ops, revision, _, _, _ := kolabpad.GetInitialState(c.userID)
+		frames, err := c.initialHistory(ops, revision)
+		if err != nil {
+			t.Fatalf("initialHistory failed: %v", err)
+		}
+		if len(frames) != 1 {
+			t.Fatalf("Expected one History frame, got %d", len(frames))
+		}
+		return frames
+	}
+
+	first, second := join(), join()
+	if &first[0][0] != &second[0][0] {
+		t.Error("Expected the second client to reuse the first one's History")
+	}
+
+	if err := kolabpad.ApplyEdit(user, 10, insertAt(10, 10, "y")); err != nil {
+		t.Fatalf("Edit failed: %v", err)
+	}
+	third := join()
+	if &third[0][0] == &first[0][0] || !strings.Contains(string(third[0]), `"y"`) {
+		t.Errorf("Expected History rebuilt after an edit, got %s", third[0])
+	}
+
+	time.Sleep(3 * config.InitialCacheWindow)
+	if fourth := join(); &fourth[0][0] == &third[0][0] {
+		t.Error("Expected History rebuilt after the cache window")
+	}
+}
+
+// BenchmarkInitialBurst measures building the initial History for 50
+// clients joining a document with 2000 edits of history at once, with and
+// without the initial cache.
+func BenchmarkInitialBurst(b *testing.B) {
+	const clients, edits = 50, 2000
+
+	for _, window := range []time.Duration{0, 2 * time.Second} {
+		b.Run(fmt.Sprintf("window=%v", window), func(b *testing.B) {
+			config := testConfig()
+			config.InitialCacheWindow = window
+			kolabpad := NewKolabpad(&config)
+			user := kolabpad.NextUserID()
+			for rev := 0; rev < edits; rev++ {
+				if err := kolabpad.ApplyEdit(user, rev, insertAt(rev, rev, "x")); err != nil {
+					b.Fatal(err)
+				}
+			}
+			conns := make([]*Connection, clients)
+			for i := range conns {
+				conns[i] = NewConnection("burst", kolabpad, nil, "", &config)
+			}
+
+			b.ResetTimer()
+			for range b.N {
+				// Each iteration is a new burst
+				kolabpad.initial.mu.Lock()
+				kolabpad.initial.frames = nil
+				kolabpad.initial.mu.Unlock()
+
+				var wg sync.WaitGroup
+				for _, c := range conns {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						ops, revision, _, _, _ := kolabpad.GetInitialState(c.userID)
+						if _, err := c.initialHistory(ops, revision); err != nil {
+							panic(err)
+						}
+					}()
+				}
+				wg.Wait()
+			}
+		})
+	}
+}
+
+// TestRejectionOrClose tests that errors which only cost a message get an
+// Error notice while the rest close the connection with a matching code.
+func TestRejectionOrClose(t *testing.T) {
+	tests := []struct {
+		err    error
+		notice string               // Error code sent, or "" if the connection closes
+		close  websocket.StatusCode // Close code when it does
+	}{
+		{ErrReadOnly, protocol.ErrorCodeReadOnly, 0},
+		{fmt.Errorf("%w: too many language changes", ErrRateLimited), protocol.ErrorCodeRateLimited, 0},
+		{ErrDraining, protocol.ErrorCodeDraining, 0},
+		{fmt.Errorf("%w: 3 lines", ErrLineLimit), protocol.ErrorCodeLineLimit, 0},
+		{ErrUnsupportedLanguage, protocol.ErrorCodeUnsupportedLanguage, 0},
+		{fmt.Errorf("%w: got 5, current is 2", ErrInvalidRevision), "", protocol.CloseInvalidRevision},
+		{fmt.Errorf("%w: incompatible lengths", ErrBaseLenMismatch), "", protocol.CloseInvalidOperation},
+		{fmt.Errorf("%w: invalid UTF-8", ErrInvalidOperation), "", protocol.CloseInvalidOperation},
+		{fmt.Errorf("%w: 300 bytes", ErrDocumentTooLarge), "", protocol.CloseDocumentTooLarge},
+	}
+	for _, tt := range tests {
+		notice := rejection(tt.err)
+		if tt.notice != "" {
+			if notice == nil || notice.Error == nil || notice.Error.Code != tt.notice {
+				t.Errorf("Expected %v to be rejected with %s, got %+v", tt.err, tt.notice, notice)
+			}
+			continue
+		}
+		if notice != nil {
+			t.Errorf("Expected %v to close the connection, got notice %+v", tt.err, notice)
+		}
+		if code, _ := closeStatus(tt.err); code != tt.close {
+			t.Errorf("Expected %v to close with %d, got %d", tt.err, tt.close, code)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/shiv248/kolabpad/pkg/database"
+	"github.com/shiv248/kolabpad/pkg/logger"
+)
+
+// newDocumentAttempts bounds how many random IDs handleNewDocument tries
+// before giving up on finding a free one.
+const newDocumentAttempts = 8
+
+// handleNewDocument creates a document from the configured template, under
+// the requested ID or a random free one. It's how documents come to exist
+// when Config.CreateOnConnect is off, and works either way.
+// Route: POST /api/document/new
+func (s *Server) handleNewDocument(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, int64(s.state.config.MaxRequestBodySize))
+
+	var reqBody struct {
+		ID string `json:"id"` // Optional; empty = a random ID
+	}
+	if !decodeRequestBody(w, r, &reqBody) {
+		return
+	}
+	if reqBody.ID != "" {
+		if err := s.state.config.validateDocumentID(reqBody.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if s.state.draining.Load() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	docID := reqBody.ID
+	var err error
+	for attempt := 0; attempt < newDocumentAttempts; attempt++ {
+		if reqBody.ID == "" {
+			docID = generateDocumentID()
+		}
+		if !s.state.config.canCreate(docID, r) {
+			logger.Info("Rejected creation of document %s from %s", docID, s.clientIP(r))
+			http.Error(w, "Forbidden: document creation not allowed", http.StatusForbidden)
+			return
+		}
+		err = s.createDocument(docID)
+		if reqBody.ID != "" || !errors.Is(err, ErrDocumentExists) {
+			break
+		}
+	}
+	switch {
+	case errors.Is(err, ErrDocumentExists):
+		http.Error(w, "a document with that ID already exists", http.StatusConflict)
+		return
+	case err != nil:
+		logger.Error("Failed to create document %s: %v", docID, err)
+		writeStoreError(w, err)
+		return
+	}
+	logger.Info("Document %s created by %s", docID, s.clientIP(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{
+		"id": docID,
+	})
+}
+
+// createDocument makes document id from the configured template, failing
+// with ErrDocumentExists if it's resident or stored. With a database it's
+// stored straight away, even untouched, so it outlives being unloaded; if
+// that fails, it's created nowhere.
+func (s *Server) createDocument(id string) error {
+	if _, ok := s.state.documents.Load(id); ok {
+		return ErrDocumentExists
+	}
+	if s.state.db != nil {
+		exists, err := s.state.db.Exists(id)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return ErrDocumentExists
+		}
+	}
+
+	// Claim the ID in memory first, so connections racing the write get
+	// this document rather than loading or creating their own. They wait on
+	// connectionCountMu until it's stored, or find it unloaded if that fails.
+	doc := s.newDocument(FromTemplate(&s.state.config), nil, nil)
+	doc.connectionCountMu.Lock()
+	defer doc.connectionCountMu.Unlock()
+	if _, loaded := s.state.documents.LoadOrStore(id, doc); loaded {
+		return ErrDocumentExists
+	}
+
+	if s.state.db != nil {
+		text, language := doc.Kolabpad.Snapshot()
+		if err := s.state.db.Store(&database.PersistedDocument{ID: id, Text: text, Language: language}); err != nil {
+			doc.unloaded = true
+			s.state.documents.CompareAndDelete(id, doc)
+			doc.Kolabpad.Kill()
+			return err
+		}
+	}
+	return nil
+}
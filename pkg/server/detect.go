@@ -0,0 +1,92 @@
+package server
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+// detectPrefixLen bounds how much of a document DetectLanguage inspects,
+// keeping detection cheap enough to run on every edit until it succeeds.
+const detectPrefixLen = 2048
+
+// minDetectLen is the document length (bytes) below which content is too
+// short to suggest a language for.
+const minDetectLen = 32
+
+// shebangLanguages maps interpreter names in a #! line to languages.
+var shebangLanguages = map[string]string{
+	"python": "python", "python3": "python", "python2": "python",
+	"bash": "shell", "sh": "shell", "zsh": "shell",
+	"node": "javascript", "deno": "typescript",
+	"ruby": "ruby", "perl": "perl", "php": "php", "lua": "lua",
+}
+
+// languageRule matches content that is characteristic of a language.
+// Rules are tried in order, so more specific languages come first.
+type languageRule struct {
+	lang    string
+	pattern *regexp.Regexp
+}
+
+var languageRules = []languageRule{
+	{"php", regexp.MustCompile(`^\s*<\?php`)},
+	{"xml", regexp.MustCompile(`^\s*<\?xml`)},
+	{"html", regexp.MustCompile(`(?i)^\s*(<!doctype html|<html)`)},
+	{"dockerfile", regexp.MustCompile(`(?m)^FROM\s+\S+(\s+AS\s+\S+)?\s*$`)},
+	{"go", regexp.MustCompile(`(?m)^package\s+\w+\s*$[\s\S]*^func\s`)},
+	{"rust", regexp.MustCompile(`(?m)^\s*(pub\s+)?fn\s+\w+\s*\(|\blet\s+mut\s|^use\s+\w+::`)},
+	{"cpp", regexp.MustCompile(`(?m)^#include\s*<(iostream|vector|string|map)>|\bstd::`)},
+	{"c", regexp.MustCompile(`(?m)^#include\s*[<"]\w+\.h[>"]`)},
+	{"java", regexp.MustCompile(`\bpublic\s+(static\s+void\s+main|class\s+\w+)`)},
+	{"typescript", regexp.MustCompile(`\binterface\s+\w+\s*\{|:\s*(string|number|boolean)\s*[;,)=]`)},
+	{"javascript", regexp.MustCompile(`\b(const|let)\s+\w+\s*=|\bfunction\s+\w+\s*\(|=>\s*\{|\brequire\(`)},
+	{"python", regexp.MustCompile(`(?m)^\s*(def\s+\w+\s*\(.*\)\s*(->.*)?:|class\s+\w+(\(.*\))?:|import\s+\w+$|from\s+[\w.]+\s+import\s)`)},
+	{"sql", regexp.MustCompile(`(?i)\b(select\s+[\s\S]+\s+from|insert\s+into|create\s+table)\b`)},
+	{"yaml", regexp.MustCompile(`(?m)\A(---\s*\n)?(\w[\w-]*:(\s.*)?\n){2,}`)},
+	{"markdown", regexp.MustCompile("(?m)^(#{1,6}\\s+\\S|```)")},
+}
+
+// DetectLanguage guesses the syntax highlighting language of text from a
+// shebang, file signatures, and characteristic keywords. It only inspects the
+// start of the document and reports ok=false when nothing matches.
+func DetectLanguage(text string) (lang string, ok bool) {
+	if len(text) > detectPrefixLen {
+		text = text[:detectPrefixLen]
+	}
+
+	if strings.HasPrefix(text, "#!") {
+		if lang, ok := shebangLanguage(text); ok {
+			return lang, true
+		}
+	}
+
+	trimmed := strings.TrimSpace(text)
+	if (strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")) && json.Valid([]byte(trimmed)) {
+		return "json", true
+	}
+
+	for _, rule := range languageRules {
+		if rule.pattern.MatchString(text) {
+			return rule.lang, true
+		}
+	}
+	return "", false
+}
+
+// shebangLanguage maps the interpreter on a "#!" first line to a language.
+func shebangLanguage(text string) (string, bool) {
+	line, _, _ := strings.Cut(text, "\n")
+	fields := strings.Fields(strings.TrimPrefix(line, "#!"))
+	if len(fields) == 0 {
+		return "", false
+	}
+
+	// "#!/usr/bin/env python3" names the interpreter in the second field
+	interpreter := fields[0][strings.LastIndex(fields[0], "/")+1:]
+	if interpreter == "env" && len(fields) > 1 {
+		interpreter = fields[1]
+	}
+	lang, ok := shebangLanguages[interpreter]
+	return lang, ok
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shiv248/kolabpad/internal/protocol"
+)
+
+// TestDetectLanguage tests detection of a few unambiguous languages.
+func TestDetectLanguage(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"python shebang", "#!/usr/bin/env python3\nprint('hi')\n", "python"},
+		{"shell shebang", "#!/bin/bash\necho hi\n", "shell"},
+		{"python keywords", "import os\n\ndef main():\n    print(os.getcwd())\n", "python"},
+		{"go", "package main\n\nimport \"fmt\"\n\nfunc main() {\n\tfmt.Println(\"hi\")\n}\n", "go"},
+		{"json", `{"name": "kolabpad", "tags": ["ot", "editor"]}`, "json"},
+		{"html", "<!DOCTYPE html>\n<html><body>hi</body></html>\n", "html"},
+		{"php", "<?php\necho 'hi';\n", "php"},
+		{"rust", "fn main() {\n    let mut x = 1;\n    x += 1;\n}\n", "rust"},
+		{"dockerfile", "FROM golang:1.23 AS build\nRUN go build ./...\n", "dockerfile"},
+		{"sql", "SELECT id, text FROM document WHERE id = 1;", "sql"},
+		{"markdown", "# Title\n\nSome notes about the project.\n", "markdown"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := DetectLanguage(tt.text)
+			if !ok || got != tt.want {
+				t.Errorf("DetectLanguage() = %q, %v; want %q", got, ok, tt.want)
+			}
+		})
+	}
+
+	if lang, ok := DetectLanguage("just some plain prose without code"); ok {
+		t.Errorf("Expected no language for prose, got %q", lang)
+	}
+}
+
+// TestLanguageSuggestion tests that a detected language is suggested once,
+// only when enabled and no language has been set.
+func TestLanguageSuggestion(t *testing.T) {
+	paste := "#!/usr/bin/env python3\nimport sys\n\nprint(sys.argv)\n"
+
+	config := testConfig()
+	config.SuggestLanguage = true
+	kolabpad := NewKolabpad(&config)
+	user := kolabpad.NextUserID()
+	updates := kolabpad.Subscribe(user)
+
+	if err := kolabpad.ApplyEdit(user, 0, insertAt(0, 0, paste)); err != nil {
+		t.Fatalf("ApplyEdit failed: %v", err)
+	}
+	select {
+	case msg := <-updates:
+		if msg.LanguageSuggestion == nil || msg.LanguageSuggestion.Language != "python" {
+			t.Fatalf("Expected python suggestion, got %+v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a LanguageSuggestion broadcast")
+	}
+	if _, lang := kolabpad.Snapshot(); lang != nil {
+		t.Errorf("Suggestion must not set the language, got %q", *lang)
+	}
+
+	// No repeat on further edits
+	if err := kolabpad.ApplyEdit(user, 1, insertAt(len(paste), len(paste), "# more\n")); err != nil {
+		t.Fatalf("ApplyEdit failed: %v", err)
+	}
+	assertNoSuggestion(t, updates)
+
+	// Disabled by default
+	disabled := testKolabpad()
+	other := disabled.NextUserID()
+	otherUpdates := disabled.Subscribe(other)
+	if err := disabled.ApplyEdit(other, 0, insertAt(0, 0, paste)); err != nil {
+		t.Fatalf("ApplyEdit failed: %v", err)
+	}
+	assertNoSuggestion(t, otherUpdates)
+}
+
+// assertNoSuggestion fails if a LanguageSuggestion is pending on updates.
+func assertNoSuggestion(t *testing.T, updates <-chan *protocol.ServerMsg) {
+	t.Helper()
+
+	select {
+	case msg := <-updates:
+		if msg.LanguageSuggestion != nil {
+			t.Errorf("Unexpected suggestion: %+v", msg.LanguageSuggestion)
+		}
+	default:
+	}
+}
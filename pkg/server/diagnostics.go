@@ -0,0 +1,139 @@
+package server
+
+import (
+	"cmp"
+	"slices"
+	"unicode/utf8"
+
+	"github.com/shiv248/kolabpad/internal/protocol"
+)
+
+// Diagnostics is a point-in-time dump of a document's internal state, for
+// debugging documents that misbehave in the field (see Kolabpad.Diagnostics).
+// It never includes the OTP, and the text only on request.
+type Diagnostics struct {
+	Revision              int     `json:"revision"`
+	BaseRevision          int     `json:"base_revision"` // Revisions from the template, not user edits
+	CoalesceFrom          int     `json:"coalesce_from"` // Oldest revision clients may still reference
+	Operations            int     `json:"operations"`    // History entries held
+	TextLength            int     `json:"text_length"`   // In characters
+	TextBytes             int     `json:"text_bytes"`    // UTF-8 size
+	Language              *string `json:"language"`
+	Protected             bool    `json:"protected"`    // An OTP is set
+	Connections           int     `json:"connections"`  // Live connections, including ones before ClientInfo
+	Subscribers           int     `json:"subscribers"`  // Metadata channels, including read-only streams
+	Sessions              int     `json:"sessions"`     // Reconnect tokens seen
+	LastEdit              int64   `json:"last_edit"`    // Unix timestamp (0 = never)
+	LastPersist           int64   `json:"last_persist"` // Unix timestamp (0 = not since loaded)
+	LastPersistedRevision int     `json:"last_persisted_revision"`
+	PersistenceDegraded   bool    `json:"persistence_degraded"`
+	StorageFull           bool    `json:"storage_full"`
+	Draining              bool    `json:"draining"`
+	Killed                bool    `json:"killed"`
+
+	Users []DiagnosticUser `json:"users"` // By ID
+
+	Text *string `json:"text,omitempty"` // Only when asked for
+}
+
+// DiagnosticUser is a user's entry in Diagnostics. Connections that haven't
+// sent ClientInfo yet have no Info; ones without a cursor have no Cursor.
+type DiagnosticUser struct {
+	ID     uint64               `json:"id"`
+	Info   *protocol.UserInfo   `json:"info,omitempty"`
+	Cursor *protocol.CursorData `json:"cursor,omitempty"`
+}
+
+// Diagnostics returns the document's internal state from a single locked
+// read, so the figures are consistent with each other. withText includes
+// the full text.
+func (r *Kolabpad) Diagnostics(withText bool) Diagnostics {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	d := Diagnostics{
+		Revision:              r.revision(),
+		BaseRevision:          r.baseRevision,
+		CoalesceFrom:          r.coalesceFrom,
+		Operations:            len(r.state.Operations),
+		TextLength:            utf8.RuneCountInString(r.state.Text),
+		TextBytes:             len(r.state.Text),
+		Language:              r.state.Language,
+		Protected:             r.state.OTP != nil,
+		Connections:           r.ConnectionCount(),
+		Subscribers:           len(r.subscribers),
+		Sessions:              len(r.sessions),
+		LastEdit:              r.activity.lastEditUnix(),
+		LastPersist:           r.lastPersistTime.Load(),
+		LastPersistedRevision: int(r.lastPersistedRevision.Load()),
+		PersistenceDegraded:   r.persistenceDegraded.Load(),
+		StorageFull:           r.storageFull.Load(),
+		Draining:              r.draining,
+		Killed:                r.killed.Load(),
+	}
+	if withText {
+		text := r.state.Text
+		d.Text = &text
+	}
+
+	users := make(map[uint64]*DiagnosticUser)
+	user := func(id uint64) *DiagnosticUser {
+		if users[id] == nil {
+			users[id] = &DiagnosticUser{ID: id}
+		}
+		return users[id]
+	}
+	for id, info := range r.state.Users {
+		if id != protocol.SystemUserID {
+			user(id).Info = &info
+		}
+	}
+	for id, cursor := range r.state.Cursors {
+		if id != protocol.SystemUserID {
+			user(id).Cursor = &cursor
+		}
+	}
+	d.Users = make([]DiagnosticUser, 0, len(users))
+	for _, u := range users {
+		d.Users = append(d.Users, *u)
+	}
+	slices.SortFunc(d.Users, func(a, b DiagnosticUser) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return d
+}
+
+// DocumentDebug is the response of /api/document/{id}/debug: the document's
+// Diagnostics plus what the server tracks about it.
+type DocumentDebug struct {
+	Diagnostics
+
+	LastAccessed     int64 `json:"last_accessed"` // Unix timestamp
+	IdleSince        int64 `json:"idle_since"`    // Unix timestamp the last socket closed (0 while connected)
+	Sockets          int   `json:"sockets"`       // Active socket requests driving the persister
+	PersisterRunning bool  `json:"persister_running"`
+	ExpiryDays       *int  `json:"expiry_days"` // Per-document override (null = server default)
+	MaxSize          *int  `json:"max_size"`    // Per-document size limit in bytes (null = server default)
+}
+
+// debug collects d's DocumentDebug.
+func (d *Document) debug(withText bool) DocumentDebug {
+	dbg := DocumentDebug{
+		Diagnostics:  d.Kolabpad.Diagnostics(withText),
+		LastAccessed: d.LastAccessed.Unix(),
+		ExpiryDays:   d.expiryOverride.Load(),
+		MaxSize:      d.Kolabpad.MaxSize(),
+	}
+
+	d.connectionCountMu.Lock()
+	dbg.Sockets = d.connectionCount
+	if !d.idleSince.IsZero() {
+		dbg.IdleSince = d.idleSince.Unix()
+	}
+	d.connectionCountMu.Unlock()
+
+	d.persisterMu.Lock()
+	dbg.PersisterRunning = d.persisterCancel != nil
+	d.persisterMu.Unlock()
+	return dbg
+}
@@ -0,0 +1,336 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+
+	"github.com/shiv248/kolabpad/internal/protocol"
+	ot "github.com/shiv248/operational-transformation-go"
+)
+
+// simOptions configures runSimulation.
+type simOptions struct {
+	Clients int   // Concurrent clients
+	Edits   int   // Local edits made by each client
+	Seed    int64 // Seeds every client's edits, so failures reproduce
+}
+
+// simClient is a scripted editor that speaks the protocol like the frontend:
+// at most one edit in flight, later local edits buffered and composed, and
+// remote operations transformed against both before they're applied.
+type simClient struct {
+	id          uint64
+	conn        *websocket.Conn
+	rng         *rand.Rand
+	text        string
+	revision    int
+	outstanding *ot.OperationSeq // Sent, waiting for the server to echo it back
+	buffer      *ot.OperationSeq // Local edits made while outstanding was in flight
+	editsLeft   int
+	incoming    chan *protocol.ServerMsg
+	readErr     chan error
+}
+
+// simAlphabet mixes ASCII and multi-byte runes so the run crosses the
+// byte/rune boundaries the transform code has to get right.
+var simAlphabet = []rune("abc \né世😀")
+
+// randomEdit builds a revision-correct edit of c.text: a random insert,
+// delete or replacement somewhere in the document.
+func (c *simClient) randomEdit() *ot.OperationSeq {
+	n := utf8.RuneCountInString(c.text)
+	pos := c.rng.Intn(n + 1)
+	del := 0
+	if pos < n && c.rng.Intn(3) == 0 {
+		del = 1 + c.rng.Intn(min(n-pos, 5))
+	}
+	insert := make([]rune, c.rng.Intn(4))
+	for i := range insert {
+		insert[i] = simAlphabet[c.rng.Intn(len(simAlphabet))]
+	}
+	if del == 0 && len(insert) == 0 {
+		insert = []rune{'x'}
+	}
+
+	op := ot.NewOperationSeq()
+	op.Retain(uint64(pos))
+	op.Insert(string(insert))
+	op.Delete(uint64(del))
+	op.Retain(uint64(n - pos - del))
+	return op
+}
+
+// send submits op as an edit against the client's current revision.
+func (c *simClient) send(ctx context.Context, op *ot.OperationSeq) error {
+	return wsjson.Write(ctx, c.conn, &protocol.ClientMsg{
+		Edit: &protocol.EditMsg{Revision: c.revision, Operation: op},
+	})
+}
+
+// edit makes one local edit, sending it or buffering it behind the
+// outstanding one.
+func (c *simClient) edit(ctx context.Context) error {
+	op := c.randomEdit()
+	text, err := op.Apply(c.text)
+	if err != nil {
+		return fmt.Errorf("apply local edit %s: %w", op, err)
+	}
+	c.text = text
+	c.editsLeft--
+
+	switch {
+	case c.outstanding == nil:
+		c.outstanding = op
+		return c.send(ctx, op)
+	case c.buffer == nil:
+		c.buffer = op
+	default:
+		if c.buffer, err = c.buffer.Compose(op); err != nil {
+			return fmt.Errorf("compose buffer: %w", err)
+		}
+	}
+	return nil
+}
+
+// handle applies a server message. History entries for the client's own
+// edits acknowledge the outstanding operation; everyone else's are
+// transformed past the outstanding and buffered operations.
+func (c *simClient) handle(ctx context.Context, msg *protocol.ServerMsg) error {
+	if msg.History == nil {
+		return nil
+	}
+	for i, entry := range msg.History.Operations {
+		rev := msg.History.Start + i
+		if rev < c.revision {
+			continue // Already applied
+		}
+		if rev > c.revision {
+			return fmt.Errorf("history gap: got revision %d at revision %d", rev, c.revision)
+		}
+		c.revision++
+
+		if entry.ID == c.id && c.outstanding != nil {
+			c.outstanding, c.buffer = c.buffer, nil
+			if c.outstanding != nil {
+				if err := c.send(ctx, c.outstanding); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		op := entry.Operation
+		var err error
+		if c.outstanding != nil {
+			if c.outstanding, op, err = c.outstanding.Transform(op); err != nil {
+				return fmt.Errorf("transform outstanding at revision %d: %w", rev, err)
+			}
+		}
+		if c.buffer != nil {
+			if c.buffer, op, err = c.buffer.Transform(op); err != nil {
+				return fmt.Errorf("transform buffer at revision %d: %w", rev, err)
+			}
+		}
+		if c.text, err = op.Apply(c.text); err != nil {
+			return fmt.Errorf("apply remote operation at revision %d: %w", rev, err)
+		}
+	}
+	return nil
+}
+
+// readLoop forwards server messages to c.incoming until the connection fails.
+func (c *simClient) readLoop(ctx context.Context) {
+	for {
+		var msg protocol.ServerMsg
+		if err := wsjson.Read(ctx, c.conn, &msg); err != nil {
+			c.readErr <- err
+			return
+		}
+		select {
+		case c.incoming <- &msg:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// runSimulation connects opts.Clients clients to docID, has them make
+// opts.Edits random edits each concurrently, drains every History broadcast,
+// and fails the test unless every client and the server end up with the same
+// text. Clients edit with no coordination, so their edits interleave with
+// each other's acknowledgements just as they would in a browser.
+func runSimulation(t *testing.T, ts *httptest.Server, server *Server, docID string, opts simOptions) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	clients := make([]*simClient, opts.Clients)
+	for i := range clients {
+		conn := connectWebSocket(t, ts, docID, "")
+		identity := readServerMsg(t, conn).Identity
+		if identity == nil {
+			t.Fatalf("Client %d: expected Identity first", i)
+		}
+		clients[i] = &simClient{
+			id:        *identity,
+			conn:      conn,
+			rng:       rand.New(rand.NewSource(opts.Seed + int64(i))),
+			editsLeft: opts.Edits,
+			incoming:  make(chan *protocol.ServerMsg, 64),
+			readErr:   make(chan error, 1),
+		}
+		go clients[i].readLoop(ctx)
+	}
+
+	// Phase 1: edit concurrently until every edit is acknowledged
+	var final int
+	ready := make(chan struct{})
+	var edited, drained sync.WaitGroup
+	errs := make(chan error, len(clients))
+	for i, c := range clients {
+		edited.Add(1)
+		drained.Add(1)
+		go func() {
+			defer drained.Done()
+			err := c.run(ctx, &edited, ready, &final)
+			if err != nil {
+				errs <- fmt.Errorf("client %d (user %d): %w", i, c.id, err)
+			}
+		}()
+	}
+
+	edited.Wait()
+	if ctx.Err() == nil {
+		// Phase 2: catch every client up to the server's final revision
+		val, ok := server.state.documents.Load(docID)
+		if !ok {
+			t.Fatalf("Document %s not found in server state", docID)
+		}
+		final = val.(*Document).Kolabpad.Revision()
+		close(ready)
+	} else {
+		cancel()
+	}
+	drained.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if t.Failed() {
+		return
+	}
+
+	val, _ := server.state.documents.Load(docID)
+	text := val.(*Document).Kolabpad.Text()
+	for i, c := range clients {
+		if c.text != text {
+			t.Errorf("Client %d (user %d) diverged:\nclient: %q\nserver: %q", i, c.id, c.text, text)
+		}
+	}
+
+	stats := server.state.transforms.snapshot()
+	t.Logf("%d edits converged at revision %d, %d transforms (max %d per edit)", stats.Edits, final, stats.Transforms, stats.Max)
+}
+
+// run drives one client through both phases of runSimulation: it marks
+// edited done once its edits are all acknowledged, then reads until it
+// reaches *final, which is set before ready is closed.
+func (c *simClient) run(ctx context.Context, edited *sync.WaitGroup, ready <-chan struct{}, final *int) error {
+	acked := func() bool { return c.editsLeft == 0 && c.outstanding == nil && c.buffer == nil }
+
+	doneEditing := false
+	markEdited := func() {
+		if !doneEditing {
+			doneEditing = true
+			edited.Done()
+		}
+	}
+	defer markEdited()
+
+	for !acked() {
+		// Now and then keep typing with an edit in flight, which exercises
+		// the buffer; otherwise wait for the next message
+		if c.editsLeft > 0 && (c.outstanding == nil || c.rng.Intn(4) == 0) {
+			if err := c.edit(ctx); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := c.receive(ctx); err != nil {
+			return err
+		}
+	}
+	markEdited()
+
+	select {
+	case <-ready:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	for c.revision < *final {
+		if err := c.receive(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// receive waits for the next server message and handles it.
+func (c *simClient) receive(ctx context.Context) error {
+	select {
+	case msg := <-c.incoming:
+		return c.handle(ctx, msg)
+	case err := <-c.readErr:
+		return fmt.Errorf("read: %w", err)
+	case <-ctx.Done():
+		return fmt.Errorf("timed out at revision %d with %d edits left", c.revision, c.editsLeft)
+	}
+}
+
+// TestConcurrentClients tests that many clients editing concurrently converge
+// with each other and the server.
+func TestConcurrentClients(t *testing.T) {
+	cases := []struct {
+		name string
+		opts simOptions
+		edit func(*Config)
+	}{
+		{name: "pair", opts: simOptions{Clients: 2, Edits: 100, Seed: 1}},
+		{name: "crowd", opts: simOptions{Clients: 8, Edits: 50, Seed: 2}},
+		{name: "many", opts: simOptions{Clients: 16, Edits: 20, Seed: 3}},
+		{
+			name: "coalescing",
+			opts: simOptions{Clients: 6, Edits: 50, Seed: 4},
+			edit: func(c *Config) { c.CoalesceWindow = time.Second },
+		},
+		{
+			name: "notify window",
+			opts: simOptions{Clients: 8, Edits: 50, Seed: 5},
+			edit: func(c *Config) { c.NotifyWindow = 5 * time.Millisecond },
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := testConfig()
+			if tc.edit != nil {
+				tc.edit(&config)
+			}
+			server := NewServer(nil, config)
+			ts := httptest.NewServer(server)
+			defer ts.Close()
+
+			runSimulation(t, ts, server, "sim-"+tc.name, tc.opts)
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// initialCache holds the encoded History and RecentChanges frames last built
+// for a connecting client. When a shared link brings dozens of clients at
+// once, the first builds them and the rest reuse them while the document is
+// unchanged, instead of each encoding the whole history again.
+type initialCache struct {
+	mu       sync.Mutex // Held while building, so a burst builds once
+	revision int        // Document revision the frames bring a client to
+	entries  int        // History entries they hold; coalescing changes this without changing the revision
+	frames   [][]byte   // nil once dropped
+	gen      int        // Bumped on each build, so a stale drop timer leaves newer frames alone
+}
+
+// initialFrames returns the encoded initial History for a client joining at
+// revision with entries history entries, from the cache if a client joined
+// at the same point within Config.InitialCacheWindow, and from build
+// otherwise. The frames are shared and must not be modified.
+func (r *Kolabpad) initialFrames(revision, entries int, build func() ([][]byte, error)) ([][]byte, error) {
+	window := r.config.InitialCacheWindow
+	if window <= 0 {
+		return build()
+	}
+
+	c := &r.initial
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.frames != nil && c.revision == revision && c.entries == entries {
+		return c.frames, nil
+	}
+
+	frames, err := build()
+	if err != nil {
+		return nil, err
+	}
+	c.revision, c.entries, c.frames = revision, entries, frames
+	c.gen++
+
+	// Drop them once the burst is over, so idle documents don't hold a
+	// second copy of their history
+	gen := c.gen
+	time.AfterFunc(window, func() {
+		c.mu.Lock()
+		if c.gen == gen {
+			c.frames = nil
+		}
+		c.mu.Unlock()
+	})
+	return frames, nil
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/shiv248/kolabpad/pkg/logger"
+)
+
+// checkIntegrity runs the database's integrity check and records the result
+// for /api/ready. Failures are logged at Error level and reported to the
+// observer, since they're the only warning before corruption loses data.
+func (s *Server) checkIntegrity() {
+	start := time.Now()
+	err := s.state.db.IntegrityCheck()
+	if err != nil {
+		logger.Error("DATABASE INTEGRITY CHECK FAILED after %v: %v (back up the database file and restore or repair it)", time.Since(start), err)
+		s.state.config.observer().OnError("", err)
+		s.state.integrityErr.Store(&err)
+		return
+	}
+	logger.Info("Database integrity check passed in %v", time.Since(start))
+	s.state.integrityErr.Store(nil)
+}
+
+// handleReady is a readiness probe for load balancers and orchestrators:
+// 200 while the server should get traffic, 503 once it is shutting down,
+// with Config.IntegrityUnready after the last integrity check failed, or
+// with Config.SaturationUnready while a document's broadcast buffers are
+// saturated.
+// Route: /api/ready
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if s.state.draining.Load() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if s.state.config.IntegrityUnready && s.state.integrityErr.Load() != nil {
+		http.Error(w, "database integrity check failed", http.StatusServiceUnavailable)
+		return
+	}
+	if s.state.config.SaturationUnready && s.broadcastSaturated() {
+		http.Error(w, "broadcast buffers saturated", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// broadcastSaturated reports whether any active document's broadcast buffers
+// are saturated (see Kolabpad.BroadcastSaturated).
+func (s *Server) broadcastSaturated() bool {
+	saturated := false
+	s.state.documents.Range(func(key, value interface{}) bool {
+		saturated = value.(*Document).Kolabpad.BroadcastSaturated()
+		return !saturated
+	})
+	return saturated
+}
@@ -2,16 +2,69 @@
 package server
 
 import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
+	"github.com/shiv248/kolabpad/internal/otutil"
 	"github.com/shiv248/kolabpad/internal/protocol"
+	"github.com/shiv248/kolabpad/pkg/database"
 	"github.com/shiv248/kolabpad/pkg/logger"
 	ot "github.com/shiv248/operational-transformation-go"
 )
 
+// ErrUnsupportedLanguage is returned by SetLanguage for languages outside the allowlist.
+var ErrUnsupportedLanguage = errors.New("unsupported language")
+
+// ErrHistoryTrimmed is returned when a revision predates the history the
+// document still holds. The client must reconnect to resync from a snapshot.
+var ErrHistoryTrimmed = errors.New("history trimmed")
+
+// ErrRevisionLag is returned when an edit's revision trails the document by
+// more than Config.MaxRevisionLag, which would make transforming it cost
+// O(history). Like ErrHistoryTrimmed, the client must reconnect to resync.
+var ErrRevisionLag = errors.New("revision too far behind")
+
+// ErrDraining is returned for edits arriving after Drain. The edit is
+// dropped so the document's final flush sees a quiescent state.
+var ErrDraining = errors.New("document is draining")
+
+// ErrKilled is returned for edits arriving after Kill. Nothing would persist
+// or deliver them, so they are dropped rather than added to history.
+var ErrKilled = errors.New("document was killed")
+
+// ErrInvalidRevision is returned by ApplyEdit when the edit claims a revision
+// the server hasn't reached.
+var ErrInvalidRevision = errors.New("invalid revision")
+
+// ErrInvalidOperation is returned when an edit can't be transformed or
+// applied: its lengths don't match the document it's based on (see
+// ErrBaseLenMismatch), or it would split a character or insert invalid UTF-8.
+var ErrInvalidOperation = errors.New("invalid operation")
+
+// ErrBaseLenMismatch is the ErrInvalidOperation returned when an edit's base
+// length isn't the length of the text at the revision it's based on. The
+// client's document has diverged from the server's.
+var ErrBaseLenMismatch = fmt.Errorf("%w: base length mismatch", ErrInvalidOperation)
+
+// ErrDocumentTooLarge is returned when an edit would grow the document past
+// its size limit (Config.MaxDocumentSize, unless overridden with SetMaxSize).
+var ErrDocumentTooLarge = errors.New("document too large")
+
+// ErrLineLimit is returned when an edit would leave the document with more
+// lines than Config.MaxLines or a line longer than Config.MaxLineLength. The
+// edit is dropped; the connection stays open.
+var ErrLineLimit = errors.New("line limit exceeded")
+
 // State represents the shared document state protected by a lock.
 type State struct {
 	Operations []protocol.UserOperation       // Complete operation history
@@ -26,19 +79,56 @@ type State struct {
 type Kolabpad struct {
 	state                 *State
 	mu                    sync.RWMutex
-	count                 atomic.Uint64                       // User ID counter
-	killed                atomic.Bool                         // Document destruction flag
-	lastEditTime          atomic.Int64                        // Unix timestamp of last edit (for idle detection)
-	lastPersistedRevision atomic.Int32                        // Last revision written to DB
-	lastCriticalWrite     atomic.Int64                        // Unix timestamp of last critical write (OTP changes)
-	subscribers           map[uint64]chan *protocol.ServerMsg // Per-connection channels for metadata broadcasts
-	notify                chan struct{}                       // Closed to wake all connections when new operations arrive
-	maxDocumentSize       int                                 // Maximum document size in bytes
-	broadcastBufferSize   int                                 // Buffer size for metadata broadcast channels
+	count                 atomic.Uint64         // User ID counter
+	connections           atomic.Int64          // Live connections (registered or not)
+	killed                atomic.Bool           // Document destruction flag
+	draining              bool                  // Edits are refused while the final flush runs (guarded by mu)
+	activity              activity              // Last edit and critical write, for the persister
+	lastPersistedRevision atomic.Int32          // Last revision written to DB
+	storedRevisionBase    int64                 // Revision the database held when the document was loaded (see storedRevision)
+	lastPersistTime       atomic.Int64          // Unix timestamp of last write to DB (0 = never)
+	staleStore            atomic.Bool           // Set while flushes are rejected for a later revision in the database (see Flush)
+	persistenceDegraded   atomic.Bool           // Set while the persister's writes keep failing
+	storageFull           atomic.Bool           // Set while the document can't be stored for lack of room (see ErrStorageFull)
+	languageSuggested     bool                  // A LanguageSuggestion has been broadcast (protected by mu)
+	nextHue               int                   // Index into config.HuePalette of the next registering user's hue (protected by mu)
+	baseRevision          int                   // Revisions from a template, not user edits (set at creation)
+	subscribers           map[uint64]subscriber // Per-connection channels for metadata broadcasts
+	notify                chan struct{}         // Closed to wake all connections when new operations arrive
+	notifyPending         bool                  // A delayed wakeup is scheduled (see wake; protected by mu)
+	config                *Config               // Server configuration (limits, allowlists)
+	maxHistoryOps         int                   // History entries kept before the oldest are folded into a snapshot (0 = unlimited)
+	maxSize               atomic.Pointer[int]   // Per-document size limit in bytes (nil = Config.MaxDocumentSize)
+	maxSizeWatchers       map[uint64]func()     // Called when maxSize changes, by user ID (see watchMaxSize; protected by mu)
+
+	// History coalescing (see coalesceHistory). Revisions are absolute: a
+	// revision counts every edit ever applied, even after coalescing has
+	// merged some of them into a single history entry.
+	coalesced    int            // Edits merged into an earlier history entry
+	coalesceFrom int            // Revision from which history hasn't been coalesced or trimmed; clients can't reference earlier ones
+	editTimes    []time.Time    // Time of the latest edit in each history entry (parallel to state.Operations)
+	watermarks   map[uint64]int // Lowest revision each connection may still submit an edit against
+
+	metrics *transformMetrics // Transform counters, shared across documents when served by a Server
+	sends   *sendMetrics      // Connection send counters, likewise shared
+
+	initial    initialCache        // Encoded History shared by a burst of joining clients (see initialFrames)
+	saturation broadcastSaturation // How often broadcasts find subscriber buffers full (see recordBroadcast)
+
+	sessions map[string]*session // Reconnect token -> session (see ResumeUserID)
+	tokens   map[uint64]string   // User ID -> reconnect token
+
+	// savedCursors holds cursors loaded from the database by cursor key until
+	// their users reconnect (see LoadSavedCursors)
+	savedCursors map[string]protocol.CursorData
+
+	grants map[uint64]accessGrant // User ID -> share link it was admitted with (see GrantAccess)
+
+	cursorOrder []uint64 // Registered users with a cursor, most recently moved first (see broadcastCursor; only with config.MaxRemoteCursors)
 }
 
 // NewKolabpad creates a new collaborative editing session.
-func NewKolabpad(maxDocumentSize, broadcastBufferSize int) *Kolabpad {
+func NewKolabpad(config *Config) *Kolabpad {
 	return &Kolabpad{
 		state: &State{
 			Operations: make([]protocol.UserOperation, 0),
@@ -47,19 +137,32 @@ func NewKolabpad(maxDocumentSize, broadcastBufferSize int) *Kolabpad {
 			Users:      make(map[uint64]protocol.UserInfo),
 			Cursors:    make(map[uint64]protocol.CursorData),
 		},
-		subscribers:         make(map[uint64]chan *protocol.ServerMsg),
-		notify:              make(chan struct{}),
-		maxDocumentSize:     maxDocumentSize,
-		broadcastBufferSize: broadcastBufferSize,
+		subscribers:   make(map[uint64]subscriber),
+		notify:        make(chan struct{}),
+		config:        config,
+		maxHistoryOps: config.MaxHistoryOps,
+		watermarks:    make(map[uint64]int),
+		metrics:       &transformMetrics{},
+		sends:         &sendMetrics{},
+		sessions:      make(map[string]*session),
+		tokens:        make(map[uint64]string),
+		grants:        make(map[uint64]accessGrant),
+
+		maxSizeWatchers: make(map[uint64]func()),
 	}
 }
 
 // FromPersistedDocument creates a Kolabpad instance from a persisted document.
-func FromPersistedDocument(text string, language *string, otp *string, maxDocumentSize, broadcastBufferSize int) *Kolabpad {
-	r := NewKolabpad(maxDocumentSize, broadcastBufferSize)
+func FromPersistedDocument(text string, language *string, otp *string, config *Config) *Kolabpad {
+	r := NewKolabpad(config)
 
-	// Initialize OTP from persisted state
+	// Initialize OTP and language from persisted state
 	r.state.OTP = otp
+	r.state.Language = language
+
+	// Edits can't be applied to text that isn't valid UTF-8 (see
+	// otutil.ByteLen), so replace stray bytes as the editor would show them
+	text = strings.ToValidUTF8(text, "\uFFFD")
 
 	// Create an initial insert operation for the loaded text
 	if text != "" {
@@ -67,20 +170,30 @@ func FromPersistedDocument(text string, language *string, otp *string, maxDocume
 		op.Insert(text)
 
 		r.state.Text = text
-		r.state.Language = language
 		r.state.Operations = []protocol.UserOperation{
-			{
-				ID:        protocol.SystemUserID, // System operation
-				Operation: op,
-			},
+			protocol.NewUserOperation(protocol.SystemUserID, op), // System operation
 		}
+		r.editTimes = []time.Time{{}}
 	}
 
 	return r
 }
 
-// NextUserID returns the next available user ID.
+// FromTemplate creates a brand-new document seeded with config.DefaultContent
+// and config.DefaultLanguage. The template is a system operation like a
+// loaded document's text, but it doesn't count as an edit: an untouched
+// templated document is never persisted. Documents loaded from the database
+// or created from other content should not use this.
+func FromTemplate(config *Config) *Kolabpad {
+	r := FromPersistedDocument(config.DefaultContent, config.DefaultLanguage, nil, config)
+	r.baseRevision = r.revision()
+	return r
+}
+
+// NextUserID returns the next available user ID for a new connection.
+// Every call counts as a live connection until the matching RemoveUser.
 func (r *Kolabpad) NextUserID() uint64 {
+	r.connections.Add(1)
 	return r.count.Add(1) - 1
 }
 
@@ -88,7 +201,12 @@ func (r *Kolabpad) NextUserID() uint64 {
 func (r *Kolabpad) Revision() int {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
-	return len(r.state.Operations)
+	return r.revision()
+}
+
+// revision returns the current revision (caller must hold r.mu).
+func (r *Kolabpad) revision() int {
+	return len(r.state.Operations) + r.coalesced
 }
 
 // Text returns a copy of the current document text.
@@ -98,6 +216,23 @@ func (r *Kolabpad) Text() string {
 	return r.state.Text
 }
 
+// textAt returns the current text and language and the revision they're at,
+// for building an edit outside the lock to apply with ApplyEdit or sending
+// a snapshot that matches its revision.
+func (r *Kolabpad) textAt() (string, *string, int) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.state.Text, r.state.Language, r.revision()
+}
+
+// SizeBytes returns the UTF-8 length of the document text, the unit
+// MaxDocumentSize is measured in. Operation lengths count characters instead.
+func (r *Kolabpad) SizeBytes() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.state.Text)
+}
+
 // Snapshot returns a snapshot of the current document for persistence.
 func (r *Kolabpad) Snapshot() (text string, language *string) {
 	r.mu.RLock()
@@ -112,11 +247,72 @@ func (r *Kolabpad) GetOTP() *string {
 	return r.state.OTP
 }
 
-// UserCount returns the number of connected users (thread-safe).
+// MaxSize returns the document's size limit override in bytes, or nil if it
+// uses Config.MaxDocumentSize (thread-safe).
+func (r *Kolabpad) MaxSize() *int {
+	return r.maxSize.Load()
+}
+
+// SetMaxSize overrides the document's size limit in bytes (nil restores
+// Config.MaxDocumentSize). It applies to edits from then on; text already
+// past a lowered limit is kept.
+func (r *Kolabpad) SetMaxSize(size *int) {
+	r.maxSize.Store(size)
+
+	r.mu.RLock()
+	watchers := make([]func(), 0, len(r.maxSizeWatchers))
+	for _, watcher := range r.maxSizeWatchers {
+		watchers = append(watchers, watcher)
+	}
+	r.mu.RUnlock()
+
+	for _, watcher := range watchers {
+		watcher()
+	}
+}
+
+// watchMaxSize calls fn now and whenever the document's size limit changes,
+// until the returned function is called. Connections use it to keep their
+// read limit in step (see Connection.updateReadLimit).
+func (r *Kolabpad) watchMaxSize(userID uint64, fn func()) (unwatch func()) {
+	r.mu.Lock()
+	r.maxSizeWatchers[userID] = fn
+	r.mu.Unlock()
+	fn()
+
+	return func() {
+		r.mu.Lock()
+		delete(r.maxSizeWatchers, userID)
+		r.mu.Unlock()
+	}
+}
+
+// maxDocumentSize returns the size limit edits are held to.
+func (r *Kolabpad) maxDocumentSize() int {
+	if size := r.maxSize.Load(); size != nil {
+		return *size
+	}
+	return r.config.MaxDocumentSize
+}
+
+// UserCount returns the number of registered users (thread-safe).
+// Users are registered once their connection sends ClientInfo, so this can be
+// lower than ConnectionCount while clients are still handshaking. The System
+// user never counts.
 func (r *Kolabpad) UserCount() int {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
-	return len(r.state.Users)
+	n := len(r.state.Users)
+	if _, ok := r.state.Users[protocol.SystemUserID]; ok {
+		n--
+	}
+	return n
+}
+
+// ConnectionCount returns the number of live connections, including clients
+// that haven't sent ClientInfo yet.
+func (r *Kolabpad) ConnectionCount() int {
+	return int(r.connections.Load())
 }
 
 // HasUser checks if a user is currently connected to this document.
@@ -129,11 +325,7 @@ func (r *Kolabpad) HasUser(userID uint64) bool {
 
 // LastEditTime returns the time of the last edit.
 func (r *Kolabpad) LastEditTime() time.Time {
-	timestamp := r.lastEditTime.Load()
-	if timestamp == 0 {
-		return time.Time{} // Zero time if never edited
-	}
-	return time.Unix(timestamp, 0)
+	return r.activity.lastEditTime() // Zero time if never edited
 }
 
 // Kill marks this document as killed and closes channels to disconnect all clients.
@@ -141,28 +333,225 @@ func (r *Kolabpad) Kill() {
 	if r.killed.CompareAndSwap(false, true) {
 		r.mu.Lock()
 		// Close all subscriber channels
-		for _, ch := range r.subscribers {
-			close(ch)
+		for _, sub := range r.subscribers {
+			close(sub.ch)
 		}
-		r.subscribers = make(map[uint64]chan *protocol.ServerMsg)
+		r.subscribers = make(map[uint64]subscriber)
 		// Close notify channel to wake all connections
 		close(r.notify)
 		r.mu.Unlock()
 	}
 }
 
+// Drain stops the document from accepting edits. Once it returns, no further
+// edit will be applied, so a following Flush captures the final text.
+func (r *Kolabpad) Drain() {
+	r.mu.Lock()
+	r.draining = true
+	r.mu.Unlock()
+}
+
+// undrain accepts edits again after Drain, when what the document was
+// drained for was called off.
+func (r *Kolabpad) undrain() {
+	r.mu.Lock()
+	r.draining = false
+	r.mu.Unlock()
+}
+
+// BroadcastShutdown notifies all subscribers that the document is about to be killed.
+// Clients use reconnect to decide between reconnecting (eviction) and showing an error.
+func (r *Kolabpad) BroadcastShutdown(reason string, reconnect bool) {
+	r.broadcast(protocol.NewShutdownMsg(reason, reconnect))
+}
+
+// BroadcastAnnouncement sends an operator notice to all subscribers.
+func (r *Kolabpad) BroadcastAnnouncement(message string) {
+	r.broadcast(protocol.NewAnnouncementMsg(message))
+}
+
+// SetPersistenceDegraded records whether the document can currently be saved
+// and, if that changed, tells connected clients.
+func (r *Kolabpad) SetPersistenceDegraded(degraded bool) {
+	if r.persistenceDegraded.Swap(degraded) == degraded {
+		return
+	}
+	r.broadcast(persistenceNotice(degraded))
+}
+
+// PersistenceDegraded reports whether recent writes of this document have failed.
+func (r *Kolabpad) PersistenceDegraded() bool {
+	return r.persistenceDegraded.Load()
+}
+
+// SetStorageFull records whether the document is refused storage because the
+// database is full and, if that changed, tells connected clients.
+func (r *Kolabpad) SetStorageFull(full bool) {
+	if r.storageFull.Swap(full) == full {
+		return
+	}
+	r.broadcast(storageNotice(full))
+}
+
+// StorageFull reports whether the document was last refused storage for lack of room.
+func (r *Kolabpad) StorageFull() bool {
+	return r.storageFull.Load()
+}
+
+// storageNotice builds the Error message announcing a storage state change.
+func storageNotice(full bool) *protocol.ServerMsg {
+	if full {
+		return protocol.NewErrorMsg(protocol.ErrorCodeStorageFull,
+			"this document can't be saved because the server's storage is full; changes last only while it stays open")
+	}
+	return protocol.NewErrorMsg(protocol.ErrorCodePersistenceRestored, "changes are being saved again")
+}
+
+// persistenceNotice builds the Error message announcing a persistence state change.
+func persistenceNotice(degraded bool) *protocol.ServerMsg {
+	if degraded {
+		return protocol.NewErrorMsg(protocol.ErrorCodePersistenceDegraded,
+			"changes are not being saved; the server will keep retrying")
+	}
+	return protocol.NewErrorMsg(protocol.ErrorCodePersistenceRestored, "changes are being saved again")
+}
+
+// Untouched reports whether the document has no edits beyond its template or
+// loaded text and no OTP, so there's nothing worth saving.
+func (r *Kolabpad) Untouched() bool {
+	return r.Revision() <= r.baseRevision && r.GetOTP() == nil
+}
+
+// Flush writes the current document snapshot to the database, giving up
+// when ctx ends. Documents that were never edited and aren't OTP-protected
+// are skipped. Returns true if a write was performed.
+func (r *Kolabpad) Flush(ctx context.Context, db Store, id string) (bool, error) {
+	if db == nil {
+		return false, nil
+	}
+
+	// The revision and cursors are taken with the text so they match it
+	r.mu.RLock()
+	doc, revision := r.persisted(id)
+	var cursors []database.SavedCursor
+	if r.config.SavedCursors > 0 {
+		cursors = r.cursorsToSave()
+	}
+	r.mu.RUnlock()
+
+	// Only flush if document was edited OR has OTP protection
+	otp := doc.OTP
+	if revision <= r.baseRevision && otp == nil {
+		logger.Debug("Skipping flush for empty unprotected document %s", id)
+		return false, nil
+	}
+
+	stored, err := storeWithRetry(ctx, db, doc, r.storedRevision(revision))
+	if err != nil {
+		return false, err
+	}
+	if !stored {
+		// Retried on every tick until the revision passes the stored one;
+		// warn once per run of rejections so it isn't silent
+		if !r.staleStore.Swap(true) {
+			logger.Warn("Document %s at stored revision %d is behind a later write in the database; its changes aren't saved until it passes it",
+				id, r.storedRevision(revision))
+		} else {
+			logger.Debug("Skipping flush of document %s at revision %d: a later one is stored", id, revision)
+		}
+		return false, nil
+	}
+	if r.staleStore.Swap(false) {
+		logger.Info("Document %s is being saved again at stored revision %d", id, r.storedRevision(revision))
+	}
+	if r.config.SavedCursors > 0 {
+		// Cursors are a convenience; losing them doesn't fail the flush
+		if err := db.StoreCursors(ctx, id, cursors); err != nil {
+			logger.Warn("Failed to save cursors of document %s: %v", id, err)
+		}
+	}
+
+	r.markPersisted(revision)
+
+	logger.Debug("Flushed document %s (revision=%d, protected=%v)", id, revision, otp != nil)
+	return true, nil
+}
+
+// persisted returns the document as stored under id, and the revision it's
+// at (caller must hold r.mu).
+func (r *Kolabpad) persisted(id string) (*database.PersistedDocument, int) {
+	return &database.PersistedDocument{
+		ID:       id,
+		Text:     r.state.Text,
+		Language: r.state.Language,
+		OTP:      r.state.OTP,
+		MaxSize:  r.maxSize.Load(),
+	}, r.revision()
+}
+
+// storedRevision maps revision to the one it's stored at. Revisions restart
+// when a document is loaded, so stored ones continue from the revision the
+// database held then, keeping them increasing across reloads for
+// StoreIfNewer.
+func (r *Kolabpad) storedRevision(revision int) int64 {
+	return r.storedRevisionBase + int64(revision)
+}
+
+// markPersisted records that revision was written to the database.
+func (r *Kolabpad) markPersisted(revision int) {
+	r.lastPersistedRevision.Store(int32(revision))
+	r.lastPersistTime.Store(time.Now().Unix())
+}
+
+// Close flushes the document to the database and then kills it.
+// The document is killed even if the flush fails or ctx ends first; the
+// flush error is returned.
+func (r *Kolabpad) Close(ctx context.Context, db Store, id string) error {
+	_, err := r.Flush(ctx, db, id)
+	r.Kill()
+	return err
+}
+
 // Killed returns true if this document has been killed.
 func (r *Kolabpad) Killed() bool {
 	return r.killed.Load()
 }
 
+// subscriber is a channel receiving metadata broadcasts. dropped, if set, is
+// called for each broadcast skipped because the channel was full.
+type subscriber struct {
+	ch      chan *protocol.ServerMsg
+	dropped func()
+	cursors map[uint64]bool // Remote cursors the client holds (see Config.MaxRemoteCursors; nil = all)
+}
+
 // Subscribe creates a new channel for receiving metadata updates.
 func (r *Kolabpad) Subscribe(userID uint64) <-chan *protocol.ServerMsg {
+	return r.subscribe(userID, nil)
+}
+
+// subscribe is Subscribe, calling dropped for each broadcast the channel
+// was too full to take (see Connection.recordDrop).
+func (r *Kolabpad) subscribe(userID uint64, dropped func()) <-chan *protocol.ServerMsg {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	ch := make(chan *protocol.ServerMsg, r.broadcastBufferSize)
-	r.subscribers[userID] = ch
+	ch := make(chan *protocol.ServerMsg, r.config.BroadcastBufferSize)
+	if r.killed.Load() {
+		// Killed documents have no subscribers; hand back an already-closed channel
+		close(ch)
+		return ch
+	}
+	sub := subscriber{ch: ch, dropped: dropped}
+	if r.config.MaxRemoteCursors > 0 {
+		// Connections subscribe after sending the initial state, which
+		// held these cursors (see initialState)
+		sub.cursors = make(map[uint64]bool)
+		for _, id := range r.visibleCursors(userID) {
+			sub.cursors[id] = true
+		}
+	}
+	r.subscribers[userID] = sub
 	return ch
 }
 
@@ -171,8 +560,8 @@ func (r *Kolabpad) Unsubscribe(userID uint64) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	if ch, ok := r.subscribers[userID]; ok {
-		close(ch)
+	if sub, ok := r.subscribers[userID]; ok {
+		close(sub.ch)
 		delete(r.subscribers, userID)
 	}
 }
@@ -189,155 +578,534 @@ func (r *Kolabpad) broadcast(msg *protocol.ServerMsg) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
-	for _, ch := range r.subscribers {
+	full := 0
+	for _, sub := range r.subscribers {
 		select {
-		case ch <- msg:
+		case sub.ch <- msg:
 		default:
 			// Skip if subscriber channel is full
+			full++
+			if sub.dropped != nil {
+				sub.dropped()
+			}
 		}
 	}
+	r.recordBroadcast(len(r.subscribers), full)
 }
 
-// GetInitialState returns the initial state to send to a connecting client.
-func (r *Kolabpad) GetInitialState() (
+// GetInitialState returns the initial state to send to a connecting client,
+// along with the revision the history brings it to. The history may hold fewer
+// entries than revision if edits were coalesced; the connection must offset
+// the client's revisions by the difference. It also registers userID's
+// watermark so history it may still need is never coalesced.
+func (r *Kolabpad) GetInitialState(userID uint64) (
 	ops []protocol.UserOperation,
+	revision int,
 	lang *string,
 	users map[uint64]protocol.UserInfo,
 	cursors map[uint64]protocol.CursorData,
 ) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+	state := r.initialState(userID, -1)
+	return state.ops, state.revision, state.lang, state.users, state.cursors
+}
+
+// joinState is what a connecting client is sent (see Kolabpad.initialState).
+type joinState struct {
+	ops      []protocol.UserOperation // History from client revision start
+	start    int
+	revision int  // Server revision ops bring the client to
+	resumed  bool // ops continue from the revision the client asked to resume at
+	lang     *string
+	users    map[uint64]protocol.UserInfo
+	cursors  map[uint64]protocol.CursorData
+}
+
+// initialState is GetInitialState for a client that may already hold the
+// document up to client revision resume (-1 = none). The history then
+// starts there, provided userID holds a reconnect session whose last
+// connection numbered revisions the same way and none of it has since been
+// coalesced or trimmed; otherwise it's the full history from 0.
+func (r *Kolabpad) initialState(userID uint64, resume int) (state joinState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	state.revision = r.revision()
+	first := r.coalesced // Server revision the history starts at
+
+	r.watermarks[userID] = state.revision
+
+	// Sessions remember the offset their connections used, so a client
+	// revision maps to the same server revision on every reconnect. A
+	// resuming client may send edits against the revision it resumed at.
+	s := r.sessions[r.tokens[userID]]
+	if s != nil && s.numbered && resume >= 0 {
+		from := resume + s.revisionOffset
+		if from >= r.coalesceFrom && from <= state.revision {
+			first, state.start, state.resumed = from, resume, true
+			r.watermarks[userID] = from
+		}
+	}
 
 	// Make copies to avoid race conditions
-	ops = make([]protocol.UserOperation, len(r.state.Operations))
-	copy(ops, r.state.Operations)
+	state.ops = make([]protocol.UserOperation, state.revision-first)
+	copy(state.ops, r.state.Operations[first-r.coalesced:])
+	if s != nil {
+		s.revisionOffset, s.numbered = first-state.start, true
+	}
 
-	lang = r.state.Language
+	state.lang = r.state.Language
 
-	users = make(map[uint64]protocol.UserInfo)
+	// The System user authors operations but is never present
+	state.users = make(map[uint64]protocol.UserInfo)
 	for k, v := range r.state.Users {
-		users[k] = v
+		if k != protocol.SystemUserID {
+			state.users[k] = v
+		}
 	}
 
-	cursors = make(map[uint64]protocol.CursorData)
+	// Only registered users' cursors, which excludes the System user and
+	// cursors held until ClientInfo (see SetCursorData)
+	state.cursors = make(map[uint64]protocol.CursorData)
+	if r.config.MaxRemoteCursors > 0 {
+		for _, id := range r.visibleCursors(userID) {
+			state.cursors[id] = r.state.Cursors[id]
+		}
+		return state
+	}
 	for k, v := range r.state.Cursors {
-		cursors[k] = v
+		if _, ok := state.users[k]; ok {
+			state.cursors[k] = v
+		}
 	}
-
-	return
+	return state
 }
 
 // GetHistory returns operations from a starting revision.
-func (r *Kolabpad) GetHistory(start int) []protocol.UserOperation {
+// It returns ErrHistoryTrimmed if start predates the retained history.
+func (r *Kolabpad) GetHistory(start int) ([]protocol.UserOperation, error) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
+	// Coalescing never merges history a connection still needs (see
+	// watermarks), so this only happens once trimHistory has dropped it
+	if start < r.coalesceFrom {
+		return nil, fmt.Errorf("%w: revision %d predates retained history (from %d)", ErrHistoryTrimmed, start, r.coalesceFrom)
+	}
+
+	index := start - r.coalesced
 	length := len(r.state.Operations)
-	if start >= length {
-		return []protocol.UserOperation{}
+	if index >= length {
+		return []protocol.UserOperation{}, nil
 	}
 
-	ops := make([]protocol.UserOperation, length-start)
-	copy(ops, r.state.Operations[start:])
-	return ops
+	ops := make([]protocol.UserOperation, length-index)
+	copy(ops, r.state.Operations[index:])
+	return ops, nil
 }
 
 // ApplyEdit applies an edit operation from a client.
 func (r *Kolabpad) ApplyEdit(userID uint64, revision int, operation *ot.OperationSeq) error {
+	return r.applyEdit(userID, revision, operation, nil)
+}
+
+// ApplyEditWithCursor applies an edit operation together with the cursor
+// the client had once it made the edit. Both change under one lock, so no
+// other edit falls between them, and the cursor is taken as already past
+// the edit rather than transformed by it. If the edit fails, the cursor is
+// discarded with it.
+func (r *Kolabpad) ApplyEditWithCursor(userID uint64, revision int, operation *ot.OperationSeq, cursor protocol.CursorData) error {
+	return r.applyEdit(userID, revision, operation, &cursor)
+}
+
+func (r *Kolabpad) applyEdit(userID uint64, revision int, operation *ot.OperationSeq, cursor *protocol.CursorData) error {
+	if cursor != nil {
+		limited := r.limitCursors(userID, *cursor)
+		cursor = &limited
+	}
+
+	// Broadcast takes the read lock, so suggest and send the cursor only
+	// after unlocking below
+	var suggestion string
+	var moved bool
+	defer func() {
+		if suggestion != "" {
+			r.broadcast(protocol.NewLanguageSuggestionMsg(suggestion))
+		}
+		if moved {
+			r.broadcastCursor(userID, *cursor)
+		}
+	}()
+
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	// Track edit time for idle detection
-	r.lastEditTime.Store(time.Now().Unix())
+	if r.killed.Load() {
+		return ErrKilled
+	}
+	if r.draining {
+		return ErrDraining
+	}
 
-	currentLen := len(r.state.Operations)
-	oldTextLen := len(r.state.Text)
+	currentRev := r.revision()
 
 	logger.Debug("ApplyEdit: user=%d, revision=%d/%d, op(base=%d, target=%d), docLen=%d",
-		userID, revision, currentLen, operation.BaseLen(), operation.TargetLen(), oldTextLen)
+		userID, revision, currentRev, operation.BaseLen(), operation.TargetLen(), len(r.state.Text))
 
 	// Validate revision
-	if revision > currentLen {
-		return fmt.Errorf("invalid revision: got %d, current is %d", revision, currentLen)
+	if revision > currentRev {
+		return fmt.Errorf("%w: got %d, current is %d", ErrInvalidRevision, revision, currentRev)
+	}
+	if revision < r.coalesceFrom {
+		return fmt.Errorf("%w: revision %d predates retained history (from %d)", ErrHistoryTrimmed, revision, r.coalesceFrom)
+	}
+	if maxLag := r.config.MaxRevisionLag; maxLag > 0 && currentRev-revision > maxLag {
+		return fmt.Errorf("%w: revision %d is %d behind %d (max %d)", ErrRevisionLag, revision, currentRev-revision, currentRev, maxLag)
 	}
 
-	// Transform against all operations since the client's revision
-	transformed := operation
-	transformCount := len(r.state.Operations[revision:])
-	if transformCount > 0 {
-		logger.Debug("ApplyEdit: transforming against %d historical operation(s)", transformCount)
+	// Transform against all operations since the client's revision. The
+	// intermediate results live in pooled buffers; Result is a fresh copy, so
+	// history never aliases the pool or the caller's operation.
+	history := r.state.Operations[revision-r.coalesced:]
+	if len(history) > 0 {
+		logger.Debug("ApplyEdit: transforming against %d historical operation(s)", len(history))
+	}
+	if len(history) > transformStormThreshold {
+		logger.Debug("ApplyEdit: user %d at revision %d/%d needs %d transforms; client may not be advancing its revision",
+			userID, revision, currentRev, len(history))
 	}
-	for _, histOp := range r.state.Operations[revision:] {
-		aPrime, _, err := transformed.Transform(histOp.Operation)
+	r.metrics.observe(len(history))
+
+	transformer := otutil.NewTransformer(operation)
+	defer transformer.Release()
+	for _, histOp := range history {
+		if err := transformer.Transform(histOp.Operation); err != nil {
+			return invalidOperation(fmt.Errorf("transform failed: %w", err))
+		}
+	}
+	transformed := transformer.Result()
+
+	if cursor != nil && len(history) > 0 {
+		// The cursor is past the client's edit, which came before history
+		// on the client's side; carry it over history reordered after it
+		mapped, err := cursorAfter(operation, history, *cursor)
 		if err != nil {
-			return fmt.Errorf("transform failed: %w", err)
+			return invalidOperation(fmt.Errorf("transform failed: %w", err))
 		}
-		transformed = aPrime
+		cursor = &mapped
 	}
 
-	// Enforce size limit
-	if int(transformed.TargetLen()) > r.maxDocumentSize {
-		return fmt.Errorf("target length %d exceeds maximum of %d bytes", transformed.TargetLen(), r.maxDocumentSize)
+	// The client has seen everything up to revision, so it won't go back
+	// further. The System user has no connection to hold history back for.
+	if userID != protocol.SystemUserID {
+		r.watermarks[userID] = max(r.watermarks[userID], revision)
 	}
 
-	// Apply operation to text
-	newText, err := transformed.Apply(r.state.Text)
+	before := len(r.state.Text)
+	var err error
+	suggestion, err = r.commit(userID, transformed)
 	if err != nil {
-		return fmt.Errorf("apply failed: %w", err)
+		return err
+	}
+	if logger.TraceEnabled() {
+		traceEdit(userID, revision, currentRev, operation, transformed, before, len(r.state.Text))
 	}
 
-	logger.Debug("ApplyEdit: text changed from %d to %d bytes, notifying %d connection(s)",
-		oldTextLen, len(newText), len(r.subscribers))
+	if cursor != nil && userID != protocol.SystemUserID {
+		// Replaces the cursor commit just transformed, which predates the edit
+		r.state.Cursors[userID] = *cursor
+		_, moved = r.state.Users[userID]
+	}
 
-	// Transform all user cursors
-	for id, cursorData := range r.state.Cursors {
-		newCursors := make([]uint32, len(cursorData.Cursors))
-		for i, cursor := range cursorData.Cursors {
-			newCursors[i] = transformIndex(transformed, cursor)
+	if r.config.NormalizeNewlines && strings.ContainsRune(otutil.InsertedText(transformed), '\r') {
+		r.normalizeLineEndings()
+	}
+	return nil
+}
+
+// invalidOperation wraps err, from transforming or applying an operation, in
+// ErrBaseLenMismatch if lengths didn't match and ErrInvalidOperation otherwise.
+func invalidOperation(err error) error {
+	if errors.Is(err, ot.ErrIncompatibleLengths) {
+		return fmt.Errorf("%w: %w", ErrBaseLenMismatch, err)
+	}
+	return fmt.Errorf("%w: %w", ErrInvalidOperation, err)
+}
+
+// traceEdit logs an applied edit in full, for reproducing convergence bugs:
+// the operation as the client sent it against revision, as transformed and
+// committed at current, and the text length in bytes before and after. It
+// logs document content, so it only runs at trace level.
+func traceEdit(userID uint64, revision, current int, operation, transformed *ot.OperationSeq, before, after int) {
+	sent, err := json.Marshal(operation)
+	if err != nil {
+		sent = []byte(err.Error())
+	}
+	applied, err := json.Marshal(transformed)
+	if err != nil {
+		applied = []byte(err.Error())
+	}
+	logger.Trace("ApplyEdit: user=%d, revision=%d/%d, op=%s, transformed=%s, docLen=%d -> %d",
+		userID, revision, current, sent, applied, before, after)
+}
+
+// normalizeLineEndings turns the document's CRLFs into LFs with an edit by
+// the System user (caller must hold r.mu). Rewriting the client's edit
+// instead would leave the sender out of sync: clients acknowledge their own
+// edits without applying the server's copy. As an edit of its own, it
+// reaches every client, including the sender, and their pending edits
+// transform against it.
+func (r *Kolabpad) normalizeLineEndings() {
+	op := otutil.NormalizeLineEndings(r.state.Text)
+	if op == nil {
+		return
+	}
+	// Only shrinks the text, so no limit can reject it
+	if _, err := r.commit(protocol.SystemUserID, op); err != nil {
+		logger.Warn("Failed to normalize line endings: %v", err)
+	}
+}
+
+// cursorAfter maps a cursor in the coordinates of the text after op, applied
+// before history, into those of the text after history and then op.
+func cursorAfter(op *ot.OperationSeq, history []protocol.UserOperation, cursor protocol.CursorData) (protocol.CursorData, error) {
+	for _, histOp := range history {
+		next, histPrime, err := op.Transform(histOp.Operation)
+		if err != nil {
+			return protocol.CursorData{}, err
 		}
+		cursor = transformCursorData(histPrime, cursor)
+		op = next
+	}
+	return cursor, nil
+}
 
-		newSelections := make([][2]uint32, len(cursorData.Selections))
-		for i, sel := range cursorData.Selections {
-			newSelections[i] = [2]uint32{
-				transformIndex(transformed, sel[0]),
-				transformIndex(transformed, sel[1]),
-			}
+// ReplaceAll replaces the whole document with newText on behalf of userID
+// (protocol.SystemUserID for server-initiated changes such as imports or
+// restores). The change is recorded in history like any edit, so connected
+// clients converge and concurrent edits transform against it. Replacing the
+// text with itself is a no-op.
+func (r *Kolabpad) ReplaceAll(newText string, userID uint64) error {
+	return r.applyLocked(userID, func(text string) *ot.OperationSeq {
+		if newText == text {
+			return nil
 		}
+		logger.Debug("ReplaceAll: user=%d, docLen=%d -> %d", userID, len(text), len(newText))
+		// Diff so unchanged regions (and cursors in them) stay put
+		return otutil.Diff(text, newText)
+	})
+}
 
-		r.state.Cursors[id] = protocol.CursorData{
-			Cursors:    newCursors,
-			Selections: newSelections,
+// ApplyServerOperation applies op, which must be based on the current text,
+// as an edit by the System user, for server-side features such as imports,
+// templates and bots. Like a client's edit it's subject to the size and line
+// limits, recorded in history, moves cursors and wakes connections, so
+// clients receive it as a History message. An op built from an earlier
+// Snapshot may no longer fit the text; it fails with ErrBaseLenMismatch.
+func (r *Kolabpad) ApplyServerOperation(op *ot.OperationSeq) error {
+	return r.applyLocked(protocol.SystemUserID, func(text string) *ot.OperationSeq {
+		logger.Debug("ApplyServerOperation: op(base=%d, target=%d), docLen=%d", op.BaseLen(), op.TargetLen(), len(text))
+		return op
+	})
+}
+
+// applyLocked commits the operation build returns for the current text on
+// behalf of userID, all under r.mu, so no edit can fall between reading the
+// text and applying the operation. A nil operation changes nothing.
+func (r *Kolabpad) applyLocked(userID uint64, build func(text string) *ot.OperationSeq) error {
+	var suggestion string
+	defer func() {
+		if suggestion != "" {
+			r.broadcast(protocol.NewLanguageSuggestionMsg(suggestion))
 		}
+	}()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.killed.Load() {
+		return ErrKilled
+	}
+	if r.draining {
+		return ErrDraining
+	}
+	op := build(r.state.Text)
+	if op == nil {
+		return nil
+	}
+
+	var err error
+	suggestion, err = r.commit(userID, op)
+	return err
+}
+
+// commit applies op, which must be based on the current revision, and
+// records it in history (caller must hold r.mu). It transforms cursors,
+// maintains history limits, and wakes connections. It returns a language to
+// suggest, if any, for the caller to broadcast once r.mu is released.
+func (r *Kolabpad) commit(userID uint64, op *ot.OperationSeq) (string, error) {
+	// Enforce size limit. TargetLen counts runes, which never exceed the
+	// UTF-8 byte count, so it's a cheap early reject before the byte check.
+	maxSize := r.maxDocumentSize()
+	if op.TargetLen() > maxSize {
+		return "", fmt.Errorf("%w: target length %d characters exceeds maximum of %d bytes", ErrDocumentTooLarge, op.TargetLen(), maxSize)
+	}
+
+	// Size the result before building it; this also rejects operations
+	// that would split a character (see otutil.ByteLen)
+	size, err := otutil.ByteLen(op, r.state.Text)
+	if err != nil {
+		return "", invalidOperation(err)
+	}
+	if size > maxSize {
+		return "", fmt.Errorf("%w: %d bytes exceeds maximum of %d bytes", ErrDocumentTooLarge, size, maxSize)
+	}
+
+	// Apply operation to text; ByteLen has validated it against the text
+	newText := otutil.Apply(op, r.state.Text, size)
+	if err := r.config.checkLines(newText); err != nil {
+		return "", err
+	}
+
+	// Track edit time for idle detection
+	r.activity.edited(time.Now())
+
+	logger.Debug("commit: text changed from %d to %d bytes, notifying %d connection(s)",
+		len(r.state.Text), len(newText), len(r.subscribers))
+
+	// Transform all user cursors, including those parked by disconnected sessions
+	for id, cursorData := range r.state.Cursors {
+		r.state.Cursors[id] = transformCursorData(op, cursorData)
+	}
+	for _, sess := range r.sessions {
+		if sess.cursor != nil {
+			transformed := transformCursorData(op, *sess.cursor)
+			sess.cursor = &transformed
+		}
+	}
+	for key, cursorData := range r.savedCursors {
+		r.savedCursors[key] = transformCursorData(op, cursorData)
 	}
 
 	// Store operation and update text
-	r.state.Operations = append(r.state.Operations, protocol.UserOperation{
-		ID:        userID,
-		Operation: transformed,
-	})
+	r.state.Operations = append(r.state.Operations, protocol.NewUserOperation(userID, op))
+	r.editTimes = append(r.editTimes, time.Now())
 	r.state.Text = newText
+	r.metrics.applied.Add(1)
+
+	r.coalesceHistory()
+	r.trimHistory()
+	suggestion := r.suggestLanguage()
 
 	// Notify all connections of new operation (broadcast by closing and recreating channel)
 	// Only do this if document hasn't been killed
 	if !r.killed.Load() {
+		r.wake()
+	}
+
+	return suggestion, nil
+}
+
+// wake wakes every connection to send the operations it hasn't seen (caller
+// must hold r.mu). With Config.NotifyWindow set, the first edit of a burst
+// schedules the wakeup and later edits ride along, so each connection
+// backfills several operations per wakeup instead of one per edit.
+func (r *Kolabpad) wake() {
+	if r.config.NotifyWindow <= 0 {
 		close(r.notify)
 		r.notify = make(chan struct{})
+		return
+	}
+	if r.notifyPending {
+		return
+	}
+	r.notifyPending = true
+	time.AfterFunc(r.config.NotifyWindow, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.notifyPending = false
+		// Kill closes the channel itself
+		if !r.killed.Load() {
+			close(r.notify)
+			r.notify = make(chan struct{})
+		}
+	})
+}
+
+// transformCursorData maps cursor positions and selections through op.
+func transformCursorData(op *ot.OperationSeq, data protocol.CursorData) protocol.CursorData {
+	cursors := make([]uint32, len(data.Cursors))
+	for i, cursor := range data.Cursors {
+		cursors[i] = transformIndex(op, cursor)
 	}
 
-	return nil
+	selections := make([][2]uint32, len(data.Selections))
+	for i, sel := range data.Selections {
+		selections[i] = [2]uint32{
+			transformIndex(op, sel[0]),
+			transformIndex(op, sel[1]),
+		}
+	}
+
+	return protocol.CursorData{
+		Cursors:    cursors,
+		Selections: selections,
+	}
+}
+
+// recentChanges returns where the last k of ops, ending at the current text,
+// inserted or deleted text, oldest first. Earlier ranges are shifted by the
+// edits after them. System operations, such as loading the document, move
+// ranges but aren't reported themselves.
+func recentChanges(ops []protocol.UserOperation, k int) []protocol.ChangeRange {
+	var ranges []protocol.ChangeRange
+	for _, entry := range ops[max(len(ops)-k, 0):] {
+		for i := range ranges {
+			ranges[i].Start = transformIndex(entry.Operation, ranges[i].Start)
+			ranges[i].End = transformIndex(entry.Operation, ranges[i].End)
+		}
+		if entry.ID == protocol.SystemUserID {
+			continue
+		}
+		for _, r := range otutil.ChangedRanges(entry.Operation) {
+			ranges = append(ranges, protocol.ChangeRange{ID: entry.ID, Start: r[0], End: r[1]})
+		}
+	}
+	return ranges
+}
+
+// suggestLanguage returns a language to suggest for the current text, or ""
+// (caller must hold r.mu). At most one suggestion is made per document, and
+// only while SuggestLanguage is enabled and no language has been set.
+func (r *Kolabpad) suggestLanguage() string {
+	if !r.config.SuggestLanguage || r.languageSuggested || r.state.Language != nil || len(r.state.Text) < minDetectLen {
+		return ""
+	}
+
+	lang, ok := DetectLanguage(r.state.Text)
+	if !ok || !r.config.languageAllowed(lang) {
+		return ""
+	}
+	r.languageSuggested = true
+	return lang
 }
 
 // SetLanguage sets the document's syntax highlighting language.
-func (r *Kolabpad) SetLanguage(lang string, userID uint64, userName string) {
+// Languages outside the configured allowlist are rejected and not broadcast.
+func (r *Kolabpad) SetLanguage(lang string, userID uint64, userName string) error {
+	if !r.config.languageAllowed(lang) {
+		return ErrUnsupportedLanguage
+	}
+
 	r.mu.Lock()
 	r.state.Language = &lang
 	r.mu.Unlock()
 
 	// Track edit time for idle detection
-	r.lastEditTime.Store(time.Now().Unix())
+	r.activity.edited(time.Now())
 
 	// Broadcast to all clients with user info
 	r.broadcast(protocol.NewLanguageMsg(lang, userID, userName))
+	return nil
 }
 
 // SetOTP updates the OTP in state and broadcasts to all connected clients.
@@ -348,37 +1116,182 @@ func (r *Kolabpad) SetOTP(otp *string, userID uint64, userName string) {
 	r.mu.Unlock()
 
 	// Mark as critical write (for persister debouncing)
-	r.lastCriticalWrite.Store(time.Now().Unix())
+	r.activity.criticalWrite(time.Now())
 
 	// Broadcast to all authenticated clients with user info
 	r.broadcast(protocol.NewOTPMsg(otp, userID, userName))
 }
 
-// SetUserInfo updates a user's display information.
+// SetUserInfo updates a user's display information. When a reconnected user
+// registers, the cursor restored from its session is re-announced as well,
+// since other clients dropped it on disconnect.
+//
+// With config.DedupUserNames, a name already used by another user gets a
+// numeric suffix ("Alice (2)"), and everyone, including the sender, is told
+// the adjusted name.
+//
+// With config.HuePalette, the hue the client asked for is ignored: a user
+// registering gets the next palette hue, round-robin, and keeps it for as
+// long as it stays registered.
+//
+// A user that connected with a reconnect token keeps its avatar seed across
+// reconnects: ClientInfo without one reuses the seed it last sent.
+//
+// The System user can't register; it would show up as a phantom user.
 func (r *Kolabpad) SetUserInfo(userID uint64, info protocol.UserInfo) {
+	if userID == protocol.SystemUserID {
+		logger.Debug("SetUserInfo: ignoring the System user")
+		return
+	}
+
 	r.mu.Lock()
+	if r.config.DedupUserNames {
+		info.Name = r.uniqueName(userID, info.Name)
+	}
+	if s := r.sessions[r.tokens[userID]]; s != nil && s.userID == userID {
+		if info.AvatarSeed == "" {
+			info.AvatarSeed = s.avatarSeed
+		} else {
+			s.avatarSeed = info.AvatarSeed
+		}
+	}
+	prev, registered := r.state.Users[userID]
+	if palette := r.config.HuePalette; len(palette) > 0 {
+		if registered {
+			info.Hue = prev.Hue
+		} else {
+			info.Hue = palette[r.nextHue%len(palette)]
+			r.nextHue++
+		}
+	}
 	r.state.Users[userID] = info
+	cursor, hasCursor := r.state.Cursors[userID]
 	r.mu.Unlock()
 
 	// Broadcast to all clients
 	r.broadcast(protocol.NewUserInfoMsg(userID, &info))
+	if !registered && hasCursor {
+		r.broadcastCursor(userID, cursor)
+	}
+}
+
+// uniqueName returns name, or name with the lowest free " (n)" suffix if
+// another user already has it (caller must hold r.mu). Names are released
+// implicitly when their user is removed.
+func (r *Kolabpad) uniqueName(userID uint64, name string) string {
+	taken := func(candidate string) bool {
+		for id, info := range r.state.Users {
+			if id != userID && info.Name == candidate {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !taken(name) {
+		return name
+	}
+	for n := 2; ; n++ {
+		if candidate := fmt.Sprintf("%s (%d)", name, n); !taken(candidate) {
+			return candidate
+		}
+	}
 }
 
-// SetCursorData updates a user's cursor positions.
+// BroadcastPresence sends every subscriber the full list of registered users,
+// healing client user lists that missed a UserInfo update because their
+// broadcast buffer was full. Documents with no subscribers are skipped.
+func (r *Kolabpad) BroadcastPresence() {
+	r.mu.RLock()
+	if len(r.subscribers) == 0 {
+		r.mu.RUnlock()
+		return
+	}
+	users := make([]protocol.UserInfoMsg, 0, len(r.state.Users))
+	for id, info := range r.state.Users {
+		if id != protocol.SystemUserID {
+			users = append(users, protocol.UserInfoMsg{ID: id, Info: &info})
+		}
+	}
+	r.mu.RUnlock()
+
+	slices.SortFunc(users, func(a, b protocol.UserInfoMsg) int { return cmp.Compare(a.ID, b.ID) })
+	r.broadcast(protocol.NewPresenceMsg(users))
+}
+
+// SetCursorData updates a user's cursor positions. Cursors and selections
+// beyond config.MaxCursorsPerUser are dropped, since every edit transforms
+// and every client receives all of them. The System user has no cursor.
+//
+// Cursors of users that haven't sent ClientInfo yet are kept (and transformed
+// by edits) but not broadcast, since other clients have no name or color to
+// draw them with; SetUserInfo broadcasts the latest one when the user registers.
 func (r *Kolabpad) SetCursorData(userID uint64, data protocol.CursorData) {
+	if userID == protocol.SystemUserID {
+		logger.Debug("SetCursorData: ignoring the System user")
+		return
+	}
+	data = r.limitCursors(userID, data)
+
 	r.mu.Lock()
 	r.state.Cursors[userID] = data
+	_, registered := r.state.Users[userID]
 	r.mu.Unlock()
 
+	if !registered {
+		logger.Debug("SetCursorData: holding cursor of user %d until ClientInfo", userID)
+		return
+	}
+
 	// Broadcast to all clients
-	r.broadcast(protocol.NewUserCursorMsg(userID, data))
+	r.broadcastCursor(userID, data)
+}
+
+// Pointer broadcasts a transient marker userID placed at position, a
+// codepoint offset into the current text (clamped to its length), stamped
+// with the revision it refers to. Unlike a cursor it isn't stored, so later
+// edits don't move it and clients joining later never see it. Pointers of
+// users that haven't sent ClientInfo yet are dropped.
+func (r *Kolabpad) Pointer(userID uint64, position uint32) {
+	r.mu.RLock()
+	_, registered := r.state.Users[userID]
+	position = min(position, uint32(utf8.RuneCountInString(r.state.Text)))
+	revision := r.revision()
+	r.mu.RUnlock()
+
+	if !registered {
+		logger.Debug("Pointer: dropping pointer of unregistered user %d", userID)
+		return
+	}
+	r.broadcast(protocol.NewPointerMsg(userID, position, revision))
+}
+
+// limitCursors keeps at most config.MaxCursorsPerUser cursors and, separately,
+// selections of data.
+func (r *Kolabpad) limitCursors(userID uint64, data protocol.CursorData) protocol.CursorData {
+	if limit := r.config.MaxCursorsPerUser; limit > 0 && (len(data.Cursors) > limit || len(data.Selections) > limit) {
+		logger.Info("User %d sent %d cursors and %d selections, keeping %d of each",
+			userID, len(data.Cursors), len(data.Selections), limit)
+		data.Cursors = data.Cursors[:min(len(data.Cursors), limit)]
+		data.Selections = data.Selections[:min(len(data.Selections), limit)]
+	}
+	return data
 }
 
-// RemoveUser removes a user from the session.
+// RemoveUser removes a user from the session and releases its connection.
 func (r *Kolabpad) RemoveUser(userID uint64) {
+	r.connections.Add(-1)
+
 	r.mu.Lock()
+	r.releaseSession(userID)
 	delete(r.state.Users, userID)
 	delete(r.state.Cursors, userID)
+	delete(r.watermarks, userID)
+	delete(r.grants, userID)
+	r.cursorOrder = slices.DeleteFunc(r.cursorOrder, func(id uint64) bool { return id == userID })
+	for _, sub := range r.subscribers {
+		delete(sub.cursors, userID) // Clients drop it with the user
+	}
 	r.mu.Unlock()
 
 	// Unsubscribe from updates
@@ -386,38 +1299,126 @@ func (r *Kolabpad) RemoveUser(userID uint64) {
 
 	// Broadcast disconnection
 	r.broadcast(protocol.NewUserInfoMsg(userID, nil))
+
+	if r.config.MaxRemoteCursors > 0 {
+		// Fill the slot the user's cursor freed with the next most recent
+		r.mu.Lock()
+		r.syncRemoteCursors(protocol.SystemUserID)
+		r.mu.Unlock()
+	}
+}
+
+// coalesceHistory merges consecutive history entries from the same user that
+// were applied within config.CoalesceWindow of each other, composing them into
+// a single operation (caller must hold r.mu).
+//
+// Only edits below every connection's watermark are merged: no connected
+// client can submit an edit against a revision inside a merged entry, and
+// every connection has already been sent those entries individually. New
+// clients receive the merged entries and have their revisions offset by the
+// number of merged edits (see GetInitialState).
+func (r *Kolabpad) coalesceHistory() {
+	if r.config.CoalesceWindow <= 0 {
+		return
+	}
+
+	frontier := r.revision()
+	for _, rev := range r.watermarks {
+		frontier = min(frontier, rev)
+	}
+
+	// Edit number rev is the one that produced revision rev+1
+	for rev := max(r.coalesceFrom, 1); rev < frontier; rev++ {
+		i := rev - r.coalesced
+		prev, cur := r.state.Operations[i-1], r.state.Operations[i]
+		if prev.ID != cur.ID || r.editTimes[i].Sub(r.editTimes[i-1]) > r.config.CoalesceWindow {
+			continue
+		}
+
+		composed, err := prev.Operation.Compose(cur.Operation)
+		if err != nil {
+			logger.Warn("coalesceHistory: compose failed at revision %d: %v", rev, err)
+			continue
+		}
+
+		r.state.Operations[i-1] = protocol.NewUserOperation(prev.ID, composed)
+		r.editTimes[i-1] = r.editTimes[i]
+		r.state.Operations = slices.Delete(r.state.Operations, i, i+1)
+		r.editTimes = slices.Delete(r.editTimes, i, i+1)
+		r.coalesced++
+	}
+
+	r.coalesceFrom = max(r.coalesceFrom, frontier)
 }
 
-// transformIndex transforms a cursor position through an operation.
+// trimHistory enforces maxHistoryOps by folding the oldest history entries
+// into a single system snapshot that inserts the text they produced
+// (caller must hold r.mu).
+//
+// Unlike coalesceHistory this ignores watermarks: a connection that still
+// references a folded revision gets ErrHistoryTrimmed from ApplyEdit or
+// GetHistory and must reconnect to resync. Revisions stay absolute, so
+// clients that are caught up are unaffected.
+func (r *Kolabpad) trimHistory() {
+	excess := len(r.state.Operations) - r.maxHistoryOps
+	if r.maxHistoryOps <= 0 || excess <= 0 {
+		return
+	}
+
+	// Fold entries [0, excess] into entry 0. History starts from the empty
+	// document, so the composition is a single insert of the text so far.
+	folded := excess + 1
+	ops := make([]*ot.OperationSeq, folded)
+	for i, entry := range r.state.Operations[:folded] {
+		ops[i] = entry.Operation
+	}
+	snapshot, err := otutil.ComposeAll(ops)
+	if err != nil {
+		logger.Error("trimHistory: %v", err)
+		return
+	}
+
+	r.state.Operations[0] = protocol.NewUserOperation(protocol.SystemUserID, snapshot)
+	r.editTimes[0] = r.editTimes[excess]
+	r.state.Operations = slices.Delete(r.state.Operations, 1, folded)
+	r.editTimes = slices.Delete(r.editTimes, 1, folded)
+	r.coalesced += excess
+
+	// The snapshot produces this revision; nothing before it can be referenced
+	r.coalesceFrom = max(r.coalesceFrom, r.coalesced+1)
+	for id, rev := range r.watermarks {
+		r.watermarks[id] = max(rev, r.coalesceFrom)
+	}
+
+	logger.Debug("trimHistory: folded %d entries into snapshot, history starts at revision %d", folded, r.coalesceFrom)
+}
+
+// transformIndex transforms a cursor position through an operation. An
+// insert at the position pushes it forward, a position inside a deleted range
+// moves to its start, and one at or past the operation's base length shifts
+// by the operation's net length change. Positions come from clients and can
+// be any uint32, so the arithmetic is in int64, where none of them wrap.
 // This is ported from rustpad-server/src/ot.rs
 func transformIndex(operation *ot.OperationSeq, position uint32) uint32 {
-	index := int32(position)
+	index := int64(position) // Base characters still before the position
 	newIndex := index
 
 	for _, op := range operation.Ops() {
 		switch v := op.(type) {
 		case ot.Retain:
-			index -= int32(v.N)
+			index -= int64(v.N)
 		case ot.Insert:
-			// Count characters in the inserted text
-			charCount := int32(len([]rune(v.Text)))
-			newIndex += charCount
+			newIndex += int64(utf8.RuneCountInString(v.Text))
 		case ot.Delete:
-			if index >= int32(v.N) {
-				newIndex -= int32(v.N)
-			} else if index > 0 {
-				newIndex -= index
-			}
-			index -= int32(v.N)
+			newIndex -= min(index, int64(v.N))
+			index -= int64(v.N)
 		}
 
+		// The rest of the operation comes after the position
 		if index < 0 {
 			break
 		}
 	}
 
-	if newIndex < 0 {
-		return 0
-	}
-	return uint32(newIndex)
+	return uint32(min(max(newIndex, 0), math.MaxUint32))
 }
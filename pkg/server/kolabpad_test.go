@@ -0,0 +1,1728 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/shiv248/kolabpad/internal/protocol"
+	"github.com/shiv248/kolabpad/pkg/database"
+	"github.com/shiv248/kolabpad/pkg/logger"
+	ot "github.com/shiv248/operational-transformation-go"
+)
+
+// testKolabpad creates a document with test-friendly settings.
+func testKolabpad() *Kolabpad {
+	config := testConfig()
+	return NewKolabpad(&config)
+}
+
+// TestKolabpadClose tests that Close flushes the document and then kills it.
+func TestKolabpadClose(t *testing.T) {
+	db := newMemStore()
+	kolabpad := testKolabpad()
+
+	op := ot.NewOperationSeq()
+	op.Insert("hello")
+	if err := kolabpad.ApplyEdit(0, 0, op); err != nil {
+		t.Fatalf("ApplyEdit failed: %v", err)
+	}
+
+	if err := kolabpad.Close(context.Background(), db, "close-test"); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	if !kolabpad.Killed() {
+		t.Error("Expected document to be killed after Close")
+	}
+
+	persisted, err := db.Load("close-test")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if persisted == nil || persisted.Text != "hello" {
+		t.Errorf("Expected persisted text 'hello', got %+v", persisted)
+	}
+}
+
+// TestKolabpadCloseSkipsEmpty tests that never-edited, unprotected documents aren't written.
+func TestKolabpadCloseSkipsEmpty(t *testing.T) {
+	db := newMemStore()
+	kolabpad := testKolabpad()
+
+	if err := kolabpad.Close(context.Background(), db, "empty-test"); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	if persisted, _ := db.Load("empty-test"); persisted != nil {
+		t.Errorf("Expected empty document to be skipped, got %+v", persisted)
+	}
+}
+
+// TestFlushOutOfOrder tests that a flush finishing after a newer one can't
+// overwrite it, and that stored revisions keep increasing across reloads.
+func TestFlushOutOfOrder(t *testing.T) {
+	db, err := database.New(filepath.Join(t.TempDir(), "kolabpad.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+
+	insert := func(kolabpad *Kolabpad, text string) {
+		t.Helper()
+		revision := kolabpad.Revision()
+		op := ot.NewOperationSeq()
+		op.Retain(uint64(len(kolabpad.Text())))
+		op.Insert(text)
+		if err := kolabpad.ApplyEdit(0, revision, op); err != nil {
+			t.Fatalf("ApplyEdit failed: %v", err)
+		}
+	}
+
+	kolabpad := testKolabpad()
+	insert(kolabpad, "old")
+
+	// A flush that snapshots now but is held up until after the next one
+	kolabpad.mu.RLock()
+	stale, staleRevision := kolabpad.persisted("doc")
+	kolabpad.mu.RUnlock()
+
+	insert(kolabpad, " new")
+	if flushed, err := kolabpad.Flush(ctx, db, "doc"); err != nil || !flushed {
+		t.Fatalf("Flush = %v, %v; want true, nil", flushed, err)
+	}
+
+	stored, err := db.StoreIfNewer(ctx, stale, kolabpad.storedRevision(staleRevision))
+	if err != nil {
+		t.Fatalf("StoreIfNewer failed: %v", err)
+	}
+	if stored {
+		t.Error("Expected the stale flush to be skipped")
+	}
+	persisted, err := db.Load("doc")
+	if err != nil || persisted == nil {
+		t.Fatalf("Load = %+v, %v", persisted, err)
+	}
+	if persisted.Text != "old new" || persisted.Revision != 2 {
+		t.Errorf("Expected %q at revision 2, got %q at %d", "old new", persisted.Text, persisted.Revision)
+	}
+
+	// Reloaded documents restart at revision 0 but store after what's there
+	config := testConfig()
+	reloaded := FromPersistedDocument(persisted.Text, persisted.Language, persisted.OTP, &config)
+	reloaded.storedRevisionBase = persisted.Revision
+	insert(reloaded, "!")
+	if flushed, err := reloaded.Flush(ctx, db, "doc"); err != nil || !flushed {
+		t.Fatalf("Flush after reload = %v, %v; want true, nil", flushed, err)
+	}
+	if persisted, _ := db.Load("doc"); persisted == nil || persisted.Text != "old new!" || persisted.Revision <= 2 {
+		t.Errorf("Expected %q after revision 2 after reload, got %+v", "old new!", persisted)
+	}
+}
+
+// TestFlushStaleWarning tests that flushes rejected for a later stored
+// revision are reported with one warning per run, not silently, and that
+// saving again once the revision passes it is reported too.
+func TestFlushStaleWarning(t *testing.T) {
+	var buf lockedBuffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	db := newMemStore()
+	ctx := context.Background()
+	if _, err := db.StoreIfNewer(ctx, &database.PersistedDocument{ID: "doc", Text: "later"}, 3); err != nil {
+		t.Fatalf("StoreIfNewer failed: %v", err)
+	}
+
+	kolabpad := testKolabpad()
+	for revision := 0; revision < 3; revision++ {
+		if err := kolabpad.ApplyEdit(0, revision, insertAt(revision, revision, "x")); err != nil {
+			t.Fatalf("ApplyEdit failed: %v", err)
+		}
+		flushed, err := kolabpad.Flush(ctx, db, "doc")
+		if err != nil {
+			t.Fatalf("Flush failed: %v", err)
+		}
+		if want := revision == 2; flushed != want {
+			t.Errorf("Flush at revision %d = %v, want %v", revision+1, flushed, want)
+		}
+	}
+
+	out := buf.String()
+	if n := strings.Count(out, "[WARN]"); n != 1 || !strings.Contains(out, "behind a later write") {
+		t.Errorf("Expected one stale-revision warning, got %d:\n%s", n, out)
+	}
+	if !strings.Contains(out, "being saved again") {
+		t.Errorf("Expected saving again to be logged, got:\n%s", out)
+	}
+	if persisted, _ := db.Load("doc"); persisted == nil || persisted.Text != "xxx" {
+		t.Errorf("Expected the caught-up flush to be stored, got %+v", persisted)
+	}
+}
+
+// TestFlushRetriesTransientErrors tests that a flush retries a busy database
+// until the write lands, but gives up at once on other errors.
+func TestFlushRetriesTransientErrors(t *testing.T) {
+	busy := fmt.Errorf("exec: %w", sqlite3.Error{Code: sqlite3.ErrBusy})
+	db := newMemStore()
+	db.failWrites(busy, busy)
+
+	kolabpad := testKolabpad()
+	if err := kolabpad.ApplyEdit(0, 0, insertAt(0, 0, "kept")); err != nil {
+		t.Fatalf("ApplyEdit failed: %v", err)
+	}
+	stored, err := kolabpad.Flush(context.Background(), db, "retry-test")
+	if err != nil || !stored {
+		t.Fatalf("Expected flush to succeed after retries, got stored=%v, err=%v", stored, err)
+	}
+	if got := db.writeCount(); got != 3 {
+		t.Errorf("Expected 3 write attempts, got %d", got)
+	}
+	if persisted, _ := db.Load("retry-test"); persisted == nil || persisted.Text != "kept" {
+		t.Errorf("Expected the write to land, got %+v", persisted)
+	}
+
+	// A logic error isn't retried
+	db.failWrites(errors.New("constraint failed"))
+	if err := kolabpad.ApplyEdit(0, 1, insertAt(4, 4, "!")); err != nil {
+		t.Fatalf("ApplyEdit failed: %v", err)
+	}
+	if _, err := kolabpad.Flush(context.Background(), db, "retry-test"); err == nil {
+		t.Error("Expected flush to fail on a non-transient error")
+	}
+	if got := db.writeCount(); got != 4 {
+		t.Errorf("Expected 4 write attempts after a non-transient failure, got %d", got)
+	}
+}
+
+// TestKolabpadCloseFlushError tests that Close returns the flush error but still kills.
+func TestKolabpadCloseFlushError(t *testing.T) {
+	db := newMemStore()
+	db.fail(errors.New("disk full")) // Every write now fails
+
+	kolabpad := testKolabpad()
+	op := ot.NewOperationSeq()
+	op.Insert("lost")
+	if err := kolabpad.ApplyEdit(0, 0, op); err != nil {
+		t.Fatalf("ApplyEdit failed: %v", err)
+	}
+
+	if err := kolabpad.Close(context.Background(), db, "error-test"); err == nil {
+		t.Error("Expected flush error from Close")
+	}
+	if !kolabpad.Killed() {
+		t.Error("Expected document to be killed even when flush fails")
+	}
+}
+
+// TestSetLanguageAllowlist tests that only allowlisted languages are accepted.
+func TestSetLanguageAllowlist(t *testing.T) {
+	config := testConfig()
+	config.AllowedLanguages = []string{"go", "python"}
+	kolabpad := NewKolabpad(&config)
+
+	if err := kolabpad.SetLanguage("go", 0, "Alice"); err != nil {
+		t.Errorf("Expected allowlisted language to be accepted, got %v", err)
+	}
+	if err := kolabpad.SetLanguage("javascript", 0, "Alice"); !errors.Is(err, ErrUnsupportedLanguage) {
+		t.Errorf("Expected ErrUnsupportedLanguage, got %v", err)
+	}
+
+	if _, lang := kolabpad.Snapshot(); lang == nil || *lang != "go" {
+		t.Errorf("Expected language to remain 'go', got %v", lang)
+	}
+}
+
+// TestConnectionCountIncludesUnregistered tests that connections are counted
+// before they register via ClientInfo, unlike UserCount.
+func TestConnectionCountIncludesUnregistered(t *testing.T) {
+	kolabpad := testKolabpad()
+
+	alice := kolabpad.NextUserID()
+	bob := kolabpad.NextUserID()
+	kolabpad.SetUserInfo(alice, protocol.UserInfo{Name: "Alice", Hue: 10})
+
+	if got := kolabpad.ConnectionCount(); got != 2 {
+		t.Errorf("Expected 2 connections, got %d", got)
+	}
+	if got := kolabpad.UserCount(); got != 1 {
+		t.Errorf("Expected 1 registered user, got %d", got)
+	}
+
+	kolabpad.RemoveUser(bob)
+	if got := kolabpad.ConnectionCount(); got != 1 {
+		t.Errorf("Expected 1 connection after unregistered client left, got %d", got)
+	}
+
+	kolabpad.RemoveUser(alice)
+	if got := kolabpad.ConnectionCount(); got != 0 {
+		t.Errorf("Expected 0 connections, got %d", got)
+	}
+	if got := kolabpad.UserCount(); got != 0 {
+		t.Errorf("Expected 0 registered users, got %d", got)
+	}
+}
+
+// TestSystemUserNotPresent tests that the System user, which authors a loaded
+// document's history, never shows up as a present user or cursor, even if
+// something tries to register it.
+func TestSystemUserNotPresent(t *testing.T) {
+	config := testConfig()
+	lang := "go"
+	kolabpad := FromPersistedDocument("package main", &lang, nil, &config)
+	if ops := mustHistory(t, kolabpad, 0); len(ops) != 1 || ops[0].ID != protocol.SystemUserID {
+		t.Fatalf("Expected one System operation in loaded history, got %+v", ops)
+	}
+
+	alice := kolabpad.NextUserID()
+	updates := kolabpad.Subscribe(alice)
+	kolabpad.SetUserInfo(alice, protocol.UserInfo{Name: "Alice", Hue: 10})
+	<-updates // Alice's UserInfo
+	kolabpad.SetUserInfo(protocol.SystemUserID, protocol.UserInfo{Name: "System"})
+	kolabpad.SetCursorData(protocol.SystemUserID, protocol.CursorData{Cursors: []uint32{0}})
+
+	if got := kolabpad.UserCount(); got != 1 {
+		t.Errorf("Expected 1 user, got %d", got)
+	}
+	if kolabpad.HasUser(protocol.SystemUserID) {
+		t.Error("Expected the System user not to be registered")
+	}
+	_, _, _, users, cursors := kolabpad.GetInitialState(alice)
+	if _, ok := users[protocol.SystemUserID]; ok || len(users) != 1 {
+		t.Errorf("Expected only Alice in initial users, got %v", users)
+	}
+	if _, ok := cursors[protocol.SystemUserID]; ok {
+		t.Errorf("Expected no System cursor in initial state, got %v", cursors)
+	}
+
+	kolabpad.BroadcastPresence()
+	msg := <-updates
+	if msg.Presence == nil {
+		t.Fatalf("Expected Presence after ignored System updates, got %+v", msg)
+	}
+	if len(msg.Presence.Users) != 1 || msg.Presence.Users[0].ID != alice {
+		t.Errorf("Expected only Alice in presence, got %+v", msg.Presence.Users)
+	}
+}
+
+// TestCursorBeforeClientInfo tests that a cursor sent before ClientInfo is
+// held back until the user registers, then broadcast after its UserInfo.
+func TestCursorBeforeClientInfo(t *testing.T) {
+	config := testConfig()
+	kolabpad := NewKolabpad(&config)
+
+	alice := kolabpad.NextUserID()
+	updates := kolabpad.Subscribe(alice)
+	kolabpad.SetUserInfo(alice, protocol.UserInfo{Name: "Alice", Hue: 10})
+	<-updates // Alice's UserInfo
+
+	bob := kolabpad.NextUserID()
+	kolabpad.SetCursorData(bob, protocol.CursorData{Cursors: []uint32{3}})
+	select {
+	case msg := <-updates:
+		t.Fatalf("Expected no broadcast for an unregistered user's cursor, got %+v", msg)
+	default:
+	}
+	if _, _, _, _, cursors := kolabpad.GetInitialState(alice); len(cursors) != 0 {
+		t.Errorf("Expected no cursors in initial state before Bob registers, got %v", cursors)
+	}
+
+	kolabpad.SetUserInfo(bob, protocol.UserInfo{Name: "Bob", Hue: 200})
+	if msg := <-updates; msg.UserInfo == nil || msg.UserInfo.ID != bob {
+		t.Fatalf("Expected Bob's UserInfo first, got %+v", msg)
+	}
+	msg := <-updates
+	if msg.UserCursor == nil || msg.UserCursor.ID != bob || !slices.Equal(msg.UserCursor.Data.Cursors, []uint32{3}) {
+		t.Fatalf("Expected Bob's held cursor after his UserInfo, got %+v", msg)
+	}
+	if _, _, _, _, cursors := kolabpad.GetInitialState(alice); len(cursors) != 1 {
+		t.Errorf("Expected Bob's cursor in initial state once registered, got %v", cursors)
+	}
+}
+
+// TestTransformCursorData tests that cursors and selections follow an edit,
+// including selections around it and endpoints past the operation's base
+// length, which shift by the edit's net length change.
+func TestTransformCursorData(t *testing.T) {
+	// deleteRange builds an operation deleting [from, to) of a document of length docLen.
+	deleteRange := func(docLen, from, to int) *ot.OperationSeq {
+		op := ot.NewOperationSeq()
+		op.Retain(uint64(from))
+		op.Delete(uint64(to - from))
+		op.Retain(uint64(docLen - to))
+		return op
+	}
+	replace := ot.NewOperationSeq() // [1, 9) becomes "xy"
+	replace.Retain(1)
+	replace.Delete(8)
+	replace.Insert("xy")
+	replace.Retain(1)
+
+	tests := []struct {
+		name string
+		op   *ot.OperationSeq
+		sel  [2]uint32
+		want [2]uint32
+	}{
+		{"insert inside", insertAt(10, 5, "abc"), [2]uint32{2, 8}, [2]uint32{2, 11}},
+		{"insert at start", insertAt(10, 2, "abc"), [2]uint32{2, 8}, [2]uint32{5, 11}},
+		{"insert at end", insertAt(10, 8, "abc"), [2]uint32{2, 8}, [2]uint32{2, 11}},
+		{"insert after", insertAt(10, 9, "abc"), [2]uint32{2, 8}, [2]uint32{2, 8}},
+		{"delete inside", deleteRange(10, 4, 6), [2]uint32{2, 8}, [2]uint32{2, 6}},
+		{"delete over start", deleteRange(10, 0, 4), [2]uint32{2, 8}, [2]uint32{0, 4}},
+		{"delete over end", deleteRange(10, 6, 10), [2]uint32{2, 8}, [2]uint32{2, 6}},
+		{"delete around", deleteRange(10, 1, 9), [2]uint32{2, 8}, [2]uint32{1, 1}},
+		{"replace around", replace, [2]uint32{2, 8}, [2]uint32{3, 3}},
+		{"insert, end past base", insertAt(10, 5, "abc"), [2]uint32{4, 20}, [2]uint32{4, 23}},
+		{"delete, end past base", deleteRange(10, 5, 7), [2]uint32{4, 20}, [2]uint32{4, 18}},
+		{"both past base", deleteRange(10, 5, 7), [2]uint32{12, 15}, [2]uint32{10, 13}},
+		{"beyond int32", deleteRange(10, 0, 2), [2]uint32{4, math.MaxUint32 - 10}, [2]uint32{2, math.MaxUint32 - 12}},
+		{"clamped to uint32", insertAt(10, 0, "abcdefghijklmnopqrst"), [2]uint32{4, math.MaxUint32 - 10}, [2]uint32{24, math.MaxUint32}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := transformCursorData(tt.op, protocol.CursorData{
+				Cursors:    []uint32{tt.sel[0], tt.sel[1]},
+				Selections: [][2]uint32{tt.sel},
+			})
+			if got.Selections[0] != tt.want {
+				t.Errorf("Expected selection %v to become %v, got %v", tt.sel, tt.want, got.Selections[0])
+			}
+			if got.Cursors[0] != tt.want[0] || got.Cursors[1] != tt.want[1] {
+				t.Errorf("Expected cursors %v to become %v, got %v", tt.sel, tt.want, got.Cursors)
+			}
+		})
+	}
+}
+
+// coalescingKolabpad creates a document that coalesces same-user edits.
+func coalescingKolabpad() *Kolabpad {
+	config := testConfig()
+	config.CoalesceWindow = time.Minute
+	return NewKolabpad(&config)
+}
+
+// insertAt builds an operation inserting text at pos in a document of length docLen.
+func insertAt(docLen, pos int, text string) *ot.OperationSeq {
+	op := ot.NewOperationSeq()
+	op.Retain(uint64(pos))
+	op.Insert(text)
+	op.Retain(uint64(docLen - pos))
+	return op
+}
+
+// replayHistory applies operations to an empty document.
+func replayHistory(t *testing.T, ops []protocol.UserOperation) string {
+	t.Helper()
+
+	text := ""
+	for i, op := range ops {
+		var err error
+		if text, err = op.Operation.Apply(text); err != nil {
+			t.Fatalf("Failed to apply history entry %d: %v", i, err)
+		}
+	}
+	return text
+}
+
+// mustHistory returns the document's history from start, failing the test on error.
+func mustHistory(t *testing.T, kolabpad *Kolabpad, start int) []protocol.UserOperation {
+	t.Helper()
+
+	ops, err := kolabpad.GetHistory(start)
+	if err != nil {
+		t.Fatalf("GetHistory(%d) failed: %v", start, err)
+	}
+	return ops
+}
+
+// TestCoalesceSameUserEdits tests that a typing burst is merged in history
+// while revisions keep counting every edit.
+func TestCoalesceSameUserEdits(t *testing.T) {
+	kolabpad := coalescingKolabpad()
+
+	alice := kolabpad.NextUserID()
+	kolabpad.GetInitialState(alice)
+
+	// Alice types one character at a time, waiting for each acknowledgement
+	for i, ch := range "hello" {
+		if err := kolabpad.ApplyEdit(alice, i, insertAt(i, i, string(ch))); err != nil {
+			t.Fatalf("Edit %d failed: %v", i, err)
+		}
+	}
+
+	if got := kolabpad.Revision(); got != 5 {
+		t.Errorf("Expected revision 5, got %d", got)
+	}
+
+	// The latest edit stays separate until Alice moves past it
+	ops, revision, _, _, _ := kolabpad.GetInitialState(kolabpad.NextUserID())
+	if len(ops) != 2 {
+		t.Errorf("Expected 2 history entries after coalescing, got %d", len(ops))
+	}
+	if revision != 5 {
+		t.Errorf("Expected initial revision 5, got %d", revision)
+	}
+	if got := replayHistory(t, ops); got != "hello" {
+		t.Errorf("Expected coalesced history to replay to %q, got %q", "hello", got)
+	}
+}
+
+// TestCoalesceRespectsWatermarks tests that edits a connected client may still
+// transform against are not merged, and that the lagging client converges.
+func TestCoalesceRespectsWatermarks(t *testing.T) {
+	kolabpad := coalescingKolabpad()
+
+	alice := kolabpad.NextUserID()
+	bob := kolabpad.NextUserID()
+	kolabpad.GetInitialState(alice)
+	kolabpad.GetInitialState(bob) // Bob stays at revision 0
+
+	for i, ch := range "abc" {
+		if err := kolabpad.ApplyEdit(alice, i, insertAt(i, i, string(ch))); err != nil {
+			t.Fatalf("Edit %d failed: %v", i, err)
+		}
+	}
+	if got := len(mustHistory(t, kolabpad, 0)); got != 3 {
+		t.Fatalf("Expected no coalescing while Bob is at revision 0, got %d entries", got)
+	}
+
+	// Bob's concurrent edit at revision 0 transforms against each of Alice's edits
+	if err := kolabpad.ApplyEdit(bob, 0, insertAt(0, 0, "X")); err != nil {
+		t.Fatalf("Bob's edit failed: %v", err)
+	}
+	if got := kolabpad.Text(); got != "Xabc" && got != "abcX" {
+		t.Errorf("Unexpected text after concurrent edit: %q", got)
+	}
+
+	// Once Bob leaves, Alice's earlier edits can be merged
+	kolabpad.RemoveUser(bob)
+	text := kolabpad.Text()
+	if err := kolabpad.ApplyEdit(alice, 4, insertAt(4, 4, "d")); err != nil {
+		t.Fatalf("Edit failed: %v", err)
+	}
+
+	ops, revision, _, _, _ := kolabpad.GetInitialState(kolabpad.NextUserID())
+	if revision != 5 {
+		t.Errorf("Expected revision 5, got %d", revision)
+	}
+	if len(ops) >= revision {
+		t.Errorf("Expected coalesced history shorter than %d, got %d", revision, len(ops))
+	}
+	if got := replayHistory(t, ops); got != text+"d" {
+		t.Errorf("Expected history to replay to %q, got %q", text+"d", got)
+	}
+}
+
+// TestCoalesceDisabled tests that history keeps one entry per edit by default.
+func TestCoalesceDisabled(t *testing.T) {
+	kolabpad := testKolabpad()
+
+	alice := kolabpad.NextUserID()
+	kolabpad.GetInitialState(alice)
+	for i, ch := range "hello" {
+		if err := kolabpad.ApplyEdit(alice, i, insertAt(i, i, string(ch))); err != nil {
+			t.Fatalf("Edit %d failed: %v", i, err)
+		}
+	}
+
+	if got := len(mustHistory(t, kolabpad, 0)); got != 5 {
+		t.Errorf("Expected 5 history entries, got %d", got)
+	}
+}
+
+// TestNotifyWindow tests that a burst of edits within the notify window
+// wakes connections once, after the edits are applied, and that a wakeup
+// still pending when the document is killed is harmless.
+func TestNotifyWindow(t *testing.T) {
+	config := testConfig()
+	config.NotifyWindow = 20 * time.Millisecond
+	kolabpad := NewKolabpad(&config)
+	user := kolabpad.NextUserID()
+
+	notified := kolabpad.NotifyChannel()
+	for i := range 10 {
+		if err := kolabpad.ApplyEdit(user, i, insertAt(i, i, "x")); err != nil {
+			t.Fatalf("Edit %d failed: %v", i, err)
+		}
+	}
+	if got := kolabpad.Revision(); got != 10 {
+		t.Fatalf("Expected edits to apply immediately, got revision %d", got)
+	}
+	select {
+	case <-notified:
+		t.Fatal("Expected the wakeup to wait for the window")
+	default:
+	}
+
+	select {
+	case <-notified:
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the batched wakeup")
+	}
+	next := kolabpad.NotifyChannel()
+	select {
+	case <-next:
+		t.Fatal("Expected one wakeup for the whole burst")
+	case <-time.After(3 * config.NotifyWindow):
+	}
+
+	// Killing with a wakeup pending closes the channel once
+	if err := kolabpad.ApplyEdit(user, 10, insertAt(10, 10, "x")); err != nil {
+		t.Fatalf("Edit failed: %v", err)
+	}
+	kolabpad.Kill()
+	<-next
+	time.Sleep(2 * config.NotifyWindow)
+}
+
+// TestApplyEditErrors tests that each way an edit can fail returns the
+// matching error, so connections can tell rejections from divergence.
+func TestApplyEditErrors(t *testing.T) {
+	config := testConfig()
+	config.MaxDocumentSize = 8
+	kolabpad := NewKolabpad(&config)
+	user := kolabpad.NextUserID()
+	if err := kolabpad.ApplyEdit(user, 0, insertAt(0, 0, "abc")); err != nil {
+		t.Fatalf("ApplyEdit failed: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		revision int
+		op       *ot.OperationSeq
+		want     error
+	}{
+		{"future revision", 2, insertAt(3, 0, "x"), ErrInvalidRevision},
+		{"base length against text", 1, insertAt(5, 0, "x"), ErrBaseLenMismatch},
+		{"base length against history", 0, insertAt(2, 0, "x"), ErrBaseLenMismatch},
+		{"invalid UTF-8", 1, insertAt(3, 0, "\xff"), ErrInvalidOperation},
+		{"too large", 1, insertAt(3, 3, "xxxxxx"), ErrDocumentTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := kolabpad.ApplyEdit(user, tt.revision, tt.op)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, err)
+			}
+			if tt.want != ErrBaseLenMismatch && errors.Is(err, ErrBaseLenMismatch) {
+				t.Errorf("Expected only length mismatches to be ErrBaseLenMismatch, got %v", err)
+			}
+		})
+	}
+
+	kolabpad.Drain()
+	if err := kolabpad.ApplyEdit(user, 1, insertAt(3, 0, "x")); !errors.Is(err, ErrDraining) {
+		t.Errorf("Expected ErrDraining, got %v", err)
+	}
+	kolabpad.Kill()
+	if err := kolabpad.ApplyEdit(user, 1, insertAt(3, 0, "x")); !errors.Is(err, ErrKilled) {
+		t.Errorf("Expected ErrKilled, got %v", err)
+	}
+}
+
+// TestActivityDebounce tests that the persister is held off for the debounce
+// window after a critical write and not otherwise.
+func TestActivityDebounce(t *testing.T) {
+	var a activity
+	now := time.Now()
+	window := 2 * time.Second
+
+	if _, ok := a.debouncing(now, window); ok {
+		t.Error("Expected no debounce before any critical write")
+	}
+	a.edited(now)
+	if _, ok := a.debouncing(now, window); ok {
+		t.Error("Expected an edit not to debounce")
+	}
+
+	a.criticalWrite(now)
+	if since, ok := a.debouncing(now.Add(1500*time.Millisecond), window); !ok || since != 1500*time.Millisecond {
+		t.Errorf("Expected debounce 1.5s after a critical write, got %v, %v", since, ok)
+	}
+	if _, ok := a.debouncing(now.Add(window), window); ok {
+		t.Error("Expected the debounce to end with the window")
+	}
+	if _, ok := a.debouncing(now, 0); ok {
+		t.Error("Expected a zero window never to debounce")
+	}
+}
+
+// TestActivityTracking tests which document changes count as edits and
+// critical writes: cursors and user info don't reset the idle timer, and OTP
+// changes debounce without counting as edits.
+func TestActivityTracking(t *testing.T) {
+	kolabpad := testKolabpad()
+	user := kolabpad.NextUserID()
+	if !kolabpad.LastEditTime().IsZero() {
+		t.Fatalf("Expected no last edit time, got %v", kolabpad.LastEditTime())
+	}
+
+	kolabpad.SetUserInfo(user, protocol.UserInfo{Name: "Alice", Hue: 10})
+	kolabpad.SetCursorData(user, protocol.CursorData{Cursors: []uint32{0}})
+	otp := "secret"
+	kolabpad.SetOTP(&otp, user, "Alice")
+	if !kolabpad.LastEditTime().IsZero() {
+		t.Errorf("Expected user info, cursors and OTP not to count as edits, got %v", kolabpad.LastEditTime())
+	}
+	if _, ok := kolabpad.activity.debouncing(time.Now(), time.Minute); !ok {
+		t.Error("Expected SetOTP to debounce the persister")
+	}
+
+	before := time.Now()
+	if err := kolabpad.ApplyEdit(user, 0, insertAt(0, 0, "hi")); err != nil {
+		t.Fatalf("Edit failed: %v", err)
+	}
+	if last := kolabpad.LastEditTime(); last.Before(before) {
+		t.Errorf("Expected the edit to update the last edit time, got %v", last)
+	}
+	if kolabpad.activity.lastEditUnix() != kolabpad.LastEditTime().Unix() {
+		t.Errorf("Expected Unix last edit %d, got %d", kolabpad.LastEditTime().Unix(), kolabpad.activity.lastEditUnix())
+	}
+}
+
+// benchText returns about size bytes of prose with some multibyte
+// characters, like a real document.
+func benchText(size int) string {
+	const line = "lorem ipsum dolor sit amet, café 世界\n"
+	return strings.Repeat(line, max(size/len(line), 1))
+}
+
+// BenchmarkApplyEdit measures applying an edit in the middle of documents of
+// various sizes from a client lagging behind by a number of revisions, so
+// the edit is transformed against that much history first.
+func BenchmarkApplyEdit(b *testing.B) {
+	for _, size := range []int{1 << 10, 64 << 10, 256 << 10} {
+		for _, lag := range []int{0, 16, 256} {
+			b.Run(fmt.Sprintf("size=%dKB/lag=%d", size>>10, lag), func(b *testing.B) {
+				config := testConfig()
+				config.MaxDocumentSize = 64 << 20
+				kolabpad := FromPersistedDocument(benchText(size), nil, nil, &config)
+				user := kolabpad.NextUserID()
+
+				// Every edit inserts one character
+				start, length := kolabpad.Revision(), utf8.RuneCountInString(kolabpad.Text())
+				lengthAt := func(rev int) int { return length + rev - start }
+				edit := func(rev int) {
+					if err := kolabpad.ApplyEdit(user, rev, insertAt(lengthAt(rev), lengthAt(rev)/2, "x")); err != nil {
+						b.Fatal(err)
+					}
+				}
+				for range lag {
+					edit(kolabpad.Revision())
+				}
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for range b.N {
+					edit(kolabpad.Revision() - lag)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkApplyEditCursors measures applying an edit to a 64KB document
+// while a number of connected users each hold 8 cursors and 8 selections,
+// all of which every edit shifts.
+func BenchmarkApplyEditCursors(b *testing.B) {
+	for _, users := range []int{1, 16, 128} {
+		b.Run(fmt.Sprintf("users=%d", users), func(b *testing.B) {
+			config := testConfig()
+			config.MaxDocumentSize = 64 << 20
+			kolabpad := FromPersistedDocument(benchText(64<<10), nil, nil, &config)
+			length := utf8.RuneCountInString(kolabpad.Text())
+			for range users {
+				id := kolabpad.NextUserID()
+				kolabpad.SetUserInfo(id, protocol.UserInfo{Name: "User"})
+				var data protocol.CursorData
+				for i := range 8 {
+					pos := uint32(length * (i + 1) / 9)
+					data.Cursors = append(data.Cursors, pos)
+					data.Selections = append(data.Selections, [2]uint32{pos, pos + 5})
+				}
+				kolabpad.SetCursorData(id, data)
+			}
+			user := kolabpad.NextUserID()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				if err := kolabpad.ApplyEdit(user, kolabpad.Revision(), insertAt(length, 0, "é")); err != nil {
+					b.Fatal(err)
+				}
+				length++
+			}
+		})
+	}
+}
+
+// BenchmarkTransformCursorData measures shifting 64 cursors and 64
+// selections through an edit.
+func BenchmarkTransformCursorData(b *testing.B) {
+	var data protocol.CursorData
+	for i := range 64 {
+		data.Cursors = append(data.Cursors, uint32(i*100))
+		data.Selections = append(data.Selections, [2]uint32{uint32(i * 100), uint32(i*100 + 50)})
+	}
+	op := insertAt(10000, 3200, "inserted café")
+
+	b.ReportAllocs()
+	for range b.N {
+		transformCursorData(op, data)
+	}
+}
+
+// BenchmarkNotifyBurst measures connection wakeups while 64 connections
+// follow bursts of 100 closely spaced edits, with and without a notify window.
+func BenchmarkNotifyBurst(b *testing.B) {
+	const connections, burst = 64, 100
+
+	for _, window := range []time.Duration{0, 10 * time.Millisecond} {
+		b.Run(fmt.Sprintf("window=%v", window), func(b *testing.B) {
+			config := testConfig()
+			config.NotifyWindow = window
+			kolabpad := NewKolabpad(&config)
+			user := kolabpad.NextUserID()
+
+			// Each follower wakes on notify and catches up like a connection
+			var wakeups atomic.Int64
+			var caughtUp sync.WaitGroup
+			target := make(chan int)
+			for range connections {
+				go func() {
+					revision := 0
+					for want := range target {
+						for revision < want {
+							notified := kolabpad.NotifyChannel()
+							if current := kolabpad.Revision(); current > revision {
+								if _, err := kolabpad.GetHistory(revision); err != nil {
+									panic(err)
+								}
+								revision = current
+								continue
+							}
+							<-notified
+							wakeups.Add(1)
+						}
+						caughtUp.Done()
+					}
+				}()
+			}
+			defer close(target)
+
+			b.ResetTimer()
+			revision := 0
+			for range b.N {
+				caughtUp.Add(connections)
+				for range connections {
+					target <- revision + burst
+				}
+				for range burst {
+					// Alternate typing and deleting a character so the text stays small
+					op := insertAt(0, 0, "x")
+					if revision%2 == 1 {
+						op = ot.NewOperationSeq()
+						op.Delete(1)
+					}
+					if err := kolabpad.ApplyEdit(user, revision, op); err != nil {
+						b.Fatal(err)
+					}
+					revision++
+					time.Sleep(50 * time.Microsecond) // Typing speed, give or take
+				}
+				caughtUp.Wait()
+			}
+			b.ReportMetric(float64(wakeups.Load())/float64(b.N), "wakeups/op")
+		})
+	}
+}
+
+// TestResumeUserID tests that a reconnect token keeps its user ID across
+// connections and that the previous holder is kicked first.
+func TestResumeUserID(t *testing.T) {
+	kolabpad := testKolabpad()
+	token := "0123456789abcdef"
+
+	// Kicking the first holder simulates its connection cleaning up
+	kicked := make(chan struct{})
+	var first uint64
+	first = kolabpad.ResumeUserID(token, func() {
+		close(kicked)
+		go kolabpad.RemoveUser(first)
+	})
+
+	other := kolabpad.ResumeUserID("fedcba9876543210", func() {})
+	if first == other {
+		t.Fatalf("Expected distinct IDs for distinct tokens, both got %d", first)
+	}
+
+	second := kolabpad.ResumeUserID(token, func() {})
+	select {
+	case <-kicked:
+	default:
+		t.Error("Expected previous holder to be kicked")
+	}
+	if second != first {
+		t.Errorf("Expected reused ID %d, got %d", first, second)
+	}
+	if got := kolabpad.ConnectionCount(); got != 2 {
+		t.Errorf("Expected 2 live connections, got %d", got)
+	}
+}
+
+// TestResumeUserIDRestoresCursor tests that a session's cursor is kept while
+// it's disconnected, follows edits made meanwhile, and is restored on resume.
+func TestResumeUserIDRestoresCursor(t *testing.T) {
+	kolabpad := testKolabpad()
+	token := "0123456789abcdef"
+
+	bob := kolabpad.NextUserID()
+	kolabpad.GetInitialState(bob)
+	if err := kolabpad.ApplyEdit(bob, 0, insertAt(0, 0, "hello")); err != nil {
+		t.Fatalf("ApplyEdit failed: %v", err)
+	}
+
+	alice := kolabpad.ResumeUserID(token, func() {})
+	kolabpad.SetCursorData(alice, protocol.CursorData{Cursors: []uint32{5}, Selections: [][2]uint32{{0, 5}}})
+	kolabpad.RemoveUser(alice)
+
+	// Edit while Alice is away; her parked cursor must shift with it
+	if err := kolabpad.ApplyEdit(bob, 1, insertAt(5, 0, ">> ")); err != nil {
+		t.Fatalf("ApplyEdit failed: %v", err)
+	}
+
+	_, _, _, _, cursors := kolabpad.GetInitialState(bob)
+	if _, ok := cursors[alice]; ok {
+		t.Error("Expected disconnected user's cursor to be hidden")
+	}
+
+	if got := kolabpad.ResumeUserID(token, func() {}); got != alice {
+		t.Fatalf("Expected reused ID %d, got %d", alice, got)
+	}
+	kolabpad.SetUserInfo(alice, protocol.UserInfo{Name: "Alice"}) // Clients resend ClientInfo on reconnect
+	_, _, _, _, cursors = kolabpad.GetInitialState(alice)
+	got, ok := cursors[alice]
+	if !ok {
+		t.Fatal("Expected cursor to be restored on resume")
+	}
+	if got.Cursors[0] != 8 || got.Selections[0] != [2]uint32{3, 8} {
+		t.Errorf("Expected cursor 8 and selection [3,8], got %+v", got)
+	}
+}
+
+// TestApplyEditDoesNotAliasOperation tests that history is unaffected when the
+// caller later mutates the operation it submitted.
+func TestApplyEditDoesNotAliasOperation(t *testing.T) {
+	kolabpad := testKolabpad()
+	user := kolabpad.NextUserID()
+
+	op := insertAt(0, 0, "hello")
+	if err := kolabpad.ApplyEdit(user, 0, op); err != nil {
+		t.Fatalf("ApplyEdit failed: %v", err)
+	}
+	op.Insert(" world")
+
+	if got := replayHistory(t, mustHistory(t, kolabpad, 0)); got != "hello" {
+		t.Errorf("Expected history to replay to %q, got %q", "hello", got)
+	}
+}
+
+// TestApplyEditTrace tests that edits are logged in full only at trace level.
+func TestApplyEditTrace(t *testing.T) {
+	var buf lockedBuffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		logger.SetLevel(logger.LevelInfo)
+	})
+
+	kolabpad := testKolabpad()
+	user := kolabpad.NextUserID()
+
+	logger.SetLevel(logger.LevelDebug)
+	if err := kolabpad.ApplyEdit(user, 0, insertAt(0, 0, "hello")); err != nil {
+		t.Fatalf("ApplyEdit failed: %v", err)
+	}
+	if strings.Contains(buf.String(), "[TRACE]") {
+		t.Fatalf("Expected no trace output at debug level, got:\n%s", buf.String())
+	}
+
+	logger.SetLevel(logger.LevelTrace)
+	if err := kolabpad.ApplyEdit(user, 1, insertAt(5, 5, " world")); err != nil {
+		t.Fatalf("ApplyEdit failed: %v", err)
+	}
+	out := buf.String()
+	for _, want := range []string{"[TRACE] ApplyEdit", `op=[5," world"]`, "docLen=5 -> 11"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected trace output to contain %q, got:\n%s", want, out)
+		}
+	}
+}
+
+// TestApplyEditHistoryStable tests that stored history entries don't change
+// as later stale edits are transformed through the pooled buffers.
+func TestApplyEditHistoryStable(t *testing.T) {
+	kolabpad := testKolabpad()
+	alice := kolabpad.NextUserID()
+	bob := kolabpad.NextUserID()
+	kolabpad.GetInitialState(alice)
+	kolabpad.GetInitialState(bob)
+
+	for i := 0; i < 3; i++ {
+		if err := kolabpad.ApplyEdit(alice, i, insertAt(i, i, "a")); err != nil {
+			t.Fatalf("Edit %d failed: %v", i, err)
+		}
+	}
+	if err := kolabpad.ApplyEdit(bob, 0, insertAt(0, 0, "b")); err != nil {
+		t.Fatalf("Stale edit failed: %v", err)
+	}
+
+	var before []string
+	for _, op := range mustHistory(t, kolabpad, 0) {
+		before = append(before, op.Operation.String())
+	}
+
+	// More stale edits reuse the transform buffers
+	for i := 0; i < 5; i++ {
+		if err := kolabpad.ApplyEdit(bob, 0, insertAt(0, 0, "c")); err != nil {
+			t.Fatalf("Stale edit %d failed: %v", i, err)
+		}
+	}
+
+	history := mustHistory(t, kolabpad, 0)
+	for i, want := range before {
+		if got := history[i].Operation.String(); got != want {
+			t.Errorf("History entry %d changed from %s to %s", i, want, got)
+		}
+	}
+	if got := replayHistory(t, history); got != kolabpad.Text() {
+		t.Errorf("History replays to %q, document is %q", got, kolabpad.Text())
+	}
+}
+
+// cappedKolabpad creates a document that keeps at most maxOps history entries.
+func cappedKolabpad(maxOps int) *Kolabpad {
+	config := testConfig()
+	config.MaxHistoryOps = maxOps
+	return NewKolabpad(&config)
+}
+
+// TestTrimHistoryLateJoiner tests that history stays within the cap and that
+// a client joining afterwards converges and can edit.
+func TestTrimHistoryLateJoiner(t *testing.T) {
+	kolabpad := cappedKolabpad(5)
+
+	alice := kolabpad.NextUserID()
+	kolabpad.GetInitialState(alice)
+	for i := 0; i < 20; i++ {
+		if err := kolabpad.ApplyEdit(alice, i, insertAt(i, i, "a")); err != nil {
+			t.Fatalf("Edit %d failed: %v", i, err)
+		}
+		if got := len(mustHistory(t, kolabpad, i+1)); got != 0 {
+			t.Fatalf("Expected no history past revision %d, got %d entries", i+1, got)
+		}
+	}
+
+	bob := kolabpad.NextUserID()
+	ops, revision, _, _, _ := kolabpad.GetInitialState(bob)
+	if len(ops) > 5 {
+		t.Errorf("Expected at most 5 history entries, got %d", len(ops))
+	}
+	if revision != 20 {
+		t.Errorf("Expected revision 20, got %d", revision)
+	}
+	if ops[0].ID != protocol.SystemUserID {
+		t.Errorf("Expected history to start with a system snapshot, got user %d", ops[0].ID)
+	}
+	text := replayHistory(t, ops)
+	if text != kolabpad.Text() {
+		t.Fatalf("Expected history to replay to %q, got %q", kolabpad.Text(), text)
+	}
+
+	// Bob edits against the revision his history brought him to
+	if err := kolabpad.ApplyEdit(bob, revision, insertAt(20, 0, "b")); err != nil {
+		t.Fatalf("Late joiner's edit failed: %v", err)
+	}
+	if got := kolabpad.Text(); got != "b"+text {
+		t.Errorf("Expected %q, got %q", "b"+text, got)
+	}
+}
+
+// TestTrimHistoryStaleRevision tests that revisions folded into the snapshot
+// are rejected with ErrHistoryTrimmed rather than silently misapplied.
+func TestTrimHistoryStaleRevision(t *testing.T) {
+	kolabpad := cappedKolabpad(3)
+
+	alice := kolabpad.NextUserID()
+	bob := kolabpad.NextUserID()
+	kolabpad.GetInitialState(alice)
+	kolabpad.GetInitialState(bob) // Bob stays at revision 0
+
+	for i := 0; i < 5; i++ {
+		if err := kolabpad.ApplyEdit(alice, i, insertAt(i, i, "a")); err != nil {
+			t.Fatalf("Edit %d failed: %v", i, err)
+		}
+	}
+
+	if err := kolabpad.ApplyEdit(bob, 0, insertAt(0, 0, "b")); !errors.Is(err, ErrHistoryTrimmed) {
+		t.Errorf("Expected ErrHistoryTrimmed for stale edit, got %v", err)
+	}
+	if _, err := kolabpad.GetHistory(0); !errors.Is(err, ErrHistoryTrimmed) {
+		t.Errorf("Expected ErrHistoryTrimmed for stale history, got %v", err)
+	}
+	if got := kolabpad.Text(); got != "aaaaa" {
+		t.Errorf("Expected stale edit to be rejected, got %q", got)
+	}
+}
+
+// TestReplaceAll tests that a server-side replacement is recorded in history
+// like any edit, so replaying history converges on the new text.
+func TestReplaceAll(t *testing.T) {
+	kolabpad := testKolabpad()
+	alice := kolabpad.NextUserID()
+	kolabpad.GetInitialState(alice)
+	kolabpad.SetUserInfo(alice, protocol.UserInfo{Name: "Alice"}) // Cursors of unregistered users aren't shared
+
+	if err := kolabpad.ApplyEdit(alice, 0, insertAt(0, 0, "hello world")); err != nil {
+		t.Fatalf("ApplyEdit failed: %v", err)
+	}
+	kolabpad.SetCursorData(alice, protocol.CursorData{Cursors: []uint32{11}, Selections: [][2]uint32{{0, 5}}})
+
+	if err := kolabpad.ReplaceAll("héllo 世界", protocol.SystemUserID); err != nil {
+		t.Fatalf("ReplaceAll failed: %v", err)
+	}
+
+	if got := kolabpad.Text(); got != "héllo 世界" {
+		t.Errorf("Expected replaced text, got %q", got)
+	}
+	if got := replayHistory(t, mustHistory(t, kolabpad, 0)); got != kolabpad.Text() {
+		t.Errorf("History replays to %q, document is %q", got, kolabpad.Text())
+	}
+	if rev := kolabpad.Revision(); rev != 2 {
+		t.Errorf("Expected revision 2, got %d", rev)
+	}
+
+	// Only the changed regions are rewritten, so cursors keep their place
+	_, _, _, _, cursors := kolabpad.GetInitialState(alice)
+	if got := cursors[alice]; got.Cursors[0] != 8 || got.Selections[0] != [2]uint32{0, 5} {
+		t.Errorf("Expected cursor at 8 and selection [0,5], got %+v", got)
+	}
+
+	// Replacing with identical text records nothing
+	if err := kolabpad.ReplaceAll("héllo 世界", protocol.SystemUserID); err != nil {
+		t.Fatalf("ReplaceAll failed: %v", err)
+	}
+	if rev := kolabpad.Revision(); rev != 2 {
+		t.Errorf("Expected no-op replacement to keep revision 2, got %d", rev)
+	}
+}
+
+// TestApplyServerOperation tests that a server operation is recorded as a
+// System edit, enforces the size limit, and must fit the current text.
+func TestApplyServerOperation(t *testing.T) {
+	config := testConfig()
+	config.MaxDocumentSize = 8
+	kolabpad := NewKolabpad(&config)
+
+	if err := kolabpad.ApplyServerOperation(insertAt(0, 0, "hello")); err != nil {
+		t.Fatalf("ApplyServerOperation failed: %v", err)
+	}
+	history := mustHistory(t, kolabpad, 0)
+	if got := kolabpad.Text(); got != "hello" || len(history) != 1 || history[0].ID != protocol.SystemUserID {
+		t.Errorf("Expected a System edit inserting %q, got text %q and history %+v", "hello", got, history)
+	}
+
+	if err := kolabpad.ApplyServerOperation(insertAt(5, 5, " world")); !errors.Is(err, ErrDocumentTooLarge) {
+		t.Errorf("Expected the size limit to apply, got %v", err)
+	}
+	if err := kolabpad.ApplyServerOperation(insertAt(3, 0, "x")); !errors.Is(err, ErrInvalidOperation) {
+		t.Errorf("Expected an op for other text to be rejected, got %v", err)
+	}
+	if got := kolabpad.Text(); got != "hello" || kolabpad.Revision() != 1 {
+		t.Errorf("Expected rejected ops to change nothing, got %q at revision %d", got, kolabpad.Revision())
+	}
+}
+
+// TestReplaceAllConcurrentEdit tests that an edit based on a revision before
+// the replacement is transformed against it rather than rejected.
+func TestReplaceAllConcurrentEdit(t *testing.T) {
+	kolabpad := testKolabpad()
+	alice := kolabpad.NextUserID()
+	kolabpad.GetInitialState(alice)
+
+	if err := kolabpad.ApplyEdit(alice, 0, insertAt(0, 0, "draft")); err != nil {
+		t.Fatalf("ApplyEdit failed: %v", err)
+	}
+	if err := kolabpad.ReplaceAll("final", protocol.SystemUserID); err != nil {
+		t.Fatalf("ReplaceAll failed: %v", err)
+	}
+
+	// Alice hasn't seen the replacement yet
+	if err := kolabpad.ApplyEdit(alice, 1, insertAt(5, 5, "!")); err != nil {
+		t.Fatalf("Concurrent edit failed: %v", err)
+	}
+
+	if got := replayHistory(t, mustHistory(t, kolabpad, 0)); got != kolabpad.Text() {
+		t.Errorf("History replays to %q, document is %q", got, kolabpad.Text())
+	}
+	if got := kolabpad.Text(); got != "final!" {
+		t.Errorf("Expected %q, got %q", "final!", got)
+	}
+}
+
+// TestReplaceAllSizeLimit tests that replacements obey MaxDocumentSize.
+func TestReplaceAllSizeLimit(t *testing.T) {
+	config := testConfig()
+	config.MaxDocumentSize = 4
+	kolabpad := NewKolabpad(&config)
+
+	if err := kolabpad.ReplaceAll("too long", protocol.SystemUserID); err == nil {
+		t.Error("Expected oversized replacement to fail")
+	}
+	if got := kolabpad.Text(); got != "" || kolabpad.Revision() != 0 {
+		t.Errorf("Expected failed replacement to leave document untouched, got %q at %d", got, kolabpad.Revision())
+	}
+}
+
+// TestTransformMetrics tests that edits record how far behind they were.
+func TestTransformMetrics(t *testing.T) {
+	kolabpad := testKolabpad()
+	alice := kolabpad.NextUserID()
+	bob := kolabpad.NextUserID()
+	kolabpad.GetInitialState(alice)
+	kolabpad.GetInitialState(bob) // Bob stays at revision 0
+
+	for i := 0; i < 5; i++ {
+		if err := kolabpad.ApplyEdit(alice, i, insertAt(i, i, "a")); err != nil {
+			t.Fatalf("Edit %d failed: %v", i, err)
+		}
+	}
+	if err := kolabpad.ApplyEdit(bob, 0, insertAt(0, 0, "b")); err != nil {
+		t.Fatalf("Stale edit failed: %v", err)
+	}
+
+	stats := kolabpad.metrics.snapshot()
+	if stats.Edits != 6 || stats.Transforms != 5 || stats.Max != 5 {
+		t.Errorf("Expected 6 edits, 5 transforms, max 5; got %+v", stats)
+	}
+
+	counts := make(map[string]uint64)
+	for _, b := range stats.Histogram {
+		counts[b.LE] = b.Count
+	}
+	if counts["0"] != 5 || counts["16"] != 1 {
+		t.Errorf("Expected 5 edits in bucket 0 and 1 in bucket 16, got %+v", stats.Histogram)
+	}
+	if last := stats.Histogram[len(stats.Histogram)-1]; last.LE != "+Inf" {
+		t.Errorf("Expected final bucket +Inf, got %q", last.LE)
+	}
+}
+
+// TestSizeLimitCountsBytes tests that MaxDocumentSize is enforced on the UTF-8
+// size of the text, not its character count.
+func TestSizeLimitCountsBytes(t *testing.T) {
+	config := testConfig()
+	config.MaxDocumentSize = 16
+	kolabpad := NewKolabpad(&config)
+	user := kolabpad.NextUserID()
+
+	// Four 4-byte emoji fill the limit exactly
+	if err := kolabpad.ApplyEdit(user, 0, insertAt(0, 0, "😀😀😀😀")); err != nil {
+		t.Fatalf("Edit at the limit failed: %v", err)
+	}
+	if got := kolabpad.SizeBytes(); got != 16 {
+		t.Errorf("Expected 16 bytes, got %d", got)
+	}
+
+	// Five characters is well under 16, but one more byte is over
+	if err := kolabpad.ApplyEdit(user, 1, insertAt(4, 4, "a")); err == nil {
+		t.Error("Expected edit past the byte limit to fail")
+	}
+	if err := kolabpad.ReplaceAll("ééééééééé", user); err == nil {
+		t.Error("Expected 18-byte replacement to fail")
+	}
+	if got := kolabpad.Text(); got != "😀😀😀😀" {
+		t.Errorf("Expected rejected edits to leave the text alone, got %q", got)
+	}
+
+	// Swapping emoji for the same number of bytes of ASCII still fits
+	if err := kolabpad.ReplaceAll("0123456789abcdef", user); err != nil {
+		t.Errorf("Expected 16-byte replacement to fit: %v", err)
+	}
+}
+
+// TestMaxSizeOverride tests that a per-document size limit replaces
+// MaxDocumentSize in either direction until cleared.
+func TestMaxSizeOverride(t *testing.T) {
+	config := testConfig()
+	config.MaxDocumentSize = 8
+	kolabpad := NewKolabpad(&config)
+	user := kolabpad.NextUserID()
+
+	raised := 16
+	kolabpad.SetMaxSize(&raised)
+	if err := kolabpad.ReplaceAll("0123456789abcdef", user); err != nil {
+		t.Fatalf("Expected 16 bytes to fit the raised limit: %v", err)
+	}
+
+	lowered := 4
+	kolabpad.SetMaxSize(&lowered)
+	if err := kolabpad.ReplaceAll("01234", user); !errors.Is(err, ErrDocumentTooLarge) {
+		t.Errorf("Expected 5 bytes to exceed the lowered limit, got %v", err)
+	}
+	if err := kolabpad.ReplaceAll("0123", user); err != nil {
+		t.Errorf("Expected 4 bytes to fit the lowered limit: %v", err)
+	}
+
+	kolabpad.SetMaxSize(nil)
+	if err := kolabpad.ReplaceAll("012345678", user); !errors.Is(err, ErrDocumentTooLarge) {
+		t.Errorf("Expected the server limit to apply again, got %v", err)
+	}
+	if err := kolabpad.ReplaceAll("01234567", user); err != nil {
+		t.Errorf("Expected 8 bytes to fit the server limit: %v", err)
+	}
+}
+
+// TestMultibyteEdits tests that edits are counted in characters, that ones
+// counted in bytes are rejected without touching the text, and that loaded
+// text with stray bytes is repaired so it can still be edited.
+func TestMultibyteEdits(t *testing.T) {
+	kolabpad := FromPersistedDocument("héllo 世界", nil, nil, &Config{MaxDocumentSize: 1024})
+	user := kolabpad.NextUserID()
+
+	// "héllo 世界" is 8 characters and 13 bytes
+	if err := kolabpad.ApplyEdit(user, 1, insertAt(8, 8, "!")); err != nil {
+		t.Fatalf("Character-counted edit failed: %v", err)
+	}
+	if err := kolabpad.ApplyEdit(user, 2, insertAt(13, 13, "?")); !errors.Is(err, ErrInvalidOperation) {
+		t.Errorf("Expected byte-counted edit to be invalid, got %v", err)
+	}
+	if got := kolabpad.Text(); got != "héllo 世界!" {
+		t.Errorf("Expected %q, got %q", "héllo 世界!", got)
+	}
+
+	// The text was cut in the middle of "é"
+	broken := FromPersistedDocument("h\xc3llo", nil, nil, &Config{MaxDocumentSize: 1024})
+	if got := broken.Text(); got != "h\uFFFDllo" {
+		t.Fatalf("Expected the stray byte to be replaced, got %q", got)
+	}
+	if err := broken.ApplyEdit(broken.NextUserID(), 1, insertAt(5, 5, "!")); err != nil {
+		t.Errorf("Expected repaired text to accept edits: %v", err)
+	}
+}
+
+// TestLineLimits tests that edits leaving too many lines, or a line with too
+// many characters, are rejected and leave the text alone.
+func TestLineLimits(t *testing.T) {
+	config := testConfig()
+	config.MaxLines = 3
+	config.MaxLineLength = 8
+	kolabpad := NewKolabpad(&config)
+	user := kolabpad.NextUserID()
+
+	// Three lines of eight characters fill both limits exactly
+	if err := kolabpad.ApplyEdit(user, 0, insertAt(0, 0, "ééééé世界!\nabcdefgh\n12345678")); err != nil {
+		t.Fatalf("Edit at the limits failed: %v", err)
+	}
+	text := kolabpad.Text()
+
+	cases := []struct {
+		name string
+		op   *ot.OperationSeq
+	}{
+		{name: "single giant line", op: insertAt(26, 12, strings.Repeat("x", 100000))},
+		{name: "one character too long", op: insertAt(26, 0, "é")},
+		{name: "too many lines", op: insertAt(26, 26, "\n")},
+		{name: "many short lines", op: insertAt(26, 9, strings.Repeat("a\n", 100000))},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := kolabpad.ApplyEdit(user, 1, tc.op)
+			if !errors.Is(err, ErrLineLimit) {
+				t.Errorf("Expected ErrLineLimit, got %v", err)
+			}
+			if got := kolabpad.Text(); got != text {
+				t.Errorf("Expected rejected edit to leave the text alone, got %q", got)
+			}
+		})
+	}
+
+	// Deleting a line makes room for another
+	swap := ot.NewOperationSeq()
+	swap.Retain(9)
+	swap.Delete(9)
+	swap.Retain(8)
+	swap.Insert("\nz")
+	if err := kolabpad.ApplyEdit(user, 1, swap); err != nil {
+		t.Errorf("Expected an edit within the limits to apply: %v", err)
+	}
+	if got := kolabpad.Text(); got != "ééééé世界!\n12345678\nz" {
+		t.Errorf("Unexpected text %q", got)
+	}
+}
+
+// TestDedupUserNames tests that colliding display names get distinct suffixes
+// that are freed again when their user leaves.
+func TestDedupUserNames(t *testing.T) {
+	config := testConfig()
+	config.DedupUserNames = true
+	kolabpad := NewKolabpad(&config)
+
+	names := func() map[uint64]string {
+		_, _, _, users, _ := kolabpad.GetInitialState(kolabpad.NextUserID())
+		got := make(map[uint64]string)
+		for id, info := range users {
+			got[id] = info.Name
+		}
+		return got
+	}
+
+	a, b, c := kolabpad.NextUserID(), kolabpad.NextUserID(), kolabpad.NextUserID()
+	kolabpad.SetUserInfo(a, protocol.UserInfo{Name: "Anonymous"})
+	kolabpad.SetUserInfo(b, protocol.UserInfo{Name: "Anonymous"})
+	kolabpad.SetUserInfo(c, protocol.UserInfo{Name: "Anonymous"})
+
+	got := names()
+	if got[a] != "Anonymous" || got[b] != "Anonymous (2)" || got[c] != "Anonymous (3)" {
+		t.Errorf("Expected suffixed names, got %v", got)
+	}
+
+	// Re-sending the same info (e.g. a hue change) keeps the assigned name
+	kolabpad.SetUserInfo(b, protocol.UserInfo{Name: "Anonymous", Hue: 50})
+	if got := names()[b]; got != "Anonymous (2)" {
+		t.Errorf("Expected stable name, got %q", got)
+	}
+
+	// A departed user's name can be reused
+	kolabpad.RemoveUser(b)
+	d := kolabpad.NextUserID()
+	kolabpad.SetUserInfo(d, protocol.UserInfo{Name: "Anonymous"})
+	if got := names()[d]; got != "Anonymous (2)" {
+		t.Errorf("Expected freed suffix to be reused, got %q", got)
+	}
+}
+
+// TestHuePalette tests that with a palette, users get its hues round-robin
+// whatever hue they ask for, and keep them when they re-send ClientInfo.
+func TestHuePalette(t *testing.T) {
+	config := testConfig()
+	config.HuePalette = []uint32{0, 120, 240}
+	kolabpad := NewKolabpad(&config)
+
+	observer := kolabpad.NextUserID()
+	updates := kolabpad.Subscribe(observer)
+	var users []uint64
+	for i := range 4 {
+		user := kolabpad.NextUserID()
+		users = append(users, user)
+		kolabpad.SetUserInfo(user, protocol.UserInfo{Name: fmt.Sprintf("User %d", i), Hue: 77})
+		msg := <-updates
+		if want := config.HuePalette[i%3]; msg.UserInfo == nil || msg.UserInfo.Info == nil || msg.UserInfo.Info.Hue != want {
+			t.Fatalf("Expected user %d to be broadcast with hue %d, got %+v", i, want, msg)
+		}
+	}
+
+	kolabpad.SetUserInfo(users[1], protocol.UserInfo{Name: "Renamed", Hue: 300})
+	_, _, _, registered, _ := kolabpad.GetInitialState(kolabpad.NextUserID())
+	if info := registered[users[1]]; info.Name != "Renamed" || info.Hue != 120 {
+		t.Errorf("Expected the renamed user to keep hue 120, got %+v", info)
+	}
+}
+
+// TestMaxRemoteCursors tests that with many users moving their cursors, each
+// client holds at most MaxRemoteCursors remote cursors, the most recently
+// moved ones, including a client that joined holding some, and that a
+// departing user's slot goes to the next one.
+func TestMaxRemoteCursors(t *testing.T) {
+	config := testConfig()
+	config.MaxRemoteCursors = 2
+	kolabpad := NewKolabpad(&config)
+
+	// held tracks the remote cursors each client holds, as a client would.
+	// Clients join like Connection.Handle: initial state, then subscribe.
+	updates := make(map[uint64]<-chan *protocol.ServerMsg)
+	held := make(map[uint64]map[uint64]bool)
+	join := func() uint64 {
+		user := kolabpad.NextUserID()
+		_, _, _, _, cursors := kolabpad.GetInitialState(user)
+		held[user] = make(map[uint64]bool)
+		for id := range cursors {
+			held[user][id] = true
+		}
+		updates[user] = kolabpad.Subscribe(user)
+		return user
+	}
+	users := make([]uint64, 6)
+	for i := range users {
+		users[i] = join()
+		kolabpad.SetUserInfo(users[i], protocol.UserInfo{Name: fmt.Sprintf("User %d", i)})
+	}
+	drain := func() {
+		t.Helper()
+		for user, ch := range updates {
+			for len(ch) > 0 {
+				msg := <-ch
+				switch {
+				case msg.UserCursor != nil && msg.UserCursor.ID != user:
+					held[user][msg.UserCursor.ID] = len(msg.UserCursor.Data.Cursors) > 0
+				case msg.UserInfo != nil && msg.UserInfo.Info == nil:
+					held[user][msg.UserInfo.ID] = false
+				}
+			}
+			n := 0
+			for _, ok := range held[user] {
+				if ok {
+					n++
+				}
+			}
+			if n > config.MaxRemoteCursors {
+				t.Fatalf("User %d holds %d remote cursors, more than %d", user, n, config.MaxRemoteCursors)
+			}
+		}
+	}
+
+	for round := range 3 {
+		for i, user := range users {
+			kolabpad.SetCursorData(user, protocol.CursorData{Cursors: []uint32{uint32(round)}})
+			if i == 3 {
+				kolabpad.ApplyEditWithCursor(user, kolabpad.Revision(), insertAt(round, 0, "x"), protocol.CursorData{Cursors: []uint32{1}})
+			}
+			drain()
+		}
+	}
+
+	// users[5] moved last, then users[4]; users[5] sees users[4] and users[3]
+	for user, want := range map[uint64][]uint64{users[0]: {users[4], users[5]}, users[5]: {users[3], users[4]}} {
+		for _, id := range want {
+			if !held[user][id] {
+				t.Errorf("Expected user %d to hold user %d's cursor, got %v", user, id, held[user])
+			}
+		}
+	}
+
+	// A late joiner starts with the most recent cursors only, and has the
+	// one that drops out of them cleared when another moves
+	late := join()
+	if got := slices.Sorted(maps.Keys(held[late])); !slices.Equal(got, []uint64{users[4], users[5]}) {
+		t.Errorf("Expected the joiner to get the two latest cursors, got %v", got)
+	}
+	kolabpad.SetCursorData(users[0], protocol.CursorData{Cursors: []uint32{5}})
+	drain()
+	if !held[late][users[0]] || !held[late][users[5]] || held[late][users[4]] {
+		t.Errorf("Expected the joiner to swap user %d's cursor for user %d's, got %v", users[4], users[0], held[late])
+	}
+
+	kolabpad.RemoveUser(users[5])
+	delete(updates, users[5])
+	drain()
+	if !held[users[1]][users[4]] || held[users[1]][users[5]] {
+		t.Errorf("Expected user %d's cursor to replace the departed user's, got %v", users[4], held[users[1]])
+	}
+}
+
+// TestRecentChangesSkipsSystem tests that the System operation loading a
+// document isn't reported as a change.
+func TestRecentChangesSkipsSystem(t *testing.T) {
+	config := testConfig()
+	kolabpad := FromPersistedDocument("text", nil, nil, &config)
+	alice := kolabpad.NextUserID()
+	kolabpad.GetInitialState(alice)
+	if err := kolabpad.ApplyEdit(alice, 1, insertAt(4, 4, "!")); err != nil {
+		t.Fatalf("ApplyEdit failed: %v", err)
+	}
+
+	got := recentChanges(mustHistory(t, kolabpad, 0), 5)
+	want := []protocol.ChangeRange{{ID: alice, Start: 4, End: 5}}
+	if !slices.Equal(got, want) {
+		t.Errorf("Expected ranges %+v, got %+v", want, got)
+	}
+}
+
+// TestApplyEditWithCursor tests that a cursor sent with an edit is stored as
+// sent rather than transformed by the edit, carried over edits the client
+// hadn't seen, and discarded with an edit that fails.
+func TestApplyEditWithCursor(t *testing.T) {
+	kolabpad := testKolabpad()
+	alice := kolabpad.NextUserID()
+	kolabpad.SetUserInfo(alice, protocol.UserInfo{Name: "Alice"})
+	bob := kolabpad.NextUserID()
+	kolabpad.SetUserInfo(bob, protocol.UserInfo{Name: "Bob"})
+	updates := kolabpad.Subscribe(bob)
+
+	cursorOf := func(userID uint64) []uint32 {
+		t.Helper()
+		_, _, _, _, cursors := kolabpad.GetInitialState(bob)
+		return cursors[userID].Cursors
+	}
+
+	if err := kolabpad.ApplyEdit(alice, 0, insertAt(0, 0, "hello")); err != nil {
+		t.Fatalf("ApplyEdit failed: %v", err)
+	}
+	kolabpad.SetCursorData(alice, protocol.CursorData{Cursors: []uint32{5}})
+	<-updates // Alice's cursor at 5
+
+	// Alice quotes the line; her cursor ends after the "> ", where
+	// transforming her old cursor would have put it at 7
+	err := kolabpad.ApplyEditWithCursor(alice, 1, insertAt(5, 0, "> "), protocol.CursorData{Cursors: []uint32{2}})
+	if err != nil {
+		t.Fatalf("ApplyEditWithCursor failed: %v", err)
+	}
+	if got := cursorOf(alice); !slices.Equal(got, []uint32{2}) {
+		t.Errorf("Expected cursor at 2, got %v", got)
+	}
+	if msg := <-updates; msg.UserCursor == nil || msg.UserCursor.ID != alice || !slices.Equal(msg.UserCursor.Data.Cursors, []uint32{2}) {
+		t.Errorf("Expected Alice's cursor at 2 broadcast, got %+v", msg)
+	}
+
+	// Bob prepends while Alice, still at revision 2, appends
+	if err := kolabpad.ApplyEdit(bob, 2, insertAt(7, 0, "XY")); err != nil {
+		t.Fatalf("ApplyEdit failed: %v", err)
+	}
+	err = kolabpad.ApplyEditWithCursor(alice, 2, insertAt(7, 7, "!"), protocol.CursorData{Cursors: []uint32{8}})
+	if err != nil {
+		t.Fatalf("ApplyEditWithCursor failed: %v", err)
+	}
+	if got := kolabpad.Text(); got != "XY> hello!" {
+		t.Errorf("Expected %q, got %q", "XY> hello!", got)
+	}
+	if got := cursorOf(alice); !slices.Equal(got, []uint32{10}) {
+		t.Errorf("Expected cursor carried over Bob's edit to 10, got %v", got)
+	}
+
+	err = kolabpad.ApplyEditWithCursor(alice, 99, insertAt(10, 0, "?"), protocol.CursorData{Cursors: []uint32{1}})
+	if !errors.Is(err, ErrInvalidRevision) {
+		t.Fatalf("Expected ErrInvalidRevision, got %v", err)
+	}
+	if got := cursorOf(alice); !slices.Equal(got, []uint32{10}) {
+		t.Errorf("Expected failed edit to leave cursor at 10, got %v", got)
+	}
+}
+
+// TestEditAfterKill tests that edits to a killed document are rejected with
+// ErrKilled and leave its history alone.
+func TestEditAfterKill(t *testing.T) {
+	kolabpad := testKolabpad()
+	alice := kolabpad.NextUserID()
+	if err := kolabpad.ApplyEdit(alice, 0, insertAt(0, 0, "hello")); err != nil {
+		t.Fatalf("ApplyEdit failed: %v", err)
+	}
+
+	kolabpad.Kill()
+
+	if err := kolabpad.ApplyEdit(alice, 1, insertAt(5, 5, "!")); !errors.Is(err, ErrKilled) {
+		t.Errorf("Expected ErrKilled from ApplyEdit, got %v", err)
+	}
+	if err := kolabpad.ReplaceAll("bye", protocol.SystemUserID); !errors.Is(err, ErrKilled) {
+		t.Errorf("Expected ErrKilled from ReplaceAll, got %v", err)
+	}
+	if rev := kolabpad.Revision(); rev != 1 {
+		t.Errorf("Expected revision to stay 1, got %d", rev)
+	}
+	if got := kolabpad.Text(); got != "hello" {
+		t.Errorf("Expected text to stay %q, got %q", "hello", got)
+	}
+}
+
+// TestNormalizeNewlines tests that with NormalizeNewlines set, inserted CRLFs
+// are turned into LFs by a System edit that history replays and concurrent
+// edits transform against, and that they are kept as sent otherwise.
+func TestNormalizeNewlines(t *testing.T) {
+	config := testConfig()
+	config.NormalizeNewlines = true
+	kolabpad := NewKolabpad(&config)
+	alice := kolabpad.NextUserID()
+	kolabpad.SetUserInfo(alice, protocol.UserInfo{Name: "Alice"})
+	bob := kolabpad.NextUserID()
+
+	err := kolabpad.ApplyEditWithCursor(alice, 0, insertAt(0, 0, "one\r\ntwo\r\n"), protocol.CursorData{Cursors: []uint32{10}})
+	if err != nil {
+		t.Fatalf("ApplyEditWithCursor failed: %v", err)
+	}
+	if got := kolabpad.Text(); got != "one\ntwo\n" {
+		t.Errorf("Expected LF line endings, got %q", got)
+	}
+	history := mustHistory(t, kolabpad, 0)
+	if len(history) != 2 || history[0].ID != alice || history[1].ID != protocol.SystemUserID {
+		t.Fatalf("Expected Alice's edit followed by a System edit, got %+v", history)
+	}
+	if got := replayHistory(t, history); got != kolabpad.Text() {
+		t.Errorf("History replays to %q, document is %q", got, kolabpad.Text())
+	}
+	if _, _, _, _, cursors := kolabpad.GetInitialState(alice); !slices.Equal(cursors[alice].Cursors, []uint32{8}) {
+		t.Errorf("Expected Alice's cursor moved to the end at 8, got %v", cursors[alice].Cursors)
+	}
+
+	// A lone CR stays, but one inserted before an existing LF completes a
+	// CRLF; so does Alice's edit, which hasn't seen Bob's
+	if err := kolabpad.ApplyEdit(bob, 2, insertAt(8, 0, "zero\r")); err != nil {
+		t.Fatalf("ApplyEdit failed: %v", err)
+	}
+	if err := kolabpad.ApplyEdit(bob, 3, insertAt(13, 8, "\r")); err != nil {
+		t.Fatalf("ApplyEdit failed: %v", err)
+	}
+	if err := kolabpad.ApplyEdit(alice, 2, insertAt(8, 8, "three\r\n")); err != nil {
+		t.Fatalf("ApplyEdit failed: %v", err)
+	}
+	if got := kolabpad.Text(); got != "zero\rone\ntwo\nthree\n" {
+		t.Errorf("Expected only the lone CR left, got %q", got)
+	}
+	if got := replayHistory(t, mustHistory(t, kolabpad, 0)); got != kolabpad.Text() {
+		t.Errorf("History replays to %q, document is %q", got, kolabpad.Text())
+	}
+
+	// Disabled, CRLFs are stored as sent
+	plain := testKolabpad()
+	user := plain.NextUserID()
+	if err := plain.ApplyEdit(user, 0, insertAt(0, 0, "one\r\n")); err != nil {
+		t.Fatalf("ApplyEdit failed: %v", err)
+	}
+	if got := plain.Text(); got != "one\r\n" || plain.Revision() != 1 {
+		t.Errorf("Expected CRLF kept in one edit, got %q at revision %d", got, plain.Revision())
+	}
+}
+
+// TestMaxRevisionLag tests that edits trailing the document by more than
+// MaxRevisionLag fail with ErrRevisionLag before any transform, while ones
+// at the limit are transformed as usual.
+func TestMaxRevisionLag(t *testing.T) {
+	config := testConfig()
+	config.MaxRevisionLag = 2
+	kolabpad := NewKolabpad(&config)
+	alice := kolabpad.NextUserID()
+	bob := kolabpad.NextUserID()
+
+	for i := 0; i < 3; i++ {
+		if err := kolabpad.ApplyEdit(alice, i, insertAt(i, i, "a")); err != nil {
+			t.Fatalf("Edit %d failed: %v", i, err)
+		}
+	}
+
+	if err := kolabpad.ApplyEdit(bob, 0, insertAt(0, 0, "b")); !errors.Is(err, ErrRevisionLag) {
+		t.Errorf("Expected ErrRevisionLag 3 revisions behind, got %v", err)
+	}
+	if got := kolabpad.Text(); got != "aaa" {
+		t.Errorf("Expected lagged edit dropped, got %q", got)
+	}
+
+	if err := kolabpad.ApplyEdit(bob, 1, insertAt(1, 0, "b")); err != nil {
+		t.Errorf("Expected edit 2 revisions behind to apply, got %v", err)
+	}
+	if got := kolabpad.Text(); got != "baaa" {
+		t.Errorf("Expected %q, got %q", "baaa", got)
+	}
+}
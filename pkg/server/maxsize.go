@@ -0,0 +1,85 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/shiv248/kolabpad/pkg/database"
+	"github.com/shiv248/kolabpad/pkg/logger"
+)
+
+// handleSetMaxSize sets or clears a document's size limit override, up to
+// Config.MaxDocumentSizeCap. The limit can't be set below the document's
+// current size. Protected documents require the current OTP.
+// Route: PUT /api/document/{id}/max-size
+func (s *Server) handleSetMaxSize(w http.ResponseWriter, r *http.Request, docID string) {
+	var reqBody struct {
+		UserID   uint64 `json:"user_id"`
+		UserName string `json:"user_name"`
+		OTP      string `json:"otp"`      // Required if the document is protected
+		MaxSize  *int   `json:"max_size"` // In bytes; null = server default
+	}
+	if !decodeRequestBody(w, r, &reqBody) {
+		return
+	}
+	limit := s.state.config.maxSizeCap()
+	if reqBody.MaxSize != nil && (*reqBody.MaxSize < 1 || *reqBody.MaxSize > limit) {
+		http.Error(w, fmt.Sprintf("max_size must be between 1 and %d", limit), http.StatusBadRequest)
+		return
+	}
+
+	doc := s.connectedDocument(w, r, docID, reqBody.UserID, reqBody.UserName, reqBody.OTP, "set the size limit of")
+	if doc == nil {
+		return
+	}
+	if size := len(doc.Kolabpad.Text()); reqBody.MaxSize != nil && size > *reqBody.MaxSize {
+		http.Error(w, fmt.Sprintf("document is already %d bytes", size), http.StatusConflict)
+		return
+	}
+
+	// CRITICAL: Write to DB FIRST (atomicity - prevents memory/DB desync)
+	exists, err := s.state.db.Exists(docID)
+	if err != nil {
+		logger.Error("Failed to check document: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	if !exists {
+		text, language := doc.Kolabpad.Snapshot()
+		err = s.state.db.Store(&database.PersistedDocument{
+			ID:           docID,
+			Text:         text,
+			Language:     language,
+			OTP:          doc.Kolabpad.GetOTP(),
+			ExpiryDays:   doc.expiryOverride.Load(),
+			MaxSize:      reqBody.MaxSize,
+			PasswordHash: doc.passwordHash.Load(),
+		})
+	} else {
+		err = s.state.db.UpdateMaxSize(docID, reqBody.MaxSize)
+	}
+	if err != nil {
+		logger.Error("Failed to update size limit: %v", err)
+		writeStoreError(w, err)
+		return // DB write failed - do NOT update memory
+	}
+
+	doc.Kolabpad.SetMaxSize(reqBody.MaxSize)
+	logger.Info("Document %s size limit set to %s by user %d (%s)", docID, formatMaxSize(reqBody.MaxSize), reqBody.UserID, reqBody.UserName)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]*int{
+		"max_size": reqBody.MaxSize,
+	})
+}
+
+// formatMaxSize describes a size limit override for logging.
+func formatMaxSize(size *int) string {
+	if size == nil {
+		return "server default"
+	}
+	return strconv.Itoa(*size) + " bytes"
+}
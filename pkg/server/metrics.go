@@ -0,0 +1,127 @@
+package server
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+// transformStormThreshold is the number of historical operations an edit
+// must be transformed against before it's logged. Clients that keep editing
+// against a stale revision show up here.
+const transformStormThreshold = 256
+
+// transformBuckets are the histogram upper bounds (inclusive) for the number
+// of transforms per edit; a final bucket catches everything larger.
+var transformBuckets = []int{0, 1, 4, 16, 64, 256, 1024}
+
+// transformMetrics records how many historical operations each edit was
+// transformed against. It's shared by all documents of a server and safe for
+// concurrent use.
+type transformMetrics struct {
+	edits      atomic.Uint64
+	transforms atomic.Uint64
+	max        atomic.Uint64
+	buckets    [8]atomic.Uint64 // len(transformBuckets) + 1
+
+	applied atomic.Uint64 // Operations committed to any document, for /api/stats/detailed
+}
+
+// observe records one edit transformed against n operations.
+func (m *transformMetrics) observe(n int) {
+	m.edits.Add(1)
+	m.transforms.Add(uint64(n))
+	for {
+		cur := m.max.Load()
+		if uint64(n) <= cur || m.max.CompareAndSwap(cur, uint64(n)) {
+			break
+		}
+	}
+
+	i := 0
+	for i < len(transformBuckets) && n > transformBuckets[i] {
+		i++
+	}
+	m.buckets[i].Add(1)
+}
+
+// TransformStats summarizes transform counts per edit for /api/stats.
+type TransformStats struct {
+	Edits      uint64            `json:"edits"`      // Edits applied since start
+	Transforms uint64            `json:"transforms"` // Historical operations transformed against, in total
+	Max        uint64            `json:"max"`        // Most transforms needed by a single edit
+	Histogram  []TransformBucket `json:"histogram"`  // Edits by transform count
+}
+
+// TransformBucket counts edits needing at most LE transforms (and more than
+// the previous bucket's bound). The last bucket's LE is "+Inf".
+type TransformBucket struct {
+	LE    string `json:"le"`
+	Count uint64 `json:"count"`
+}
+
+// snapshot returns the current counters.
+func (m *transformMetrics) snapshot() TransformStats {
+	stats := TransformStats{
+		Edits:      m.edits.Load(),
+		Transforms: m.transforms.Load(),
+		Max:        m.max.Load(),
+		Histogram:  make([]TransformBucket, len(m.buckets)),
+	}
+	for i := range m.buckets {
+		le := "+Inf"
+		if i < len(transformBuckets) {
+			le = strconv.Itoa(transformBuckets[i])
+		}
+		stats.Histogram[i] = TransformBucket{LE: le, Count: m.buckets[i].Load()}
+	}
+	return stats
+}
+
+// A connection is logged as a slow consumer once at least
+// slowConsumerDropPercent of the messages meant for it were broadcasts its
+// buffer was too full to take, counted after slowConsumerMinMessages so a
+// single early drop doesn't trip it.
+const (
+	slowConsumerDropPercent = 10
+	slowConsumerMinMessages = 20
+)
+
+// sendMetrics counts what was sent to WebSocket clients. Each Connection
+// keeps its own, and adds to one shared by all documents of a server (see
+// Kolabpad.sends). Safe for concurrent use.
+type sendMetrics struct {
+	messages      atomic.Uint64 // Messages written to the socket
+	bytes         atomic.Uint64 // Their encoded size
+	writeTimeouts atomic.Uint64 // Writes that hit the write timeout
+	drops         atomic.Uint64 // Broadcasts skipped because the subscriber buffer was full
+
+	slowConsumers atomic.Uint64 // Connections logged as slow consumers (aggregate only)
+}
+
+// SendStats summarizes what was sent to WebSocket clients for /api/stats.
+type SendStats struct {
+	Messages       uint64 `json:"messages"`        // Messages written since start
+	Bytes          uint64 `json:"bytes"`           // Their encoded size
+	WriteTimeouts  uint64 `json:"write_timeouts"`  // Writes that timed out, each ending its connection
+	BroadcastDrops uint64 `json:"broadcast_drops"` // Broadcasts a connection's buffer was too full to take
+	SlowConsumers  uint64 `json:"slow_consumers"`  // Connections whose drop rate crossed the slow consumer threshold
+}
+
+// snapshot returns the current counters.
+func (m *sendMetrics) snapshot() SendStats {
+	return SendStats{
+		Messages:       m.messages.Load(),
+		Bytes:          m.bytes.Load(),
+		WriteTimeouts:  m.writeTimeouts.Load(),
+		BroadcastDrops: m.drops.Load(),
+		SlowConsumers:  m.slowConsumers.Load(),
+	}
+}
+
+// slowConsumer reports whether m's drops have reached the slow consumer
+// threshold.
+func (m *sendMetrics) slowConsumer() bool {
+	drops := m.drops.Load()
+	total := drops + m.messages.Load()
+	return total >= slowConsumerMinMessages && drops*100 >= total*slowConsumerDropPercent
+}
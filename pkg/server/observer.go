@@ -0,0 +1,77 @@
+package server
+
+import (
+	"time"
+
+	"github.com/shiv248/kolabpad/pkg/logger"
+)
+
+// EventObserver receives server events, for feeding an external metrics or
+// tracing system. Set it as Config.Observer. Methods are called synchronously
+// from the goroutine that caused the event, often while a client waits, so
+// implementations must be safe for concurrent use and return quickly.
+type EventObserver interface {
+	// OnConnect is called when a WebSocket client has been admitted to a document.
+	OnConnect(docID string, userID uint64)
+
+	// OnDisconnect is called when a client's connection ends. err is what
+	// ended it (nil for a normal close).
+	OnDisconnect(docID string, userID uint64, err error)
+
+	// OnEdit is called after a client's edit is applied.
+	OnEdit(docID string, userID uint64)
+
+	// OnProtect is called after OTP protection is enabled (or its OTP
+	// regenerated) or disabled.
+	OnProtect(docID string, userID uint64, protected bool)
+
+	// OnPersist is called after each attempt to save a document, with how
+	// long it took and whether it failed.
+	OnPersist(docID string, elapsed time.Duration, err error)
+
+	// OnError is called for server-side failures not reported by another
+	// method, such as a connection ending with an internal error.
+	OnError(docID string, err error)
+}
+
+// NopObserver ignores every event. It's the default when Config.Observer is nil.
+type NopObserver struct{}
+
+func (NopObserver) OnConnect(string, uint64)               {}
+func (NopObserver) OnDisconnect(string, uint64, error)     {}
+func (NopObserver) OnEdit(string, uint64)                  {}
+func (NopObserver) OnProtect(string, uint64, bool)         {}
+func (NopObserver) OnPersist(string, time.Duration, error) {}
+func (NopObserver) OnError(string, error)                  {}
+
+// LogObserver logs every event: edits at Debug level, failures at Error and
+// everything else at Info.
+type LogObserver struct{}
+
+func (LogObserver) OnConnect(docID string, userID uint64) {
+	logger.Info("event: connect document=%s user=%d", docID, userID)
+}
+
+func (LogObserver) OnDisconnect(docID string, userID uint64, err error) {
+	logger.Info("event: disconnect document=%s user=%d err=%v", docID, userID, err)
+}
+
+func (LogObserver) OnEdit(docID string, userID uint64) {
+	logger.Debug("event: edit document=%s user=%d", docID, userID)
+}
+
+func (LogObserver) OnProtect(docID string, userID uint64, protected bool) {
+	logger.Info("event: protect document=%s user=%d protected=%v", docID, userID, protected)
+}
+
+func (LogObserver) OnPersist(docID string, elapsed time.Duration, err error) {
+	if err != nil {
+		logger.Error("event: persist document=%s elapsed=%v err=%v", docID, elapsed, err)
+		return
+	}
+	logger.Info("event: persist document=%s elapsed=%v", docID, elapsed)
+}
+
+func (LogObserver) OnError(docID string, err error) {
+	logger.Error("event: error document=%s err=%v", docID, err)
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/shiv248/kolabpad/internal/protocol"
+	"github.com/shiv248/kolabpad/pkg/database"
+	"github.com/shiv248/kolabpad/pkg/logger"
+)
+
+// ErrNotOwner is returned when Config.DocumentOwners is set and a change to
+// a document's protection comes without its owner key.
+var ErrNotOwner = errors.New("not the document owner")
+
+// protectOwnedDocument is protectDocument under Config.DocumentOwners. The
+// OTP and owner are written in one conditional update, so two users
+// protecting an unowned document at once can't both become its owner.
+func (s *Server) protectOwnedDocument(docID string, doc *Document, userID uint64, userName, ownerKey string) (string, string, error) {
+	exists, err := s.state.db.Exists(docID)
+	if err != nil {
+		return "", "", fmt.Errorf("check document: %w", err)
+	}
+	if !exists {
+		// Create it unprotected and unowned, then claim it like any other
+		err = s.state.db.Store(&database.PersistedDocument{ID: docID})
+		if err != nil {
+			return "", "", fmt.Errorf("store document: %w", err)
+		}
+	}
+
+	otp, claim := GenerateOTP(), generateSessionToken()
+	ok, claimed, err := s.state.db.UpdateOTPAsOwner(docID, &otp, ownerKey, claim)
+	if err != nil {
+		return "", "", fmt.Errorf("store OTP: %w", err) // DB write failed - do NOT update memory
+	}
+	if !ok {
+		return "", "", ErrNotOwner
+	}
+	if claimed {
+		logger.Info("User %d (%s) is now the owner of document %s", userID, userName, docID)
+	} else {
+		claim = ""
+	}
+
+	logger.Info("Document %s protected with OTP by user %d (%s) (DB write successful)", docID, userID, userName)
+
+	doc.Kolabpad.SetOTP(&otp, userID, userName) // Updates memory + broadcasts to clients
+	s.state.config.observer().OnProtect(docID, userID, true)
+	return otp, claim, nil
+}
+
+// sendOwnership delivers an owner key to userID alone. It fails if the user
+// isn't registered, was admitted with a share link (owning the document
+// would give them the OTP their link withholds), or has a full channel.
+func (r *Kolabpad) sendOwnership(userID uint64, ownerKey string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if _, ok := r.state.Users[userID]; !ok {
+		return false
+	}
+	if _, ok := r.grants[userID]; ok {
+		return false
+	}
+	sub, ok := r.subscribers[userID]
+	if !ok {
+		return false
+	}
+	select {
+	case sub.ch <- protocol.NewOwnershipMsg(ownerKey):
+		return true
+	default:
+		return false
+	}
+}
+
+// handleTransferOwner makes another connected user the document's owner.
+// The current owner presents their key; a fresh key is generated and sent
+// only to the new owner over their WebSocket, so it never passes through
+// the old owner. The old key stops working.
+func (s *Server) handleTransferOwner(w http.ResponseWriter, r *http.Request, docID string) {
+	var reqBody struct {
+		UserID     uint64 `json:"user_id"`
+		UserName   string `json:"user_name"`
+		OTP        string `json:"otp"` // Required if the document is protected
+		OwnerKey   string `json:"owner_key"`
+		NewOwnerID uint64 `json:"new_owner_id"`
+	}
+	if !s.state.config.DocumentOwners {
+		http.Error(w, "document owners not enabled", http.StatusNotFound)
+		return
+	}
+	if !decodeRequestBody(w, r, &reqBody) {
+		return
+	}
+
+	doc := s.connectedDocument(w, r, docID, reqBody.UserID, reqBody.UserName, reqBody.OTP, "transfer ownership of")
+	if doc == nil {
+		return
+	}
+	if !doc.Kolabpad.HasUser(reqBody.NewOwnerID) {
+		http.Error(w, "new owner is not connected to the document", http.StatusConflict)
+		return
+	}
+
+	// CRITICAL: Write to DB FIRST; the key only counts once it's stored
+	key := generateSessionToken()
+	swapped, err := s.state.db.SwapOwnerKey(docID, reqBody.OwnerKey, &key)
+	if err != nil {
+		logger.Error("Failed to transfer ownership of document %s: %v", docID, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !swapped {
+		logger.Info("User %d (%s) attempted to transfer ownership of document %s without its owner key", reqBody.UserID, reqBody.UserName, docID)
+		http.Error(w, "Forbidden: only the document owner can transfer ownership", http.StatusForbidden)
+		return
+	}
+
+	if !doc.Kolabpad.sendOwnership(reqBody.NewOwnerID, key) {
+		// Nobody holds the new key; give it back to the old owner
+		if _, err := s.state.db.SwapOwnerKey(docID, key, &reqBody.OwnerKey); err != nil {
+			logger.Error("Failed to restore owner of document %s: %v", docID, err)
+		}
+		http.Error(w, "couldn't deliver ownership to the new owner", http.StatusServiceUnavailable)
+		return
+	}
+
+	logger.Info("Ownership of document %s transferred from user %d (%s) to user %d", docID, reqBody.UserID, reqBody.UserName, reqBody.NewOwnerID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleReleaseOwner gives up ownership of a document. Its protection is left
+// as it is; whoever protects it next becomes the new owner.
+func (s *Server) handleReleaseOwner(w http.ResponseWriter, r *http.Request, docID string) {
+	var reqBody struct {
+		UserID   uint64 `json:"user_id"`
+		UserName string `json:"user_name"`
+		OTP      string `json:"otp"` // Required if the document is protected
+		OwnerKey string `json:"owner_key"`
+	}
+	if !s.state.config.DocumentOwners {
+		http.Error(w, "document owners not enabled", http.StatusNotFound)
+		return
+	}
+	if !decodeRequestBody(w, r, &reqBody) {
+		return
+	}
+
+	if s.connectedDocument(w, r, docID, reqBody.UserID, reqBody.UserName, reqBody.OTP, "release ownership of") == nil {
+		return
+	}
+
+	swapped, err := s.state.db.SwapOwnerKey(docID, reqBody.OwnerKey, nil)
+	if err != nil {
+		logger.Error("Failed to release ownership of document %s: %v", docID, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !swapped {
+		logger.Info("User %d (%s) attempted to release ownership of document %s without its owner key", reqBody.UserID, reqBody.UserName, docID)
+		http.Error(w, "Forbidden: only the document owner can release ownership", http.StatusForbidden)
+		return
+	}
+
+	logger.Info("Document %s released by its owner, user %d (%s)", docID, reqBody.UserID, reqBody.UserName)
+	w.WriteHeader(http.StatusNoContent)
+}
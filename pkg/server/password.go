@@ -0,0 +1,281 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/shiv248/kolabpad/pkg/database"
+	"github.com/shiv248/kolabpad/pkg/logger"
+)
+
+const (
+	// maxPasswordLength caps document passwords, in characters. Every attempt
+	// costs a full PBKDF2 derivation, so there's no reason to accept essays.
+	maxPasswordLength = 128
+
+	// passwordSessionTTL is how long a session token from
+	// /api/document/{id}/auth can be used to open (or reopen) a connection.
+	passwordSessionTTL = time.Hour
+
+	// passwordHeader carries the plaintext password for clients that can set
+	// headers on the WebSocket request. Browsers can't, and use ?session=.
+	passwordHeader = "X-Document-Password"
+)
+
+// passwordSession grants access to one document until it expires. It records
+// the hash it was issued against, so changing or removing the password
+// revokes outstanding sessions.
+type passwordSession struct {
+	docID   string
+	hash    string
+	expires time.Time
+}
+
+// passwordHash returns a document's password hash, or nil if it has none.
+// Documents that are only in the database are checked without loading them.
+func (s *Server) passwordHash(docID string) (*string, error) {
+	if val, ok := s.state.documents.Load(docID); ok {
+		return val.(*Document).passwordHash.Load(), nil
+	}
+	if s.state.db == nil {
+		return nil, nil
+	}
+	return s.state.db.GetPasswordHash(docID)
+}
+
+// authorizePassword checks a request against the document's password, writing
+// an error response and returning false if it's not satisfied. Requests need
+// either a session token (?session=) or the password itself in the
+// X-Document-Password header. Documents without a password always pass.
+func (s *Server) authorizePassword(w http.ResponseWriter, r *http.Request, docID string) bool {
+	hash, err := s.passwordHash(docID)
+	if err != nil {
+		logger.Error("Failed to check password of document %s: %v", docID, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return false
+	}
+	if hash == nil {
+		return true
+	}
+
+	if s.passwordSatisfied(r, docID, *hash) {
+		return true
+	}
+
+	logger.Info("Rejected password-protected access to document %s from %s", docID, s.clientIP(r))
+	http.Error(w, "Invalid or missing password", http.StatusUnauthorized)
+	return false
+}
+
+// passwordSatisfied reports whether r carries the password of a document
+// whose password hash is hash, in the X-Document-Password header, or failing
+// that a valid ?session= token for it.
+func (s *Server) passwordSatisfied(r *http.Request, docID, hash string) bool {
+	if password := r.Header.Get(passwordHeader); password != "" {
+		return verifyPassword(hash, password)
+	}
+	return s.validSession(r.URL.Query().Get("session"), docID, hash)
+}
+
+// validSession reports whether token is an unexpired session for docID,
+// issued while the document's password hash was hash.
+func (s *Server) validSession(token, docID, hash string) bool {
+	if token == "" {
+		return false
+	}
+	val, ok := s.state.sessions.Load(token)
+	if !ok {
+		return false
+	}
+	session := val.(passwordSession)
+	if time.Now().After(session.expires) {
+		s.state.sessions.Delete(token)
+		return false
+	}
+	return session.docID == docID && session.hash == hash
+}
+
+// issueSession creates a session token for docID, pruning expired ones.
+func (s *Server) issueSession(docID, hash string) string {
+	now := time.Now()
+	s.state.sessions.Range(func(key, value interface{}) bool {
+		if now.After(value.(passwordSession).expires) {
+			s.state.sessions.Delete(key)
+		}
+		return true
+	})
+
+	token := generateSessionToken()
+	s.state.sessions.Store(token, passwordSession{
+		docID:   docID,
+		hash:    hash,
+		expires: now.Add(passwordSessionTTL),
+	})
+	return token
+}
+
+// handlePasswordAuth exchanges a document password for a short-lived session
+// token to pass as ?session= on the WebSocket URL.
+func (s *Server) handlePasswordAuth(w http.ResponseWriter, r *http.Request, docID string) {
+	var reqBody struct {
+		Password string `json:"password"`
+	}
+	if !decodeRequestBody(w, r, &reqBody) {
+		return
+	}
+
+	hash, err := s.passwordHash(docID)
+	if err != nil {
+		logger.Error("Failed to check password of document %s: %v", docID, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if hash == nil {
+		http.Error(w, "document has no password", http.StatusBadRequest)
+		return
+	}
+	if utf8.RuneCountInString(reqBody.Password) > maxPasswordLength || !verifyPassword(*hash, reqBody.Password) {
+		logger.Info("Invalid password for document %s from %s", docID, s.clientIP(r))
+		http.Error(w, "Invalid password", http.StatusUnauthorized)
+		return
+	}
+
+	token := s.issueSession(docID, *hash)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"session":    token,
+		"expires_in": int(passwordSessionTTL.Seconds()),
+	})
+}
+
+// connectedDocument returns docID's document if userID is connected to it,
+// supplied the current OTP (when protected) and r carries a session or the
+// password (when it has one), writing 403 and returning nil otherwise. User
+// IDs are sequential, so being connected alone proves nothing. action
+// describes the attempt for logging.
+func (s *Server) connectedDocument(w http.ResponseWriter, r *http.Request, docID string, userID uint64, userName, otp, action string) *Document {
+	val, ok := s.state.documents.Load(docID)
+	if !ok || !val.(*Document).Kolabpad.HasUser(userID) {
+		logger.Info("User %d (%s) attempted to %s document %s without being connected", userID, userName, action, docID)
+		http.Error(w, "Forbidden: not connected to document", http.StatusForbidden)
+		return nil
+	}
+	doc := val.(*Document)
+
+	if current := doc.Kolabpad.GetOTP(); current != nil && otp != *current {
+		logger.Info("User %d (%s) attempted to %s document %s with invalid OTP", userID, userName, action, docID)
+		http.Error(w, "Forbidden: invalid OTP", http.StatusForbidden)
+		return nil
+	}
+	if !s.documentPasswordSatisfied(w, r, doc, docID, userID, userName, action) {
+		return nil
+	}
+	return doc
+}
+
+// documentPasswordSatisfied checks r against doc's password like
+// authorizePassword, writing 403 and returning false if it's not satisfied.
+func (s *Server) documentPasswordSatisfied(w http.ResponseWriter, r *http.Request, doc *Document, docID string, userID uint64, userName, action string) bool {
+	if hash := doc.passwordHash.Load(); hash != nil && !s.passwordSatisfied(r, docID, *hash) {
+		logger.Info("User %d (%s) attempted to %s document %s without its password", userID, userName, action, docID)
+		http.Error(w, "Forbidden: invalid or missing password", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// handleSetPassword sets or replaces a document's password. Only the salted
+// hash is stored. Protected documents require the current OTP.
+func (s *Server) handleSetPassword(w http.ResponseWriter, r *http.Request, docID string) {
+	var reqBody struct {
+		UserID   uint64 `json:"user_id"`
+		UserName string `json:"user_name"`
+		OTP      string `json:"otp"` // Required if the document is protected
+		Password string `json:"password"`
+	}
+	if !decodeRequestBody(w, r, &reqBody) {
+		return
+	}
+	if n := utf8.RuneCountInString(reqBody.Password); n == 0 || n > maxPasswordLength {
+		http.Error(w, fmt.Sprintf("password must be 1-%d characters", maxPasswordLength), http.StatusBadRequest)
+		return
+	}
+
+	doc := s.connectedDocument(w, r, docID, reqBody.UserID, reqBody.UserName, reqBody.OTP, "set the password of")
+	if doc == nil {
+		return
+	}
+
+	hash := hashPassword(reqBody.Password)
+
+	// CRITICAL: Write to DB FIRST (atomicity - prevents memory/DB desync)
+	exists, err := s.state.db.Exists(docID)
+	if err != nil {
+		logger.Error("Failed to check document: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	if !exists {
+		text, language := doc.Kolabpad.Snapshot()
+		err = s.state.db.Store(&database.PersistedDocument{
+			ID:           docID,
+			Text:         text,
+			Language:     language,
+			OTP:          doc.Kolabpad.GetOTP(),
+			ExpiryDays:   doc.expiryOverride.Load(),
+			MaxSize:      doc.Kolabpad.MaxSize(),
+			PasswordHash: &hash,
+		})
+	} else {
+		err = s.state.db.UpdatePassword(docID, &hash)
+	}
+	if err != nil {
+		logger.Error("Failed to update password: %v", err)
+		writeStoreError(w, err)
+		return // DB write failed - do NOT update memory
+	}
+
+	doc.passwordHash.Store(&hash)
+	logger.Info("Document %s password set by user %d (%s)", docID, reqBody.UserID, reqBody.UserName)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRemovePassword removes a document's password, revoking its sessions.
+// Protected documents require the current OTP.
+func (s *Server) handleRemovePassword(w http.ResponseWriter, r *http.Request, docID string) {
+	var reqBody struct {
+		UserID   uint64 `json:"user_id"`
+		UserName string `json:"user_name"`
+		OTP      string `json:"otp"` // Required if the document is protected
+	}
+	if !decodeRequestBody(w, r, &reqBody) {
+		return
+	}
+
+	doc := s.connectedDocument(w, r, docID, reqBody.UserID, reqBody.UserName, reqBody.OTP, "remove the password of")
+	if doc == nil {
+		return
+	}
+	if doc.passwordHash.Load() == nil {
+		http.Error(w, "document has no password", http.StatusBadRequest)
+		return
+	}
+
+	// CRITICAL: Write to DB FIRST (atomicity - prevents memory/DB desync)
+	if err := s.state.db.UpdatePassword(docID, nil); err != nil {
+		logger.Error("Failed to remove password: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return // DB write failed - do NOT update memory
+	}
+
+	doc.passwordHash.Store(nil)
+	logger.Info("Document %s password removed by user %d (%s)", docID, reqBody.UserID, reqBody.UserName)
+
+	w.WriteHeader(http.StatusNoContent)
+}
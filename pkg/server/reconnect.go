@@ -0,0 +1,206 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+	"unicode/utf8"
+
+	"github.com/shiv248/kolabpad/internal/protocol"
+	"github.com/shiv248/kolabpad/pkg/database"
+	"github.com/shiv248/kolabpad/pkg/logger"
+)
+
+// ghostReapTimeout bounds how long a reconnecting client waits for the
+// connection still holding its user ID to shut down.
+const ghostReapTimeout = 5 * time.Second
+
+// session ties a client-supplied reconnect token to a stable user ID, so a
+// client that reconnects after a dropped socket keeps its identity instead of
+// leaving a ghost user behind.
+type session struct {
+	userID   uint64
+	active   bool          // A connection currently holds userID
+	kick     func()        // Disconnects the connection holding userID
+	released chan struct{} // Closed when that connection's user is removed
+
+	// cursor is the user's last cursor while no connection holds userID.
+	// It's transformed by edits in the meantime and restored on reconnect.
+	cursor *protocol.CursorData
+
+	// avatarSeed is the last UserInfo.AvatarSeed the user registered with,
+	// kept for a reconnect whose ClientInfo leaves it out.
+	avatarSeed string
+
+	// revisionOffset is the client revision offset (see
+	// Connection.revisionOffset) the token's connections use, once numbered
+	// is set, so a reconnect can resume history (see Kolabpad.initialState).
+	revisionOffset int
+	numbered       bool
+}
+
+// ResumeUserID returns the user ID previously used with token, or allocates a
+// new one for an unknown token. If a connection still holds the ID (typically
+// a dead socket that hasn't timed out yet), it is disconnected via its kick
+// function and removed before the ID is handed over. kick is stored to evict
+// the caller in turn if the token reconnects again.
+//
+// Like NextUserID, the returned ID counts as a live connection until RemoveUser.
+func (r *Kolabpad) ResumeUserID(token string, kick func()) uint64 {
+	r.mu.Lock()
+	s, ok := r.sessions[token]
+	if ok && s.active {
+		ghost := s
+		r.mu.Unlock()
+
+		logger.Info("Reaping ghost connection for user %d on reconnect", ghost.userID)
+		ghost.kick()
+		select {
+		case <-ghost.released:
+		case <-time.After(ghostReapTimeout):
+			logger.Warn("Timed out reaping ghost connection for user %d", ghost.userID)
+		}
+
+		r.mu.Lock()
+	}
+
+	if ok && !s.active {
+		// Take over the released ID
+		s.active = true
+		s.kick = kick
+		s.released = make(chan struct{})
+		if s.cursor != nil {
+			r.state.Cursors[s.userID] = *s.cursor
+			s.cursor = nil
+		}
+		r.mu.Unlock()
+
+		r.connections.Add(1)
+		return s.userID
+	}
+	r.mu.Unlock()
+
+	// Unknown token, or the ghost couldn't be reaped: start a fresh identity
+	userID := r.NextUserID()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ok {
+		delete(r.tokens, s.userID)
+	}
+	if len(r.savedCursors) > 0 {
+		key := cursorKey(token)
+		if cursor, saved := r.savedCursors[key]; saved {
+			r.state.Cursors[userID] = cursor
+			delete(r.savedCursors, key)
+		}
+	}
+	r.sessions[token] = &session{
+		userID:   userID,
+		active:   true,
+		kick:     kick,
+		released: make(chan struct{}),
+	}
+	r.tokens[userID] = token
+	return userID
+}
+
+// releaseSession marks userID's session as free for its token to reclaim and
+// parks the user's cursor for a reconnect to restore (caller must hold r.mu,
+// and must call it before removing the user's cursor).
+func (r *Kolabpad) releaseSession(userID uint64) {
+	token, ok := r.tokens[userID]
+	if !ok {
+		return
+	}
+	if s := r.sessions[token]; s != nil && s.active {
+		s.active = false
+		s.kick = nil
+		if cursor, ok := r.state.Cursors[userID]; ok {
+			s.cursor = &cursor
+		}
+		close(s.released)
+	}
+}
+
+// cursorKey identifies a reconnect token's user among saved cursors. Only a
+// hash is stored, so reading the database doesn't give away tokens that
+// would let the reader take over the user's identity.
+func cursorKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// LoadSavedCursors holds cursors saved with the document (see
+// config.SavedCursors) until their users reconnect, transforming them by
+// edits in the meantime like parked session cursors. Cursors that don't
+// decode or lie past the end of the text are dropped. Call it right after
+// loading the document, before any edit.
+func (r *Kolabpad) LoadSavedCursors(saved []database.SavedCursor) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	length := uint32(utf8.RuneCountInString(r.state.Text))
+	inText := func(data protocol.CursorData) bool {
+		for _, cursor := range data.Cursors {
+			if cursor > length {
+				return false
+			}
+		}
+		for _, sel := range data.Selections {
+			if sel[0] > length || sel[1] > length {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, s := range saved {
+		var data protocol.CursorData
+		if err := json.Unmarshal([]byte(s.Data), &data); err != nil || !inText(data) {
+			logger.Debug("LoadSavedCursors: dropping unusable cursor")
+			continue
+		}
+		if r.savedCursors == nil {
+			r.savedCursors = make(map[string]protocol.CursorData)
+		}
+		r.savedCursors[s.UserKey] = data
+	}
+}
+
+// cursorsToSave returns up to config.SavedCursors cursors of users with a
+// reconnect token, for saving with the document: connected users first,
+// then those parked by disconnected sessions, then loaded cursors whose
+// users haven't come back yet (caller must hold r.mu).
+func (r *Kolabpad) cursorsToSave() []database.SavedCursor {
+	limit := r.config.SavedCursors
+	var saved []database.SavedCursor
+	seen := make(map[string]bool)
+	add := func(key string, data protocol.CursorData) {
+		if len(saved) >= limit || seen[key] {
+			return
+		}
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			return
+		}
+		seen[key] = true
+		saved = append(saved, database.SavedCursor{UserKey: key, Data: string(encoded)})
+	}
+
+	for userID, token := range r.tokens {
+		if data, ok := r.state.Cursors[userID]; ok {
+			add(cursorKey(token), data)
+		}
+	}
+	for token, s := range r.sessions {
+		if !s.active && s.cursor != nil {
+			add(cursorKey(token), *s.cursor)
+		}
+	}
+	for key, data := range r.savedCursors {
+		add(key, data)
+	}
+	return saved
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"slices"
+
+	"github.com/shiv248/kolabpad/internal/protocol"
+)
+
+// With Config.MaxRemoteCursors set, each client is sent the cursors of only
+// the users who most recently moved theirs, so cursor traffic in a big room
+// grows with the number of clients rather than its square. cursorOrder ranks
+// the registered users with a cursor, most recently moved first, and each
+// subscriber remembers which remote cursors its client holds. When a user
+// drops out of a client's top K, the client is sent an empty cursor for it
+// to clear the stale one; when a slot frees up, the next user's cursor is
+// sent to fill it.
+
+// emptyCursor clears a remote cursor on the client.
+var emptyCursor = protocol.CursorData{Cursors: []uint32{}, Selections: [][2]uint32{}}
+
+// broadcastCursor sends userID's cursor to every client that's shown it
+// (see Config.MaxRemoteCursors).
+func (r *Kolabpad) broadcastCursor(userID uint64, data protocol.CursorData) {
+	if r.config.MaxRemoteCursors <= 0 {
+		r.broadcast(protocol.NewUserCursorMsg(userID, data))
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// The user may have left since its cursor was set
+	if _, ok := r.state.Users[userID]; !ok {
+		return
+	}
+	if _, ok := r.state.Cursors[userID]; !ok {
+		return
+	}
+	r.cursorOrder = slices.DeleteFunc(r.cursorOrder, func(id uint64) bool { return id == userID })
+	r.cursorOrder = slices.Insert(r.cursorOrder, 0, userID)
+	r.syncRemoteCursors(userID)
+}
+
+// visibleCursors returns the users whose cursors viewer's client is shown:
+// the config.MaxRemoteCursors most recently moved, other than viewer's own
+// (caller must hold r.mu).
+func (r *Kolabpad) visibleCursors(viewer uint64) []uint64 {
+	limit := r.config.MaxRemoteCursors
+	visible := make([]uint64, 0, limit)
+	for _, id := range r.cursorOrder {
+		if len(visible) == limit {
+			break
+		}
+		if id != viewer {
+			visible = append(visible, id)
+		}
+	}
+	return visible
+}
+
+// syncRemoteCursors brings every subscriber's remote cursors in line with
+// visibleCursors, sending the current cursor of moved (protocol.SystemUserID
+// = none) to those who are shown it, including moved's own client (caller
+// must hold r.mu).
+func (r *Kolabpad) syncRemoteCursors(moved uint64) {
+	sends, full := 0, 0
+	send := func(sub subscriber, msg *protocol.ServerMsg) {
+		sends++
+		select {
+		case sub.ch <- msg:
+		default:
+			full++
+			if sub.dropped != nil {
+				sub.dropped()
+			}
+		}
+	}
+
+	for viewer, sub := range r.subscribers {
+		if viewer == moved {
+			send(sub, protocol.NewUserCursorMsg(moved, r.state.Cursors[moved]))
+			continue
+		}
+		visible := r.visibleCursors(viewer)
+		for id := range sub.cursors {
+			if !slices.Contains(visible, id) {
+				send(sub, protocol.NewUserCursorMsg(id, emptyCursor))
+				delete(sub.cursors, id)
+			}
+		}
+		for _, id := range visible {
+			if id == moved || !sub.cursors[id] {
+				send(sub, protocol.NewUserCursorMsg(id, r.state.Cursors[id]))
+				sub.cursors[id] = true
+			}
+		}
+	}
+	r.recordBroadcast(sends, full)
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/shiv248/kolabpad/internal/protocol"
+	"github.com/shiv248/kolabpad/pkg/database"
+	"github.com/shiv248/kolabpad/pkg/logger"
+)
+
+// ErrDocumentExists is returned when a document can't be renamed because a
+// document already has the new ID, in memory or in the database.
+var ErrDocumentExists = errors.New("document already exists")
+
+// errDocumentGone is returned when a document left its ID (renamed or
+// unloaded) while a rename of it was waiting.
+var errDocumentGone = errors.New("document is no longer at this ID")
+
+// handleRenameDocument moves a document to a new ID (see renameDocument).
+// Protected documents require the current OTP, and the new ID must be one the
+// requester could create.
+// Route: POST /api/document/{id}/rename
+func (s *Server) handleRenameDocument(w http.ResponseWriter, r *http.Request, docID string) {
+	var reqBody struct {
+		UserID   uint64 `json:"user_id"`
+		UserName string `json:"user_name"`
+		OTP      string `json:"otp"` // Required if the document is protected
+		NewID    string `json:"new_id"`
+	}
+	if !decodeRequestBody(w, r, &reqBody) {
+		return
+	}
+	if err := s.state.config.validateDocumentID(reqBody.NewID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if reqBody.NewID == docID {
+		http.Error(w, "new_id is the document's current ID", http.StatusBadRequest)
+		return
+	}
+	if s.state.draining.Load() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	doc := s.connectedDocument(w, r, docID, reqBody.UserID, reqBody.UserName, reqBody.OTP, "rename")
+	if doc == nil {
+		return
+	}
+	if !s.state.config.canCreate(reqBody.NewID, r) {
+		logger.Info("User %d (%s) attempted to rename document %s to %s, which they may not create", reqBody.UserID, reqBody.UserName, docID, reqBody.NewID)
+		http.Error(w, "Forbidden: document creation not allowed", http.StatusForbidden)
+		return
+	}
+
+	err := s.renameDocument(docID, doc, reqBody.NewID)
+	switch {
+	case errors.Is(err, ErrDocumentExists):
+		logger.Info("User %d (%s) attempted to rename document %s to existing document %s", reqBody.UserID, reqBody.UserName, docID, reqBody.NewID)
+		http.Error(w, "a document with that ID already exists", http.StatusConflict)
+		return
+	case errors.Is(err, errDocumentGone):
+		http.Error(w, "document was renamed or closed", http.StatusConflict)
+		return
+	case err != nil:
+		logger.Error("Failed to rename document %s to %s: %v", docID, reqBody.NewID, err)
+		writeStoreError(w, err)
+		return
+	}
+	logger.Info("Document %s renamed to %s by user %d (%s)", docID, reqBody.NewID, reqBody.UserID, reqBody.UserName)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"id": reqBody.NewID,
+	})
+}
+
+// renameDocument moves doc from docID to newID in memory and in the database,
+// failing with ErrDocumentExists if either already holds newID. Its clients
+// are sent Renamed and disconnected after a grace period, to reconnect at
+// newID, where a copy of the document without its history is served (see
+// copyDocument). If the database write fails, nothing changes.
+//
+// Connections racing the rename wait for it: doc's connectionCountMu keeps
+// them off the old ID, which they then find unloaded and start over with a
+// fresh document, and the copy's keeps them off the new ID until the rename
+// is done or undone.
+func (s *Server) renameDocument(docID string, doc *Document, newID string) error {
+	doc.connectionCountMu.Lock()
+	defer doc.connectionCountMu.Unlock()
+
+	if doc.unloaded {
+		return errDocumentGone
+	}
+	if _, ok := s.state.documents.Load(newID); ok {
+		return ErrDocumentExists
+	}
+
+	// Stop edits so the copy and the flush below see the final text, and the
+	// persister so it can't store the old ID again once the row has moved
+	doc.Kolabpad.Drain()
+	doc.stopPersister()
+	undo := func() {
+		doc.Kolabpad.undrain()
+		s.startPersister(docID, doc)
+	}
+
+	moved := s.copyDocument(doc)
+	moved.connectionCountMu.Lock()
+	defer moved.connectionCountMu.Unlock()
+	if _, loaded := s.state.documents.LoadOrStore(newID, moved); loaded {
+		undo()
+		return ErrDocumentExists
+	}
+
+	// CRITICAL: Write to DB FIRST (atomicity - prevents memory/DB desync).
+	// The flush makes the row that moves hold the final text.
+	ctx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+	_, err := doc.Kolabpad.Flush(ctx, s.state.db, docID)
+	cancel()
+	if err == nil {
+		err = s.state.db.Rename(docID, newID)
+	}
+	if err != nil {
+		moved.unloaded = true
+		s.state.documents.CompareAndDelete(newID, moved)
+		moved.Kolabpad.Kill()
+		undo()
+		if errors.Is(err, database.ErrExists) {
+			return ErrDocumentExists
+		}
+		return err
+	}
+
+	// Password sessions follow the document, so their holders can reconnect
+	// without signing in again
+	s.state.sessions.Range(func(key, value interface{}) bool {
+		if session := value.(passwordSession); session.docID == docID {
+			session.docID = newID
+			s.state.sessions.Store(key, session)
+		}
+		return true
+	})
+
+	doc.unloaded = true
+	s.state.documents.CompareAndDelete(docID, doc)
+	doc.Kolabpad.broadcast(protocol.NewRenamedMsg(newID))
+
+	// Give clients a moment to receive the notice before their sockets close
+	time.AfterFunc(shutdownGracePeriod, doc.Kolabpad.Kill)
+	return nil
+}
+
+// copyDocument returns a new Document with doc's text, language, OTP,
+// settings (size limit included) and saved cursors, for serving it under another ID. History,
+// users and reconnect sessions stay behind. The caller has drained doc.
+func (s *Server) copyDocument(doc *Document) *Document {
+	from := doc.Kolabpad
+	from.mu.RLock()
+	persisted, revision := from.persisted("")
+	var cursors []database.SavedCursor
+	if s.state.config.SavedCursors > 0 {
+		cursors = from.cursorsToSave()
+	}
+	from.mu.RUnlock()
+
+	kolabpad := FromPersistedDocument(persisted.Text, persisted.Language, persisted.OTP, &s.state.config)
+	kolabpad.storedRevisionBase = from.storedRevision(revision)
+	kolabpad.SetMaxSize(persisted.MaxSize)
+	if revision <= from.baseRevision && persisted.OTP == nil {
+		// Still an untouched template, so still discarded when left empty
+		kolabpad.baseRevision = kolabpad.revision()
+	}
+	if cursors != nil {
+		kolabpad.LoadSavedCursors(cursors)
+	}
+	return s.newDocument(kolabpad, doc.expiryOverride.Load(), doc.passwordHash.Load())
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/shiv248/kolabpad/internal/otutil"
+	"github.com/shiv248/kolabpad/internal/protocol"
+	"github.com/shiv248/kolabpad/pkg/logger"
+)
+
+// maxReplacePatternLength caps the find text of a replacement in bytes. Go
+// regular expressions match in linear time, so there's no backtracking to
+// time out, but a pattern's compiled size and matching cost grow with its
+// length.
+const maxReplacePatternLength = 1024
+
+// replacement is a find-and-replace over a document's text.
+type replacement struct {
+	Find    string `json:"find"`
+	Replace string `json:"replace"`
+	All     bool   `json:"all"`   // Replace every match, not just the first
+	Regex   bool   `json:"regex"` // Find is a regular expression (RE2 syntax) and Replace may use $1-style references
+}
+
+// compile validates rep and, in regex mode, compiles its pattern (nil
+// otherwise).
+func (rep replacement) compile() (*regexp.Regexp, error) {
+	if rep.Find == "" {
+		return nil, errors.New("find must not be empty")
+	}
+	if len(rep.Find) > maxReplacePatternLength {
+		return nil, fmt.Errorf("find must be at most %d bytes", maxReplacePatternLength)
+	}
+	if !rep.Regex {
+		return nil, nil
+	}
+	re, err := regexp.Compile(rep.Find)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regex: %w", err)
+	}
+	return re, nil
+}
+
+// apply returns text with rep applied, using re from compile, and the number
+// of replacements. Results over maxSize bytes fail with ErrDocumentTooLarge
+// before they're built in full.
+func (rep replacement) apply(text string, re *regexp.Regexp, maxSize int) (string, int, error) {
+	limit := 1
+	if rep.All {
+		limit = -1
+	}
+
+	if re == nil {
+		count := strings.Count(text, rep.Find)
+		if !rep.All {
+			count = min(count, 1)
+		}
+		if size := len(text) + count*(len(rep.Replace)-len(rep.Find)); size > maxSize {
+			return "", 0, fmt.Errorf("%w: %d bytes exceeds maximum of %d bytes", ErrDocumentTooLarge, size, maxSize)
+		}
+		return strings.Replace(text, rep.Find, rep.Replace, limit), count, nil
+	}
+
+	matches := re.FindAllStringSubmatchIndex(text, limit)
+	var out []byte
+	last := 0
+	for _, match := range matches {
+		out = append(out, text[last:match[0]]...)
+		out = re.ExpandString(out, rep.Replace, text, match)
+		last = match[1]
+		if len(out)+len(text)-last > maxSize {
+			return "", 0, fmt.Errorf("%w: more than %d bytes", ErrDocumentTooLarge, maxSize)
+		}
+	}
+	out = append(out, text[last:]...)
+	return string(out), len(matches), nil
+}
+
+// maxReplaceAttempts bounds how often replaceText starts over when the
+// history it would rebase across has been merged or trimmed meanwhile.
+const maxReplaceAttempts = 3
+
+// replaceText applies rep to the document as an edit by the System user and
+// returns the number of replacements. Matching and diffing cost up to
+// O((N+M)·maxDiffEdits), so they run on a snapshot outside the lock, and the
+// result is rebased over any edits made meanwhile like a client's edit.
+func (r *Kolabpad) replaceText(rep replacement, re *regexp.Regexp) (int, error) {
+	var err error
+	for attempt := 0; attempt < maxReplaceAttempts; attempt++ {
+		text, _, revision := r.textAt()
+		newText, count, replaceErr := rep.apply(text, re, r.maxDocumentSize())
+		if replaceErr != nil {
+			return 0, replaceErr
+		}
+		if newText == text {
+			return count, nil
+		}
+		logger.Debug("replaceText: %d replacement(s) at revision %d, docLen=%d -> %d", count, revision, len(text), len(newText))
+
+		// Diff so unchanged regions (and cursors in them) stay put
+		err = r.ApplyEdit(protocol.SystemUserID, revision, otutil.Diff(text, newText))
+		if !errors.Is(err, ErrHistoryTrimmed) && !errors.Is(err, ErrRevisionLag) {
+			return count, err
+		}
+	}
+	return 0, err
+}
+
+// handleReplace finds and replaces text in a document. The change is an
+// ordinary edit by the System user, so connected clients converge on it.
+// Protected documents require the current OTP.
+// Route: POST /api/document/{id}/replace
+func (s *Server) handleReplace(w http.ResponseWriter, r *http.Request, docID string) {
+	var reqBody struct {
+		UserID   uint64 `json:"user_id"`
+		UserName string `json:"user_name"`
+		OTP      string `json:"otp"` // Required if the document is protected
+		replacement
+	}
+	if !decodeRequestBody(w, r, &reqBody) {
+		return
+	}
+	re, err := reqBody.compile()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	doc := s.connectedDocument(w, r, docID, reqBody.UserID, reqBody.UserName, reqBody.OTP, "find and replace in")
+	if doc == nil {
+		return
+	}
+
+	count, err := doc.Kolabpad.replaceText(reqBody.replacement, re)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrDraining), errors.Is(err, ErrKilled):
+			http.Error(w, "document is draining", http.StatusServiceUnavailable)
+		case errors.Is(err, ErrDocumentTooLarge), errors.Is(err, ErrLineLimit):
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		case errors.Is(err, ErrHistoryTrimmed), errors.Is(err, ErrRevisionLag):
+			http.Error(w, "document is changing too quickly, try again", http.StatusConflict)
+		default:
+			logger.Error("Failed to replace in document %s: %v", docID, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	logger.Info("Document %s: %d replacement(s) by user %d (%s)", docID, count, reqBody.UserID, reqBody.UserName)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{
+		"replacements": count,
+	})
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/shiv248/kolabpad/internal/protocol"
+	"github.com/shiv248/kolabpad/pkg/logger"
+)
+
+// requestHandler answers a Request from c, returning the value to encode as
+// the Response result, or the error to send instead.
+type requestHandler func(c *Connection, req *protocol.RequestMsg) (any, *protocol.ErrorMsg)
+
+// serveRequests sets the handler for the client's Request messages. Call it
+// before Handle.
+func (c *Connection) serveRequests(h requestHandler) {
+	c.requests = h
+}
+
+// requestsFor returns the handler for Request messages on connections to
+// doc. The connection has already admitted the user, so unlike the REST
+// equivalents nothing re-checks that they're connected.
+func (s *Server) requestsFor(docID string, doc *Document) requestHandler {
+	return func(c *Connection, req *protocol.RequestMsg) (any, *protocol.ErrorMsg) {
+		switch req.Method {
+		case protocol.MethodStats:
+			return s.stats(), nil
+
+		case protocol.MethodProtect:
+			// The OTP would let a share link holder past their link's role
+			if c.access != nil {
+				logger.Info("User %d attempted to protect document %s with a share link", c.userID, docID)
+				return nil, &protocol.ErrorMsg{Code: protocol.ErrorCodeForbidden, Message: "share link holders can't change protection"}
+			}
+			if s.state.db == nil {
+				return nil, &protocol.ErrorMsg{Code: protocol.ErrorCodeUnavailable, Message: "database not enabled"}
+			}
+			var params struct {
+				OwnerKey string `json:"owner_key"`
+			}
+			if len(req.Params) > 0 {
+				if err := json.Unmarshal(req.Params, &params); err != nil {
+					return nil, &protocol.ErrorMsg{Code: protocol.ErrorCodeMalformedMessage, Message: "invalid params"}
+				}
+			}
+			otp, ownerKey, err := s.protectDocument(docID, doc, c.userID, c.getUserName(), params.OwnerKey)
+			if errors.Is(err, ErrNotOwner) {
+				logger.Info("User %d attempted to protect document %s without its owner key", c.userID, docID)
+				return nil, &protocol.ErrorMsg{Code: protocol.ErrorCodeForbidden, Message: "only the document owner can change protection"}
+			}
+			if err != nil {
+				logger.Error("Failed to protect document %s: %v", docID, err)
+				if errors.Is(err, ErrStorageFull) {
+					return nil, &protocol.ErrorMsg{Code: protocol.ErrorCodeStorageFull, Message: "document storage is full"}
+				}
+				return nil, &protocol.ErrorMsg{Code: protocol.ErrorCodeInternal, Message: "internal error"}
+			}
+			result := map[string]string{"otp": otp}
+			if ownerKey != "" {
+				result["owner_key"] = ownerKey
+			}
+			return result, nil
+
+		default:
+			return nil, &protocol.ErrorMsg{Code: protocol.ErrorCodeUnknownMethod, Message: "unknown method: " + req.Method}
+		}
+	}
+}
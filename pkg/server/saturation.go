@@ -0,0 +1,76 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shiv248/kolabpad/pkg/logger"
+)
+
+// A document's broadcast buffers are saturated once, over a
+// Config.SaturationWindow with at least saturationMinSends broadcast sends,
+// saturationPercent of them found the subscriber's buffer full. Those updates
+// were dropped, so clients see stale cursors and user lists until the next
+// presence snapshot.
+const (
+	saturationPercent  = 50
+	saturationMinSends = 32
+)
+
+// broadcastSaturation tracks how often a document's broadcasts find
+// subscriber buffers full. It has its own lock, since broadcast only holds
+// the document's for reading.
+type broadcastSaturation struct {
+	mu    sync.Mutex
+	start time.Time // Start of the current window
+	sends int       // Broadcast sends in the window, one per subscriber
+	full  int       // Of those, sends that found the buffer full
+
+	until atomic.Int64 // Unix nanoseconds the last saturated window is reported until (0 = healthy)
+}
+
+// recordBroadcast records a broadcast sent to sends subscribers, full of
+// which had no room for it. At the end of each window it judges whether the
+// buffers were saturated, logging when that changes.
+func (r *Kolabpad) recordBroadcast(sends, full int) {
+	window := r.config.SaturationWindow
+	if window <= 0 || sends == 0 {
+		return
+	}
+
+	s := &r.saturation
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.start.IsZero() {
+		s.start = now
+	}
+	s.sends += sends
+	s.full += full
+	if now.Sub(s.start) < window {
+		return
+	}
+
+	saturated := s.sends >= saturationMinSends && s.full*100 >= s.sends*saturationPercent
+	if saturated {
+		if s.until.Swap(now.Add(window).UnixNano()) == 0 {
+			logger.Warn("Broadcast buffers saturated: %d of %d sends in the last %v found a full buffer (%d subscribers); updates are being dropped, consider raising BROADCAST_BUFFER_SIZE",
+				s.full, s.sends, now.Sub(s.start).Round(time.Millisecond), sends)
+		}
+	} else if s.until.Swap(0) != 0 {
+		logger.Info("Broadcast buffers recovered: %d of %d sends in the last %v found a full buffer",
+			s.full, s.sends, now.Sub(s.start).Round(time.Millisecond))
+	}
+	s.start, s.sends, s.full = now, 0, 0
+}
+
+// BroadcastSaturated reports whether the document's broadcast buffers were
+// saturated in its last judged window. It stops reporting a window after
+// another one has passed, so a document that goes quiet doesn't stay
+// saturated.
+func (r *Kolabpad) BroadcastSaturated() bool {
+	until := r.saturation.until.Load()
+	return until != 0 && time.Now().UnixNano() < until
+}
@@ -1,8 +1,25 @@
 package server
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Password hashing parameters. Hashes are encoded as
+// "pbkdf2-sha256$<iterations>$<salt>$<key>" with unpadded base64 salt and key,
+// so the iteration count can be raised later without invalidating old hashes.
+const (
+	passwordScheme     = "pbkdf2-sha256"
+	passwordIterations = 600_000 // OWASP recommendation for PBKDF2-HMAC-SHA256
+	passwordSaltLen    = 16
+	passwordKeyLen     = sha256.Size
 )
 
 // GenerateOTP generates a cryptographically secure random 12-character OTP.
@@ -20,3 +37,105 @@ func GenerateOTP() string {
 	// RawURLEncoding has no padding (=)
 	return base64.RawURLEncoding.EncodeToString(b)
 }
+
+// generateSessionToken returns a random 32-character URL-safe token for
+// password sessions (see handlePasswordAuth) and owner keys.
+func generateSessionToken() string {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // Should never fail
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// documentIDChars and documentIDLength match the IDs the frontend makes up
+// for new documents (frontend/src/constants.ts).
+const (
+	documentIDChars  = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	documentIDLength = 6
+)
+
+// generateDocumentID returns a random document ID for POST
+// /api/document/new requests that don't name one.
+func generateDocumentID() string {
+	b := make([]byte, documentIDLength)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // Should never fail
+	}
+	for i := range b {
+		b[i] = documentIDChars[int(b[i])%len(documentIDChars)] // Slightly biased; IDs needn't be uniform
+	}
+	return string(b)
+}
+
+// hashPassword returns a salted PBKDF2-HMAC-SHA256 hash of password, for
+// storing in place of the plaintext.
+func hashPassword(password string) string {
+	salt := make([]byte, passwordSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err) // Should never fail
+	}
+	key := pbkdf2SHA256([]byte(password), salt, passwordIterations)
+	return fmt.Sprintf("%s$%d$%s$%s", passwordScheme, passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+// verifyPassword reports whether password matches a hash from hashPassword.
+// Malformed hashes never match.
+func verifyPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != passwordScheme {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(want) != passwordKeyLen {
+		return false
+	}
+
+	got := pbkdf2SHA256([]byte(password), salt, iterations)
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// pbkdf2SHA256 derives a single-block (32-byte) PBKDF2 key (RFC 8018) with
+// HMAC-SHA256. The module targets Go 1.23, which predates crypto/pbkdf2.
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, password)
+	prf.Write(salt)
+	prf.Write(binary.BigEndian.AppendUint32(nil, 1)) // Block index
+	u := prf.Sum(nil)
+
+	key := make([]byte, len(u))
+	copy(key, u)
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		subtle.XORBytes(key, key, u)
+	}
+	return key
+}
+
+// validReconnectToken reports whether a client-supplied reconnect token is
+// well-formed: 16-128 characters of letters, digits, '-' or '_' (covers UUIDs
+// and URL-safe base64).
+func validReconnectToken(token string) bool {
+	if len(token) < 16 || len(token) > 128 {
+		return false
+	}
+	for _, c := range token {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -3,7 +3,11 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -15,52 +19,121 @@ import (
 	"github.com/shiv248/kolabpad/pkg/logger"
 )
 
+// shutdownGracePeriod is the least time a Shutdown notice is given to reach
+// clients before the document is killed and their sockets are closed.
+// Config.ShutdownGrace can extend it for server shutdown.
+const shutdownGracePeriod = 250 * time.Millisecond
+
+// persistTimeout bounds a single document write, so a hung database can't
+// wedge the persister or a disconnecting client's flush.
+const persistTimeout = 10 * time.Second
+
+// shutdownFlushTimeout bounds Shutdown's flushes when its context has no
+// earlier deadline.
+const shutdownFlushTimeout = 10 * time.Second
+
 // Document represents a document entry in the server map.
 type Document struct {
 	LastAccessed      time.Time
 	Kolabpad          *Kolabpad
-	persisterCancel   context.CancelFunc // Cancel function to stop persister
-	persisterMu       sync.Mutex         // Protects persister start/stop
-	connectionCount   int                // Number of active connections
-	connectionCountMu sync.Mutex         // Protects connectionCount
+	persisterCancel   context.CancelFunc     // Cancel function to stop persister
+	persisterMu       sync.Mutex             // Protects persister start/stop
+	connectionCount   int                    // Active socket requests, drives the persister lifecycle (see Kolabpad.ConnectionCount for live sessions)
+	connectionCountMu sync.Mutex             // Protects connectionCount, idleSince and unloaded
+	idleSince         time.Time              // When connectionCount last dropped to 0 (zero while connected or never connected)
+	unloaded          bool                   // Set once the document was unloaded, discarded or renamed; connections must fetch it again
+	flushReq          chan chan error        // On-demand flush requests served by the persister
+	expiryOverride    atomic.Pointer[int]    // Per-document expiry in days (nil = server default, 0 = never)
+	passwordHash      atomic.Pointer[string] // Salted password hash (nil = no password), mirrors the DB
+}
+
+// stopPersister cancels the document's persister goroutine if one is running.
+func (d *Document) stopPersister() {
+	d.persisterMu.Lock()
+	defer d.persisterMu.Unlock()
+
+	if d.persisterCancel != nil {
+		d.persisterCancel()
+		d.persisterCancel = nil
+	}
+}
+
+// expiry returns how long the document may sit unaccessed before eviction, or
+// false if it never expires.
+func (d *Document) expiry(defaultDays int) (time.Duration, bool) {
+	days := defaultDays
+	if override := d.expiryOverride.Load(); override != nil {
+		if *override == 0 {
+			return 0, false
+		}
+		days = *override
+	}
+	return time.Duration(days) * 24 * time.Hour, true
 }
 
+// maxExpiryDays caps per-document expiry overrides (about ten years).
+const maxExpiryDays = 3650
+
 // ServerState holds all server-wide state.
 type ServerState struct {
-	documents           sync.Map // map[string]*Document
-	startTime           time.Time
-	db                  *database.Database // Optional database
-	maxDocumentSize     int
-	maxMessageSize      int64 // WebSocket message size limit (maxDocumentSize + overhead)
-	broadcastBufferSize int
-	wsReadTimeout       time.Duration
-	wsWriteTimeout      time.Duration
-	wsHeartbeatInterval time.Duration
+	documents  sync.Map // map[string]*Document
+	startTime  time.Time
+	db         Store // Optional persistence backend (nil = in-memory only)
+	config     Config
+	transforms *transformMetrics
+	sends      *sendMetrics
+	draining   atomic.Bool // Set by Shutdown; new connections are refused and documents drained
+	sessions   sync.Map    // map[string]passwordSession, issued by /api/document/{id}/auth
+
+	// integrityErr is the last integrity check's failure (nil = passed or never run)
+	integrityErr atomic.Pointer[error]
 }
 
 // NewServerState creates a new server state.
-func NewServerState(db *database.Database, maxDocumentSize, broadcastBufferSize int, wsReadTimeout, wsWriteTimeout, wsHeartbeatInterval time.Duration) *ServerState {
-	// Set message size limit to document size + 64KB overhead for JSON encoding
-	const overheadBytes = 64 * 1024
-	maxMessageSize := int64(maxDocumentSize + overheadBytes)
+func NewServerState(db Store, config Config) *ServerState {
+	if db != nil && config.MaxStoredDocuments > 0 {
+		db = newCappedStore(db, config.MaxStoredDocuments)
+	}
 
 	return &ServerState{
-		startTime:           time.Now(),
-		db:                  db,
-		maxDocumentSize:     maxDocumentSize,
-		maxMessageSize:      maxMessageSize,
-		broadcastBufferSize: broadcastBufferSize,
-		wsReadTimeout:       wsReadTimeout,
-		wsWriteTimeout:      wsWriteTimeout,
-		wsHeartbeatInterval: wsHeartbeatInterval,
+		startTime:  time.Now(),
+		db:         db,
+		config:     config,
+		transforms: &transformMetrics{},
+		sends:      &sendMetrics{},
 	}
 }
 
 // Stats represents server statistics.
 type Stats struct {
-	StartTime    int64 `json:"start_time"`    // Unix timestamp
-	NumDocuments int   `json:"num_documents"` // Active documents
-	DatabaseSize int   `json:"database_size"` // Documents in database (TODO)
+	StartTime      int64 `json:"start_time"`      // Unix timestamp
+	NumDocuments   int   `json:"num_documents"`   // Active documents
+	NumConnections int   `json:"num_connections"` // Live WebSocket connections across documents
+	DatabaseSize   int   `json:"database_size"`   // Documents in database (TODO)
+
+	Transforms TransformStats `json:"transforms"` // Transforms per edit, to spot clients stuck at old revisions
+	Sends      SendStats      `json:"sends"`      // Messages sent to clients, to spot slow consumers
+}
+
+// DetailedStats extends Stats with the operational data behind the ops
+// dashboard. It's served separately because it's costlier to collect.
+type DetailedStats struct {
+	Stats
+
+	UptimeSeconds       int64          `json:"uptime_seconds"`
+	OperationsApplied   uint64         `json:"operations_applied"`     // Operations committed since start
+	ResidentBytes       int64          `json:"resident_bytes"`         // Text size of active documents
+	Languages           map[string]int `json:"languages"`              // Active documents per language; "" is plain text
+	AvgUsersPerDocument float64        `json:"avg_users_per_document"` // Live connections per active document
+
+	Stored *StoredStats `json:"stored,omitempty"` // Omitted without a database or if it can't be read
+}
+
+// StoredStats summarizes the documents in the database.
+type StoredStats struct {
+	Documents int            `json:"documents"`
+	Bytes     int64          `json:"bytes"`     // Total text size
+	Languages map[string]int `json:"languages"` // Stored documents per language; "" is plain text
 }
 
 // Server is the main HTTP server.
@@ -70,15 +143,20 @@ type Server struct {
 }
 
 // NewServer creates a new HTTP server.
-func NewServer(db *database.Database, maxDocumentSize, broadcastBufferSize int, wsReadTimeout, wsWriteTimeout, wsHeartbeatInterval time.Duration) *Server {
+func NewServer(db Store, config Config) *Server {
 	s := &Server{
-		state: NewServerState(db, maxDocumentSize, broadcastBufferSize, wsReadTimeout, wsWriteTimeout, wsHeartbeatInterval),
+		state: NewServerState(db, config),
 		mux:   http.NewServeMux(),
 	}
 
 	// API routes (must be registered first for priority)
 	s.mux.HandleFunc("/api/socket/", s.handleSocket)
 	s.mux.HandleFunc("/api/stats", s.handleStats)
+	s.mux.HandleFunc("/api/stats/detailed", s.handleDetailedStats)
+	s.mux.HandleFunc("/api/version", s.handleVersion)
+	s.mux.HandleFunc("/api/ready", s.handleReady)
+	s.mux.HandleFunc("/api/announce", s.handleAnnounce)
+	s.mux.HandleFunc("/api/document/new", s.handleNewDocument)
 	s.mux.HandleFunc("/api/document/", s.handleDocument)
 
 	// Serve frontend static files from dist/
@@ -90,6 +168,10 @@ func NewServer(db *database.Database, maxDocumentSize, broadcastBufferSize int,
 
 // ServeHTTP implements http.Handler.
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.state.config.AccessLog {
+		s.serveWithAccessLog(w, r)
+		return
+	}
 	s.mux.ServeHTTP(w, r)
 }
 
@@ -98,126 +180,207 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func (s *Server) handleSocket(w http.ResponseWriter, r *http.Request) {
 	// Extract document ID from path
 	docID := r.URL.Path[len("/api/socket/"):]
-	if docID == "" {
-		http.Error(w, "document ID required", http.StatusBadRequest)
+	if err := s.state.config.validateDocumentID(docID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	logger.Info("WebSocket connection request for document: %s from %s", docID, s.clientIP(r))
+
+	if s.state.draining.Load() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Optional reconnect token lets a returning client reclaim its user ID
+	reconnectToken := r.URL.Query().Get("token")
+	if reconnectToken != "" && !validReconnectToken(reconnectToken) {
+		http.Error(w, "invalid reconnect token", http.StatusBadRequest)
 		return
 	}
 
-	logger.Info("WebSocket connection request for document: %s", docID)
+	// Optional revision a reconnecting client already holds, so it's only
+	// sent the history after it (see Connection.resumeAt)
+	resume := -1
+	if rev := r.URL.Query().Get("rev"); rev != "" {
+		n, err := strconv.Atoi(rev)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid revision", http.StatusBadRequest)
+			return
+		}
+		resume = n
+	}
 
-	// Validate OTP with dual-check pattern (prevents DoS)
+	// Validate OTP with dual-check pattern (prevents DoS). Share link tokens
+	// are accepted in place of the OTP (see authorizeOTP).
 	providedOTP := r.URL.Query().Get("otp")
 
-	// Fast path: Document already in memory
+	var link *database.ShareLink
+	var authorized bool
 	if val, ok := s.state.documents.Load(docID); ok {
+		// Fast path: Document already in memory
 		doc := val.(*Document)
-		if otp := doc.Kolabpad.GetOTP(); otp != nil {
-			if providedOTP != *otp {
-				http.Error(w, "Invalid or missing OTP", http.StatusUnauthorized)
-				logger.Info("Unauthorized access attempt for hot document: %s", docID)
-				return
-			}
+		if link, authorized = s.authorizeOTP(docID, providedOTP, doc.Kolabpad.GetOTP()); !authorized {
+			http.Error(w, "Invalid or missing OTP", http.StatusUnauthorized)
+			logger.Info("Unauthorized access attempt for hot document: %s from %s", docID, s.clientIP(r))
+			return
 		}
 	} else {
 		// Slow path: Document not in memory - validate from DB BEFORE loading
+		var otp *string
+		exists := false
 		if s.state.db != nil {
-			if persisted, err := s.state.db.Load(docID); err == nil && persisted != nil && persisted.OTP != nil {
-				if providedOTP != *persisted.OTP {
-					http.Error(w, "Invalid or missing OTP", http.StatusUnauthorized)
-					logger.Info("Unauthorized access attempt for cold document: %s (prevented DoS)", docID)
-					return
-				}
+			if stored, found, err := s.state.db.GetOTP(docID); err == nil && found {
+				otp, exists = stored, true
 			}
 		}
+		if !exists && !s.state.config.CreateOnConnect {
+			http.Error(w, "document not found", http.StatusNotFound)
+			logger.Info("Rejected connection to unknown document %s from %s", docID, s.clientIP(r))
+			return
+		}
+		if !exists && !s.state.config.canCreate(docID, r) {
+			http.Error(w, "Forbidden: document creation not allowed", http.StatusForbidden)
+			logger.Info("Rejected creation of document %s from %s", docID, s.clientIP(r))
+			return
+		}
+		if link, authorized = s.authorizeOTP(docID, providedOTP, otp); !authorized {
+			http.Error(w, "Invalid or missing OTP", http.StatusUnauthorized)
+			logger.Info("Unauthorized access attempt for cold document: %s from %s (prevented DoS)", docID, s.clientIP(r))
+			return
+		}
 	}
 
-	// Get or create document
-	doc := s.getOrCreateDocument(docID)
-	doc.LastAccessed = time.Now()
-
-	// Track connection count and start persister if needed
-	doc.connectionCountMu.Lock()
-	doc.connectionCount++
-	isFirstConnection := doc.connectionCount == 1
-	doc.connectionCountMu.Unlock()
-
-	// Start persister for first connection
-	if isFirstConnection && s.state.db != nil {
-		doc.persisterMu.Lock()
-		ctx, cancel := context.WithCancel(context.Background())
-		doc.persisterCancel = cancel
-		go s.persister(ctx, docID, doc.Kolabpad)
-		doc.persisterMu.Unlock()
-		logger.Info("Started persister for document %s (first connection)", docID)
+	// The password is checked separately from the OTP; documents may have both
+	if !s.authorizePassword(w, r, docID) {
+		return
 	}
 
-	// Ensure persister is stopped when last connection closes
-	defer func() {
-		doc.connectionCountMu.Lock()
-		doc.connectionCount--
-		isLastConnection := doc.connectionCount == 0
-		doc.connectionCountMu.Unlock()
-
-		if isLastConnection && s.state.db != nil {
-			doc.persisterMu.Lock()
-			if doc.persisterCancel != nil {
-				// Only flush if document was edited OR has OTP protection
-				revision := doc.Kolabpad.Revision()
-				otp := doc.Kolabpad.GetOTP()
-
-				if revision > 0 || otp != nil {
-					// Flush to DB immediately before stopping
-					text, language := doc.Kolabpad.Snapshot()
-
-					if err := s.state.db.Store(&database.PersistedDocument{
-						ID:       docID,
-						Text:     text,
-						Language: language,
-						OTP:      otp,
-					}); err != nil {
-						logger.Error("Failed to flush document %s on last disconnect: %v", docID, err)
-					} else {
-						logger.Debug("Flushed document %s on last disconnect (revision=%d, protected=%v)", docID, revision, otp != nil)
-					}
-				} else {
-					logger.Debug("Skipping flush for empty unprotected document %s (never edited)", docID)
-				}
-
-				// Stop persister
-				doc.persisterCancel()
-				doc.persisterCancel = nil
-				logger.Info("Stopped persister for document %s (last connection closed)", docID)
-			}
-			doc.persisterMu.Unlock()
-		}
-	}()
+	doc := s.acquireDocument(docID)
+	defer s.releaseDocument(docID, doc)
 
 	// Upgrade to WebSocket
 	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
-		CompressionMode: websocket.CompressionDisabled,
+		CompressionMode: s.state.config.WSCompression,
 	})
 	if err != nil {
 		logger.Error("WebSocket upgrade failed: %v", err)
 		return
 	}
 
-	// Set message size limit to prevent large message attacks while allowing document-sized operations
-	conn.SetReadLimit(s.state.maxMessageSize)
-
 	// Handle connection
-	connHandler := NewConnection(doc.Kolabpad, conn, s.state.wsReadTimeout, s.state.wsWriteTimeout, s.state.wsHeartbeatInterval)
-	_ = connHandler.Handle(r.Context())
+	connHandler := NewConnection(docID, doc.Kolabpad, conn, reconnectToken, &s.state.config)
+	if resume >= 0 {
+		connHandler.resumeAt(resume)
+	}
+	if link != nil {
+		logger.Info("User %d admitted to document %s with share link %q (%s)", connHandler.userID, docID, link.Label, link.Role)
+		connHandler.grantAccess(link)
+	}
+	connHandler.serveRequests(s.requestsFor(docID, doc))
+	observer := s.state.config.observer()
+	observer.OnConnect(docID, connHandler.userID)
+	handleErr := connHandler.Handle(r.Context())
+	code, reason := closeStatus(handleErr)
+	if code == websocket.StatusInternalError {
+		observer.OnError(docID, handleErr)
+	}
+	observer.OnDisconnect(docID, connHandler.userID, handleErr)
+	conn.Close(code, reason)
+}
+
+// acquireDocument gets or loads a document and counts a connection to it,
+// starting its persister for the first. Pair it with releaseDocument.
+func (s *Server) acquireDocument(docID string) *Document {
+	// A document unloaded between the lookup and the count is stale; fetch it
+	// again from the DB.
+	var doc *Document
+	var isFirstConnection bool
+	for doc == nil {
+		doc = s.getOrCreateDocument(docID)
+		doc.connectionCountMu.Lock()
+		if doc.unloaded {
+			doc.connectionCountMu.Unlock()
+			doc = nil
+			continue
+		}
+		doc.connectionCount++
+		doc.idleSince = time.Time{}
+		isFirstConnection = doc.connectionCount == 1
+		doc.connectionCountMu.Unlock()
+	}
+	doc.LastAccessed = time.Now()
+
+	// Start persister for first connection
+	if isFirstConnection && s.state.db != nil {
+		s.startPersister(docID, doc)
+		logger.Info("Started persister for document %s (first connection)", docID)
+	}
+	return doc
+}
+
+// startPersister runs a persister for doc under docID until stopPersister.
+func (s *Server) startPersister(docID string, doc *Document) {
+	doc.persisterMu.Lock()
+	defer doc.persisterMu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	doc.persisterCancel = cancel
+	go s.persister(ctx, docID, doc.Kolabpad, doc.flushReq)
+}
 
-	conn.Close(websocket.StatusNormalClosure, "")
+// releaseDocument uncounts a connection made with acquireDocument. The last
+// one out flushes the document and stops its persister.
+func (s *Server) releaseDocument(docID string, doc *Document) {
+	doc.connectionCountMu.Lock()
+	doc.connectionCount--
+	isLastConnection := doc.connectionCount == 0
+	discarded := false
+	if isLastConnection {
+		doc.idleSince = time.Now()
+		discarded = s.discardIfEmpty(docID, doc)
+	}
+	doc.connectionCountMu.Unlock()
+
+	if isLastConnection && !discarded && s.state.db != nil {
+		doc.persisterMu.Lock()
+		if doc.persisterCancel != nil {
+			// Flush to DB immediately before stopping
+			start := time.Now()
+			ctx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+			stored, err := doc.Kolabpad.Flush(ctx, s.state.db, docID)
+			cancel()
+			if err != nil {
+				logger.Error("Failed to flush document %s on last disconnect: %v", docID, err)
+			}
+			if stored || err != nil {
+				s.state.config.observer().OnPersist(docID, time.Since(start), err)
+			}
+
+			// Stop persister
+			doc.persisterCancel()
+			doc.persisterCancel = nil
+			logger.Info("Stopped persister for document %s (last connection closed)", docID)
+		}
+		doc.persisterMu.Unlock()
+	}
 }
 
 // handleStats returns server statistics.
 // Route: /api/stats
 func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
-	// Count active documents
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.stats())
+}
+
+// stats collects server statistics for /api/stats and the stats request.
+func (s *Server) stats() Stats {
+	// Count active documents and their live connections
 	numDocs := 0
+	numConns := 0
 	s.state.documents.Range(func(key, value interface{}) bool {
 		numDocs++
+		numConns += value.(*Document).Kolabpad.ConnectionCount()
 		return true
 	})
 
@@ -229,60 +392,254 @@ func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	stats := Stats{
-		StartTime:    s.state.startTime.Unix(),
-		NumDocuments: numDocs,
-		DatabaseSize: dbSize,
+	return Stats{
+		StartTime:      s.state.startTime.Unix(),
+		NumDocuments:   numDocs,
+		NumConnections: numConns,
+		DatabaseSize:   dbSize,
+		Transforms:     s.state.transforms.snapshot(),
+		Sends:          s.state.sends.snapshot(),
 	}
+}
 
+// handleDetailedStats returns server statistics with operational detail.
+// Route: /api/stats/detailed
+func (s *Server) handleDetailedStats(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(stats)
+	json.NewEncoder(w).Encode(s.detailedStats())
+}
+
+// detailedStats collects /api/stats/detailed. Resident figures come from the
+// active documents, stored ones from a summary query over the database.
+func (s *Server) detailedStats() DetailedStats {
+	stats := DetailedStats{
+		Stats:             s.stats(),
+		UptimeSeconds:     int64(time.Since(s.state.startTime).Seconds()),
+		OperationsApplied: s.state.transforms.applied.Load(),
+		Languages:         make(map[string]int),
+	}
+
+	s.state.documents.Range(func(key, value interface{}) bool {
+		text, language := value.(*Document).Kolabpad.Snapshot()
+		stats.ResidentBytes += int64(len(text))
+		if language != nil {
+			stats.Languages[*language]++
+		} else {
+			stats.Languages[""]++
+		}
+		return true
+	})
+	if stats.NumDocuments > 0 {
+		stats.AvgUsersPerDocument = float64(stats.NumConnections) / float64(stats.NumDocuments)
+	}
+
+	if s.state.db != nil {
+		summary, err := s.state.db.Summary()
+		if err != nil {
+			logger.Error("Failed to summarize stored documents: %v", err)
+		} else {
+			stats.Stored = &StoredStats{Documents: summary.Documents, Bytes: summary.TextBytes, Languages: summary.Languages}
+		}
+	}
+	return stats
 }
 
-// handleDocument handles document protection endpoints.
-// Route: /api/document/{id}/protect
+// documentActions are the endpoints under /api/document/{id}/.
+var documentActions = map[string]bool{"protect": true, "owner": true, "password": true, "auth": true, "links": true, "expiry": true, "raw": true, "stream": true, "snapshots": true, "debug": true, "rename": true, "max-size": true, "replace": true}
+
+// handleDocument handles document protection, ownership, password, share link, expiry, raw text, stream, snapshot, debug, rename, size limit and replace endpoints.
+// Routes: /api/document/{id}/protect, /api/document/{id}/owner, /api/document/{id}/password,
+// /api/document/{id}/auth, /api/document/{id}/links, /api/document/{id}/expiry,
+// /api/document/{id}/raw, /api/document/{id}/stream, /api/document/{id}/snapshots,
+// /api/document/{id}/debug, /api/document/{id}/rename, /api/document/{id}/max-size,
+// /api/document/{id}/replace
 func (s *Server) handleDocument(w http.ResponseWriter, r *http.Request) {
-	// Parse path to get document ID and action
+	// Parse path to get document ID and action. The action is the last
+	// segment; namespaced IDs contain a slash of their own.
 	path := r.URL.Path[len("/api/document/"):]
-	parts := strings.Split(path, "/")
-
-	if len(parts) != 2 || parts[0] == "" || parts[1] != "protect" {
+	i := strings.LastIndex(path, "/")
+	if i < 0 || !documentActions[path[i+1:]] {
 		http.Error(w, "invalid endpoint", http.StatusNotFound)
 		return
 	}
 
-	docID := parts[0]
+	docID, action := path[:i], path[i+1:]
+	if err := s.state.config.validateDocumentID(docID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Reading works for in-memory documents, so neither it, streaming nor debugging needs the database
+	if action == "raw" {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.handleRawDocument(w, r, docID)
+		return
+	}
+	if action == "stream" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.handleStream(w, r, docID)
+		return
+	}
+	if action == "debug" {
+		s.handleDocumentDebug(w, r, docID)
+		return
+	}
+
+	// Bound what the JSON handlers will read (see decodeRequestBody)
+	r.Body = http.MaxBytesReader(w, r.Body, int64(s.state.config.MaxRequestBodySize))
+
+	// Replacing edits the in-memory document, like any client
+	if action == "replace" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.handleReplace(w, r, docID)
+		return
+	}
 
 	if s.state.db == nil {
 		http.Error(w, "database not enabled", http.StatusServiceUnavailable)
 		return
 	}
 
-	switch r.Method {
-	case http.MethodPost:
+	switch {
+	case action == "protect" && r.Method == http.MethodPost:
 		s.handleProtectDocument(w, r, docID)
-	case http.MethodDelete:
+	case action == "protect" && r.Method == http.MethodDelete:
 		s.handleUnprotectDocument(w, r, docID)
+	case action == "owner" && r.Method == http.MethodPost:
+		s.handleTransferOwner(w, r, docID)
+	case action == "owner" && r.Method == http.MethodDelete:
+		s.handleReleaseOwner(w, r, docID)
+	case action == "password" && r.Method == http.MethodPost:
+		s.handleSetPassword(w, r, docID)
+	case action == "password" && r.Method == http.MethodDelete:
+		s.handleRemovePassword(w, r, docID)
+	case action == "auth" && r.Method == http.MethodPost:
+		s.handlePasswordAuth(w, r, docID)
+	case action == "links" && r.Method == http.MethodGet:
+		s.handleListShareLinks(w, r, docID)
+	case action == "links" && r.Method == http.MethodPost:
+		s.handleCreateShareLink(w, r, docID)
+	case action == "links" && r.Method == http.MethodDelete:
+		s.handleRevokeShareLink(w, r, docID)
+	case action == "expiry" && r.Method == http.MethodPut:
+		s.handleSetExpiry(w, r, docID)
+	case action == "snapshots" && r.Method == http.MethodGet:
+		s.handleListSnapshots(w, r, docID)
+	case action == "snapshots" && r.Method == http.MethodPost:
+		s.handleRestoreSnapshot(w, r, docID)
+	case action == "rename" && r.Method == http.MethodPost:
+		s.handleRenameDocument(w, r, docID)
+	case action == "max-size" && r.Method == http.MethodPut:
+		s.handleSetMaxSize(w, r, docID)
 	default:
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
+// handleRawDocument returns a document's current text as text/plain, for
+// scripts and link unfurlers that don't speak the WebSocket protocol.
+// Protected documents require ?otp= (the OTP or a share link), and password-protected ones a session
+// token or password (see authorizePassword). Documents that are only in the database
+// are read without loading them into memory.
+func (s *Server) handleRawDocument(w http.ResponseWriter, r *http.Request, docID string) {
+	var text string
+	var otp *string
+	if val, ok := s.state.documents.Load(docID); ok {
+		kolabpad := val.(*Document).Kolabpad
+		text, otp = kolabpad.Text(), kolabpad.GetOTP()
+		if _, ok := s.authorizeOTP(docID, r.URL.Query().Get("otp"), otp); !ok {
+			http.Error(w, "Invalid or missing OTP", http.StatusUnauthorized)
+			return
+		}
+		if !s.authorizePassword(w, r, docID) {
+			return
+		}
+	} else {
+		// Authorize before reading the (possibly large) text
+		var found bool
+		if s.state.db != nil {
+			var err error
+			if otp, found, err = s.state.db.GetOTP(docID); err != nil {
+				logger.Error("Failed to load document %s for raw read: %v", docID, err)
+				http.Error(w, "failed to load document", http.StatusInternalServerError)
+				return
+			}
+		}
+		if !found {
+			http.Error(w, "document not found", http.StatusNotFound)
+			return
+		}
+		if _, ok := s.authorizeOTP(docID, r.URL.Query().Get("otp"), otp); !ok {
+			http.Error(w, "Invalid or missing OTP", http.StatusUnauthorized)
+			return
+		}
+		if !s.authorizePassword(w, r, docID) {
+			return
+		}
+
+		persisted, err := s.state.db.Load(docID)
+		if err != nil {
+			logger.Error("Failed to load document %s for raw read: %v", docID, err)
+			http.Error(w, "failed to load document", http.StatusInternalServerError)
+			return
+		}
+		if persisted == nil {
+			http.Error(w, "document not found", http.StatusNotFound)
+			return
+		}
+		text = persisted.Text
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", "inline")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "no-store")
+	io.WriteString(w, text)
+}
+
+// decodeRequestBody decodes a JSON request body into v, writing 413 if the
+// body exceeded MaxRequestBodySize and 400 if it is otherwise malformed.
+// It returns false if an error response was written.
+func decodeRequestBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err == nil {
+		return true
+	}
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+	} else {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+	}
+	return false
+}
+
 // handleProtectDocument enables OTP protection for a document.
 func (s *Server) handleProtectDocument(w http.ResponseWriter, r *http.Request, docID string) {
 	// Parse request body to get user info
 	var reqBody struct {
 		UserID   uint64 `json:"user_id"`
 		UserName string `json:"user_name"`
+		OwnerKey string `json:"owner_key"` // Required if the server enforces owners and the document has one
 	}
-	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
-		http.Error(w, "invalid request body", http.StatusBadRequest)
+	if !decodeRequestBody(w, r, &reqBody) {
 		return
 	}
 
 	// Validate user is connected to the document
+	var doc *Document
 	if val, ok := s.state.documents.Load(docID); ok {
-		doc := val.(*Document)
+		doc = val.(*Document)
 		if !doc.Kolabpad.HasUser(reqBody.UserID) {
 			logger.Info("User %d (%s) attempted to protect document %s without being connected", reqBody.UserID, reqBody.UserName, docID)
 			http.Error(w, "Forbidden: not connected to document", http.StatusForbidden)
@@ -294,54 +651,72 @@ func (s *Server) handleProtectDocument(w http.ResponseWriter, r *http.Request, d
 		http.Error(w, "Forbidden: not connected to document", http.StatusForbidden)
 		return
 	}
+	if !s.documentPasswordSatisfied(w, r, doc, docID, reqBody.UserID, reqBody.UserName, "protect") {
+		return
+	}
+
+	otp, ownerKey, err := s.protectDocument(docID, doc, reqBody.UserID, reqBody.UserName, reqBody.OwnerKey)
+	if errors.Is(err, ErrNotOwner) {
+		logger.Info("User %d (%s) attempted to protect document %s without its owner key", reqBody.UserID, reqBody.UserName, docID)
+		http.Error(w, "Forbidden: only the document owner can change protection", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to protect document %s: %v", docID, err)
+		writeStoreError(w, err)
+		return
+	}
 
-	// Generate OTP
+	// Return OTP to client, and the owner key if they just became the owner
+	resp := map[string]string{"otp": otp}
+	if ownerKey != "" {
+		resp["owner_key"] = ownerKey
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// protectDocument generates a new OTP for doc on behalf of userID, stores it
+// and broadcasts it to the document's clients. The caller has checked that
+// the user is connected. If the database write fails, nothing changes.
+// With Config.DocumentOwners, ownerKey must match an owned document's key
+// (else ErrNotOwner), and protecting an unowned one makes the user its
+// owner: the new key is returned, and is "" otherwise.
+func (s *Server) protectDocument(docID string, doc *Document, userID uint64, userName, ownerKey string) (string, string, error) {
+	if s.state.config.DocumentOwners {
+		return s.protectOwnedDocument(docID, doc, userID, userName, ownerKey)
+	}
 	otp := GenerateOTP()
 
 	// CRITICAL: Write to DB FIRST (atomicity - prevents memory/DB desync)
 	// Check if document exists in DB, if not create it
-	doc, err := s.state.db.Load(docID)
+	exists, err := s.state.db.Exists(docID)
 	if err != nil {
-		logger.Error("Failed to load document: %v", err)
-		http.Error(w, "internal error", http.StatusInternalServerError)
-		return
+		return "", "", fmt.Errorf("check document: %w", err)
 	}
 
-	if doc == nil {
+	if !exists {
 		// Document doesn't exist in DB yet, create it
-		doc = &database.PersistedDocument{
+		err = s.state.db.Store(&database.PersistedDocument{
 			ID:       docID,
 			Text:     "",
 			Language: nil,
 			OTP:      &otp,
-		}
-		if err := s.state.db.Store(doc); err != nil {
-			logger.Error("Failed to store document: %v", err)
-			http.Error(w, "internal error", http.StatusInternalServerError)
-			return // DB write failed - do NOT update memory
-		}
+		})
 	} else {
 		// Update existing document's OTP
-		if err := s.state.db.UpdateOTP(docID, &otp); err != nil {
-			logger.Error("Failed to update OTP: %v", err)
-			http.Error(w, "internal error", http.StatusInternalServerError)
-			return // DB write failed - do NOT update memory
-		}
+		err = s.state.db.UpdateOTP(docID, &otp)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("store OTP: %w", err) // DB write failed - do NOT update memory
 	}
 
-	logger.Info("Document %s protected with OTP by user %d (%s) (DB write successful)", docID, reqBody.UserID, reqBody.UserName)
+	logger.Info("Document %s protected with OTP by user %d (%s) (DB write successful)", docID, userID, userName)
 
 	// DB write successful - NOW update memory and broadcast
-	if val, ok := s.state.documents.Load(docID); ok {
-		doc := val.(*Document)
-		doc.Kolabpad.SetOTP(&otp, reqBody.UserID, reqBody.UserName) // Updates memory + broadcasts to clients
-	}
-
-	// Return OTP to client
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"otp": otp,
-	})
+	doc.Kolabpad.SetOTP(&otp, userID, userName) // Updates memory + broadcasts to clients
+	s.state.config.observer().OnProtect(docID, userID, true)
+	return otp, "", nil
 }
 
 // handleUnprotectDocument disables OTP protection for a document.
@@ -350,10 +725,10 @@ func (s *Server) handleUnprotectDocument(w http.ResponseWriter, r *http.Request,
 	var reqBody struct {
 		UserID   uint64 `json:"user_id"`
 		UserName string `json:"user_name"`
-		OTP      string `json:"otp"` // Current OTP required for security
+		OTP      string `json:"otp"`       // Current OTP required for security
+		OwnerKey string `json:"owner_key"` // Required if the server enforces owners and the document has one
 	}
-	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
-		http.Error(w, "invalid request body", http.StatusBadRequest)
+	if !decodeRequestBody(w, r, &reqBody) {
 		return
 	}
 
@@ -372,6 +747,9 @@ func (s *Server) handleUnprotectDocument(w http.ResponseWriter, r *http.Request,
 		http.Error(w, "Forbidden: not connected to document", http.StatusForbidden)
 		return
 	}
+	if !s.documentPasswordSatisfied(w, r, doc, docID, reqBody.UserID, reqBody.UserName, "unprotect") {
+		return
+	}
 
 	// CRITICAL SECURITY: Validate the provided OTP matches the current OTP
 	// This prevents anyone who just knows the document ID from disabling protection
@@ -388,7 +766,19 @@ func (s *Server) handleUnprotectDocument(w http.ResponseWriter, r *http.Request,
 
 	// CRITICAL: Write to DB FIRST (atomicity - prevents memory/DB desync)
 	// Remove OTP by setting it to NULL
-	if err := s.state.db.UpdateOTP(docID, nil); err != nil {
+	if s.state.config.DocumentOwners {
+		ok, _, err := s.state.db.UpdateOTPAsOwner(docID, nil, reqBody.OwnerKey, "")
+		if err != nil {
+			logger.Error("Failed to remove OTP: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return // DB write failed - do NOT update memory
+		}
+		if !ok {
+			logger.Info("User %d (%s) attempted to unprotect document %s without its owner key", reqBody.UserID, reqBody.UserName, docID)
+			http.Error(w, "Forbidden: only the document owner can change protection", http.StatusForbidden)
+			return
+		}
+	} else if err := s.state.db.UpdateOTP(docID, nil); err != nil {
 		logger.Error("Failed to remove OTP: %v", err)
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return // DB write failed - do NOT update memory
@@ -398,10 +788,81 @@ func (s *Server) handleUnprotectDocument(w http.ResponseWriter, r *http.Request,
 
 	// DB write successful - NOW update memory and broadcast
 	doc.Kolabpad.SetOTP(nil, reqBody.UserID, reqBody.UserName) // Updates memory + broadcasts to clients
+	s.state.config.observer().OnProtect(docID, reqBody.UserID, false)
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// handleSetExpiry sets or clears a document's expiry override.
+// Protected documents require the current OTP.
+func (s *Server) handleSetExpiry(w http.ResponseWriter, r *http.Request, docID string) {
+	var reqBody struct {
+		UserID     uint64 `json:"user_id"`
+		UserName   string `json:"user_name"`
+		OTP        string `json:"otp"`         // Required if the document is protected
+		ExpiryDays *int   `json:"expiry_days"` // null = server default, 0 = never expire
+	}
+	if !decodeRequestBody(w, r, &reqBody) {
+		return
+	}
+	if reqBody.ExpiryDays != nil && (*reqBody.ExpiryDays < 0 || *reqBody.ExpiryDays > maxExpiryDays) {
+		http.Error(w, fmt.Sprintf("expiry_days must be between 0 and %d", maxExpiryDays), http.StatusBadRequest)
+		return
+	}
+
+	doc := s.connectedDocument(w, r, docID, reqBody.UserID, reqBody.UserName, reqBody.OTP, "set the expiry of")
+	if doc == nil {
+		return
+	}
+
+	// CRITICAL: Write to DB FIRST (atomicity - prevents memory/DB desync)
+	exists, err := s.state.db.Exists(docID)
+	if err != nil {
+		logger.Error("Failed to check document: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	if !exists {
+		text, language := doc.Kolabpad.Snapshot()
+		err = s.state.db.Store(&database.PersistedDocument{
+			ID:         docID,
+			Text:       text,
+			Language:   language,
+			OTP:        doc.Kolabpad.GetOTP(),
+			ExpiryDays: reqBody.ExpiryDays,
+			MaxSize:    doc.Kolabpad.MaxSize(),
+		})
+	} else {
+		err = s.state.db.UpdateExpiry(docID, reqBody.ExpiryDays)
+	}
+	if err != nil {
+		logger.Error("Failed to update expiry: %v", err)
+		writeStoreError(w, err)
+		return // DB write failed - do NOT update memory
+	}
+
+	doc.expiryOverride.Store(reqBody.ExpiryDays)
+	logger.Info("Document %s expiry set to %s by user %d (%s)", docID, formatExpiry(reqBody.ExpiryDays), reqBody.UserID, reqBody.UserName)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]*int{
+		"expiry_days": reqBody.ExpiryDays,
+	})
+}
+
+// formatExpiry describes an expiry override for logging.
+func formatExpiry(days *int) string {
+	switch {
+	case days == nil:
+		return "server default"
+	case *days == 0:
+		return "never"
+	default:
+		return strconv.Itoa(*days) + " days"
+	}
+}
+
 // getOrCreateDocument gets an existing document or creates a new one.
 func (s *Server) getOrCreateDocument(id string) *Document {
 	// Try to load existing
@@ -411,46 +872,200 @@ func (s *Server) getOrCreateDocument(id string) *Document {
 
 	// Try loading from database
 	var kolabpad *Kolabpad
+	var expiryOverride *int
+	var passwordHash *string
 	if s.state.db != nil {
 		if persisted, err := s.state.db.Load(id); err == nil && persisted != nil {
 			logger.Debug("Loaded document %s from database", id)
-			kolabpad = FromPersistedDocument(persisted.Text, persisted.Language, persisted.OTP, s.state.maxDocumentSize, s.state.broadcastBufferSize)
+			kolabpad = FromPersistedDocument(persisted.Text, persisted.Language, persisted.OTP, &s.state.config)
+			kolabpad.storedRevisionBase = persisted.Revision
+			expiryOverride = persisted.ExpiryDays
+			passwordHash = persisted.PasswordHash
+			kolabpad.SetMaxSize(persisted.MaxSize)
+
+			if s.state.config.SavedCursors > 0 {
+				if saved, err := s.state.db.LoadCursors(id); err != nil {
+					logger.Warn("Failed to load saved cursors of document %s: %v", id, err)
+				} else {
+					kolabpad.LoadSavedCursors(saved)
+				}
+			}
 		}
 	}
 
-	// Create new document if not in database
+	// Create new document from the configured template if not in database
 	if kolabpad == nil {
-		kolabpad = NewKolabpad(s.state.maxDocumentSize, s.state.broadcastBufferSize)
+		kolabpad = FromTemplate(&s.state.config)
 	}
+	doc := s.newDocument(kolabpad, expiryOverride, passwordHash)
+
+	// Store with LoadOrStore to handle race conditions
+	actual, _ := s.state.documents.LoadOrStore(id, doc)
+	return actual.(*Document)
+}
+
+// newDocument wraps kolabpad in a Document sharing the server's metrics.
+func (s *Server) newDocument(kolabpad *Kolabpad, expiryOverride *int, passwordHash *string) *Document {
+	kolabpad.metrics = s.state.transforms
+	kolabpad.sends = s.state.sends
 
 	doc := &Document{
 		LastAccessed: time.Now(),
 		Kolabpad:     kolabpad,
+		flushReq:     make(chan chan error),
 	}
-
-	// Store with LoadOrStore to handle race conditions
-	actual, _ := s.state.documents.LoadOrStore(id, doc)
-	return actual.(*Document)
+	doc.expiryOverride.Store(expiryOverride)
+	doc.passwordHash.Store(passwordHash)
+	return doc
 }
 
-// StartCleaner starts the background document cleanup task.
+// StartCleaner starts the background document cleanup task. With
+// Config.IntegrityInterval set and a database, it also checks the
+// database's integrity that often (see checkIntegrity).
 func (s *Server) StartCleaner(ctx context.Context, expiryDays int, cleanupInterval time.Duration) {
 	ticker := time.NewTicker(cleanupInterval)
 	defer ticker.Stop()
 
+	var integrity <-chan time.Time // nil blocks forever when checks are off
+	if interval := s.state.config.IntegrityInterval; interval > 0 && s.state.db != nil {
+		integrityTicker := time.NewTicker(interval)
+		defer integrityTicker.Stop()
+		integrity = integrityTicker.C
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
 			s.cleanupExpiredDocuments(expiryDays)
+		case <-integrity:
+			s.checkIntegrity()
+		}
+	}
+}
+
+// StartPresenceHeartbeat periodically broadcasts the full user list of every
+// active document (see Kolabpad.BroadcastPresence) until ctx is cancelled.
+func (s *Server) StartPresenceHeartbeat(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.state.documents.Range(func(key, value interface{}) bool {
+				value.(*Document).Kolabpad.BroadcastPresence()
+				return true
+			})
+		}
+	}
+}
+
+// StartIdleUnloader periodically unloads documents that have had no
+// connections for at least idle (see unloadIdleDocuments) until ctx is
+// cancelled. Documents are checked every idle/2, so one may stay resident for
+// up to 1.5x idle. It does nothing without a database, where unloading would
+// lose the document.
+func (s *Server) StartIdleUnloader(ctx context.Context, idle time.Duration) {
+	if s.state.db == nil {
+		return
+	}
+
+	ticker := time.NewTicker(max(idle/2, time.Second))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.unloadIdleDocuments(idle)
+		}
+	}
+}
+
+// unloadIdleDocuments flushes and removes documents that have had no
+// connections for longer than idle. Unlike expiry they stay in the database,
+// so the next connection reloads them. A document whose flush fails stays
+// resident and is retried on the next sweep.
+func (s *Server) unloadIdleDocuments(idle time.Duration) {
+	now := time.Now()
+	unloaded := 0
+
+	s.state.documents.Range(func(key, value interface{}) bool {
+		docID := key.(string)
+		doc := value.(*Document)
+
+		// Holding connectionCountMu keeps new connections out until the
+		// document is either unloaded or left alone
+		doc.connectionCountMu.Lock()
+		defer doc.connectionCountMu.Unlock()
+
+		if doc.connectionCount > 0 || doc.idleSince.IsZero() || now.Sub(doc.idleSince) < idle {
+			return true
+		}
+
+		// Flush before removing so a reconnect never loads a stale copy
+		ctx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+		defer cancel()
+		if _, err := doc.Kolabpad.Flush(ctx, s.state.db, docID); err != nil {
+			logger.Error("Failed to flush idle document %s, keeping it resident: %v", docID, err)
+			return true
+		}
+		doc.unloaded = true
+		s.state.documents.CompareAndDelete(docID, doc)
+		doc.stopPersister()
+		doc.Kolabpad.Kill()
+		unloaded++
+		return true
+	})
+
+	if unloaded > 0 {
+		logger.Debug("Unloaded %d idle document(s)", unloaded)
+	}
+}
+
+// discardIfEmpty removes a document that nobody edited, protected or
+// configured from memory and the database, so throwaway documents don't
+// linger until expiry. Without Config.CreateOnConnect documents are only
+// made on purpose and nothing is discarded, as connecting couldn't bring
+// them back. It reports whether the document was removed. The
+// caller must hold doc.connectionCountMu with no connections left, which
+// keeps new connections out until the document is gone; they then see it
+// unloaded and start over with a fresh one.
+func (s *Server) discardIfEmpty(docID string, doc *Document) bool {
+	// Documents are only made on purpose (POST /api/document/new), and
+	// connecting to a discarded one would get 404 rather than recreate it
+	if !s.state.config.CreateOnConnect {
+		return false
+	}
+	// A renamed document's ID may already belong to a new one
+	if doc.unloaded || !doc.Kolabpad.Untouched() || doc.passwordHash.Load() != nil || doc.expiryOverride.Load() != nil {
+		return false
+	}
+
+	// Delete from the DB first, while the document still keeps out new
+	// connections, so a new copy's saves can't be deleted with it
+	if s.state.db != nil {
+		if err := s.state.db.Delete(docID); err != nil {
+			logger.Error("Failed to delete empty document %s, keeping it resident: %v", docID, err)
+			return false
 		}
 	}
+	doc.unloaded = true
+	s.state.documents.CompareAndDelete(docID, doc)
+	doc.stopPersister()
+	doc.Kolabpad.Kill()
+	logger.Debug("Discarded empty document %s (last connection closed)", docID)
+	return true
 }
 
 // cleanupExpiredDocuments removes documents that haven't been accessed recently.
+// expiryDays applies to documents without a per-document override.
 func (s *Server) cleanupExpiredDocuments(expiryDays int) {
-	expiry := time.Duration(expiryDays) * 24 * time.Hour
 	now := time.Now()
 	var toDelete []string
 
@@ -458,7 +1073,7 @@ func (s *Server) cleanupExpiredDocuments(expiryDays int) {
 		docID := key.(string)
 		doc := value.(*Document)
 
-		if now.Sub(doc.LastAccessed) > expiry {
+		if expiry, expires := doc.expiry(expiryDays); expires && now.Sub(doc.LastAccessed) > expiry {
 			toDelete = append(toDelete, docID)
 		}
 		return true
@@ -467,116 +1082,126 @@ func (s *Server) cleanupExpiredDocuments(expiryDays int) {
 	if len(toDelete) > 0 {
 		logger.Debug("cleaner removing %d document(s): %v", len(toDelete), toDelete)
 
+		evicted := make(map[string]*Document, len(toDelete))
 		for _, id := range toDelete {
-			if val, ok := s.state.documents.LoadAndDelete(id); ok {
+			if val, ok := s.state.documents.Load(id); ok {
 				doc := val.(*Document)
+				doc.Kolabpad.BroadcastShutdown("document evicted after inactivity", true)
+				evicted[id] = doc
+			}
+		}
 
-				// Only flush if document was edited OR has OTP protection
-				if s.state.db != nil {
-					revision := doc.Kolabpad.Revision()
-					otp := doc.Kolabpad.GetOTP()
-
-					if revision > 0 || otp != nil {
-						text, language := doc.Kolabpad.Snapshot()
-
-						if err := s.state.db.Store(&database.PersistedDocument{
-							ID:       id,
-							Text:     text,
-							Language: language,
-							OTP:      otp,
-						}); err != nil {
-							logger.Error("Failed to flush document %s before eviction: %v", id, err)
-						} else {
-							logger.Debug("Flushed document %s before eviction (revision=%d, protected=%v)", id, revision, otp != nil)
-						}
-					} else {
-						logger.Debug("Skipping flush for empty unprotected document %s before eviction", id)
-					}
-
-					// Stop persister if running
-					doc.persisterMu.Lock()
-					if doc.persisterCancel != nil {
-						doc.persisterCancel()
-						doc.persisterCancel = nil
-					}
-					doc.persisterMu.Unlock()
-				}
+		// Give clients a moment to receive the notice before their sockets close
+		time.Sleep(shutdownGracePeriod)
 
-				// Kill document
-				doc.Kolabpad.Kill()
-			}
+		for id, doc := range evicted {
+			s.evictDocument(id, doc)
 		}
 	}
 }
 
+// evictDocument flushes doc and removes it from memory. Like
+// unloadIdleDocuments it flushes while the document is still loaded and
+// keeps new connections out until it's gone, so a client reconnecting
+// meanwhile loads the final text rather than racing a stale copy's write;
+// if the flush fails the document stays resident.
+func (s *Server) evictDocument(docID string, doc *Document) {
+	doc.connectionCountMu.Lock()
+	defer doc.connectionCountMu.Unlock()
+
+	if doc.unloaded {
+		return
+	}
+
+	// Refuse edits so the flush captures the final text
+	doc.Kolabpad.Drain()
+	ctx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+	defer cancel()
+	if _, err := doc.Kolabpad.Flush(ctx, s.state.db, docID); err != nil {
+		doc.Kolabpad.undrain()
+		logger.Error("Failed to flush document %s before eviction, keeping it resident: %v", docID, err)
+		return
+	}
+	doc.unloaded = true
+	s.state.documents.CompareAndDelete(docID, doc)
+	doc.stopPersister()
+	doc.Kolabpad.Kill()
+}
+
+// HTTPServer returns an *http.Server for s on addr with the configured
+// header, keep-alive and size limits. ReadTimeout and WriteTimeout are left
+// unset: they would also bound the request that upgrades to a WebSocket,
+// which lives for as long as the client stays (see Config.WSReadTimeout).
+func (s *Server) HTTPServer(addr string) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           s,
+		ReadHeaderTimeout: s.state.config.ReadHeaderTimeout,
+		IdleTimeout:       s.state.config.IdleTimeout,
+		MaxHeaderBytes:    s.state.config.MaxHeaderSize,
+	}
+}
+
 // ListenAndServe starts the HTTP server.
 func (s *Server) ListenAndServe(addr string) error {
 	logger.Info("Server listening on %s", addr)
-	return http.ListenAndServe(addr, s)
+	return s.HTTPServer(addr).ListenAndServe()
 }
 
 // Shutdown gracefully shuts down the server.
 func (s *Server) Shutdown(ctx context.Context) error {
-	if s.state.db == nil {
-		// No database - just kill all documents
-		s.state.documents.Range(func(key, value interface{}) bool {
-			doc := value.(*Document)
-			doc.Kolabpad.Kill()
-			return true
-		})
-		return nil
+	if s.state.db != nil {
+		logger.Info("Graceful shutdown: flushing all documents to DB")
 	}
 
-	logger.Info("Graceful shutdown: flushing all documents to DB")
-
-	// Flush all documents in parallel with timeout
-	var wg sync.WaitGroup
-	var flushedCount, skippedCount, errorCount int32
+	// Refuse new connections while documents are drained and flushed
+	s.state.draining.Store(true)
 
+	// Stop edits first so the flushes below see the final text, then give
+	// clients the grace period to save local state and show the notice
+	// before their sockets close
+	docs := make(map[string]*Document)
 	s.state.documents.Range(func(key, value interface{}) bool {
-		docID := key.(string)
 		doc := value.(*Document)
+		doc.Kolabpad.Drain()
+		doc.Kolabpad.BroadcastShutdown("server shutting down", false)
+		docs[key.(string)] = doc
+		return true
+	})
+	if len(docs) > 0 {
+		grace := max(s.state.config.ShutdownGrace, shutdownGracePeriod)
+		select {
+		case <-time.After(grace):
+		case <-ctx.Done():
+			logger.Warn("Shutdown grace period cut short (%v)", ctx.Err())
+		}
+	}
+
+	// Bound the flushes even if ctx has no deadline; a hung database then
+	// fails them instead of blocking. The budget starts after the grace
+	// period, so a long one doesn't eat into it.
+	ctx, cancel := context.WithTimeout(ctx, shutdownFlushTimeout)
+	defer cancel()
 
+	// Flush and kill all documents in parallel with timeout
+	var wg sync.WaitGroup
+	var closedCount, errorCount int32
+
+	for docID, doc := range docs {
 		wg.Add(1)
 		go func(id string, d *Document) {
 			defer wg.Done()
 
-			// Only flush if document was edited OR has OTP protection
-			revision := d.Kolabpad.Revision()
-			otp := d.Kolabpad.GetOTP()
-
-			if revision > 0 || otp != nil {
-				// Flush to DB
-				text, language := d.Kolabpad.Snapshot()
-
-				if err := s.state.db.Store(&database.PersistedDocument{
-					ID:       id,
-					Text:     text,
-					Language: language,
-					OTP:      otp,
-				}); err != nil {
-					logger.Error("Failed to flush document %s during shutdown: %v", id, err)
-					atomic.AddInt32(&errorCount, 1)
-				} else {
-					logger.Debug("Flushed document %s during shutdown (revision=%d, protected=%v)", id, revision, otp != nil)
-					atomic.AddInt32(&flushedCount, 1)
-				}
-			} else {
-				logger.Debug("Skipping flush for empty unprotected document %s during shutdown", id)
-				atomic.AddInt32(&skippedCount, 1)
-			}
+			d.stopPersister()
 
-			// Stop persister if running
-			d.persisterMu.Lock()
-			if d.persisterCancel != nil {
-				d.persisterCancel()
-				d.persisterCancel = nil
+			if err := d.Kolabpad.Close(ctx, s.state.db, id); err != nil {
+				logger.Error("Failed to flush document %s during shutdown: %v", id, err)
+				atomic.AddInt32(&errorCount, 1)
+			} else {
+				atomic.AddInt32(&closedCount, 1)
 			}
-			d.persisterMu.Unlock()
 		}(docID, doc)
-
-		return true
-	})
+	}
 
 	// Wait for all flushes with timeout
 	done := make(chan struct{})
@@ -587,12 +1212,12 @@ func (s *Server) Shutdown(ctx context.Context) error {
 
 	select {
 	case <-done:
-		logger.Info("Shutdown flush complete: %d flushed, %d skipped (empty), %d errors", flushedCount, skippedCount, errorCount)
-	case <-time.After(10 * time.Second):
-		logger.Error("Shutdown timeout after 10s, some documents may not be flushed")
+		logger.Info("Shutdown flush complete: %d closed, %d errors", closedCount, errorCount)
+	case <-ctx.Done():
+		logger.Error("Shutdown flush cut short (%v), some documents may not be flushed", ctx.Err())
 	}
 
-	// Kill all documents
+	// Kill any documents whose flush didn't finish in time
 	s.state.documents.Range(func(key, value interface{}) bool {
 		doc := value.(*Document)
 		doc.Kolabpad.Kill()
@@ -604,7 +1229,9 @@ func (s *Server) Shutdown(ctx context.Context) error {
 }
 
 // persister periodically saves a document to the database with lazy persistence.
-func (s *Server) persister(ctx context.Context, id string, kolabpad *Kolabpad) {
+// It also serves on-demand requests from flushReq, replying on the given
+// channel once the write has completed (used by tests to avoid sleeping).
+func (s *Server) persister(ctx context.Context, id string, kolabpad *Kolabpad, flushReq <-chan chan error) {
 	if s.state.db == nil {
 		return
 	}
@@ -613,18 +1240,76 @@ func (s *Server) persister(ctx context.Context, id string, kolabpad *Kolabpad) {
 	const idleWriteThreshold = 30 * time.Second
 	const safetyNetInterval = 5 * time.Minute
 
-	lastPersistedRev := 0
+	lastPersistedRev := kolabpad.baseRevision // An untouched template isn't worth storing
 	lastPersistTime := time.Now()
+	breaker := &storeBreaker{}
+	snapshots := snapshotMark{at: time.Now(), revision: kolabpad.Revision()}
+
+	store := func(reason string) error {
+		// OTP comes from memory, not DB
+		kolabpad.mu.RLock()
+		doc, revision := kolabpad.persisted(id)
+		kolabpad.mu.RUnlock()
+
+		logger.Debug("persisting document %s: reason=%s, revision=%d, timeSinceEdit=%v, timeSincePersist=%v",
+			id, reason, revision, time.Since(kolabpad.LastEditTime()), time.Since(lastPersistTime))
+
+		start := time.Now()
+		writeCtx, cancel := context.WithTimeout(ctx, persistTimeout)
+		stored, err := storeWithRetry(writeCtx, s.state.db, doc, kolabpad.storedRevision(revision))
+		cancel()
+		s.state.config.observer().OnPersist(id, time.Since(start), err)
+		if errors.Is(err, ErrStorageFull) {
+			// Not a database failure, so leave the breaker alone. Wait for the
+			// next edit before trying again; a slot may have freed up by then.
+			logger.Info("not persisting document %s: %v", id, err)
+			kolabpad.SetStorageFull(true)
+			lastPersistedRev = revision
+			lastPersistTime = time.Now()
+			return err
+		}
+		if breaker.record(err, time.Now()) {
+			if breaker.open() {
+				logger.Warn("persistence degraded for document %s after %d consecutive failures, retrying from %v",
+					id, breaker.failures, breaker.retryAt.Format(time.RFC3339))
+			} else {
+				logger.Info("persistence restored for document %s", id)
+			}
+			kolabpad.SetPersistenceDegraded(breaker.open())
+		}
+		if err != nil {
+			logger.Error("error persisting document %s: %v", id, err)
+			return err
+		}
+		kolabpad.SetStorageFull(false)
+		if stored {
+			kolabpad.markPersisted(revision)
+		} else {
+			// A flush that raced this one already stored a later revision
+			logger.Debug("skipped persisting document %s at revision %d: a later one is stored", id, revision)
+		}
+		lastPersistedRev = revision
+		lastPersistTime = time.Now()
+		return nil
+	}
 
 	ticker := time.NewTicker(persistCheckInterval)
 	defer ticker.Stop()
 
 	for {
+		var flushDone chan error
 		select {
 		case <-ctx.Done():
 			logger.Debug("persister for document %s stopped (context cancelled)", id)
 			return
 		case <-ticker.C:
+		case flushDone = <-flushReq:
+		}
+
+		// On-demand flush bypasses the triggers below
+		if flushDone != nil {
+			flushDone <- store("requested")
+			continue
 		}
 
 		// Check if document has been killed
@@ -633,6 +1318,13 @@ func (s *Server) persister(ctx context.Context, id string, kolabpad *Kolabpad) {
 			return
 		}
 
+		// Snapshot on its own schedule, whether or not a write is due
+		if breaker.allow(time.Now()) {
+			if _, err := s.takeSnapshot(id, kolabpad, &snapshots, time.Now()); err != nil {
+				logger.Error("error snapshotting document %s: %v", id, err)
+			}
+		}
+
 		// Check if there are new changes
 		revision := kolabpad.Revision()
 		if revision <= lastPersistedRev {
@@ -640,9 +1332,13 @@ func (s *Server) persister(ctx context.Context, id string, kolabpad *Kolabpad) {
 		}
 
 		// Debounce: Skip if critical write happened recently
-		timeSinceCritical := time.Now().Unix() - kolabpad.lastCriticalWrite.Load()
-		if timeSinceCritical < 2 {
-			logger.Debug("persister skipping for document %s: critical write %ds ago", id, timeSinceCritical)
+		if since, ok := kolabpad.activity.debouncing(time.Now(), s.state.config.PersistDebounce); ok {
+			logger.Debug("persister skipping for document %s: critical write %v ago", id, since.Round(time.Millisecond))
+			continue
+		}
+
+		// Back off while the database keeps failing
+		if !breaker.allow(time.Now()) {
 			continue
 		}
 
@@ -650,42 +1346,15 @@ func (s *Server) persister(ctx context.Context, id string, kolabpad *Kolabpad) {
 		timeSinceEdit := time.Since(kolabpad.LastEditTime())
 		timeSincePersist := time.Since(lastPersistTime)
 
-		shouldWrite := false
-		reason := ""
-
 		// Trigger 1: Idle threshold
 		if timeSinceEdit >= idleWriteThreshold {
-			shouldWrite = true
-			reason = "idle"
+			store("idle")
+			continue
 		}
 
 		// Trigger 2: Safety net
 		if timeSincePersist >= safetyNetInterval {
-			shouldWrite = true
-			reason = "safety_net"
-		}
-
-		// Write to DB if triggered
-		if shouldWrite {
-			text, language := kolabpad.Snapshot()
-			otp := kolabpad.GetOTP() // Get OTP from memory, not DB
-
-			doc := &database.PersistedDocument{
-				ID:       id,
-				Text:     text,
-				Language: language,
-				OTP:      otp,
-			}
-
-			logger.Debug("persisting document %s: reason=%s, revision=%d, timeSinceEdit=%v, timeSincePersist=%v",
-				id, reason, revision, timeSinceEdit, timeSincePersist)
-
-			if err := s.state.db.Store(doc); err != nil {
-				logger.Error("error persisting document %s: %v", id, err)
-			} else {
-				lastPersistedRev = revision
-				lastPersistTime = time.Now()
-			}
+			store("safety_net")
 		}
 	}
 }
@@ -693,7 +1362,7 @@ func (s *Server) persister(ctx context.Context, id string, kolabpad *Kolabpad) {
 // Example usage:
 //
 //	db, _ := database.New("kolabpad.db")
-//	server := NewServer(db)
+//	server := NewServer(db, DefaultConfig())
 //
 //	// Start cleanup task
 //	ctx, cancel := context.WithCancel(context.Background())
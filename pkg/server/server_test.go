@@ -1,11 +1,23 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -17,41 +29,63 @@ import (
 	ot "github.com/shiv248/operational-transformation-go"
 )
 
-// testServer creates a test server with an in-memory database.
-func testServer(t *testing.T) *Server {
-	t.Helper()
-
-	db, err := database.New(":memory:")
-	if err != nil {
-		t.Fatalf("Failed to create test database: %v", err)
+// testConfig returns test-friendly server settings.
+func testConfig() Config {
+	return Config{
+		MaxDocumentSize:     256 * 1024,
+		BroadcastBufferSize: 256,
+		WSReadTimeout:       5 * time.Minute,
+		WSWriteTimeout:      5 * time.Second,
+		WSHeartbeatInterval: 60 * time.Second,
+		MaxRequestBodySize:  64 * 1024,
+		MaxCursorsPerUser:   64,
+		CreateOnConnect:     true,
 	}
+}
 
-	t.Cleanup(func() {
-		db.Close()
-	})
-
-	// Create server with test-friendly settings
-	const maxDocumentSize = 256 * 1024
-	const broadcastBufferSize = 256
-	const wsReadTimeout = 5 * time.Minute
-	const wsWriteTimeout = 5 * time.Second
-	const wsHeartbeatInterval = 60 * time.Second
+// testServer creates a test server backed by an in-memory store.
+func testServer(t *testing.T) *Server {
+	t.Helper()
 
-	return NewServer(db, maxDocumentSize, broadcastBufferSize, wsReadTimeout, wsWriteTimeout, wsHeartbeatInterval)
+	return NewServer(newMemStore(), testConfig())
 }
 
 // testServerNoDb creates a test server without a database.
 func testServerNoDb(t *testing.T) *Server {
 	t.Helper()
 
-	// Create server with test-friendly settings
-	const maxDocumentSize = 256 * 1024
-	const broadcastBufferSize = 256
-	const wsReadTimeout = 5 * time.Minute
-	const wsWriteTimeout = 5 * time.Second
-	const wsHeartbeatInterval = 60 * time.Second
+	return NewServer(nil, testConfig())
+}
+
+// flushDocument synchronously persists a hot document. It goes through the
+// document's persister when one is running and flushes directly otherwise,
+// so tests can assert on the database without sleeping.
+func flushDocument(t *testing.T, server *Server, docID string) {
+	t.Helper()
 
-	return NewServer(nil, maxDocumentSize, broadcastBufferSize, wsReadTimeout, wsWriteTimeout, wsHeartbeatInterval)
+	val, ok := server.state.documents.Load(docID)
+	if !ok {
+		t.Fatalf("Document %s not found in server state", docID)
+	}
+	doc := val.(*Document)
+
+	done := make(chan error, 1)
+	select {
+	case doc.flushReq <- done:
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("Failed to flush document %s: %v", docID, err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timeout waiting for document %s to flush", docID)
+		}
+	default:
+		// No persister waiting for requests
+		if _, err := doc.Kolabpad.Flush(context.Background(), server.state.db, docID); err != nil {
+			t.Fatalf("Failed to flush document %s: %v", docID, err)
+		}
+	}
 }
 
 // connectWebSocket establishes a WebSocket connection to a test server.
@@ -79,9 +113,21 @@ func connectWebSocket(t *testing.T, server *httptest.Server, docID string, otp s
 }
 
 // readServerMsg reads a message from the WebSocket and returns the parsed ServerMsg.
+// ServerTime clock messages are skipped; use readRawServerMsg to see them.
 func readServerMsg(t *testing.T, conn *websocket.Conn) *protocol.ServerMsg {
 	t.Helper()
 
+	for {
+		if msg := readRawServerMsg(t, conn); msg.ServerTime == nil {
+			return msg
+		}
+	}
+}
+
+// readRawServerMsg reads the next ServerMsg from the WebSocket connection.
+func readRawServerMsg(t *testing.T, conn *websocket.Conn) *protocol.ServerMsg {
+	t.Helper()
+
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 
@@ -375,14 +421,18 @@ func TestOTPColdStart(t *testing.T) {
 	}
 	json.NewDecoder(resp.Body).Decode(&protectResp)
 
-	// Close connection to evict from memory
+	// Persist the protected document, then close the connection
+	flushDocument(t, server, docID)
 	conn1.Close(websocket.StatusNormalClosure, "")
 
-	// Wait for document to be flushed
-	time.Sleep(100 * time.Millisecond)
+	persisted, err := server.state.db.Load(docID)
+	if err != nil || persisted == nil || persisted.OTP == nil || *persisted.OTP != protectResp.OTP {
+		t.Fatalf("Expected OTP to be persisted after flush, got %+v (err=%v)", persisted, err)
+	}
 
 	// Force evict from memory by accessing server state
 	server.state.documents.Delete(docID)
+	loads := server.state.db.(*memStore).loadCount()
 
 	// Try connecting without OTP (should fail - cold start validation)
 	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/socket/" + docID
@@ -396,6 +446,9 @@ func TestOTPColdStart(t *testing.T) {
 	if httpResp != nil && httpResp.StatusCode != http.StatusUnauthorized {
 		t.Errorf("Expected status 401 on cold start, got %d", httpResp.StatusCode)
 	}
+	if got := server.state.db.(*memStore).loadCount(); got != loads {
+		t.Errorf("Expected rejected cold start not to load the document, got %d loads", got-loads)
+	}
 
 	// Connect with correct OTP (should succeed and load from DB)
 	conn2 := connectWebSocket(t, ts, docID, protectResp.OTP)
@@ -491,6 +544,11 @@ func TestCursorBroadcast(t *testing.T) {
 	conn2 := connectWebSocket(t, ts, "cursor-test", "")
 	readServerMsg(t, conn2) // Read Identity
 
+	// Cursors are only shared once their user has a name
+	sendClientMsg(t, conn1, &protocol.ClientMsg{ClientInfo: &protocol.UserInfo{Name: "Alice", Hue: 0}})
+	readServerMsg(t, conn1) // Read UserInfo broadcast
+	readServerMsg(t, conn2) // Read UserInfo broadcast
+
 	// Client 1 sends cursor data
 	sendClientMsg(t, conn1, &protocol.ClientMsg{
 		CursorData: &protocol.CursorData{
@@ -518,6 +576,54 @@ func TestCursorBroadcast(t *testing.T) {
 	}
 }
 
+// TestPointerBroadcast tests that a pointer is broadcast with the revision it
+// refers to, but not kept in cursor state.
+func TestPointerBroadcast(t *testing.T) {
+	server := testServer(t)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	conn1 := connectWebSocket(t, ts, "pointer-test", "")
+	readServerMsg(t, conn1) // Read Identity
+	conn2 := connectWebSocket(t, ts, "pointer-test", "")
+	readServerMsg(t, conn2) // Read Identity
+
+	sendClientMsg(t, conn1, &protocol.ClientMsg{ClientInfo: &protocol.UserInfo{Name: "Alice", Hue: 0}})
+	readServerMsg(t, conn1) // Read UserInfo broadcast
+	readServerMsg(t, conn2) // Read UserInfo broadcast
+
+	op := ot.NewOperationSeq()
+	op.Insert("hello")
+	sendClientMsg(t, conn1, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 0, Operation: op}})
+	readServerMsg(t, conn1) // Read History
+	readServerMsg(t, conn2) // Read History
+
+	for _, tc := range []struct{ sent, want uint32 }{{3, 3}, {99, 5}} {
+		sendClientMsg(t, conn1, &protocol.ClientMsg{Pointer: &protocol.PointerMsg{Position: tc.sent}})
+		for i, conn := range []*websocket.Conn{conn1, conn2} {
+			msg := readServerMsg(t, conn)
+			if msg.Pointer == nil {
+				t.Fatalf("Client %d expected Pointer, got %+v", i+1, msg)
+			}
+			if *msg.Pointer != (protocol.UserPointerMsg{ID: 0, Position: tc.want, Revision: 1}) {
+				t.Errorf("Client %d: pointer at %d: expected position %d at revision 1, got %+v", i+1, tc.sent, tc.want, *msg.Pointer)
+			}
+		}
+	}
+
+	val, ok := server.state.documents.Load("pointer-test")
+	if !ok {
+		t.Fatal("Document not found in server state")
+	}
+	kolabpad := val.(*Document).Kolabpad
+	kolabpad.mu.RLock()
+	_, stored := kolabpad.state.Cursors[0]
+	kolabpad.mu.RUnlock()
+	if stored {
+		t.Error("Expected the pointer not to be stored as a cursor")
+	}
+}
+
 // TestUserInfoBroadcast tests that user info updates are broadcast.
 func TestUserInfoBroadcast(t *testing.T) {
 	server := testServer(t)
@@ -558,6 +664,66 @@ func TestUserInfoBroadcast(t *testing.T) {
 	}
 }
 
+// TestAvatarSeedBroadcast tests that an avatar seed round-trips through the
+// UserInfo broadcast, survives a reconnect that leaves it out, and is dropped
+// when too long.
+func TestAvatarSeedBroadcast(t *testing.T) {
+	server := testServer(t)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	docID := "avatar-seed"
+	dialWithToken := func() *websocket.Conn {
+		url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/socket/" + docID + "?token=0123456789abcdef-avatar"
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		conn, _, err := websocket.Dial(ctx, url, nil)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		t.Cleanup(func() { conn.CloseNow() })
+		return conn
+	}
+
+	observer := connectWebSocket(t, ts, docID, "")
+	readServerMsg(t, observer) // Read Identity
+
+	seed := strings.Repeat("ab12", 16)
+	alice := dialWithToken()
+	aliceID := *readServerMsg(t, alice).Identity
+	sendClientMsg(t, alice, &protocol.ClientMsg{ClientInfo: &protocol.UserInfo{Name: "Alice", Hue: 10, AvatarSeed: seed}})
+	if msg := readServerMsg(t, observer); msg.UserInfo == nil || msg.UserInfo.Info == nil || msg.UserInfo.Info.AvatarSeed != seed {
+		t.Fatalf("Expected UserInfo with avatar seed %q, got %+v", seed, msg)
+	}
+
+	// Reconnecting without the seed keeps it
+	alice.Close(websocket.StatusNormalClosure, "")
+	if msg := readServerMsg(t, observer); msg.UserInfo == nil || msg.UserInfo.Info != nil {
+		t.Fatalf("Expected Alice to leave, got %+v", msg)
+	}
+	alice = dialWithToken()
+	if id := *readServerMsg(t, alice).Identity; id != aliceID {
+		t.Fatalf("Expected reused Identity %d, got %d", aliceID, id)
+	}
+	sendClientMsg(t, alice, &protocol.ClientMsg{ClientInfo: &protocol.UserInfo{Name: "Alice", Hue: 10}})
+	if msg := readServerMsg(t, observer); msg.UserInfo == nil || msg.UserInfo.Info == nil || msg.UserInfo.Info.AvatarSeed != seed {
+		t.Fatalf("Expected the avatar seed to survive the reconnect, got %+v", msg)
+	}
+
+	// An oversized seed is dropped, but the user still registers
+	bob := connectWebSocket(t, ts, docID, "")
+	readServerMsg(t, bob) // Read Identity
+	long := strings.Repeat("x", protocol.MaxAvatarSeedLength+1)
+	sendClientMsg(t, bob, &protocol.ClientMsg{ClientInfo: &protocol.UserInfo{Name: "Bob", Hue: 200, AvatarSeed: long}})
+	msg := readServerMsg(t, observer)
+	if msg.UserInfo == nil || msg.UserInfo.Info == nil || msg.UserInfo.Info.Name != "Bob" {
+		t.Fatalf("Expected UserInfo for Bob, got %+v", msg)
+	}
+	if msg.UserInfo.Info.AvatarSeed != "" {
+		t.Errorf("Expected the oversized avatar seed to be dropped, got %d bytes", len(msg.UserInfo.Info.AvatarSeed))
+	}
+}
+
 // TestConcurrentEdits tests that concurrent edits from multiple users converge.
 func TestConcurrentEdits(t *testing.T) {
 	server := testServer(t)
@@ -622,6 +788,11 @@ func TestStatsEndpoint(t *testing.T) {
 	conn := connectWebSocket(t, ts, "stats-test", "")
 	readServerMsg(t, conn) // Read Identity
 
+	op := ot.NewOperationSeq()
+	op.Insert("hi")
+	sendClientMsg(t, conn, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 0, Operation: op}})
+	readServerMsg(t, conn) // Read History broadcast of the edit
+
 	// Request stats
 	resp, err := http.Get(ts.URL + "/api/stats")
 	if err != nil {
@@ -645,6 +816,248 @@ func TestStatsEndpoint(t *testing.T) {
 	if stats.StartTime == 0 {
 		t.Error("Expected non-zero start time")
 	}
+
+	if stats.Transforms.Edits != 1 {
+		t.Errorf("Expected 1 edit in transform metrics, got %+v", stats.Transforms)
+	}
+}
+
+// TestDetailedStatsEndpoint tests that /api/stats/detailed reports activity
+// on resident documents and a summary of stored ones.
+func TestDetailedStatsEndpoint(t *testing.T) {
+	store := newMemStore()
+	goLang := "go"
+	store.Store(&database.PersistedDocument{ID: "stored-go", Text: "package main", Language: &goLang})
+	ts := httptest.NewServer(NewServer(store, testConfig()))
+	defer ts.Close()
+
+	conn := connectWebSocket(t, ts, "detailed-stats", "")
+	readServerMsg(t, conn) // Read Identity
+
+	for rev, text := range []string{"hi", "!"} {
+		op := ot.NewOperationSeq()
+		op.Retain(uint64(rev * 2))
+		op.Insert(text)
+		sendClientMsg(t, conn, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: rev, Operation: op}})
+		readServerMsg(t, conn) // Read History broadcast of the edit
+	}
+	lang := "python"
+	sendClientMsg(t, conn, &protocol.ClientMsg{SetLanguage: &lang})
+	readServerMsg(t, conn) // Read Language broadcast
+
+	resp, err := http.Get(ts.URL + "/api/stats/detailed")
+	if err != nil {
+		t.Fatalf("Failed to get detailed stats: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	var stats DetailedStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatalf("Failed to decode detailed stats: %v", err)
+	}
+
+	// The basic fields are still there
+	if stats.NumDocuments != 1 || stats.NumConnections != 1 || stats.StartTime == 0 {
+		t.Errorf("Expected basic stats for 1 document and connection, got %+v", stats.Stats)
+	}
+	if stats.OperationsApplied != 2 {
+		t.Errorf("Expected 2 operations applied, got %d", stats.OperationsApplied)
+	}
+	if stats.ResidentBytes != int64(len("hi!")) {
+		t.Errorf("Expected %d resident bytes, got %d", len("hi!"), stats.ResidentBytes)
+	}
+	if stats.Languages["python"] != 1 || len(stats.Languages) != 1 {
+		t.Errorf("Expected 1 resident python document, got %v", stats.Languages)
+	}
+	if stats.AvgUsersPerDocument != 1 {
+		t.Errorf("Expected 1 user per document, got %v", stats.AvgUsersPerDocument)
+	}
+	if stats.UptimeSeconds < 0 {
+		t.Errorf("Expected non-negative uptime, got %d", stats.UptimeSeconds)
+	}
+
+	if stats.Stored == nil {
+		t.Fatal("Expected stored document summary")
+	}
+	if stats.Stored.Documents != 1 || stats.Stored.Bytes != int64(len("package main")) || stats.Stored.Languages["go"] != 1 {
+		t.Errorf("Expected the stored go document, got %+v", *stats.Stored)
+	}
+}
+
+// TestVersionEndpoint tests that /api/version reports build and protocol versions.
+func TestVersionEndpoint(t *testing.T) {
+	ts := httptest.NewServer(NewServer(nil, testConfig()))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/api/version")
+	if err != nil {
+		t.Fatalf("Failed to get version: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	var info VersionInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatalf("Failed to decode version: %v", err)
+	}
+	if info.Version != Version || info.Commit != Commit || info.BuildTime != BuildTime {
+		t.Errorf("Unexpected build info: %+v", info)
+	}
+	if info.ProtocolVersion != protocol.Version {
+		t.Errorf("Expected protocol version %d, got %d", protocol.Version, info.ProtocolVersion)
+	}
+
+	resp, err = http.Post(ts.URL+"/api/version", "application/json", nil)
+	if err != nil {
+		t.Fatalf("Failed to post version: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405 for POST, got %d", resp.StatusCode)
+	}
+}
+
+// TestAnnounce tests that an admin announcement reaches clients on every
+// document and that the endpoint requires the admin token.
+func TestAnnounce(t *testing.T) {
+	config := testConfig()
+	config.AdminToken = "0123456789abcdef"
+	ts := httptest.NewServer(NewServer(nil, config))
+	defer ts.Close()
+
+	announce := func(token, body string) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/api/announce", strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to announce: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	conn1 := connectWebSocket(t, ts, "announce-a", "")
+	readServerMsg(t, conn1) // Read Identity
+	conn2 := connectWebSocket(t, ts, "announce-b", "")
+	readServerMsg(t, conn2) // Read Identity
+
+	if status := announce("", `{"message": "hi"}`); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without token, got %d", status)
+	}
+	if status := announce("wrong-token-wrong", `{"message": "hi"}`); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with wrong token, got %d", status)
+	}
+	if status := announce(config.AdminToken, `{"message": "  "}`); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for empty message, got %d", status)
+	}
+
+	if status := announce(config.AdminToken, `{"message": "Restarting in 5 minutes"}`); status != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", status)
+	}
+	for _, conn := range []*websocket.Conn{conn1, conn2} {
+		msg := readServerMsg(t, conn)
+		if msg.Announcement == nil || msg.Announcement.Message != "Restarting in 5 minutes" {
+			t.Errorf("Expected Announcement, got %+v", msg)
+		}
+	}
+
+	// Without a configured token the endpoint doesn't exist
+	disabled := httptest.NewServer(NewServer(nil, testConfig()))
+	defer disabled.Close()
+	resp, err := http.Post(disabled.URL+"/api/announce", "application/json", strings.NewReader(`{"message": "hi"}`))
+	if err != nil {
+		t.Fatalf("Failed to announce: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 with admin endpoints disabled, got %d", resp.StatusCode)
+	}
+}
+
+// TestDocumentDebug tests that the debug endpoint needs the admin token,
+// reports a resident document's state without its OTP, and only includes
+// the text when asked.
+func TestDocumentDebug(t *testing.T) {
+	config := testConfig()
+	config.AdminToken = "0123456789abcdef"
+	server := NewServer(nil, config)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	debug := func(docID, token, query string) (int, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/api/document/"+docID+"/debug"+query, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to get debug dump: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, body
+	}
+
+	docID := "debug-doc"
+	conn := connectWebSocket(t, ts, docID, "")
+	id := *readServerMsg(t, conn).Identity
+	sendClientMsg(t, conn, &protocol.ClientMsg{ClientInfo: &protocol.UserInfo{Name: "Alice", Hue: 10}})
+	readServerMsg(t, conn) // Read own UserInfo
+	sendClientMsg(t, conn, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 0, Operation: insertAt(0, 0, "héllo")}})
+	readServerMsg(t, conn) // Read History broadcast
+	cursor := protocol.CursorData{Cursors: []uint32{2}, Selections: [][2]uint32{}}
+	sendClientMsg(t, conn, &protocol.ClientMsg{CursorData: &cursor})
+	readServerMsg(t, conn) // Read own UserCursor
+	otp := "secret-otp-value"
+	val, _ := server.state.documents.Load(docID)
+	val.(*Document).Kolabpad.SetOTP(&otp, protocol.SystemUserID, "System")
+	readServerMsg(t, conn) // Read OTP broadcast
+
+	if status, _ := debug(docID, "", ""); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without token, got %d", status)
+	}
+	if status, _ := debug("not-loaded", config.AdminToken, ""); status != http.StatusNotFound {
+		t.Errorf("Expected 404 for a document not in memory, got %d", status)
+	}
+
+	status, body := debug(docID, config.AdminToken, "")
+	if status != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", status, body)
+	}
+	if strings.Contains(string(body), otp) || strings.Contains(string(body), "héllo") {
+		t.Errorf("Expected dump without OTP or text, got %s", body)
+	}
+	var dump DocumentDebug
+	if err := json.Unmarshal(body, &dump); err != nil {
+		t.Fatalf("Failed to decode dump: %v", err)
+	}
+	if dump.Revision != 1 || dump.TextLength != 5 || dump.TextBytes != 6 || !dump.Protected {
+		t.Errorf("Expected revision 1, 5 characters in 6 bytes, protected; got %+v", dump.Diagnostics)
+	}
+	if dump.Connections != 1 || dump.Subscribers != 1 || dump.Killed || dump.LastEdit == 0 {
+		t.Errorf("Expected one live, edited connection; got %+v", dump.Diagnostics)
+	}
+	if len(dump.Users) != 1 || dump.Users[0].ID != id || dump.Users[0].Info == nil || dump.Users[0].Info.Name != "Alice" ||
+		dump.Users[0].Cursor == nil || !slices.Equal(dump.Users[0].Cursor.Cursors, cursor.Cursors) {
+		t.Errorf("Expected Alice with her cursor, got %+v", dump.Users)
+	}
+
+	_, body = debug(docID, config.AdminToken, "?text=true")
+	if err := json.Unmarshal(body, &dump); err != nil {
+		t.Fatalf("Failed to decode dump: %v", err)
+	}
+	if dump.Text == nil || *dump.Text != "héllo" {
+		t.Errorf("Expected text with ?text=true, got %v", dump.Text)
+	}
 }
 
 // TestServerWithoutDatabase tests that server works without a database.
@@ -718,7 +1131,8 @@ func TestInvalidRevision(t *testing.T) {
 
 	// Connect client
 	conn := connectWebSocket(t, ts, "invalid-rev", "")
-	readServerMsg(t, conn) // Read Identity
+	readServerMsg(t, conn)    // Read Identity
+	readRawServerMsg(t, conn) // Read ServerTime
 
 	// Send edit with future revision
 	op := ot.NewOperationSeq()
@@ -739,4 +1153,3684 @@ func TestInvalidRevision(t *testing.T) {
 	if err == nil {
 		t.Error("Expected connection to close due to invalid revision")
 	}
+	if status := websocket.CloseStatus(err); status != protocol.CloseInvalidRevision {
+		t.Errorf("Expected close code %d, got %d (%v)", protocol.CloseInvalidRevision, status, err)
+	}
+}
+
+// TestCloseCodes tests that fatal connection errors close the socket with the
+// matching application close code rather than a normal closure.
+func TestCloseCodes(t *testing.T) {
+	config := testConfig()
+	config.MaxDocumentSize = 16
+	server := NewServer(newMemStore(), config)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	// readClose reads until the socket closes and returns the close code
+	readClose := func(conn *websocket.Conn) websocket.StatusCode {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		for {
+			var msg protocol.ServerMsg
+			if err := wsjson.Read(ctx, conn, &msg); err != nil {
+				return websocket.CloseStatus(err)
+			}
+		}
+	}
+
+	edit := func(conn *websocket.Conn, revision int, op *ot.OperationSeq) {
+		sendClientMsg(t, conn, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: revision, Operation: op}})
+	}
+
+	// Edit growing the document past the limit
+	conn := connectWebSocket(t, ts, "close-too-large", "")
+	readServerMsg(t, conn) // Read Identity
+	op := ot.NewOperationSeq()
+	op.Insert(strings.Repeat("x", 17))
+	edit(conn, 0, op)
+	if code := readClose(conn); code != protocol.CloseDocumentTooLarge {
+		t.Errorf("Too large: expected close code %d, got %d", protocol.CloseDocumentTooLarge, code)
+	}
+
+	// Edit whose base length doesn't match the document
+	conn = connectWebSocket(t, ts, "close-invalid-op", "")
+	readServerMsg(t, conn) // Read Identity
+	op = ot.NewOperationSeq()
+	op.Retain(5)
+	edit(conn, 0, op)
+	if code := readClose(conn); code != protocol.CloseInvalidOperation {
+		t.Errorf("Invalid operation: expected close code %d, got %d", protocol.CloseInvalidOperation, code)
+	}
+
+	// Document killed under the connection
+	conn = connectWebSocket(t, ts, "close-killed", "")
+	readServerMsg(t, conn) // Read Identity
+	val, _ := server.state.documents.Load("close-killed")
+	val.(*Document).Kolabpad.Kill()
+	if code := readClose(conn); code != protocol.CloseDocumentKilled {
+		t.Errorf("Killed: expected close code %d, got %d", protocol.CloseDocumentKilled, code)
+	}
+}
+
+// TestEvictionSendsShutdown tests that clients are told about eviction before the socket closes.
+func TestEvictionSendsShutdown(t *testing.T) {
+	server := testServer(t)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	conn := connectWebSocket(t, ts, "evict-notice", "")
+	readServerMsg(t, conn) // Read Identity
+
+	// Zero-day expiry evicts every resident document
+	go server.cleanupExpiredDocuments(0)
+
+	msg := readServerMsg(t, conn)
+	if msg.Shutdown == nil {
+		t.Fatalf("Expected Shutdown message, got %+v", msg)
+	}
+	if !msg.Shutdown.Reconnect {
+		t.Error("Expected eviction to allow reconnect")
+	}
+
+	// Socket closes after the notice
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	var next protocol.ServerMsg
+	if err := wsjson.Read(ctx, conn, &next); err == nil {
+		t.Errorf("Expected connection to close after Shutdown, got %+v", next)
+	}
+}
+
+// TestReconnectDuringEviction tests that a client reconnecting while an
+// evicted document is being flushed gets the final text, and that its edits
+// to the reloaded copy are saved rather than rejected as older than the
+// evicted copy's last write.
+func TestReconnectDuringEviction(t *testing.T) {
+	db := newMemStore()
+	server := NewServer(db, testConfig())
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	docID := "evict-reconnect"
+	conn := connectWebSocket(t, ts, docID, "")
+	readServerMsg(t, conn) // Read Identity
+	sendClientMsg(t, conn, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 0, Operation: insertAt(0, 0, "a")}})
+	readServerMsg(t, conn) // Read History broadcast
+	flushDocument(t, server, docID)
+	for i, text := range []string{"b", "c"} {
+		sendClientMsg(t, conn, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: i + 1, Operation: insertAt(i+1, i+1, text)}})
+		readServerMsg(t, conn) // Read History broadcast
+	}
+	val, _ := server.state.documents.Load(docID)
+	evicted := val.(*Document).Kolabpad
+
+	// Hold the eviction's flush until the client has started reconnecting
+	release := db.stallWrites()
+	defer release()
+	done := make(chan struct{})
+	go func() {
+		server.cleanupExpiredDocuments(0)
+		close(done)
+	}()
+	if msg := readServerMsg(t, conn); msg.Shutdown == nil {
+		t.Fatalf("Expected Shutdown message, got %+v", msg)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		evicted.mu.RLock()
+		draining := evicted.draining
+		evicted.mu.RUnlock()
+		if draining {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for the eviction to flush")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.AfterFunc(50*time.Millisecond, release)
+
+	reconnected := connectWebSocket(t, ts, docID, "")
+	revision := 0
+	for {
+		msg := readServerMsg(t, reconnected)
+		if msg.History != nil {
+			revision = msg.History.Start + len(msg.History.Operations)
+			break
+		}
+	}
+	<-done
+	sendClientMsg(t, reconnected, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: revision, Operation: insertAt(3, 3, "!")}})
+	for msg := readServerMsg(t, reconnected); msg.History == nil; msg = readServerMsg(t, reconnected) {
+	}
+	reconnected.Close(websocket.StatusNormalClosure, "")
+
+	// The last disconnect flushes the reloaded copy
+	deadline = time.Now().Add(2 * time.Second)
+	for {
+		stored, _ := db.Load(docID)
+		if stored != nil && stored.Text == "abc!" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the reconnected client's edit to be saved, got %+v", stored)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestServerShutdownSendsShutdown tests that server shutdown tells clients not to reconnect.
+func TestServerShutdownSendsShutdown(t *testing.T) {
+	server := testServer(t)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	conn := connectWebSocket(t, ts, "shutdown-notice", "")
+	readServerMsg(t, conn) // Read Identity
+
+	go server.Shutdown(context.Background())
+
+	msg := readServerMsg(t, conn)
+	if msg.Shutdown == nil {
+		t.Fatalf("Expected Shutdown message, got %+v", msg)
+	}
+	if msg.Shutdown.Reconnect {
+		t.Error("Expected server shutdown to disallow reconnect")
+	}
+}
+
+// TestShutdownGracePeriod tests that clients get the shutdown notice and
+// keep their socket for Config.ShutdownGrace before it closes, and that a
+// caller's context cuts the grace period short.
+func TestShutdownGracePeriod(t *testing.T) {
+	config := testConfig()
+	config.ShutdownGrace = 500 * time.Millisecond
+	server := NewServer(newMemStore(), config)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	conn := connectWebSocket(t, ts, "shutdown-grace", "")
+	readServerMsg(t, conn) // Read Identity
+
+	start := time.Now()
+	go server.Shutdown(context.Background())
+
+	if msg := readServerMsg(t, conn); msg.Shutdown == nil {
+		t.Fatalf("Expected Shutdown message, got %+v", msg)
+	}
+	if elapsed := time.Since(start); elapsed >= config.ShutdownGrace {
+		t.Errorf("Expected the notice before the grace period ended, got it after %v", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	var next protocol.ServerMsg
+	if err := wsjson.Read(ctx, conn, &next); err == nil {
+		t.Fatalf("Expected connection to close after Shutdown, got %+v", next)
+	}
+	if elapsed := time.Since(start); elapsed < config.ShutdownGrace {
+		t.Errorf("Expected the socket open for the %v grace period, closed after %v", config.ShutdownGrace, elapsed)
+	}
+
+	// A caller in a hurry doesn't wait out the grace period
+	config.ShutdownGrace = time.Minute
+	hurried := NewServer(newMemStore(), config)
+	hts := httptest.NewServer(hurried)
+	defer hts.Close()
+	conn = connectWebSocket(t, hts, "shutdown-hurried", "")
+	readServerMsg(t, conn) // Read Identity
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	hurried.Shutdown(ctx)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected Shutdown to end with its context, took %v", elapsed)
+	}
+}
+
+// TestStalledDatabaseCancelled tests that writes to a hung database give up
+// when their context ends, so flushes and Shutdown return instead of
+// blocking, and a cancelled write never lands afterwards.
+func TestStalledDatabaseCancelled(t *testing.T) {
+	db := newMemStore()
+	server := NewServer(db, testConfig())
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	docID := "stalled"
+	conn := connectWebSocket(t, ts, docID, "")
+	readServerMsg(t, conn) // Read Identity
+	sendClientMsg(t, conn, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 0, Operation: insertAt(0, 0, "unsaved")}})
+	readServerMsg(t, conn) // Read History broadcast
+
+	release := db.stallWrites()
+	defer release()
+
+	val, _ := server.state.documents.Load(docID)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := val.(*Document).Kolabpad.Flush(ctx, db, docID); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected flush to a stalled database to time out, got %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), shutdownGracePeriod+200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	server.Shutdown(ctx)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected Shutdown to give up with its context, took %v", elapsed)
+	}
+
+	release()
+	time.Sleep(50 * time.Millisecond) // Let any write that wrongly survived land
+	if exists, _ := db.Exists(docID); exists {
+		t.Error("Expected cancelled writes not to be stored")
+	}
+}
+
+// TestShutdownDrainsEdits tests that edits arriving after shutdown begins are
+// rejected with a notice and that the final flush holds the text from before.
+func TestShutdownDrainsEdits(t *testing.T) {
+	db := newMemStore()
+	server := NewServer(db, testConfig())
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	conn := connectWebSocket(t, ts, "drain", "")
+	readServerMsg(t, conn) // Read Identity
+
+	op := ot.NewOperationSeq()
+	op.Insert("saved")
+	sendClientMsg(t, conn, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 0, Operation: op}})
+	readServerMsg(t, conn) // Read History broadcast
+
+	done := make(chan struct{})
+	go func() {
+		server.Shutdown(context.Background())
+		close(done)
+	}()
+
+	if msg := readServerMsg(t, conn); msg.Shutdown == nil {
+		t.Fatalf("Expected Shutdown message, got %+v", msg)
+	}
+
+	late := ot.NewOperationSeq()
+	late.Retain(5)
+	late.Insert(" lost")
+	sendClientMsg(t, conn, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 1, Operation: late}})
+
+	msg := readServerMsg(t, conn)
+	if msg.Error == nil || msg.Error.Code != protocol.ErrorCodeDraining {
+		t.Fatalf("Expected draining Error, got %+v", msg)
+	}
+
+	// New connections are refused while draining
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/socket/drain"
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, resp, err := websocket.Dial(ctx, url, nil); err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 for a new connection while draining, got %v", err)
+	}
+
+	<-done
+	persisted, err := db.Load("drain")
+	if err != nil || persisted == nil {
+		t.Fatalf("Expected document to be flushed, got %+v (%v)", persisted, err)
+	}
+	if persisted.Text != "saved" {
+		t.Errorf("Expected flushed text %q, got %q", "saved", persisted.Text)
+	}
+}
+
+// TestInvalidLanguageRejected tests that unknown languages are rejected without closing the connection.
+func TestInvalidLanguageRejected(t *testing.T) {
+	server := testServer(t)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	conn1 := connectWebSocket(t, ts, "bad-lang", "")
+	readServerMsg(t, conn1) // Read Identity
+
+	conn2 := connectWebSocket(t, ts, "bad-lang", "")
+	readServerMsg(t, conn2) // Read Identity
+
+	bogus := strings.Repeat("x", 10000)
+	sendClientMsg(t, conn1, &protocol.ClientMsg{SetLanguage: &bogus})
+
+	// Sender gets an error notice instead of a broadcast
+	msg := readServerMsg(t, conn1)
+	if msg.Error == nil || msg.Error.Code != protocol.ErrorCodeUnsupportedLanguage {
+		t.Fatalf("Expected unsupported_language error, got %+v", msg)
+	}
+
+	// Connection stays usable and a valid language still broadcasts
+	lang := "python"
+	sendClientMsg(t, conn1, &protocol.ClientMsg{SetLanguage: &lang})
+
+	msg1 := readServerMsg(t, conn1)
+	if msg1.Language == nil || msg1.Language.Language != "python" {
+		t.Fatalf("Expected Language broadcast, got %+v", msg1)
+	}
+
+	// The other client never sees the bogus value
+	msg2 := readServerMsg(t, conn2)
+	if msg2.Language == nil || msg2.Language.Language != "python" {
+		t.Fatalf("Client 2 expected only the valid Language broadcast, got %+v", msg2)
+	}
+}
+
+// TestDisabledMessageTypes tests that message types left out of
+// Config.AllowedMessages are ignored, with a notice only if configured, while
+// the allowed ones still work.
+func TestDisabledMessageTypes(t *testing.T) {
+	for _, notice := range []bool{false, true} {
+		t.Run(fmt.Sprintf("notice=%v", notice), func(t *testing.T) {
+			config := testConfig()
+			config.AllowedMessages = []string{protocol.MsgEdit, protocol.MsgClientInfo, protocol.MsgCursorData, protocol.MsgPointer, protocol.MsgRequest}
+			config.DisabledNotice = notice
+			server := NewServer(nil, config)
+			ts := httptest.NewServer(server)
+			defer ts.Close()
+
+			conn := connectWebSocket(t, ts, "no-lang", "")
+			readServerMsg(t, conn) // Read Identity
+
+			lang := "python"
+			sendClientMsg(t, conn, &protocol.ClientMsg{SetLanguage: &lang})
+			if notice {
+				msg := readServerMsg(t, conn)
+				if msg.Error == nil || msg.Error.Code != protocol.ErrorCodeDisabled {
+					t.Fatalf("Expected disabled error, got %+v", msg)
+				}
+			}
+
+			// Edits still apply; no Language broadcast comes before their History
+			op := ot.NewOperationSeq()
+			op.Insert("hello")
+			sendClientMsg(t, conn, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 0, Operation: op}})
+			msg := readServerMsg(t, conn)
+			if msg.History == nil {
+				t.Fatalf("Expected History for the edit, got %+v", msg)
+			}
+
+			val, _ := server.state.documents.Load("no-lang")
+			kolabpad := val.(*Document).Kolabpad
+			if text, language := kolabpad.Snapshot(); text != "hello" || language != nil {
+				t.Errorf("Expected text %q without a language, got %q and %v", "hello", text, language)
+			}
+		})
+	}
+}
+
+// TestServerOperationBroadcast tests that connected clients receive a server
+// operation as a System edit in History.
+func TestServerOperationBroadcast(t *testing.T) {
+	server := NewServer(nil, testConfig())
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	conn := connectWebSocket(t, ts, "server-op", "")
+	readServerMsg(t, conn) // Read Identity
+
+	val, _ := server.state.documents.Load("server-op")
+	if err := val.(*Document).Kolabpad.ApplyServerOperation(insertAt(0, 0, "injected")); err != nil {
+		t.Fatalf("ApplyServerOperation failed: %v", err)
+	}
+
+	msg := readServerMsg(t, conn)
+	if msg.History == nil || len(msg.History.Operations) != 1 {
+		t.Fatalf("Expected History with the server operation, got %+v", msg)
+	}
+	if got := msg.History.Operations[0]; got.ID != protocol.SystemUserID || replayHistory(t, msg.History.Operations) != "injected" {
+		t.Errorf("Expected a System insert of %q, got %+v", "injected", got)
+	}
+}
+
+// TestLineLimitRejected tests that an edit past the line limits gets an
+// error notice, is not broadcast, and leaves the connection usable.
+func TestLineLimitRejected(t *testing.T) {
+	config := testConfig()
+	config.MaxLineLength = 80
+	server := NewServer(nil, config)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	conn1 := connectWebSocket(t, ts, "line-limit", "")
+	readServerMsg(t, conn1) // Read Identity
+	conn2 := connectWebSocket(t, ts, "line-limit", "")
+	readServerMsg(t, conn2) // Read Identity
+
+	giant := ot.NewOperationSeq()
+	giant.Insert(strings.Repeat("{}", 1000))
+	sendClientMsg(t, conn1, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 0, Operation: giant}})
+
+	msg := readServerMsg(t, conn1)
+	if msg.Error == nil || msg.Error.Code != protocol.ErrorCodeLineLimit {
+		t.Fatalf("Expected line_limit error, got %+v", msg)
+	}
+
+	// The connection still accepts edits within the limits
+	op := ot.NewOperationSeq()
+	op.Insert("fits")
+	sendClientMsg(t, conn1, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 0, Operation: op}})
+
+	for i, conn := range []*websocket.Conn{conn1, conn2} {
+		msg := readServerMsg(t, conn)
+		if msg.History == nil || msg.History.Start != 0 || len(msg.History.Operations) != 1 {
+			t.Fatalf("Client %d expected only the valid edit in History, got %+v", i+1, msg)
+		}
+	}
+}
+
+// TestMalformedMessage tests that a frame that isn't a valid ClientMsg gets an
+// error notice and leaves the connection usable.
+func TestMalformedMessage(t *testing.T) {
+	server := testServer(t)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	conn := connectWebSocket(t, ts, "malformed", "")
+	readServerMsg(t, conn) // Read Identity
+
+	for _, frame := range []string{
+		`{"Edit": `,                     // Truncated JSON
+		`["not", "an", "object"]`,       // Valid JSON, wrong shape
+		`{"Edit": {"revision": 0}}`,     // Edit without an operation
+		`{"SetLanguage": 42}`,           // Wrong field type
+		`{"Edit": {"operation": "??"}}`, // Undecodable operation
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		err := conn.Write(ctx, websocket.MessageText, []byte(frame))
+		cancel()
+		if err != nil {
+			t.Fatalf("Failed to send %q: %v", frame, err)
+		}
+
+		msg := readServerMsg(t, conn)
+		if msg.Error == nil || msg.Error.Code != protocol.ErrorCodeMalformedMessage {
+			t.Fatalf("Expected malformed_message error for %q, got %+v", frame, msg)
+		}
+	}
+
+	// The connection still accepts edits
+	op := ot.NewOperationSeq()
+	op.Insert("still here")
+	sendClientMsg(t, conn, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 0, Operation: op}})
+	if msg := readServerMsg(t, conn); msg.History == nil {
+		t.Fatalf("Expected History after a valid edit, got %+v", msg)
+	}
+}
+
+// TestCoalescedHistoryConvergence tests that a client joining after edits were
+// coalesced can edit using its own revision numbering and both clients converge.
+func TestCoalescedHistoryConvergence(t *testing.T) {
+	config := testConfig()
+	config.CoalesceWindow = time.Minute
+	server := NewServer(nil, config)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	docID := "coalesce-converge"
+
+	alice := connectWebSocket(t, ts, docID, "")
+	readServerMsg(t, alice) // Read Identity
+
+	// Alice types, waiting for each acknowledgement like the frontend does
+	for i, ch := range "hello" {
+		sendClientMsg(t, alice, &protocol.ClientMsg{
+			Edit: &protocol.EditMsg{Revision: i, Operation: insertAt(i, i, string(ch))},
+		})
+		msg := readServerMsg(t, alice)
+		if msg.History == nil || msg.History.Start != i {
+			t.Fatalf("Expected History ack at %d, got %+v", i, msg)
+		}
+	}
+
+	// Bob joins and receives the coalesced history
+	bob := connectWebSocket(t, ts, docID, "")
+	readServerMsg(t, bob) // Read Identity
+	msg := readServerMsg(t, bob)
+	if msg.History == nil || msg.History.Start != 0 {
+		t.Fatalf("Expected History from 0, got %+v", msg)
+	}
+	bobRev := len(msg.History.Operations)
+	if bobRev >= 5 {
+		t.Errorf("Expected coalesced history shorter than 5 entries, got %d", bobRev)
+	}
+	if got := replayHistory(t, msg.History.Operations); got != "hello" {
+		t.Fatalf("Expected history to replay to %q, got %q", "hello", got)
+	}
+
+	// Bob edits at his own revision
+	sendClientMsg(t, bob, &protocol.ClientMsg{
+		Edit: &protocol.EditMsg{Revision: bobRev, Operation: insertAt(5, 5, "!")},
+	})
+
+	bobAck := readServerMsg(t, bob)
+	if bobAck.History == nil || bobAck.History.Start != bobRev {
+		t.Fatalf("Expected Bob's ack at his revision %d, got %+v", bobRev, bobAck)
+	}
+
+	// Alice sees Bob's edit at her revision 5
+	aliceMsg := readServerMsg(t, alice)
+	if aliceMsg.History == nil || aliceMsg.History.Start != 5 {
+		t.Fatalf("Expected Alice to receive History at 5, got %+v", aliceMsg)
+	}
+
+	val, _ := server.state.documents.Load(docID)
+	if got := val.(*Document).Kolabpad.Text(); got != "hello!" {
+		t.Errorf("Expected text %q, got %q", "hello!", got)
+	}
+}
+
+// TestWSCompression tests that clients can negotiate permessage-deflate when
+// enabled and that large messages round-trip through it.
+func TestWSCompression(t *testing.T) {
+	config := testConfig()
+	config.WSCompression = websocket.CompressionContextTakeover
+	ts := httptest.NewServer(NewServer(newMemStore(), config))
+	defer ts.Close()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/socket/compressed"
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	conn, resp, err := websocket.Dial(ctx, url, &websocket.DialOptions{
+		CompressionMode: websocket.CompressionContextTakeover,
+	})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.CloseNow()
+
+	if ext := resp.Header.Get("Sec-WebSocket-Extensions"); !strings.Contains(ext, "permessage-deflate") {
+		t.Fatalf("Expected permessage-deflate to be negotiated, got %q", ext)
+	}
+
+	readServerMsg(t, conn) // Read Identity
+
+	// Big enough to be compressed
+	text := strings.Repeat("compress me ", 200)
+	op := ot.NewOperationSeq()
+	op.Insert(text)
+	sendClientMsg(t, conn, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 0, Operation: op}})
+
+	msg := readServerMsg(t, conn)
+	if msg.History == nil || len(msg.History.Operations) != 1 {
+		t.Fatalf("Expected History with the edit, got %+v", msg)
+	}
+	if got := replayHistory(t, msg.History.Operations); got != text {
+		t.Errorf("Expected edit to round-trip, got %d bytes", len(got))
+	}
+}
+
+// TestCursorDataLimit tests that oversized cursor payloads are truncated
+// before they're stored or broadcast.
+func TestCursorDataLimit(t *testing.T) {
+	server := testServer(t)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	observer := connectWebSocket(t, ts, "cursor-limit", "")
+	readServerMsg(t, observer) // Read Identity
+
+	conn := connectWebSocket(t, ts, "cursor-limit", "")
+	userID := *readServerMsg(t, conn).Identity
+	sendClientMsg(t, conn, &protocol.ClientMsg{ClientInfo: &protocol.UserInfo{Name: "Alice", Hue: 0}})
+	readServerMsg(t, observer) // Read UserInfo broadcast
+
+	data := protocol.CursorData{
+		Cursors:    make([]uint32, 10000),
+		Selections: make([][2]uint32, 100),
+	}
+	sendClientMsg(t, conn, &protocol.ClientMsg{CursorData: &data})
+
+	msg := readServerMsg(t, observer)
+	if msg.UserCursor == nil {
+		t.Fatalf("Expected UserCursor, got %+v", msg)
+	}
+	if got := msg.UserCursor.Data; len(got.Cursors) != 64 || len(got.Selections) != 64 {
+		t.Errorf("Expected 64 cursors and 64 selections, got %d and %d", len(got.Cursors), len(got.Selections))
+	}
+
+	val, _ := server.state.documents.Load("cursor-limit")
+	_, _, _, _, cursors := val.(*Document).Kolabpad.GetInitialState(userID)
+	if got := len(cursors[userID].Cursors); got != 64 {
+		t.Errorf("Expected 64 stored cursors, got %d", got)
+	}
+}
+
+// TestPresenceHeartbeat tests that periodic presence snapshots bring a client
+// that missed UserInfo updates back in sync with the registered users.
+func TestPresenceHeartbeat(t *testing.T) {
+	server := testServer(t)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	observer := connectWebSocket(t, ts, "presence", "")
+	readServerMsg(t, observer) // Read Identity
+
+	alice := connectWebSocket(t, ts, "presence", "")
+	aliceID := *readServerMsg(t, alice).Identity
+	sendClientMsg(t, alice, &protocol.ClientMsg{ClientInfo: &protocol.UserInfo{Name: "Alice", Hue: 10}})
+	readServerMsg(t, observer) // Read Alice's UserInfo
+
+	// Simulate a join whose broadcast the observer never received
+	val, _ := server.state.documents.Load("presence")
+	kolabpad := val.(*Document).Kolabpad
+	kolabpad.mu.Lock()
+	kolabpad.state.Users[99] = protocol.UserInfo{Name: "Bob", Hue: 200}
+	kolabpad.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.StartPresenceHeartbeat(ctx, 10*time.Millisecond)
+
+	msg := readServerMsg(t, observer)
+	if msg.Presence == nil {
+		t.Fatalf("Expected Presence snapshot, got %+v", msg)
+	}
+	users := msg.Presence.Users
+	if len(users) != 2 || users[0].ID != aliceID || users[1].ID != 99 || users[1].Info.Name != "Bob" {
+		t.Errorf("Expected Alice and Bob sorted by ID, got %+v", users)
+	}
+}
+
+// TestDedupUserNamesBroadcast tests that two users joining with the same name
+// are broadcast with distinct names.
+func TestDedupUserNamesBroadcast(t *testing.T) {
+	config := testConfig()
+	config.DedupUserNames = true
+	server := NewServer(newMemStore(), config)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	observer := connectWebSocket(t, ts, "dedup", "")
+	readServerMsg(t, observer) // Read Identity
+
+	var broadcast []string
+	for i := 0; i < 2; i++ {
+		conn := connectWebSocket(t, ts, "dedup", "")
+		readServerMsg(t, conn) // Read Identity
+		sendClientMsg(t, conn, &protocol.ClientMsg{ClientInfo: &protocol.UserInfo{Name: "Alice", Hue: 10}})
+
+		msg := readServerMsg(t, observer)
+		if msg.UserInfo == nil || msg.UserInfo.Info == nil {
+			t.Fatalf("Expected UserInfo, got %+v", msg)
+		}
+		broadcast = append(broadcast, msg.UserInfo.Info.Name)
+	}
+
+	if broadcast[0] != "Alice" || broadcast[1] != "Alice (2)" {
+		t.Errorf("Expected Alice and Alice (2), got %v", broadcast)
+	}
+}
+
+// TestReconnectTokenReapsGhost tests that reconnecting with the same token
+// reuses the user ID and disconnects the stale connection, leaving no ghost user.
+func TestReconnectTokenReapsGhost(t *testing.T) {
+	server := testServer(t)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	docID := "reconnect-ghost"
+	token := "0123456789abcdef-tab1"
+
+	dialWithToken := func() *websocket.Conn {
+		url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/socket/" + docID + "?token=" + token
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		conn, _, err := websocket.Dial(ctx, url, nil)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		t.Cleanup(func() { conn.CloseNow() })
+		return conn
+	}
+
+	observer := connectWebSocket(t, ts, docID, "")
+	readServerMsg(t, observer) // Read Identity
+
+	// First connection registers, then goes silent (socket dropped without a close)
+	ghost := dialWithToken()
+	ghostID := *readServerMsg(t, ghost).Identity
+	sendClientMsg(t, ghost, &protocol.ClientMsg{ClientInfo: &protocol.UserInfo{Name: "Alice", Hue: 10}})
+	if msg := readServerMsg(t, observer); msg.UserInfo == nil || msg.UserInfo.ID != ghostID {
+		t.Fatalf("Expected UserInfo for ghost, got %+v", msg)
+	}
+
+	// Reconnect with the same token
+	alice := dialWithToken()
+	msg := readServerMsg(t, alice)
+	if msg.Identity == nil || *msg.Identity != ghostID {
+		t.Fatalf("Expected reused Identity %d, got %+v", ghostID, msg)
+	}
+	sendClientMsg(t, alice, &protocol.ClientMsg{ClientInfo: &protocol.UserInfo{Name: "Alice", Hue: 10}})
+
+	// Observer sees the ghost leave and Alice return under the same ID
+	if msg := readServerMsg(t, observer); msg.UserInfo == nil || msg.UserInfo.ID != ghostID || msg.UserInfo.Info != nil {
+		t.Fatalf("Expected ghost removal, got %+v", msg)
+	}
+	if msg := readServerMsg(t, observer); msg.UserInfo == nil || msg.UserInfo.ID != ghostID || msg.UserInfo.Info == nil {
+		t.Fatalf("Expected Alice to rejoin, got %+v", msg)
+	}
+
+	// The stale connection has been closed by the server
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for {
+		if _, _, err := ghost.Read(ctx); err != nil {
+			if ctx.Err() != nil {
+				t.Fatal("Ghost connection was not closed")
+			}
+			break
+		}
+	}
+
+	val, _ := server.state.documents.Load(docID)
+	kolabpad := val.(*Document).Kolabpad
+	if got := kolabpad.UserCount(); got != 1 {
+		t.Errorf("Expected 1 registered user, got %d", got)
+	}
+	if got := kolabpad.ConnectionCount(); got != 2 {
+		t.Errorf("Expected 2 live connections, got %d", got)
+	}
+}
+
+// TestReconnectResumesHistory tests that a client reconnecting with its
+// token and ?rev= is only sent the history after that revision, and gets the
+// full history when the revision doesn't match.
+func TestReconnectResumesHistory(t *testing.T) {
+	server := testServer(t)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	docID := "reconnect-resume"
+	dial := func(query string) *websocket.Conn {
+		url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/socket/" + docID + "?token=0123456789abcdef-tab1" + query
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		conn, _, err := websocket.Dial(ctx, url, nil)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		t.Cleanup(func() { conn.CloseNow() })
+		return conn
+	}
+	readHistory := func(conn *websocket.Conn) *protocol.HistoryMsg {
+		t.Helper()
+		for {
+			if msg := readServerMsg(t, conn); msg.History != nil {
+				return msg.History
+			}
+		}
+	}
+
+	writer := connectWebSocket(t, ts, docID, "")
+	readServerMsg(t, writer) // Read Identity
+
+	alice := dial("")
+	sendClientMsg(t, writer, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 0, Operation: insertAt(0, 0, "abc")}})
+	if history := readHistory(alice); history.Start != 0 || len(history.Operations) != 1 {
+		t.Fatalf("Expected the first edit, got %+v", history)
+	}
+	readHistory(writer)
+	alice.Close(websocket.StatusNormalClosure, "")
+
+	// Alice holds revision 1 while another edit lands
+	sendClientMsg(t, writer, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 1, Operation: insertAt(3, 3, "d")}})
+	readHistory(writer)
+
+	alice = dial("&rev=1")
+	if history := readHistory(alice); history.Start != 1 || len(history.Operations) != 1 {
+		t.Errorf("Expected history to resume at revision 1 with one edit, got start %d with %d", history.Start, len(history.Operations))
+	}
+	alice.Close(websocket.StatusNormalClosure, "")
+
+	// A revision the document hasn't reached falls back to the full history
+	alice = dial("&rev=99")
+	if history := readHistory(alice); history.Start != 0 || len(history.Operations) != 2 {
+		t.Errorf("Expected full history, got start %d with %d edits", history.Start, len(history.Operations))
+	}
+	alice.Close(websocket.StatusNormalClosure, "")
+
+	if status := dialStatus(t, ts, docID, "?rev=-1", nil); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a negative revision, got %d", status)
+	}
+}
+
+// TestReconnectRestoresCursor tests that a user reconnecting with its token
+// gets its cursor back and that other clients see it again.
+func TestReconnectRestoresCursor(t *testing.T) {
+	server := testServer(t)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	docID := "reconnect-cursor"
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/socket/" + docID + "?token=0123456789abcdef-tab1"
+	dialWithToken := func() *websocket.Conn {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		conn, _, err := websocket.Dial(ctx, url, nil)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		t.Cleanup(func() { conn.CloseNow() })
+		return conn
+	}
+
+	observer := connectWebSocket(t, ts, docID, "")
+	readServerMsg(t, observer) // Read Identity
+
+	ghost := dialWithToken()
+	ghostID := *readServerMsg(t, ghost).Identity
+	sendClientMsg(t, ghost, &protocol.ClientMsg{ClientInfo: &protocol.UserInfo{Name: "Alice", Hue: 10}})
+	cursor := protocol.CursorData{Cursors: []uint32{0}, Selections: [][2]uint32{{0, 0}}}
+	sendClientMsg(t, ghost, &protocol.ClientMsg{CursorData: &cursor})
+	readServerMsg(t, observer) // Read UserInfo
+	if msg := readServerMsg(t, observer); msg.UserCursor == nil {
+		t.Fatalf("Expected UserCursor for ghost, got %+v", msg)
+	}
+
+	alice := dialWithToken()
+	if msg := readServerMsg(t, alice); msg.Identity == nil || *msg.Identity != ghostID {
+		t.Fatalf("Expected reused Identity %d, got %+v", ghostID, msg)
+	}
+	sendClientMsg(t, alice, &protocol.ClientMsg{ClientInfo: &protocol.UserInfo{Name: "Alice", Hue: 10}})
+
+	readServerMsg(t, observer) // Read ghost removal
+	readServerMsg(t, observer) // Read Alice rejoining
+	msg := readServerMsg(t, observer)
+	if msg.UserCursor == nil || msg.UserCursor.ID != ghostID {
+		t.Fatalf("Expected restored UserCursor for %d, got %+v", ghostID, msg)
+	}
+	if got := msg.UserCursor.Data; len(got.Cursors) != 1 || len(got.Selections) != 1 {
+		t.Errorf("Expected restored cursor %+v, got %+v", cursor, got)
+	}
+}
+
+// TestSavedCursorSurvivesEviction tests that with SavedCursors set, a user's
+// cursor is saved when its document is evicted and restored when the same
+// reconnect token reopens it.
+func TestSavedCursorSurvivesEviction(t *testing.T) {
+	db := newMemStore()
+	config := testConfig()
+	config.SavedCursors = 4
+	server := NewServer(db, config)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	docID := "saved-cursor"
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/socket/" + docID + "?token=0123456789abcdef-tab1"
+	dialWithToken := func() *websocket.Conn {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		conn, _, err := websocket.Dial(ctx, url, nil)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		t.Cleanup(func() { conn.CloseNow() })
+		return conn
+	}
+
+	observer := connectWebSocket(t, ts, docID, "")
+	readServerMsg(t, observer) // Read Identity
+
+	alice := dialWithToken()
+	readServerMsg(t, alice) // Read Identity
+	sendClientMsg(t, alice, &protocol.ClientMsg{ClientInfo: &protocol.UserInfo{Name: "Alice", Hue: 10}})
+	readServerMsg(t, observer) // Read UserInfo
+	sendClientMsg(t, alice, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 0, Operation: insertAt(0, 0, "hello")}})
+	readServerMsg(t, observer) // Read History broadcast
+	cursor := protocol.CursorData{Cursors: []uint32{3}, Selections: [][2]uint32{{1, 3}}}
+	sendClientMsg(t, alice, &protocol.ClientMsg{CursorData: &cursor})
+	if msg := readServerMsg(t, observer); msg.UserCursor == nil {
+		t.Fatalf("Expected UserCursor for Alice, got %+v", msg)
+	}
+
+	server.cleanupExpiredDocuments(0)
+	if _, ok := server.state.documents.Load(docID); ok {
+		t.Fatal("Expected document to be evicted")
+	}
+	if saved, _ := db.LoadCursors(docID); len(saved) != 1 {
+		t.Fatalf("Expected Alice's cursor saved, got %+v", saved)
+	}
+
+	alice = dialWithToken()
+	msg := readServerMsg(t, alice)
+	if msg.Identity == nil {
+		t.Fatalf("Expected Identity, got %+v", msg)
+	}
+	id := *msg.Identity
+	sendClientMsg(t, alice, &protocol.ClientMsg{ClientInfo: &protocol.UserInfo{Name: "Alice", Hue: 10}})
+	for {
+		msg = readServerMsg(t, alice)
+		if msg.UserCursor != nil {
+			break
+		}
+	}
+	if msg.UserCursor.ID != id {
+		t.Fatalf("Expected restored cursor for user %d, got %+v", id, msg.UserCursor)
+	}
+	if got := msg.UserCursor.Data; !slices.Equal(got.Cursors, cursor.Cursors) || !slices.Equal(got.Selections, cursor.Selections) {
+		t.Errorf("Expected restored cursor %+v, got %+v", cursor, got)
+	}
+}
+
+// TestInvalidReconnectToken tests that malformed reconnect tokens are rejected.
+func TestInvalidReconnectToken(t *testing.T) {
+	server := testServerNoDb(t)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/socket/doc?token=short"
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	_, resp, err := websocket.Dial(ctx, url, nil)
+	if err == nil {
+		t.Fatal("Expected connection with invalid token to fail")
+	}
+	if resp != nil && resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", resp.StatusCode)
+	}
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent log writes.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// TestAccessLog tests that API requests are logged when enabled and WebSocket upgrades are not.
+func TestAccessLog(t *testing.T) {
+	var buf lockedBuffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	config := testConfig()
+	config.AccessLog = true
+	server := NewServer(nil, config)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/api/stats")
+	if err != nil {
+		t.Fatalf("Failed to get stats: %v", err)
+	}
+	resp.Body.Close()
+
+	conn := connectWebSocket(t, ts, "access-log", "")
+	readServerMsg(t, conn)
+
+	out := buf.String()
+	if !strings.Contains(out, `"GET /api/stats HTTP/1.1" 200`) {
+		t.Errorf("Expected access log line for /api/stats, got:\n%s", out)
+	}
+	if strings.Contains(out, `"GET /api/socket/`) {
+		t.Errorf("Expected WebSocket upgrade to be excluded, got:\n%s", out)
+	}
+}
+
+// TestClientIP tests that forwarding headers are only honored when the
+// immediate peer is a trusted proxy.
+func TestClientIP(t *testing.T) {
+	config := testConfig()
+	config.TrustedProxies = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	server := NewServer(nil, config)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{"direct client", "203.0.113.5:4000", nil, "203.0.113.5"},
+		{"spoofed XFF from untrusted peer", "203.0.113.5:4000", map[string]string{"X-Forwarded-For": "1.2.3.4"}, "203.0.113.5"},
+		{"spoofed X-Real-IP from untrusted peer", "203.0.113.5:4000", map[string]string{"X-Real-IP": "1.2.3.4"}, "203.0.113.5"},
+		{"XFF from trusted proxy", "10.0.0.2:4000", map[string]string{"X-Forwarded-For": "198.51.100.9"}, "198.51.100.9"},
+		{"client-supplied hop before the real one", "10.0.0.2:4000", map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.9"}, "198.51.100.9"},
+		{"chained trusted proxies", "10.0.0.2:4000", map[string]string{"X-Forwarded-For": "198.51.100.9, 10.1.1.1"}, "198.51.100.9"},
+		{"X-Real-IP from trusted proxy", "10.0.0.2:4000", map[string]string{"X-Real-IP": "198.51.100.9"}, "198.51.100.9"},
+		{"malformed XFF from trusted proxy", "10.0.0.2:4000", map[string]string{"X-Forwarded-For": "not-an-ip"}, "10.0.0.2"},
+		{"trusted proxy without headers", "10.0.0.2:4000", nil, "10.0.0.2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/stats", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for key, value := range tt.headers {
+				r.Header.Set(key, value)
+			}
+			if got := server.clientIP(r); got != tt.want {
+				t.Errorf("Expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+
+	// Without trusted proxies, headers are never believed
+	untrusting := NewServer(nil, testConfig())
+	r := httptest.NewRequest(http.MethodGet, "/api/stats", nil)
+	r.RemoteAddr = "10.0.0.2:4000"
+	r.Header.Set("X-Forwarded-For", "198.51.100.9")
+	if got := untrusting.clientIP(r); got != "10.0.0.2" {
+		t.Errorf("Expected peer address with no trusted proxies, got %s", got)
+	}
+}
+
+// TestRawDocument tests that /raw serves the current text of resident and
+// database-only documents, guarded by the OTP when protected.
+func TestRawDocument(t *testing.T) {
+	db := newMemStore()
+	server := NewServer(db, testConfig())
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	get := func(path string) (int, string, http.Header) {
+		t.Helper()
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body), resp.Header
+	}
+
+	// Resident document, edited over the WebSocket
+	conn := connectWebSocket(t, ts, "raw-live", "")
+	readServerMsg(t, conn) // Read Identity
+	op := ot.NewOperationSeq()
+	op.Insert("héllo\n")
+	sendClientMsg(t, conn, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 0, Operation: op}})
+	readServerMsg(t, conn) // Read History broadcast
+
+	status, body, header := get("/api/document/raw-live/raw")
+	if status != http.StatusOK || body != "héllo\n" {
+		t.Errorf("Expected 200 with live text, got %d %q", status, body)
+	}
+	if ct := header.Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("Expected text/plain, got %q", ct)
+	}
+	if cd := header.Get("Content-Disposition"); cd != "inline" {
+		t.Errorf("Expected inline disposition, got %q", cd)
+	}
+
+	// Database-only, protected document
+	otp := "secret"
+	if err := db.Store(&database.PersistedDocument{ID: "raw-cold", Text: "stored", OTP: &otp}); err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+	loads := db.loadCount()
+	if status, _, _ := get("/api/document/raw-cold/raw"); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without OTP, got %d", status)
+	}
+	if db.loadCount() != loads {
+		t.Error("Expected unauthorized raw read not to load the document text")
+	}
+	if status, body, _ := get("/api/document/raw-cold/raw?otp=secret"); status != http.StatusOK || body != "stored" {
+		t.Errorf("Expected 200 with stored text, got %d %q", status, body)
+	}
+	if _, ok := server.state.documents.Load("raw-cold"); ok {
+		t.Error("Expected raw read not to load the document into memory")
+	}
+
+	if status, _, _ := get("/api/document/missing/raw"); status != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown document, got %d", status)
+	}
+}
+
+// setExpiry calls the expiry endpoint and returns the response status.
+func setExpiry(t *testing.T, ts *httptest.Server, docID string, userID uint64, otp string, days *int) int {
+	t.Helper()
+
+	body, _ := json.Marshal(map[string]any{"user_id": userID, "user_name": "Test", "otp": otp, "expiry_days": days})
+	req, _ := http.NewRequest(http.MethodPut, ts.URL+"/api/document/"+docID+"/expiry", bytes.NewReader(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to set expiry: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// TestDocumentExpiryOverride tests that pinned documents survive cleanup while
+// documents with a short override expire before the server default.
+func TestDocumentExpiryOverride(t *testing.T) {
+	server := testServer(t)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	never, oneDay := 0, 1
+	for docID, days := range map[string]*int{"pinned": &never, "scratch": &oneDay} {
+		conn := connectWebSocket(t, ts, docID, "")
+		userID := *readServerMsg(t, conn).Identity
+		sendClientMsg(t, conn, &protocol.ClientMsg{ClientInfo: &protocol.UserInfo{Name: "Test", Hue: 0}})
+		readServerMsg(t, conn) // Read UserInfo broadcast
+		if status := setExpiry(t, ts, docID, userID, "", days); status != http.StatusOK {
+			t.Fatalf("Expected 200 setting expiry on %s, got %d", docID, status)
+		}
+		conn.Close(websocket.StatusNormalClosure, "")
+	}
+	server.getOrCreateDocument("default") // No override
+
+	// Pretend every document was last accessed two days ago
+	server.state.documents.Range(func(key, value interface{}) bool {
+		value.(*Document).LastAccessed = time.Now().Add(-48 * time.Hour)
+		return true
+	})
+	server.cleanupExpiredDocuments(7)
+
+	for docID, wantResident := range map[string]bool{"pinned": true, "scratch": false, "default": true} {
+		if _, ok := server.state.documents.Load(docID); ok != wantResident {
+			t.Errorf("Document %s: expected resident=%v, got %v", docID, wantResident, ok)
+		}
+	}
+
+	// The override is persisted and restored on reload
+	persisted, err := server.state.db.Load("pinned")
+	if err != nil || persisted == nil || persisted.ExpiryDays == nil || *persisted.ExpiryDays != 0 {
+		t.Fatalf("Expected persisted override of 0 days, got %+v (err=%v)", persisted, err)
+	}
+	server.state.documents.Delete("pinned")
+	if override := server.getOrCreateDocument("pinned").expiryOverride.Load(); override == nil || *override != 0 {
+		t.Errorf("Expected override to be restored from the database, got %v", override)
+	}
+}
+
+// TestSetExpiryRequiresOTP tests that protected documents need the OTP to change expiry.
+func TestSetExpiryRequiresOTP(t *testing.T) {
+	server := testServer(t)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	docID := "expiry-otp"
+	conn := connectWebSocket(t, ts, docID, "")
+	userID := *readServerMsg(t, conn).Identity
+	sendClientMsg(t, conn, &protocol.ClientMsg{ClientInfo: &protocol.UserInfo{Name: "Dana", Hue: 90}})
+	readServerMsg(t, conn) // Read UserInfo broadcast
+
+	resp, err := http.Post(ts.URL+"/api/document/"+docID+"/protect", "application/json",
+		strings.NewReader(fmt.Sprintf(`{"user_id": %d, "user_name": "Dana"}`, userID)))
+	if err != nil {
+		t.Fatalf("Failed to protect document: %v", err)
+	}
+	var protectResp struct {
+		OTP string `json:"otp"`
+	}
+	json.NewDecoder(resp.Body).Decode(&protectResp)
+	resp.Body.Close()
+
+	never := 0
+	if status := setExpiry(t, ts, docID, userID, "wrong", &never); status != http.StatusForbidden {
+		t.Errorf("Expected 403 with wrong OTP, got %d", status)
+	}
+	if status := setExpiry(t, ts, docID, userID, protectResp.OTP, &never); status != http.StatusOK {
+		t.Errorf("Expected 200 with correct OTP, got %d", status)
+	}
+
+	invalid := -1
+	if status := setExpiry(t, ts, docID, userID, protectResp.OTP, &invalid); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for negative expiry, got %d", status)
+	}
+}
+
+// setMaxSize calls the size limit endpoint and returns the status code.
+func setMaxSize(t *testing.T, ts *httptest.Server, docID string, userID uint64, otp string, size *int) int {
+	t.Helper()
+
+	body, _ := json.Marshal(map[string]any{"user_id": userID, "user_name": "Test", "otp": otp, "max_size": size})
+	req, _ := http.NewRequest(http.MethodPut, ts.URL+"/api/document/"+docID+"/max-size", bytes.NewReader(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to set size limit: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// TestDocumentMaxSizeOverride tests that a raised per-document size limit
+// admits edits, and WebSocket messages, past the server default, that it's
+// bounded by the cap and the current text, and that it survives a reload.
+func TestDocumentMaxSizeOverride(t *testing.T) {
+	config := testConfig()
+	config.MaxDocumentSize = 16
+	config.MaxDocumentSizeCap = 256 * 1024
+	server := NewServer(newMemStore(), config)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	docID := "max-size"
+	conn := connectWebSocket(t, ts, docID, "")
+	conn.SetReadLimit(1024 * 1024) // For the edit echoed back
+	userID := *readServerMsg(t, conn).Identity
+	sendClientMsg(t, conn, &protocol.ClientMsg{ClientInfo: &protocol.UserInfo{Name: "Test", Hue: 0}})
+	readServerMsg(t, conn) // Read UserInfo broadcast
+
+	overCap := config.MaxDocumentSizeCap + 1
+	if status := setMaxSize(t, ts, docID, userID, "", &overCap); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a limit over the cap, got %d", status)
+	}
+	raised := 128 * 1024
+	if status := setMaxSize(t, ts, docID, userID, "", &raised); status != http.StatusOK {
+		t.Fatalf("Expected 200 raising the limit, got %d", status)
+	}
+
+	// 100KB is past both the server default and its message limit
+	text := strings.Repeat("x", 100*1024)
+	sendClientMsg(t, conn, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 0, Operation: insertAt(0, 0, text)}})
+	for {
+		if msg := readServerMsg(t, conn); msg.History != nil {
+			break
+		}
+	}
+	doc, _ := server.state.documents.Load(docID)
+	if got := doc.(*Document).Kolabpad.SizeBytes(); got != len(text) {
+		t.Fatalf("Expected the edit to be applied, document is %d bytes", got)
+	}
+
+	lowered := 1024
+	if status := setMaxSize(t, ts, docID, userID, "", &lowered); status != http.StatusConflict {
+		t.Errorf("Expected 409 for a limit below the current size, got %d", status)
+	}
+
+	// The override is persisted and restored on reload
+	persisted, err := server.state.db.Load(docID)
+	if err != nil || persisted == nil || persisted.MaxSize == nil || *persisted.MaxSize != raised {
+		t.Fatalf("Expected persisted limit of %d bytes, got %+v (err=%v)", raised, persisted, err)
+	}
+	conn.Close(websocket.StatusNormalClosure, "")
+	server.state.documents.Delete(docID)
+	if size := server.getOrCreateDocument(docID).Kolabpad.MaxSize(); size == nil || *size != raised {
+		t.Errorf("Expected limit to be restored from the database, got %v", size)
+	}
+}
+
+// TestServerTimeSent tests that the server clock follows Identity and is
+// resent periodically when configured.
+func TestServerTimeSent(t *testing.T) {
+	config := testConfig()
+	config.ServerTimeInterval = 50 * time.Millisecond
+	server := NewServer(nil, config)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	before := time.Now().UnixMilli()
+	conn := connectWebSocket(t, ts, "clock", "")
+
+	if msg := readRawServerMsg(t, conn); msg.Identity == nil {
+		t.Fatalf("Expected Identity first, got %+v", msg)
+	}
+	msg := readRawServerMsg(t, conn)
+	if msg.ServerTime == nil {
+		t.Fatalf("Expected ServerTime after Identity, got %+v", msg)
+	}
+	if *msg.ServerTime < before || *msg.ServerTime > time.Now().UnixMilli() {
+		t.Errorf("ServerTime %d outside expected range", *msg.ServerTime)
+	}
+
+	// The next message on an idle document is a periodic resync
+	if msg := readRawServerMsg(t, conn); msg.ServerTime == nil {
+		t.Errorf("Expected periodic ServerTime, got %+v", msg)
+	}
+}
+
+// TestTrimmedHistoryForcesResync tests that a client left behind by the
+// history cap is told to reconnect instead of silently missing edits.
+func TestTrimmedHistoryForcesResync(t *testing.T) {
+	config := testConfig()
+	config.MaxHistoryOps = 2
+	server := NewServer(nil, config)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	docID := "trimmed"
+	conn := connectWebSocket(t, ts, docID, "")
+	readServerMsg(t, conn) // Read Identity
+
+	// Another writer pushes the document past the cap before this client catches up
+	kolabpad := server.getOrCreateDocument(docID).Kolabpad
+	writer := kolabpad.NextUserID()
+	for i := 0; i < 5; i++ {
+		if err := kolabpad.ApplyEdit(writer, i, insertAt(i, i, "x")); err != nil {
+			t.Fatalf("Edit %d failed: %v", i, err)
+		}
+	}
+
+	// The client's stale edit can't be transformed, so it must resync
+	sendClientMsg(t, conn, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 0, Operation: insertAt(0, 0, "y")}})
+	for {
+		msg := readServerMsg(t, conn)
+		if msg.Shutdown != nil {
+			if !msg.Shutdown.Reconnect {
+				t.Error("Expected resync notice to allow reconnect")
+			}
+			break
+		}
+		if msg.History == nil {
+			t.Fatalf("Expected History or Shutdown, got %+v", msg)
+		}
+	}
+
+	if got := kolabpad.Text(); got != "xxxxx" {
+		t.Errorf("Expected stale edit to be dropped, got %q", got)
+	}
+}
+
+// TestRevisionLagForcesResync tests that an edit trailing the document by
+// more than MaxRevisionLag is rejected without being applied and the client
+// is told to reconnect.
+func TestRevisionLagForcesResync(t *testing.T) {
+	config := testConfig()
+	config.MaxRevisionLag = 3
+	server := NewServer(nil, config)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	docID := "lagged"
+	conn := connectWebSocket(t, ts, docID, "")
+	readServerMsg(t, conn) // Read Identity
+
+	kolabpad := server.getOrCreateDocument(docID).Kolabpad
+	writer := kolabpad.NextUserID()
+	for i := 0; i < 50; i++ {
+		if err := kolabpad.ApplyEdit(writer, i, insertAt(i, i, "x")); err != nil {
+			t.Fatalf("Edit %d failed: %v", i, err)
+		}
+	}
+
+	sendClientMsg(t, conn, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 0, Operation: insertAt(0, 0, "y")}})
+	for {
+		msg := readServerMsg(t, conn)
+		if msg.Shutdown != nil {
+			if !msg.Shutdown.Reconnect {
+				t.Error("Expected resync notice to allow reconnect")
+			}
+			break
+		}
+		if msg.History == nil {
+			t.Fatalf("Expected History or Shutdown, got %+v", msg)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	var next protocol.ServerMsg
+	err := wsjson.Read(ctx, conn, &next)
+	if status := websocket.CloseStatus(err); status != protocol.CloseInvalidRevision {
+		t.Errorf("Expected close code %d, got %d (%v)", protocol.CloseInvalidRevision, status, err)
+	}
+
+	if got := kolabpad.Text(); got != strings.Repeat("x", 50) {
+		t.Errorf("Expected lagged edit to be dropped, got %q", got)
+	}
+}
+
+// TestOversizedRequestBody tests that REST bodies over the limit get 413.
+func TestOversizedRequestBody(t *testing.T) {
+	config := testConfig()
+	config.MaxRequestBodySize = 128
+	server := NewServer(newMemStore(), config)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	body := fmt.Sprintf(`{"user_id": 0, "user_name": %q}`, strings.Repeat("x", 1024))
+	resp, err := http.Post(ts.URL+"/api/document/big-body/protect", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413, got %d", resp.StatusCode)
+	}
+
+	// A small malformed body is still a plain 400
+	resp, err = http.Post(ts.URL+"/api/document/big-body/protect", "application/json", strings.NewReader("{"))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400, got %d", resp.StatusCode)
+	}
+}
+
+// TestStoreBreaker tests that the breaker trips after consecutive failures,
+// backs off scheduled writes, and recovers on the first success.
+func TestStoreBreaker(t *testing.T) {
+	b := &storeBreaker{}
+	now := time.Now()
+	failure := errors.New("disk full")
+
+	for i := 1; i < persistFailureThreshold; i++ {
+		if b.record(failure, now) {
+			t.Fatalf("Breaker changed state after %d failures", i)
+		}
+	}
+	if !b.record(failure, now) || !b.open() {
+		t.Fatal("Expected breaker to trip at the failure threshold")
+	}
+	if b.allow(now) {
+		t.Error("Expected scheduled writes to back off while open")
+	}
+	if !b.allow(now.Add(persistBaseBackoff)) {
+		t.Error("Expected a retry once the backoff elapsed")
+	}
+
+	// Further failures keep it open and extend the backoff, capped
+	for i := 0; i < 10; i++ {
+		if b.record(failure, now) {
+			t.Fatal("Expected no state change while already open")
+		}
+	}
+	if got := b.retryAt.Sub(now); got != persistMaxBackoff {
+		t.Errorf("Expected backoff capped at %v, got %v", persistMaxBackoff, got)
+	}
+
+	if !b.record(nil, now) || b.open() {
+		t.Error("Expected a successful write to close the breaker")
+	}
+}
+
+// TestPersistenceDegradedNotice tests that clients are warned once writes keep
+// failing, including clients that join afterwards, and told when writes recover.
+func TestPersistenceDegradedNotice(t *testing.T) {
+	store := newMemStore()
+	server := NewServer(store, testConfig())
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	docID := "degraded"
+	conn := connectWebSocket(t, ts, docID, "")
+	readServerMsg(t, conn) // Read Identity
+
+	requestFlush := func() error {
+		doc, _ := server.state.documents.Load(docID)
+		done := make(chan error, 1)
+		doc.(*Document).flushReq <- done
+		return <-done
+	}
+
+	store.fail(errors.New("disk full"))
+	for i := 0; i < persistFailureThreshold; i++ {
+		if err := requestFlush(); err == nil {
+			t.Fatal("Expected flush to fail")
+		}
+	}
+
+	msg := readServerMsg(t, conn)
+	if msg.Error == nil || msg.Error.Code != protocol.ErrorCodePersistenceDegraded {
+		t.Fatalf("Expected persistence_degraded notice, got %+v", msg)
+	}
+
+	late := connectWebSocket(t, ts, docID, "")
+	readServerMsg(t, late) // Read Identity
+	if msg := readServerMsg(t, late); msg.Error == nil || msg.Error.Code != protocol.ErrorCodePersistenceDegraded {
+		t.Errorf("Expected late joiner to be warned, got %+v", msg)
+	}
+
+	store.fail(nil)
+	if err := requestFlush(); err != nil {
+		t.Fatalf("Expected flush to succeed after recovery: %v", err)
+	}
+	if msg := readServerMsg(t, conn); msg.Error == nil || msg.Error.Code != protocol.ErrorCodePersistenceRestored {
+		t.Errorf("Expected persistence_restored notice, got %+v", msg)
+	}
+}
+
+// TestMaxStoredDocuments tests that once the database holds
+// MaxStoredDocuments, new documents are edited in memory but not persisted,
+// while stored ones keep saving.
+func TestMaxStoredDocuments(t *testing.T) {
+	store := newMemStore()
+	store.Store(&database.PersistedDocument{ID: "stored-1", Text: "one"})
+	store.Store(&database.PersistedDocument{ID: "stored-2", Text: "two"})
+	config := testConfig()
+	config.MaxStoredDocuments = 2
+	server := NewServer(store, config)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	requestFlush := func(docID string) error {
+		doc, _ := server.state.documents.Load(docID)
+		done := make(chan error, 1)
+		doc.(*Document).flushReq <- done
+		return <-done
+	}
+	insert := func(conn *websocket.Conn, docLen int, text string) {
+		sendClientMsg(t, conn, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 1, Operation: insertAt(docLen, docLen, text)}})
+	}
+
+	// A new document still takes edits, but isn't saved
+	conn := connectWebSocket(t, ts, "new", "")
+	readServerMsg(t, conn) // Read Identity
+	sendClientMsg(t, conn, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 0, Operation: insertAt(0, 0, "ephemeral")}})
+	readServerMsg(t, conn) // Read History broadcast of the edit
+	if err := requestFlush("new"); !errors.Is(err, ErrStorageFull) {
+		t.Fatalf("Expected ErrStorageFull, got %v", err)
+	}
+	if msg := readServerMsg(t, conn); msg.Error == nil || msg.Error.Code != protocol.ErrorCodeStorageFull {
+		t.Fatalf("Expected storage_full notice, got %+v", msg)
+	}
+	if exists, _ := store.Exists("new"); exists {
+		t.Error("Expected new document not to be persisted")
+	}
+	if count, _ := store.Count(); count != 2 {
+		t.Errorf("Expected 2 stored documents, got %d", count)
+	}
+
+	// Protecting it would create a row too
+	resp, _ := sendRequest(t, conn, 1, protocol.MethodProtect)
+	if resp.Error == nil || resp.Error.Code != protocol.ErrorCodeStorageFull {
+		t.Errorf("Expected storage_full protecting a new document, got %+v", resp)
+	}
+
+	// Stored documents keep saving
+	stored := connectWebSocket(t, ts, "stored-1", "")
+	readServerMsg(t, stored) // Read Identity
+	readServerMsg(t, stored) // Read History
+	insert(stored, 3, "!")
+	readServerMsg(t, stored) // Read History broadcast of the edit
+	if err := requestFlush("stored-1"); err != nil {
+		t.Fatalf("Expected stored document to save: %v", err)
+	}
+	if doc, _ := store.Load("stored-1"); doc == nil || doc.Text != "one!" {
+		t.Errorf("Expected stored-1 to be updated, got %+v", doc)
+	}
+
+	// Freeing a slot lets the new document save on its next write
+	if err := server.state.db.Delete("stored-2"); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	insert(conn, 9, "!")
+	readServerMsg(t, conn) // Read History broadcast of the edit
+	if err := requestFlush("new"); err != nil {
+		t.Fatalf("Expected new document to save once there's room: %v", err)
+	}
+	if msg := readServerMsg(t, conn); msg.Error == nil || msg.Error.Code != protocol.ErrorCodePersistenceRestored {
+		t.Errorf("Expected persistence_restored notice, got %+v", msg)
+	}
+	if doc, _ := store.Load("new"); doc == nil || doc.Text != "ephemeral!" {
+		t.Errorf("Expected new document to be persisted, got %+v", doc)
+	}
+}
+
+// TestDefaultContent tests that brand-new documents start from the template,
+// while stored documents keep their own content.
+func TestDefaultContent(t *testing.T) {
+	store := newMemStore()
+	lang := "markdown"
+	config := testConfig()
+	config.DefaultContent = "# Notes\n"
+	config.DefaultLanguage = &lang
+	server := NewServer(store, config)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	conn := connectWebSocket(t, ts, "fresh", "")
+	readServerMsg(t, conn) // Read Identity
+
+	msg := readServerMsg(t, conn)
+	if msg.History == nil || len(msg.History.Operations) != 1 {
+		t.Fatalf("Expected a single template operation, got %+v", msg)
+	}
+	if entry := msg.History.Operations[0]; entry.ID != protocol.SystemUserID || replayHistory(t, msg.History.Operations) != "# Notes\n" {
+		t.Errorf("Expected system template %q, got %+v", "# Notes\n", entry)
+	}
+	if msg := readServerMsg(t, conn); msg.Language == nil || msg.Language.Language != "markdown" {
+		t.Errorf("Expected template language, got %+v", msg)
+	}
+
+	// An untouched template isn't persisted
+	doc := server.getOrCreateDocument("fresh")
+	if wrote, err := doc.Kolabpad.Flush(context.Background(), store, "fresh"); err != nil || wrote {
+		t.Errorf("Expected untouched template to be skipped, wrote=%v err=%v", wrote, err)
+	}
+
+	// Stored documents bypass the template
+	store.Store(&database.PersistedDocument{ID: "existing", Text: "mine"})
+	if got := server.getOrCreateDocument("existing").Kolabpad.Text(); got != "mine" {
+		t.Errorf("Expected stored text %q, got %q", "mine", got)
+	}
+}
+
+// waitIdle waits until the document has no connections and returns when it became idle.
+func waitIdle(t *testing.T, server *Server, docID string) time.Time {
+	t.Helper()
+
+	val, ok := server.state.documents.Load(docID)
+	if !ok {
+		t.Fatalf("Document %s not found in server state", docID)
+	}
+	doc := val.(*Document)
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		doc.connectionCountMu.Lock()
+		idleSince := doc.idleSince
+		doc.connectionCountMu.Unlock()
+		if !idleSince.IsZero() {
+			return idleSince
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timeout waiting for document %s to become idle", docID)
+	return time.Time{}
+}
+
+// TestIdleUnload tests that a document without connections is flushed and
+// unloaded after the idle period, and reloads from the database on reconnect.
+func TestIdleUnload(t *testing.T) {
+	store := newMemStore()
+	server := NewServer(store, testConfig())
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	docID := "idle-unload"
+	conn := connectWebSocket(t, ts, docID, "")
+	readServerMsg(t, conn) // Read Identity
+	op := ot.NewOperationSeq()
+	op.Insert("kept")
+	sendClientMsg(t, conn, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 0, Operation: op}})
+	readServerMsg(t, conn) // Read History broadcast
+
+	// A connected document is never unloaded
+	server.unloadIdleDocuments(0)
+	if _, ok := server.state.documents.Load(docID); !ok {
+		t.Fatal("Expected connected document to stay resident")
+	}
+
+	conn.Close(websocket.StatusNormalClosure, "")
+	waitIdle(t, server, docID)
+
+	// Not idle long enough yet
+	server.unloadIdleDocuments(time.Hour)
+	if _, ok := server.state.documents.Load(docID); !ok {
+		t.Fatal("Expected document to stay resident before the idle period")
+	}
+
+	server.unloadIdleDocuments(0)
+	if _, ok := server.state.documents.Load(docID); ok {
+		t.Fatal("Expected idle document to be unloaded")
+	}
+	if persisted, _ := store.Load(docID); persisted == nil || persisted.Text != "kept" {
+		t.Fatalf("Expected unloaded document in the database, got %+v", persisted)
+	}
+
+	// Reconnecting loads it back
+	conn = connectWebSocket(t, ts, docID, "")
+	readServerMsg(t, conn) // Read Identity
+	msg := readServerMsg(t, conn)
+	if msg.History == nil || len(msg.History.Operations) == 0 {
+		t.Fatalf("Expected History after reload, got %+v", msg)
+	}
+	if got := replayHistory(t, msg.History.Operations); got != "kept" {
+		t.Errorf("Expected reloaded text %q, got %q", "kept", got)
+	}
+}
+
+// TestDiscardEmptyDocument tests that a document nobody edited or protected
+// is removed from memory and the database when its last connection closes,
+// while edited documents stay, and that reconnecting starts a fresh one.
+func TestDiscardEmptyDocument(t *testing.T) {
+	store := newMemStore()
+	store.Store(&database.PersistedDocument{ID: "stale"})
+	server := NewServer(store, testConfig())
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	waitGone := func(docID string) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if _, ok := server.state.documents.Load(docID); !ok {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Timeout waiting for document %s to be discarded", docID)
+	}
+
+	// A second connection keeps the document alive
+	conn1 := connectWebSocket(t, ts, "throwaway", "")
+	readServerMsg(t, conn1) // Read Identity
+	conn2 := connectWebSocket(t, ts, "throwaway", "")
+	readServerMsg(t, conn2) // Read Identity
+	conn1.Close(websocket.StatusNormalClosure, "")
+	if msg := readServerMsg(t, conn2); msg.UserInfo == nil || msg.UserInfo.Info != nil {
+		t.Fatalf("Expected UserInfo leave for the first client, got %+v", msg)
+	}
+	if _, ok := server.state.documents.Load("throwaway"); !ok {
+		t.Fatal("Expected document with a connection to stay resident")
+	}
+
+	conn2.Close(websocket.StatusNormalClosure, "")
+	waitGone("throwaway")
+
+	// An empty row left in the database goes too
+	conn := connectWebSocket(t, ts, "stale", "")
+	readServerMsg(t, conn) // Read Identity
+	conn.Close(websocket.StatusNormalClosure, "")
+	waitGone("stale")
+	if persisted, _ := store.Load("stale"); persisted != nil {
+		t.Errorf("Expected empty document to be deleted from the database, got %+v", persisted)
+	}
+
+	// Edited documents are kept
+	conn = connectWebSocket(t, ts, "edited", "")
+	readServerMsg(t, conn) // Read Identity
+	op := ot.NewOperationSeq()
+	op.Insert("kept")
+	sendClientMsg(t, conn, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 0, Operation: op}})
+	readServerMsg(t, conn) // Read History broadcast
+	conn.Close(websocket.StatusNormalClosure, "")
+	waitIdle(t, server, "edited")
+	if _, ok := server.state.documents.Load("edited"); !ok {
+		t.Error("Expected edited document to stay resident")
+	}
+	if persisted, _ := store.Load("edited"); persisted == nil || persisted.Text != "kept" {
+		t.Errorf("Expected edited document in the database, got %+v", persisted)
+	}
+
+	// Reconnecting to a discarded document starts a working new one
+	conn = connectWebSocket(t, ts, "throwaway", "")
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	readServerMsg(t, conn) // Read Identity
+	op = ot.NewOperationSeq()
+	op.Insert("again")
+	sendClientMsg(t, conn, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 0, Operation: op}})
+	if msg := readServerMsg(t, conn); msg.History == nil || msg.History.Start != 0 {
+		t.Fatalf("Expected History from revision 0, got %+v", msg)
+	}
+}
+
+// TestIdleUnloadKeepsUnflushed tests that a document whose flush fails stays
+// resident rather than losing its edits.
+func TestIdleUnloadKeepsUnflushed(t *testing.T) {
+	store := newMemStore()
+	server := NewServer(store, testConfig())
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	docID := "idle-unflushed"
+	conn := connectWebSocket(t, ts, docID, "")
+	readServerMsg(t, conn) // Read Identity
+	op := ot.NewOperationSeq()
+	op.Insert("unsaved")
+	sendClientMsg(t, conn, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 0, Operation: op}})
+	readServerMsg(t, conn) // Read History broadcast
+
+	store.fail(errors.New("disk full"))
+	conn.Close(websocket.StatusNormalClosure, "")
+	waitIdle(t, server, docID)
+
+	server.unloadIdleDocuments(0)
+	if _, ok := server.state.documents.Load(docID); !ok {
+		t.Fatal("Expected document to stay resident when its flush fails")
+	}
+}
+
+// TestPasswordHash tests that hashes are salted and only verify the password
+// they were made from.
+func TestPasswordHash(t *testing.T) {
+	hash := hashPassword("correct horse")
+	if strings.Contains(hash, "correct horse") {
+		t.Fatalf("Expected hash not to contain the plaintext, got %q", hash)
+	}
+	if !verifyPassword(hash, "correct horse") {
+		t.Error("Expected the correct password to verify")
+	}
+	if verifyPassword(hash, "correct horsE") || verifyPassword(hash, "") {
+		t.Error("Expected an incorrect password not to verify")
+	}
+	if hashPassword("correct horse") == hash {
+		t.Error("Expected hashes of the same password to differ by salt")
+	}
+	if verifyPassword("plaintext", "plaintext") || verifyPassword("pbkdf2-sha256$0$$", "") {
+		t.Error("Expected malformed hashes never to verify")
+	}
+}
+
+// setPassword calls the password endpoint with a session token (if not "")
+// and returns the response status.
+func setPassword(t *testing.T, ts *httptest.Server, docID string, userID uint64, password, session string) int {
+	t.Helper()
+
+	body, _ := json.Marshal(map[string]any{"user_id": userID, "user_name": "Test", "password": password})
+	resp, err := http.Post(ts.URL+"/api/document/"+docID+"/password?session="+session, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to set password: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// passwordSessionFor exchanges a password for a session token, returning the
+// response status and the token.
+func passwordSessionFor(t *testing.T, ts *httptest.Server, docID, password string) (int, string) {
+	t.Helper()
+
+	body, _ := json.Marshal(map[string]string{"password": password})
+	resp, err := http.Post(ts.URL+"/api/document/"+docID+"/auth", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var authResp struct {
+		Session   string `json:"session"`
+		ExpiresIn int    `json:"expires_in"`
+	}
+	json.NewDecoder(resp.Body).Decode(&authResp)
+	if resp.StatusCode == http.StatusOK && authResp.ExpiresIn <= 0 {
+		t.Errorf("Expected a positive expires_in, got %d", authResp.ExpiresIn)
+	}
+	return resp.StatusCode, authResp.Session
+}
+
+// dialStatus opens a WebSocket with the given query and headers and returns
+// the HTTP status of the handshake (101 on success).
+func dialStatus(t *testing.T, ts *httptest.Server, docID, query string, header http.Header) int {
+	t.Helper()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/socket/" + docID + query
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, resp, err := websocket.Dial(ctx, url, &websocket.DialOptions{HTTPHeader: header})
+	if err != nil {
+		if resp == nil {
+			t.Fatalf("Failed to connect WebSocket: %v", err)
+		}
+		return resp.StatusCode
+	}
+	conn.Close(websocket.StatusNormalClosure, "")
+	return resp.StatusCode
+}
+
+// TestCanCreateDocument tests that Config.CanCreateDocument gates new
+// documents only: stored and resident documents stay reachable without it.
+func TestCanCreateDocument(t *testing.T) {
+	var mu sync.Mutex
+	var asked []string
+	config := testConfig()
+	config.CanCreateDocument = func(id string, r *http.Request) bool {
+		mu.Lock()
+		asked = append(asked, id)
+		mu.Unlock()
+		return r.Header.Get("X-Creator") == "yes"
+	}
+	store := newMemStore()
+	store.Store(&database.PersistedDocument{ID: "stored", Text: "hello"})
+	server := NewServer(store, config)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	// Denied creation
+	if status := dialStatus(t, ts, "new-denied", "", nil); status != http.StatusForbidden {
+		t.Errorf("Expected 403 creating without permission, got %d", status)
+	}
+	if _, ok := server.state.documents.Load("new-denied"); ok {
+		t.Error("Expected denied document not to be created")
+	}
+
+	// Allowed creation; keep the connection so the document stays resident
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/socket/new-allowed"
+	creator, _, err := websocket.Dial(ctx, url, &websocket.DialOptions{HTTPHeader: http.Header{"X-Creator": {"yes"}}})
+	if err != nil {
+		t.Fatalf("Expected allowed creation to connect: %v", err)
+	}
+	defer creator.Close(websocket.StatusNormalClosure, "")
+	readServerMsg(t, creator) // Read Identity
+
+	// Existing documents don't ask
+	mu.Lock()
+	asked = nil
+	mu.Unlock()
+	if status := dialStatus(t, ts, "new-allowed", "", nil); status != http.StatusSwitchingProtocols {
+		t.Errorf("Expected resident document to accept anyone, got %d", status)
+	}
+	if status := dialStatus(t, ts, "stored", "", nil); status != http.StatusSwitchingProtocols {
+		t.Errorf("Expected stored document to accept anyone, got %d", status)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(asked) != 0 {
+		t.Errorf("Expected CanCreateDocument not to be asked about existing documents, asked about %v", asked)
+	}
+}
+
+// postNewDocument creates a document with POST /api/document/new, naming it
+// id unless that's empty, and returns the status and the created ID.
+func postNewDocument(t *testing.T, ts *httptest.Server, id string) (int, string) {
+	t.Helper()
+
+	body, _ := json.Marshal(map[string]string{"id": id})
+	resp, err := http.Post(ts.URL+"/api/document/new", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to create document: %v", err)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		ID string `json:"id"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	return resp.StatusCode, result.ID
+}
+
+// TestCreateOnConnect tests both modes of Config.CreateOnConnect: by default
+// connecting creates unknown documents; without it they're 404 until made
+// with POST /api/document/new, after which they stay even if left untouched.
+func TestCreateOnConnect(t *testing.T) {
+	t.Run("enabled", func(t *testing.T) {
+		ts := httptest.NewServer(testServer(t))
+		defer ts.Close()
+
+		if status := dialStatus(t, ts, "fresh", "", nil); status != http.StatusSwitchingProtocols {
+			t.Errorf("Expected connecting to create the document, got %d", status)
+		}
+		if status, id := postNewDocument(t, ts, "made"); status != http.StatusCreated || id != "made" {
+			t.Errorf("Expected explicit creation to work too, got %d %q", status, id)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		config := testConfig()
+		config.CreateOnConnect = false
+		store := newMemStore()
+		store.Store(&database.PersistedDocument{ID: "stored", Text: "hello"})
+		server := NewServer(store, config)
+		ts := httptest.NewServer(server)
+		defer ts.Close()
+
+		if status := dialStatus(t, ts, "typo", "", nil); status != http.StatusNotFound {
+			t.Errorf("Expected 404 connecting to an unknown document, got %d", status)
+		}
+		if _, ok := server.state.documents.Load("typo"); ok {
+			t.Error("Expected the unknown document not to be created")
+		}
+		if status := dialStatus(t, ts, "stored", "", nil); status != http.StatusSwitchingProtocols {
+			t.Errorf("Expected stored document to accept connections, got %d", status)
+		}
+
+		status, id := postNewDocument(t, ts, "made")
+		if status != http.StatusCreated || id != "made" {
+			t.Fatalf("Expected 201 creating the document, got %d %q", status, id)
+		}
+		if persisted, _ := store.Load("made"); persisted == nil {
+			t.Error("Expected the created document to be stored")
+		}
+		if status, _ := postNewDocument(t, ts, "made"); status != http.StatusConflict {
+			t.Errorf("Expected 409 creating it again, got %d", status)
+		}
+		if status, _ := postNewDocument(t, ts, "stored"); status != http.StatusConflict {
+			t.Errorf("Expected 409 creating a stored document, got %d", status)
+		}
+
+		// Left untouched, it isn't discarded when its only visitor leaves
+		for range 2 {
+			if status := dialStatus(t, ts, "made", "", nil); status != http.StatusSwitchingProtocols {
+				t.Errorf("Expected the created document to accept connections, got %d", status)
+			}
+		}
+		time.Sleep(100 * time.Millisecond) // Let the server see the close
+		if _, ok := server.state.documents.Load("made"); !ok {
+			t.Error("Expected the untouched document to stay resident")
+		}
+		if persisted, _ := store.Load("made"); persisted == nil {
+			t.Error("Expected the untouched document to stay stored")
+		}
+
+		// Without an ID, a random one
+		status, id = postNewDocument(t, ts, "")
+		if status != http.StatusCreated || len(id) != documentIDLength {
+			t.Fatalf("Expected 201 with a random ID, got %d %q", status, id)
+		}
+		if status := dialStatus(t, ts, id, "", nil); status != http.StatusSwitchingProtocols {
+			t.Errorf("Expected the random document to accept connections, got %d", status)
+		}
+
+		if status, _ := postNewDocument(t, ts, "team/doc"); status != http.StatusBadRequest {
+			t.Errorf("Expected 400 for an invalid ID, got %d", status)
+		}
+		resp, err := http.Get(ts.URL + "/api/document/new")
+		if err != nil {
+			t.Fatalf("GET failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("Expected 405 for GET, got %d", resp.StatusCode)
+		}
+	})
+}
+
+// TestDocumentPassword tests that a password-protected document only accepts
+// connections with a valid session token or the correct password, on both
+// the hot and cold paths, and that changing the password revokes sessions.
+func TestDocumentPassword(t *testing.T) {
+	db := newMemStore()
+	server := NewServer(db, testConfig())
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	docID := "password-doc"
+	conn := connectWebSocket(t, ts, docID, "")
+	userID := *readServerMsg(t, conn).Identity
+	sendClientMsg(t, conn, &protocol.ClientMsg{ClientInfo: &protocol.UserInfo{Name: "Erin", Hue: 200}})
+	readServerMsg(t, conn) // Read UserInfo broadcast
+
+	if status := setPassword(t, ts, docID, userID+1, "correct horse", ""); status != http.StatusForbidden {
+		t.Errorf("Expected 403 for a user who isn't connected, got %d", status)
+	}
+	if status := setPassword(t, ts, docID, userID, "", ""); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an empty password, got %d", status)
+	}
+	if status := setPassword(t, ts, docID, userID, "correct horse", ""); status != http.StatusNoContent {
+		t.Fatalf("Expected 204 setting the password, got %d", status)
+	}
+	if hash, _ := db.GetPasswordHash(docID); hash == nil || *hash == "correct horse" {
+		t.Fatalf("Expected a hash to be stored, got %v", hash)
+	}
+
+	if status := dialStatus(t, ts, docID, "", nil); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a password, got %d", status)
+	}
+	if status, _ := passwordSessionFor(t, ts, docID, "wrong"); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for an incorrect password, got %d", status)
+	}
+	status, session := passwordSessionFor(t, ts, docID, "correct horse")
+	if status != http.StatusOK || session == "" {
+		t.Fatalf("Expected a session for the correct password, got %d", status)
+	}
+	if status := dialStatus(t, ts, docID, "?session="+session, nil); status != http.StatusSwitchingProtocols {
+		t.Errorf("Expected the session to connect, got %d", status)
+	}
+	if status := dialStatus(t, ts, "other-doc", "?session="+session, nil); status != http.StatusSwitchingProtocols {
+		t.Errorf("Expected documents without a password to ignore sessions, got %d", status)
+	}
+	if status := dialStatus(t, ts, docID, "", http.Header{passwordHeader: {"wrong"}}); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for an incorrect password header, got %d", status)
+	}
+	if status := dialStatus(t, ts, docID, "", http.Header{passwordHeader: {"correct horse"}}); status != http.StatusSwitchingProtocols {
+		t.Errorf("Expected the password header to connect, got %d", status)
+	}
+	resp, err := http.Get(ts.URL + "/api/document/" + docID + "/raw")
+	if err != nil {
+		t.Fatalf("GET raw failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected raw reads to require the password, got %d", resp.StatusCode)
+	}
+
+	// Cold path: checked from the database without loading the text
+	cold := httptest.NewServer(NewServer(db, testConfig()))
+	defer cold.Close()
+	loads := db.loadCount()
+	if status := dialStatus(t, cold, docID, "", nil); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a password on a cold document, got %d", status)
+	}
+	if db.loadCount() != loads {
+		t.Error("Expected rejected connection not to load the document")
+	}
+	if status := dialStatus(t, cold, docID, "", http.Header{passwordHeader: {"correct horse"}}); status != http.StatusSwitchingProtocols {
+		t.Errorf("Expected the password header to connect to a cold document, got %d", status)
+	}
+
+	// Changing the password takes a session, since user IDs are guessable,
+	// and revokes outstanding sessions
+	if status := setPassword(t, ts, docID, userID, "battery staple", ""); status != http.StatusForbidden {
+		t.Errorf("Expected 403 changing the password without a session, got %d", status)
+	}
+	if status := setPassword(t, ts, docID, userID, "battery staple", "bogus"); status != http.StatusForbidden {
+		t.Errorf("Expected 403 changing the password with an invalid session, got %d", status)
+	}
+	if status := setPassword(t, ts, docID, userID, "battery staple", session); status != http.StatusNoContent {
+		t.Fatalf("Expected 204 changing the password, got %d", status)
+	}
+	if status := dialStatus(t, ts, docID, "?session="+session, nil); status != http.StatusUnauthorized {
+		t.Errorf("Expected the old session to be revoked, got %d", status)
+	}
+
+	removePassword := func(session string) int {
+		t.Helper()
+		body, _ := json.Marshal(map[string]any{"user_id": userID, "user_name": "Test"})
+		req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/api/document/"+docID+"/password?session="+session, bytes.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to remove password: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := removePassword(""); status != http.StatusForbidden {
+		t.Errorf("Expected 403 removing the password without a session, got %d", status)
+	}
+	if status := removePassword(session); status != http.StatusForbidden {
+		t.Errorf("Expected 403 removing the password with a revoked session, got %d", status)
+	}
+	_, session = passwordSessionFor(t, ts, docID, "battery staple")
+	if status := removePassword(session); status != http.StatusNoContent {
+		t.Fatalf("Expected 204 removing the password, got %d", status)
+	}
+	if status := dialStatus(t, ts, docID, "", nil); status != http.StatusSwitchingProtocols {
+		t.Errorf("Expected connections without a password once removed, got %d", status)
+	}
+}
+
+// createShareLink creates a share link, returning the response status and the link.
+func createShareLink(t *testing.T, ts *httptest.Server, docID string, userID uint64, otp, label, role string) (int, shareLinkResponse) {
+	t.Helper()
+
+	body, _ := json.Marshal(map[string]any{"user_id": userID, "user_name": "Test", "otp": otp, "label": label, "role": role})
+	resp, err := http.Post(ts.URL+"/api/document/"+docID+"/links", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to create share link: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var link shareLinkResponse
+	json.NewDecoder(resp.Body).Decode(&link)
+	return resp.StatusCode, link
+}
+
+// revokeShareLink revokes a share link and returns the response status.
+func revokeShareLink(t *testing.T, ts *httptest.Server, docID string, userID uint64, otp, token string) int {
+	t.Helper()
+
+	body, _ := json.Marshal(map[string]any{"user_id": userID, "user_name": "Test", "otp": otp, "token": token})
+	req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/api/document/"+docID+"/links", bytes.NewReader(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to revoke share link: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// TestShareLinks tests that every share link of a protected document admits
+// clients with its role, that viewers can't edit, that link holders never see
+// the OTP, and that revoking one link disconnects its clients without
+// affecting the OTP or other links.
+func TestShareLinks(t *testing.T) {
+	db := newMemStore()
+	server := NewServer(db, testConfig())
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	docID := "shared-doc"
+	owner := connectWebSocket(t, ts, docID, "")
+	ownerID := *readServerMsg(t, owner).Identity
+	sendClientMsg(t, owner, &protocol.ClientMsg{ClientInfo: &protocol.UserInfo{Name: "Alice", Hue: 0}})
+	readServerMsg(t, owner) // Read UserInfo broadcast
+
+	if status, _ := createShareLink(t, ts, docID, ownerID, "", "early", protocol.RoleViewer); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 creating a link for an unprotected document, got %d", status)
+	}
+
+	protect := func() string {
+		t.Helper()
+		body := fmt.Sprintf(`{"user_id": %d, "user_name": "Alice"}`, ownerID)
+		resp, err := http.Post(ts.URL+"/api/document/"+docID+"/protect", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to protect document: %v", err)
+		}
+		defer resp.Body.Close()
+		var protectResp struct {
+			OTP string `json:"otp"`
+		}
+		json.NewDecoder(resp.Body).Decode(&protectResp)
+		if msg := readServerMsg(t, owner); msg.OTP == nil {
+			t.Fatalf("Expected OTP broadcast, got %+v", msg)
+		}
+		return protectResp.OTP
+	}
+	otp := protect()
+
+	if status, _ := createShareLink(t, ts, docID, ownerID, "wrong", "team", protocol.RoleEditor); status != http.StatusForbidden {
+		t.Errorf("Expected 403 without the OTP, got %d", status)
+	}
+	if status, _ := createShareLink(t, ts, docID, ownerID, otp, "team", "owner"); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown role, got %d", status)
+	}
+	if status, _ := createShareLink(t, ts, docID, ownerID, otp, " ", protocol.RoleEditor); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a blank label, got %d", status)
+	}
+	status, viewerLink := createShareLink(t, ts, docID, ownerID, otp, "reviewers", protocol.RoleViewer)
+	if status != http.StatusCreated || viewerLink.Token == "" || viewerLink.Token == otp {
+		t.Fatalf("Expected 201 and a new token for the viewer link, got %d %+v", status, viewerLink)
+	}
+	status, editorLink := createShareLink(t, ts, docID, ownerID, otp, "team", protocol.RoleEditor)
+	if status != http.StatusCreated || editorLink.Token == viewerLink.Token {
+		t.Fatalf("Expected 201 and a distinct token for the editor link, got %d %+v", status, editorLink)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("%s/api/document/%s/links?user_id=%d&otp=%s", ts.URL, docID, ownerID, otp))
+	if err != nil {
+		t.Fatalf("Failed to list share links: %v", err)
+	}
+	var list struct {
+		Links []shareLinkResponse `json:"links"`
+	}
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list.Links) != 2 || list.Links[0].Label != "reviewers" || list.Links[1].Label != "team" {
+		t.Errorf("Expected both links listed in creation order, got %+v", list.Links)
+	}
+
+	// Every token is accepted; anything else isn't
+	if status := dialStatus(t, ts, docID, "?otp=bogus", nil); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for an unknown token, got %d", status)
+	}
+
+	viewer := connectWebSocket(t, ts, docID, viewerLink.Token)
+	readServerMsg(t, viewer) // Read Identity
+	if msg := readServerMsg(t, viewer); msg.Access == nil || msg.Access.Role != protocol.RoleViewer || msg.Access.Label != "reviewers" {
+		t.Fatalf("Expected viewer Access, got %+v", msg)
+	}
+	readServerMsg(t, viewer) // Read Alice's UserInfo
+	editor := connectWebSocket(t, ts, docID, editorLink.Token)
+	readServerMsg(t, editor) // Read Identity
+	if msg := readServerMsg(t, editor); msg.Access == nil || msg.Access.Role != protocol.RoleEditor {
+		t.Fatalf("Expected editor Access, got %+v", msg)
+	}
+	readServerMsg(t, editor) // Read Alice's UserInfo
+
+	// Viewers can't edit
+	op := ot.NewOperationSeq()
+	op.Insert("x")
+	sendClientMsg(t, viewer, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 0, Operation: op}})
+	if msg := readServerMsg(t, viewer); msg.Error == nil || msg.Error.Code != protocol.ErrorCodeReadOnly {
+		t.Fatalf("Expected read_only error, got %+v", msg)
+	}
+
+	// Editors can
+	sendClientMsg(t, editor, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 0, Operation: op}})
+	if msg := readServerMsg(t, editor); msg.History == nil {
+		t.Fatalf("Expected History acknowledging the edit, got %+v", msg)
+	}
+	if msg := readServerMsg(t, viewer); msg.History == nil {
+		t.Fatalf("Expected History on the viewer, got %+v", msg)
+	}
+	readServerMsg(t, owner) // Read History
+
+	// Changing the OTP keeps links working and isn't shown to link holders
+	otp = protect()
+	op = ot.NewOperationSeq()
+	op.Retain(1)
+	op.Insert("y")
+	sendClientMsg(t, owner, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 1, Operation: op}})
+	for _, conn := range []*websocket.Conn{viewer, editor} {
+		if msg := readServerMsg(t, conn); msg.History == nil {
+			t.Fatalf("Expected History and no OTP for a link holder, got %+v", msg)
+		}
+	}
+	readServerMsg(t, owner) // Read History
+	if status := dialStatus(t, ts, docID, "?otp="+editorLink.Token, nil); status != http.StatusSwitchingProtocols {
+		t.Errorf("Expected the editor link to survive an OTP change, got %d", status)
+	}
+
+	// Revoking the viewer link disconnects only its clients
+	if status := revokeShareLink(t, ts, docID, ownerID, otp, viewerLink.Token); status != http.StatusNoContent {
+		t.Fatalf("Expected 204 revoking the viewer link, got %d", status)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for {
+		var msg protocol.ServerMsg
+		if err := wsjson.Read(ctx, viewer, &msg); err != nil {
+			if code := websocket.CloseStatus(err); code != protocol.CloseAccessRevoked {
+				t.Errorf("Expected close code %d, got %d (%v)", protocol.CloseAccessRevoked, code, err)
+			}
+			break
+		}
+	}
+	if status := revokeShareLink(t, ts, docID, ownerID, otp, viewerLink.Token); status != http.StatusNotFound {
+		t.Errorf("Expected 404 revoking the link twice, got %d", status)
+	}
+	if status := dialStatus(t, ts, docID, "?otp="+viewerLink.Token, nil); status != http.StatusUnauthorized {
+		t.Errorf("Expected the revoked link to be refused, got %d", status)
+	}
+	if status := dialStatus(t, ts, docID, "?otp="+otp, nil); status != http.StatusSwitchingProtocols {
+		t.Errorf("Expected the OTP to keep working, got %d", status)
+	}
+
+	op = ot.NewOperationSeq()
+	op.Retain(2)
+	op.Insert("z")
+	sendClientMsg(t, editor, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 2, Operation: op}})
+	for msg := readServerMsg(t, editor); msg.History == nil; msg = readServerMsg(t, editor) {
+		if msg.UserInfo == nil {
+			t.Fatalf("Expected the editor to stay connected, got %+v", msg)
+		}
+	}
+
+	// Cold path: links are checked from the database
+	cold := httptest.NewServer(NewServer(db, testConfig()))
+	defer cold.Close()
+	if status := dialStatus(t, cold, docID, "?otp="+editorLink.Token, nil); status != http.StatusSwitchingProtocols {
+		t.Errorf("Expected the editor link to connect to a cold document, got %d", status)
+	}
+	if status := dialStatus(t, cold, docID, "?otp="+viewerLink.Token, nil); status != http.StatusUnauthorized {
+		t.Errorf("Expected the revoked link to be refused on a cold document, got %d", status)
+	}
+}
+
+// TestNamespacedDocumentIDs tests that document IDs are checked against the
+// length limit and namespace rules on both the socket and document routes.
+func TestNamespacedDocumentIDs(t *testing.T) {
+	config := testConfig()
+	config.MaxDocumentIDLength = 24
+	config.DocumentNamespaces = true
+	ts := httptest.NewServer(NewServer(newMemStore(), config))
+	defer ts.Close()
+
+	plainConfig := testConfig()
+	plainConfig.MaxDocumentIDLength = 24
+	plain := httptest.NewServer(NewServer(newMemStore(), plainConfig))
+	defer plain.Close()
+
+	tests := []struct {
+		name   string
+		ts     *httptest.Server
+		id     string
+		socket int // Expected socket handshake status
+		raw    int // Expected /raw status
+	}{
+		// Valid IDs pass validation; /raw runs first, before the document exists
+		{"plain", ts, "doc1", http.StatusSwitchingProtocols, http.StatusNotFound},
+		{"namespaced", ts, "teamA/doc1", http.StatusSwitchingProtocols, http.StatusNotFound},
+		// The mux cleans "teamA//raw" to "teamA/raw", a missing document
+		{"empty name", ts, "teamA/", http.StatusBadRequest, http.StatusNotFound},
+		{"nested namespace", ts, "teamA/sub/doc1", http.StatusBadRequest, http.StatusBadRequest},
+		{"too long", ts, "teamA/" + strings.Repeat("x", 19), http.StatusBadRequest, http.StatusBadRequest},
+		{"namespaces disabled", plain, "teamA/doc1", http.StatusBadRequest, http.StatusBadRequest},
+		{"plain without namespaces", plain, "doc1", http.StatusSwitchingProtocols, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Get(tt.ts.URL + "/api/document/" + tt.id + "/raw")
+			if err != nil {
+				t.Fatalf("Failed to read raw document: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.raw {
+				t.Errorf("Raw: expected %d for %q, got %d", tt.raw, tt.id, resp.StatusCode)
+			}
+
+			if status := dialStatus(t, tt.ts, tt.id, "", nil); status != tt.socket {
+				t.Errorf("Socket: expected %d for %q, got %d", tt.socket, tt.id, status)
+			}
+		})
+	}
+
+	// Protecting a namespaced document routes to the full ID
+	docID := "teamA/notes"
+	conn := connectWebSocket(t, ts, docID, "")
+	userID := *readServerMsg(t, conn).Identity
+	sendClientMsg(t, conn, &protocol.ClientMsg{ClientInfo: &protocol.UserInfo{Name: "Alice", Hue: 0}})
+	readServerMsg(t, conn) // Read UserInfo broadcast
+
+	body := fmt.Sprintf(`{"user_id": %d, "user_name": "Alice"}`, userID)
+	resp, err := http.Post(ts.URL+"/api/document/"+docID+"/protect", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to protect document: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 protecting a namespaced document, got %d", resp.StatusCode)
+	}
+	if msg := readServerMsg(t, conn); msg.OTP == nil {
+		t.Fatalf("Expected OTP broadcast, got %+v", msg)
+	}
+	if status := dialStatus(t, ts, docID, "", nil); status != http.StatusUnauthorized {
+		t.Errorf("Expected the namespaced document to require the OTP, got %d", status)
+	}
+	if status := dialStatus(t, ts, "notes", "", nil); status != http.StatusSwitchingProtocols {
+		t.Errorf("Expected a same-named document outside the namespace to be separate, got %d", status)
+	}
+}
+
+// recordingObserver records EventObserver callbacks as strings.
+type recordingObserver struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (o *recordingObserver) record(format string, args ...any) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, fmt.Sprintf(format, args...))
+}
+
+func (o *recordingObserver) snapshot() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return slices.Clone(o.events)
+}
+
+func (o *recordingObserver) OnConnect(docID string, userID uint64) {
+	o.record("connect %s %d", docID, userID)
+}
+
+func (o *recordingObserver) OnDisconnect(docID string, userID uint64, err error) {
+	o.record("disconnect %s %d", docID, userID)
+}
+
+func (o *recordingObserver) OnEdit(docID string, userID uint64) {
+	o.record("edit %s %d", docID, userID)
+}
+
+func (o *recordingObserver) OnProtect(docID string, userID uint64, protected bool) {
+	o.record("protect %s %d %v", docID, userID, protected)
+}
+
+func (o *recordingObserver) OnPersist(docID string, elapsed time.Duration, err error) {
+	o.record("persist %s failed=%v", docID, err != nil)
+}
+
+func (o *recordingObserver) OnError(docID string, err error) {
+	o.record("error %s", docID)
+}
+
+// TestEventObserver tests that the configured observer sees connections,
+// edits, protection changes and saves, including failed ones.
+func TestEventObserver(t *testing.T) {
+	obs := &recordingObserver{}
+	config := testConfig()
+	config.Observer = obs
+	db := newMemStore()
+	server := NewServer(db, config)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	docID := "observed"
+	conn := connectWebSocket(t, ts, docID, "")
+	userID := *readServerMsg(t, conn).Identity
+	sendClientMsg(t, conn, &protocol.ClientMsg{ClientInfo: &protocol.UserInfo{Name: "Alice", Hue: 0}})
+	readServerMsg(t, conn) // Read UserInfo broadcast
+
+	op := ot.NewOperationSeq()
+	op.Insert("hi")
+	sendClientMsg(t, conn, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 0, Operation: op}})
+	readServerMsg(t, conn) // Read History
+
+	body := fmt.Sprintf(`{"user_id": %d, "user_name": "Alice"}`, userID)
+	resp, err := http.Post(ts.URL+"/api/document/"+docID+"/protect", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to protect document: %v", err)
+	}
+	resp.Body.Close()
+	otp := readServerMsg(t, conn).OTP.OTP
+
+	body = fmt.Sprintf(`{"user_id": %d, "user_name": "Alice", "otp": %q}`, userID, *otp)
+	req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/api/document/"+docID+"/protect", strings.NewReader(body))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to unprotect document: %v", err)
+	}
+	resp.Body.Close()
+	readServerMsg(t, conn) // Read OTP broadcast
+
+	flushDocument(t, server, docID)
+
+	// The flush on last disconnect fails
+	db.fail(errors.New("disk full"))
+	conn.Close(websocket.StatusNormalClosure, "")
+
+	want := []string{
+		fmt.Sprintf("connect %s %d", docID, userID),
+		fmt.Sprintf("edit %s %d", docID, userID),
+		fmt.Sprintf("protect %s %d true", docID, userID),
+		fmt.Sprintf("protect %s %d false", docID, userID),
+		fmt.Sprintf("persist %s failed=false", docID),
+		fmt.Sprintf("disconnect %s %d", docID, userID),
+		fmt.Sprintf("persist %s failed=true", docID),
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(obs.snapshot()) < len(want) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := obs.snapshot(); !slices.Equal(got, want) {
+		t.Errorf("Unexpected events:\ngot:  %q\nwant: %q", got, want)
+	}
+}
+
+// pinnedBufferListener sets the send buffer of accepted connections, which
+// also turns off its autotuning, so a peer that stops reading blocks writes
+// after a known number of bytes.
+type pinnedBufferListener struct {
+	net.Listener
+	size int
+}
+
+func (l pinnedBufferListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetWriteBuffer(l.size)
+	}
+	return conn, err
+}
+
+// TestInitialStateDelivery tests that an initial state larger than the
+// outbound queue is still delivered, and that a client which connects but
+// never reads is dropped and removed from the session within the write
+// timeout.
+func TestInitialStateDelivery(t *testing.T) {
+	// Socket buffer size pinned on both ends of the stuck client's connection
+	const socketBuffer = 64 * 1024
+
+	config := testConfig()
+	config.MaxDocumentSize = 1024 * 1024
+	config.WSWriteTimeout = 200 * time.Millisecond
+	server := NewServer(nil, config)
+	ts := httptest.NewUnstartedServer(server)
+	ts.Listener = pinnedBufferListener{ts.Listener, socketBuffer}
+	ts.Start()
+	defer ts.Close()
+
+	t.Run("larger than queue", func(t *testing.T) {
+		doc := server.getOrCreateDocument("crowded")
+		for id := uint64(1000); id < 1000+writeQueueSize; id++ {
+			doc.Kolabpad.SetUserInfo(id, protocol.UserInfo{Name: "Ghost", Hue: 0})
+			doc.Kolabpad.SetCursorData(id, protocol.CursorData{Cursors: []uint32{0}})
+		}
+
+		conn := connectWebSocket(t, ts, "crowded", "")
+		if msg := readServerMsg(t, conn); msg.Identity == nil {
+			t.Fatalf("Expected Identity, got %+v", msg)
+		}
+		for range 2 * writeQueueSize {
+			if msg := readServerMsg(t, conn); msg.UserInfo == nil && msg.UserCursor == nil {
+				t.Fatalf("Expected UserInfo and UserCursor messages, got %+v", msg)
+			}
+		}
+	})
+
+	t.Run("never reads", func(t *testing.T) {
+		// More than both socket buffers hold (the kernel doubles the pinned
+		// sizes), so the write blocks
+		size := config.MaxDocumentSize
+		doc := server.getOrCreateDocument("huge")
+		if err := doc.Kolabpad.ReplaceAll(strings.Repeat("x", size), 0); err != nil {
+			t.Fatalf("Failed to fill document: %v", err)
+		}
+
+		dialer := &net.Dialer{}
+		client := &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := dialer.DialContext(ctx, network, addr)
+				if tcp, ok := conn.(*net.TCPConn); ok {
+					tcp.SetReadBuffer(socketBuffer)
+				}
+				return conn, err
+			},
+		}}
+		url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/socket/huge"
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		stuck, _, err := websocket.Dial(ctx, url, &websocket.DialOptions{HTTPClient: client})
+		if err != nil {
+			t.Fatalf("Failed to connect WebSocket: %v", err)
+		}
+		defer stuck.CloseNow()
+
+		// The initial state's write timeout, plus a margin for encoding it
+		// and cleaning up, which the race detector slows down
+		timeout := (&Connection{writeTimeout: config.WSWriteTimeout, writeThroughput: config.WSWriteThroughput}).writeTimeoutFor(size)
+		deadline := time.Now().Add(timeout + 2*time.Second)
+		for doc.Kolabpad.ConnectionCount() != 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if n := doc.Kolabpad.ConnectionCount(); n != 0 {
+			t.Fatalf("Expected the stuck client to be removed, %d connection(s) left", n)
+		}
+		if doc.Kolabpad.HasUser(0) {
+			t.Error("Expected the stuck client not to be a user")
+		}
+	})
+}
+
+// TestChunkedHistory tests that a long history reaches a new client as
+// several History messages that reassemble into the document, and that
+// catch-up after connecting is chunked the same way.
+func TestChunkedHistory(t *testing.T) {
+	config := testConfig()
+	config.MaxHistoryFrameSize = 1024
+	server := NewServer(nil, config)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	doc := server.getOrCreateDocument("long-history")
+	text := ""
+	for i := range 200 {
+		text += fmt.Sprintf("line %d\n", i)
+		if err := doc.Kolabpad.ReplaceAll(text, 0); err != nil {
+			t.Fatalf("Edit %d failed: %v", i, err)
+		}
+	}
+
+	conn := connectWebSocket(t, ts, "long-history", "")
+	readServerMsg(t, conn) // Read Identity
+
+	// receive applies History messages until the client reaches revision
+	// target, returning how many messages it took
+	got, revision := "", 0
+	receive := func(target int) int {
+		t.Helper()
+		frames := 0
+		for revision < target {
+			msg := readServerMsg(t, conn)
+			if msg.History == nil {
+				continue
+			}
+			frames++
+			if msg.History.Start != revision {
+				t.Fatalf("Expected History from revision %d, got %d", revision, msg.History.Start)
+			}
+			for _, entry := range msg.History.Operations {
+				var err error
+				if got, err = entry.Operation.Apply(got); err != nil {
+					t.Fatalf("Failed to apply revision %d: %v", revision, err)
+				}
+				revision++
+			}
+		}
+		return frames
+	}
+
+	if frames := receive(200); frames < 2 {
+		t.Errorf("Expected the initial history in several messages, got %d", frames)
+	}
+	if got != text {
+		t.Fatalf("Reassembled history doesn't match the document:\ngot:  %q\nwant: %q", got, text)
+	}
+
+	// Edits made while the client is connected are chunked too once they pile up
+	for i := range 100 {
+		text += strings.Repeat("y", 20) + fmt.Sprint(i) + "\n"
+		if err := doc.Kolabpad.ReplaceAll(text, 0); err != nil {
+			t.Fatalf("Edit %d failed: %v", i, err)
+		}
+	}
+	receive(300)
+	if got != text {
+		t.Errorf("Reassembled catch-up doesn't match the document:\ngot:  %q\nwant: %q", got, text)
+	}
+}
+
+// sendRequest sends a Request and reads until its Response, returning the
+// Response and the messages that arrived before it.
+func sendRequest(t *testing.T, conn *websocket.Conn, id uint64, method string) (*protocol.ResponseMsg, []*protocol.ServerMsg) {
+	t.Helper()
+
+	sendClientMsg(t, conn, &protocol.ClientMsg{Request: &protocol.RequestMsg{ID: id, Method: method}})
+	var before []*protocol.ServerMsg
+	for {
+		msg := readServerMsg(t, conn)
+		if msg.Response != nil {
+			if msg.Response.ID != id {
+				t.Fatalf("Expected Response %d, got %+v", id, msg.Response)
+			}
+			return msg.Response, before
+		}
+		before = append(before, msg)
+	}
+}
+
+// TestWebSocketRequests tests that clients can protect the document and
+// fetch stats over their connection, and that failed requests are answered
+// with an error without closing it.
+func TestWebSocketRequests(t *testing.T) {
+	server := testServer(t)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	docID := "requests"
+	conn := connectWebSocket(t, ts, docID, "")
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	userID := *readServerMsg(t, conn).Identity
+	sendClientMsg(t, conn, &protocol.ClientMsg{ClientInfo: &protocol.UserInfo{Name: "Alice", Hue: 10}})
+	readServerMsg(t, conn) // Read own UserInfo
+
+	resp, _ := sendRequest(t, conn, 1, protocol.MethodStats)
+	var stats Stats
+	if resp.Error != nil || json.Unmarshal(resp.Result, &stats) != nil {
+		t.Fatalf("Expected stats result, got %+v", resp)
+	}
+	if stats.NumDocuments != 1 || stats.NumConnections != 1 {
+		t.Errorf("Expected 1 document with 1 connection, got %+v", stats)
+	}
+
+	// Protecting answers with the OTP, which is broadcast as usual. The
+	// broadcast races the Response, so it may come first.
+	resp, before := sendRequest(t, conn, 2, protocol.MethodProtect)
+	var result struct {
+		OTP string `json:"otp"`
+	}
+	if resp.Error != nil || json.Unmarshal(resp.Result, &result) != nil || result.OTP == "" {
+		t.Fatalf("Expected OTP result, got %+v", resp)
+	}
+	var msg *protocol.ServerMsg
+	if len(before) > 0 {
+		msg = before[0]
+	} else {
+		msg = readServerMsg(t, conn)
+	}
+	if msg.OTP == nil || msg.OTP.OTP == nil || *msg.OTP.OTP != result.OTP || msg.OTP.UserName != "Alice" {
+		t.Fatalf("Expected OTP broadcast from Alice, got %+v", msg)
+	}
+	if otp, _, _ := server.state.db.GetOTP(docID); otp == nil || *otp != result.OTP {
+		t.Errorf("Expected OTP %q in the database, got %v", result.OTP, otp)
+	}
+
+	resp, _ = sendRequest(t, conn, 3, "fork")
+	if resp.Error == nil || resp.Error.Code != protocol.ErrorCodeUnknownMethod || resp.Result != nil {
+		t.Fatalf("Expected unknown_method error, got %+v", resp)
+	}
+
+	// Share link holders can't learn the OTP by regenerating it
+	status, link := createShareLink(t, ts, docID, userID, result.OTP, "team", protocol.RoleEditor)
+	if status != http.StatusCreated {
+		t.Fatalf("Expected 201 creating share link, got %d", status)
+	}
+	linked := connectWebSocket(t, ts, docID, link.Token)
+	defer linked.Close(websocket.StatusNormalClosure, "")
+	resp, _ = sendRequest(t, linked, 4, protocol.MethodProtect)
+	if resp.Error == nil || resp.Error.Code != protocol.ErrorCodeForbidden {
+		t.Fatalf("Expected forbidden error, got %+v", resp)
+	}
+
+	// The connection is still usable after failed requests
+	if resp, _ := sendRequest(t, conn, 5, protocol.MethodStats); resp.Error != nil {
+		t.Errorf("Expected stats after failed requests, got %+v", resp)
+	}
+
+	// Without a database there's nowhere to keep the OTP
+	noDB := httptest.NewServer(testServerNoDb(t))
+	defer noDB.Close()
+	conn = connectWebSocket(t, noDB, docID, "")
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	if resp, _ := sendRequest(t, conn, 6, protocol.MethodProtect); resp.Error == nil || resp.Error.Code != protocol.ErrorCodeUnavailable {
+		t.Errorf("Expected unavailable error, got %+v", resp)
+	}
+}
+
+// TestDocumentSnapshots tests that snapshots are taken on their interval only
+// when the document changed, pruned to the retention limit, listed newest
+// first and restorable.
+func TestDocumentSnapshots(t *testing.T) {
+	config := testConfig()
+	config.SnapshotInterval = time.Hour
+	config.SnapshotRetention = 3
+	server := NewServer(newMemStore(), config)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	docID := "snapshot-doc"
+	conn := connectWebSocket(t, ts, docID, "")
+	userID := *readServerMsg(t, conn).Identity
+	sendClientMsg(t, conn, &protocol.ClientMsg{ClientInfo: &protocol.UserInfo{Name: "Alice", Hue: 0}})
+	readServerMsg(t, conn) // Read UserInfo broadcast
+
+	val, _ := server.state.documents.Load(docID)
+	kolabpad := val.(*Document).Kolabpad
+	start := time.Unix(1_700_000_000, 0)
+	mark := snapshotMark{at: start, revision: kolabpad.Revision()}
+	take := func(hours float64) bool {
+		t.Helper()
+		taken, err := server.takeSnapshot(docID, kolabpad, &mark, start.Add(time.Duration(hours*float64(time.Hour))))
+		if err != nil {
+			t.Fatalf("Failed to take snapshot: %v", err)
+		}
+		return taken
+	}
+
+	if take(1) {
+		t.Error("Expected no snapshot of an unchanged document")
+	}
+	kolabpad.ReplaceAll("v1", protocol.SystemUserID)
+	if !take(1) {
+		t.Fatal("Expected a snapshot once the interval passed")
+	}
+	if take(3) {
+		t.Error("Expected no snapshot when nothing changed since the last one")
+	}
+	kolabpad.ReplaceAll("v2", protocol.SystemUserID)
+	if take(1.5) {
+		t.Error("Expected no snapshot before the interval passed")
+	}
+	for i := 2; i <= 5; i++ {
+		kolabpad.ReplaceAll(fmt.Sprintf("v%d", i), protocol.SystemUserID)
+		if !take(float64(2 + i)) {
+			t.Fatalf("Expected snapshot of v%d", i)
+		}
+	}
+
+	list := func(userID uint64) (int, []snapshotResponse) {
+		t.Helper()
+		resp, err := http.Get(fmt.Sprintf("%s/api/document/%s/snapshots?user_id=%d", ts.URL, docID, userID))
+		if err != nil {
+			t.Fatalf("Failed to list snapshots: %v", err)
+		}
+		defer resp.Body.Close()
+		var body struct {
+			Snapshots []snapshotResponse `json:"snapshots"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body.Snapshots
+	}
+
+	if status, _ := list(userID + 1); status != http.StatusForbidden {
+		t.Errorf("Expected 403 listing snapshots without being connected, got %d", status)
+	}
+	status, snaps := list(userID)
+	if status != http.StatusOK || len(snaps) != 3 {
+		t.Fatalf("Expected 3 snapshots after pruning, got %d %+v", status, snaps)
+	}
+	for i, snap := range snaps {
+		if want := start.Add(time.Duration(7-i) * time.Hour).Unix(); snap.CreatedAt != want || snap.Size != 2 {
+			t.Errorf("Snapshot %d: expected 2 bytes at %d, got %+v", i, want, snap)
+		}
+	}
+
+	restore := func(createdAt int64) int {
+		t.Helper()
+		body := fmt.Sprintf(`{"user_id": %d, "user_name": "Alice", "created_at": %d}`, userID, createdAt)
+		resp, err := http.Post(ts.URL+"/api/document/"+docID+"/snapshots", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to restore snapshot: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := restore(start.Add(time.Hour).Unix()); status != http.StatusNotFound {
+		t.Errorf("Expected 404 restoring a pruned snapshot, got %d", status)
+	}
+	if status := restore(snaps[2].CreatedAt); status != http.StatusNoContent {
+		t.Fatalf("Expected 204 restoring the oldest snapshot, got %d", status)
+	}
+	if text := kolabpad.Text(); text != "v3" {
+		t.Errorf("Expected text v3 after restore, got %q", text)
+	}
+}
+
+// TestHTTPServerTimeouts tests that a client trickling its request headers is
+// disconnected after ReadHeaderTimeout, while an upgraded WebSocket outlives
+// both it and IdleTimeout.
+func TestHTTPServerTimeouts(t *testing.T) {
+	config := testConfig()
+	config.ReadHeaderTimeout = 200 * time.Millisecond
+	config.IdleTimeout = 200 * time.Millisecond
+	server := NewServer(nil, config)
+	ts := httptest.NewUnstartedServer(server)
+	ts.Config = server.HTTPServer("")
+	ts.Start()
+	defer ts.Close()
+
+	ws := connectWebSocket(t, ts, "timeouts", "")
+	readServerMsg(t, ws) // Read Identity
+
+	// Send part of the headers and never finish them
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "GET /api/stats HTTP/1.1\r\nHost: example.com\r\n"); err != nil {
+		t.Fatalf("Failed to write headers: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("Expected the server to close the slow connection, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the slow connection closed after about 200ms, took %v", elapsed)
+	}
+
+	// The WebSocket has been open past both timeouts and still works
+	sendClientMsg(t, ws, &protocol.ClientMsg{ClientInfo: &protocol.UserInfo{Name: "Alice", Hue: 0}})
+	if msg := readServerMsg(t, ws); msg.UserInfo == nil {
+		t.Fatalf("Expected UserInfo on the long-lived WebSocket, got %+v", msg)
+	}
+}
+
+// TestRecentChangesOnConnect tests that a client joining a document receives
+// the ranges of its latest edits, shifted to the current text, after History.
+func TestRecentChangesOnConnect(t *testing.T) {
+	config := testConfig()
+	config.RecentChangeOps = 2
+	server := NewServer(nil, config)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	alice := connectWebSocket(t, ts, "recent", "")
+	aliceID := *readServerMsg(t, alice).Identity
+	for rev, op := range []*ot.OperationSeq{insertAt(0, 0, "hello"), insertAt(5, 5, " world"), insertAt(11, 0, ">> ")} {
+		sendClientMsg(t, alice, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: rev, Operation: op}})
+		readServerMsg(t, alice) // Read History broadcast of the edit
+	}
+
+	bob := connectWebSocket(t, ts, "recent", "")
+	readServerMsg(t, bob) // Read Identity
+	if msg := readServerMsg(t, bob); msg.History == nil {
+		t.Fatalf("Expected History, got %+v", msg)
+	}
+	msg := readServerMsg(t, bob)
+	if msg.RecentChanges == nil {
+		t.Fatalf("Expected RecentChanges after History, got %+v", msg)
+	}
+	// " world" was inserted at 5, then pushed along by ">> "
+	want := []protocol.ChangeRange{{ID: aliceID, Start: 8, End: 14}, {ID: aliceID, Start: 0, End: 3}}
+	if !slices.Equal(msg.RecentChanges.Ranges, want) {
+		t.Errorf("Expected ranges %+v, got %+v", want, msg.RecentChanges.Ranges)
+	}
+}
+
+// TestDocumentOwners tests that with DocumentOwners only the first user to
+// protect a document, or whoever they transfer ownership to, may change its
+// protection.
+func TestDocumentOwners(t *testing.T) {
+	config := testConfig()
+	config.DocumentOwners = true
+	server := NewServer(newMemStore(), config)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	docID := "owned-doc"
+	join := func(name string) (*websocket.Conn, uint64) {
+		conn := connectWebSocket(t, ts, docID, "")
+		userID := *readServerMsg(t, conn).Identity
+		sendClientMsg(t, conn, &protocol.ClientMsg{ClientInfo: &protocol.UserInfo{Name: name, Hue: 0}})
+		return conn, userID
+	}
+	alice, aliceID := join("Alice")
+	bob, bobID := join("Bob")
+	val, _ := server.state.documents.Load(docID)
+	kolabpad := val.(*Document).Kolabpad
+	for !kolabpad.HasUser(aliceID) || !kolabpad.HasUser(bobID) {
+		time.Sleep(time.Millisecond)
+	}
+
+	call := func(method, action string, body any) (int, map[string]string) {
+		t.Helper()
+		data, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, ts.URL+"/api/document/"+docID+"/"+action, bytes.NewReader(data))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to %s %s: %v", method, action, err)
+		}
+		defer resp.Body.Close()
+		var result map[string]string
+		json.NewDecoder(resp.Body).Decode(&result)
+		return resp.StatusCode, result
+	}
+	protect := func(userID uint64, ownerKey string) (int, map[string]string) {
+		return call(http.MethodPost, "protect", map[string]any{"user_id": userID, "user_name": "x", "owner_key": ownerKey})
+	}
+
+	// The first protector becomes the owner
+	status, result := protect(aliceID, "")
+	aliceKey := result["owner_key"]
+	if status != http.StatusOK || aliceKey == "" {
+		t.Fatalf("Expected the first protector to get an owner key, got %d %v", status, result)
+	}
+	otp := result["otp"]
+
+	// Nobody else may rotate or remove the OTP, even knowing it
+	if status, _ := protect(bobID, ""); status != http.StatusForbidden {
+		t.Errorf("Expected 403 rotating without the owner key, got %d", status)
+	}
+	if status, _ := protect(bobID, "wrong"); status != http.StatusForbidden {
+		t.Errorf("Expected 403 rotating with the wrong owner key, got %d", status)
+	}
+	unprotect := func(userID uint64, ownerKey string) int {
+		status, _ := call(http.MethodDelete, "protect", map[string]any{"user_id": userID, "user_name": "x", "otp": otp, "owner_key": ownerKey})
+		return status
+	}
+	if status := unprotect(bobID, ""); status != http.StatusForbidden {
+		t.Errorf("Expected 403 unprotecting without the owner key, got %d", status)
+	}
+	resp, _ := sendRequest(t, bob, 1, protocol.MethodProtect)
+	if resp.Error == nil || resp.Error.Code != protocol.ErrorCodeForbidden {
+		t.Errorf("Expected a forbidden protect request, got %+v", resp)
+	}
+
+	// The owner may rotate, without being handed a new key
+	status, result = protect(aliceID, aliceKey)
+	if status != http.StatusOK || result["owner_key"] != "" {
+		t.Fatalf("Expected the owner to rotate the OTP, got %d %v", status, result)
+	}
+	otp = result["otp"]
+
+	// Transferring needs the key, and sends a new one to the new owner only
+	transfer := func(userID uint64, ownerKey string, to uint64) int {
+		status, _ := call(http.MethodPost, "owner", map[string]any{"user_id": userID, "user_name": "x", "otp": otp, "owner_key": ownerKey, "new_owner_id": to})
+		return status
+	}
+	if status := transfer(bobID, "", bobID); status != http.StatusForbidden {
+		t.Errorf("Expected 403 taking ownership without the owner key, got %d", status)
+	}
+	if status := transfer(aliceID, aliceKey, bobID+100); status != http.StatusConflict {
+		t.Errorf("Expected 409 transferring to a user who isn't connected, got %d", status)
+	}
+	if status := transfer(aliceID, aliceKey, bobID); status != http.StatusNoContent {
+		t.Fatalf("Expected 204 transferring ownership, got %d", status)
+	}
+	var bobKey string
+	for bobKey == "" {
+		if msg := readServerMsg(t, bob); msg.Ownership != nil {
+			bobKey = msg.Ownership.OwnerKey
+		}
+	}
+	if bobKey == aliceKey {
+		t.Error("Expected a new owner key on transfer")
+	}
+
+	if status, _ := protect(aliceID, aliceKey); status != http.StatusForbidden {
+		t.Errorf("Expected 403 for the previous owner's key, got %d", status)
+	}
+	if status := unprotect(bobID, bobKey); status != http.StatusNoContent {
+		t.Fatalf("Expected the new owner to unprotect, got %d", status)
+	}
+	otp = ""
+
+	// Once released, the next protector becomes the owner
+	release := map[string]any{"user_id": bobID, "user_name": "Bob", "owner_key": bobKey}
+	if status, _ := call(http.MethodDelete, "owner", release); status != http.StatusNoContent {
+		t.Fatalf("Expected 204 releasing ownership, got %d", status)
+	}
+	if status, result := protect(aliceID, ""); status != http.StatusOK || result["owner_key"] == "" {
+		t.Errorf("Expected Alice to own the released document, got %d %v", status, result)
+	}
+	alice.Close(websocket.StatusNormalClosure, "")
+}
+
+// TestDocumentOwnersDisabled tests that without DocumentOwners anyone
+// connected may change protection and the ownership endpoints are absent.
+func TestDocumentOwnersDisabled(t *testing.T) {
+	server := testServer(t)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	docID := "shared-doc"
+	conn := connectWebSocket(t, ts, docID, "")
+	userID := *readServerMsg(t, conn).Identity
+	sendClientMsg(t, conn, &protocol.ClientMsg{ClientInfo: &protocol.UserInfo{Name: "Alice", Hue: 0}})
+	readServerMsg(t, conn) // Read UserInfo broadcast
+
+	for range 2 {
+		body := fmt.Sprintf(`{"user_id": %d, "user_name": "Alice"}`, userID)
+		resp, err := http.Post(ts.URL+"/api/document/"+docID+"/protect", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to protect document: %v", err)
+		}
+		var result map[string]string
+		json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || result["owner_key"] != "" {
+			t.Fatalf("Expected protection without an owner, got %d %v", resp.StatusCode, result)
+		}
+	}
+
+	body := fmt.Sprintf(`{"user_id": %d, "user_name": "Alice", "new_owner_id": %d}`, userID, userID)
+	resp, err := http.Post(ts.URL+"/api/document/"+docID+"/owner", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to transfer ownership: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for the owner endpoint, got %d", resp.StatusCode)
+	}
+}
+
+// TestCursorThrottle tests that a client flooding cursor updates is
+// broadcast at most once per CursorInterval, ending on its latest position.
+func TestCursorThrottle(t *testing.T) {
+	config := testConfig()
+	config.CursorInterval = 100 * time.Millisecond
+	server := NewServer(nil, config)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	alice := connectWebSocket(t, ts, "cursor-flood", "")
+	aliceID := *readServerMsg(t, alice).Identity
+	sendClientMsg(t, alice, &protocol.ClientMsg{ClientInfo: &protocol.UserInfo{Name: "Alice", Hue: 0}})
+	readServerMsg(t, alice) // Read UserInfo broadcast
+
+	bob := connectWebSocket(t, ts, "cursor-flood", "")
+	readServerMsg(t, bob) // Read Identity
+
+	const updates = 200
+	start := time.Now()
+	for i := 1; i <= updates; i++ {
+		sendClientMsg(t, alice, &protocol.ClientMsg{CursorData: &protocol.CursorData{Cursors: []uint32{uint32(i)}}})
+	}
+
+	broadcasts := 0
+	for {
+		msg := readServerMsg(t, bob)
+		if msg.UserCursor == nil || msg.UserCursor.ID != aliceID {
+			continue
+		}
+		broadcasts++
+		if msg.UserCursor.Data.Cursors[0] == updates {
+			break
+		}
+	}
+	elapsed := time.Since(start)
+	if limit := int(elapsed/config.CursorInterval) + 1; broadcasts > limit {
+		t.Errorf("Expected at most %d cursor broadcasts in %v, got %d", limit, elapsed, broadcasts)
+	}
+	t.Logf("%d updates became %d broadcasts in %v", updates, broadcasts, elapsed)
+}
+
+// TestLanguageRateLimit tests that language changes past LanguageRateLimit
+// are rejected without closing the connection.
+func TestLanguageRateLimit(t *testing.T) {
+	config := testConfig()
+	config.LanguageRateLimit = 2
+	server := NewServer(nil, config)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	conn := connectWebSocket(t, ts, "language-flood", "")
+	readServerMsg(t, conn) // Read Identity
+
+	for i, lang := range []string{"go", "python"} {
+		sendClientMsg(t, conn, &protocol.ClientMsg{SetLanguage: &lang})
+		if msg := readServerMsg(t, conn); msg.Language == nil || msg.Language.Language != lang {
+			t.Fatalf("Change %d: expected Language broadcast of %s, got %+v", i, lang, msg)
+		}
+	}
+
+	lang := "rust"
+	sendClientMsg(t, conn, &protocol.ClientMsg{SetLanguage: &lang})
+	msg := readServerMsg(t, conn)
+	if msg.Error == nil || msg.Error.Code != protocol.ErrorCodeRateLimited {
+		t.Fatalf("Expected rate_limited error, got %+v", msg)
+	}
+
+	// Still connected
+	sendClientMsg(t, conn, &protocol.ClientMsg{ClientInfo: &protocol.UserInfo{Name: "Alice", Hue: 0}})
+	if msg := readServerMsg(t, conn); msg.UserInfo == nil {
+		t.Fatalf("Expected UserInfo after a rate-limited change, got %+v", msg)
+	}
+}
+
+// TestIntegrityCheck tests that a healthy database passes the integrity
+// check, and that a failed check flips /api/ready only with IntegrityUnready.
+func TestIntegrityCheck(t *testing.T) {
+	db, err := database.New(filepath.Join(t.TempDir(), "kolabpad.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	if err := db.Store(&database.PersistedDocument{ID: "healthy", Text: "hello"}); err != nil {
+		t.Fatalf("Failed to store document: %v", err)
+	}
+	if err := db.IntegrityCheck(); err != nil {
+		t.Fatalf("Expected a healthy database to pass, got %v", err)
+	}
+
+	ready := func(server *Server) int {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/ready", nil))
+		return rec.Code
+	}
+
+	for _, unready := range []bool{false, true} {
+		config := testConfig()
+		config.IntegrityUnready = unready
+		store := newMemStore()
+		server := NewServer(store, config)
+
+		server.checkIntegrity()
+		if status := ready(server); status != http.StatusOK {
+			t.Errorf("unready=%v: expected 200 after a passing check, got %d", unready, status)
+		}
+
+		store.fail(fmt.Errorf("%w: page 3 is never used", database.ErrCorrupt))
+		server.checkIntegrity()
+		want := http.StatusOK
+		if unready {
+			want = http.StatusServiceUnavailable
+		}
+		if status := ready(server); status != want {
+			t.Errorf("unready=%v: expected %d after a failing check, got %d", unready, want, status)
+		}
+
+		store.fail(nil)
+		server.checkIntegrity()
+		if status := ready(server); status != http.StatusOK {
+			t.Errorf("unready=%v: expected 200 once the check passes again, got %d", unready, status)
+		}
+	}
+}
+
+// TestBroadcastSaturation tests that a document whose broadcasts keep finding
+// subscriber buffers full logs a warning and, with SaturationUnready, fails
+// /api/ready until it goes quiet.
+func TestBroadcastSaturation(t *testing.T) {
+	var buf lockedBuffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	config := testConfig()
+	config.BroadcastBufferSize = 2
+	config.SaturationWindow = 20 * time.Millisecond
+	config.SaturationUnready = true
+	server := NewServer(nil, config)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	conn := connectWebSocket(t, ts, "busy", "")
+	readServerMsg(t, conn)
+	val, ok := server.state.documents.Load("busy")
+	if !ok {
+		t.Fatal("Document not found in server state")
+	}
+	kolabpad := val.(*Document).Kolabpad
+
+	ready := func() int {
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/ready", nil))
+		return rec.Code
+	}
+	if status := ready(); status != http.StatusOK {
+		t.Fatalf("Expected 200 before any broadcasts, got %d", status)
+	}
+
+	// Subscribers that never read, overwhelmed by notices
+	for range 4 {
+		kolabpad.Subscribe(kolabpad.NextUserID())
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !kolabpad.BroadcastSaturated() {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the document's broadcast buffers to be saturated")
+		}
+		kolabpad.BroadcastAnnouncement("notice")
+		time.Sleep(time.Millisecond)
+	}
+
+	if out := buf.String(); !strings.Contains(out, "Broadcast buffers saturated") {
+		t.Errorf("Expected a saturation warning, got:\n%s", out)
+	}
+	if status := ready(); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 while saturated, got %d", status)
+	}
+
+	// A quiet document stops counting as saturated after a window
+	time.Sleep(2 * config.SaturationWindow)
+	if status := ready(); status != http.StatusOK {
+		t.Errorf("Expected 200 once the document went quiet, got %d", status)
+	}
+}
+
+// TestDocumentStream tests that /stream sends the current text, then the new
+// text after edits, and rejects unknown and unauthorized documents.
+func TestDocumentStream(t *testing.T) {
+	db := newMemStore()
+	server := NewServer(db, testConfig())
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	conn := connectWebSocket(t, ts, "stream-doc", "")
+	readServerMsg(t, conn) // Read Identity
+
+	resp, err := http.Get(ts.URL + "/api/document/stream-doc/stream")
+	if err != nil {
+		t.Fatalf("GET stream failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Expected text/event-stream, got %q", ct)
+	}
+
+	events := bufio.NewScanner(resp.Body)
+	readEvent := func() (string, streamEvent) {
+		t.Helper()
+		var name string
+		for events.Scan() {
+			line := events.Text()
+			if event, ok := strings.CutPrefix(line, "event: "); ok {
+				name = event
+			} else if data, ok := strings.CutPrefix(line, "data: "); ok {
+				var ev streamEvent
+				if err := json.Unmarshal([]byte(data), &ev); err != nil {
+					t.Fatalf("Invalid event data %q: %v", data, err)
+				}
+				return name, ev
+			}
+		}
+		t.Fatalf("Stream ended: %v", events.Err())
+		return "", streamEvent{}
+	}
+
+	if name, ev := readEvent(); name != "document" || ev.Revision != 0 || ev.Text != "" {
+		t.Errorf("Expected empty document event, got %s %+v", name, ev)
+	}
+
+	op := ot.NewOperationSeq()
+	op.Insert("hello")
+	sendClientMsg(t, conn, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 0, Operation: op}})
+	if name, ev := readEvent(); name != "document" || ev.Revision != 1 || ev.Text != "hello" {
+		t.Errorf("Expected document event after first edit, got %s %+v", name, ev)
+	}
+
+	op = ot.NewOperationSeq()
+	op.Retain(5)
+	op.Insert(" world")
+	sendClientMsg(t, conn, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 1, Operation: op}})
+	if name, ev := readEvent(); name != "document" || ev.Revision != 2 || ev.Text != "hello world" {
+		t.Errorf("Expected document event after second edit, got %s %+v", name, ev)
+	}
+
+	status := func(path string) int {
+		t.Helper()
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if got := status("/api/document/missing/stream"); got != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown document, got %d", got)
+	}
+	otp := "secret"
+	if err := db.Store(&database.PersistedDocument{ID: "stream-cold", Text: "stored", OTP: &otp}); err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+	if got := status("/api/document/stream-cold/stream"); got != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without OTP, got %d", got)
+	}
+}
+
+// renameDocument asks the server to move docID to newID on behalf of userID
+// and returns the status code.
+func renameDocument(t *testing.T, ts *httptest.Server, docID, newID string, userID uint64, otp string) int {
+	t.Helper()
+
+	body, _ := json.Marshal(map[string]any{"user_id": userID, "user_name": "Test", "otp": otp, "new_id": newID})
+	resp, err := http.Post(ts.URL+"/api/document/"+docID+"/rename", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to rename document: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// TestRenameDocument tests that a renamed document moves with its OTP in
+// memory and the database, its clients are told the new ID, and the old ID
+// no longer finds it.
+func TestRenameDocument(t *testing.T) {
+	store := newMemStore()
+	server := NewServer(store, testConfig())
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	conn := connectWebSocket(t, ts, "scratch", "")
+	userID := *readServerMsg(t, conn).Identity
+	sendClientMsg(t, conn, &protocol.ClientMsg{ClientInfo: &protocol.UserInfo{Name: "Test", Hue: 0}})
+	readServerMsg(t, conn) // Read UserInfo broadcast
+	sendClientMsg(t, conn, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 0, Operation: insertAt(0, 0, "hello")}})
+	readServerMsg(t, conn) // Read History broadcast
+
+	resp, err := http.Post(ts.URL+"/api/document/scratch/protect", "application/json",
+		strings.NewReader(fmt.Sprintf(`{"user_id": %d, "user_name": "Test"}`, userID)))
+	if err != nil {
+		t.Fatalf("Failed to protect document: %v", err)
+	}
+	var protectResp struct {
+		OTP string `json:"otp"`
+	}
+	json.NewDecoder(resp.Body).Decode(&protectResp)
+	resp.Body.Close()
+	readServerMsg(t, conn) // Read OTP broadcast
+
+	if status := renameDocument(t, ts, "scratch", "meeting-notes", userID, "wrong"); status != http.StatusForbidden {
+		t.Fatalf("Expected 403 with wrong OTP, got %d", status)
+	}
+	if status := renameDocument(t, ts, "scratch", "meeting-notes", userID, protectResp.OTP); status != http.StatusOK {
+		t.Fatalf("Expected 200 renaming, got %d", status)
+	}
+
+	if msg := readServerMsg(t, conn); msg.Renamed == nil || msg.Renamed.ID != "meeting-notes" {
+		t.Fatalf("Expected Renamed to meeting-notes, got %+v", msg)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, _, err := conn.Read(ctx); websocket.CloseStatus(err) == -1 {
+		t.Fatalf("Expected the connection to the old ID to be closed, got %v", err)
+	}
+
+	if _, ok := server.state.documents.Load("scratch"); ok {
+		t.Error("Expected old ID to be removed from memory")
+	}
+	if persisted, _ := store.Load("scratch"); persisted != nil {
+		t.Errorf("Expected old ID to be removed from the database, got %+v", persisted)
+	}
+	persisted, _ := store.Load("meeting-notes")
+	if persisted == nil || persisted.Text != "hello" || persisted.OTP == nil || *persisted.OTP != protectResp.OTP {
+		t.Fatalf("Expected renamed document in the database with its OTP, got %+v", persisted)
+	}
+
+	// The new ID needs the same OTP and serves the same text
+	if status := dialStatus(t, ts, "meeting-notes", "", nil); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without OTP at the new ID, got %d", status)
+	}
+	conn = connectWebSocket(t, ts, "meeting-notes", protectResp.OTP)
+	readServerMsg(t, conn) // Read Identity
+	msg := readServerMsg(t, conn)
+	if msg.History == nil {
+		t.Fatalf("Expected History at the new ID, got %+v", msg)
+	}
+	if got := replayHistory(t, msg.History.Operations); got != "hello" {
+		t.Errorf("Expected text %q at the new ID, got %q", "hello", got)
+	}
+}
+
+// TestRenameDocumentCollision tests that a rename onto a stored or resident
+// document is refused and leaves the document editable at its old ID.
+func TestRenameDocumentCollision(t *testing.T) {
+	store := newMemStore()
+	server := NewServer(store, testConfig())
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	if err := store.Store(&database.PersistedDocument{ID: "stored", Text: "other"}); err != nil {
+		t.Fatalf("Failed to store document: %v", err)
+	}
+	server.getOrCreateDocument("resident")
+
+	conn := connectWebSocket(t, ts, "source", "")
+	userID := *readServerMsg(t, conn).Identity
+	sendClientMsg(t, conn, &protocol.ClientMsg{ClientInfo: &protocol.UserInfo{Name: "Test", Hue: 0}})
+	readServerMsg(t, conn) // Read UserInfo broadcast
+	sendClientMsg(t, conn, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 0, Operation: insertAt(0, 0, "mine")}})
+	readServerMsg(t, conn) // Read History broadcast
+
+	for _, target := range []string{"stored", "resident"} {
+		if status := renameDocument(t, ts, "source", target, userID, ""); status != http.StatusConflict {
+			t.Errorf("Expected 409 renaming onto %s, got %d", target, status)
+		}
+	}
+	if persisted, _ := store.Load("stored"); persisted == nil || persisted.Text != "other" {
+		t.Errorf("Expected the stored document untouched, got %+v", persisted)
+	}
+
+	// Refused renames leave the document where it was, accepting edits
+	sendClientMsg(t, conn, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 1, Operation: insertAt(4, 4, "!")}})
+	if msg := readServerMsg(t, conn); msg.History == nil {
+		t.Fatalf("Expected History after a refused rename, got %+v", msg)
+	}
+	flushDocument(t, server, "source")
+	if persisted, _ := store.Load("source"); persisted == nil || persisted.Text != "mine!" {
+		t.Errorf("Expected source document stored with its edit, got %+v", persisted)
+	}
+}
+
+// replaceInDocument calls the find-and-replace endpoint on behalf of userID,
+// with a password session token (if not ""), and returns the status code and
+// reported replacement count.
+func replaceInDocument(t *testing.T, ts *httptest.Server, docID string, userID uint64, session string, rep map[string]any) (int, int) {
+	t.Helper()
+
+	rep["user_id"], rep["user_name"] = userID, "Test"
+	body, _ := json.Marshal(rep)
+	resp, err := http.Post(ts.URL+"/api/document/"+docID+"/replace?session="+session, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to replace: %v", err)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Replacements int `json:"replacements"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	return resp.StatusCode, result.Replacements
+}
+
+// TestReplaceEndpoint tests literal and regex find-and-replace over REST:
+// connected clients receive the change, and only connected users with a
+// valid pattern may replace.
+func TestReplaceEndpoint(t *testing.T) {
+	server := NewServer(nil, testConfig())
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	docID := "replace"
+	conn := connectWebSocket(t, ts, docID, "")
+	userID := *readServerMsg(t, conn).Identity
+	sendClientMsg(t, conn, &protocol.ClientMsg{ClientInfo: &protocol.UserInfo{Name: "Test", Hue: 0}})
+	readServerMsg(t, conn) // Read UserInfo broadcast
+	sendClientMsg(t, conn, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 0, Operation: insertAt(0, 0, "foo bar foo v1.2")}})
+	readServerMsg(t, conn) // Read History broadcast
+	doc, _ := server.state.documents.Load(docID)
+	kolabpad := doc.(*Document).Kolabpad
+
+	status, count := replaceInDocument(t, ts, docID, userID, "", map[string]any{"find": "foo", "replace": "baz"})
+	if status != http.StatusOK || count != 1 || kolabpad.Text() != "baz bar foo v1.2" {
+		t.Fatalf("Expected the first foo replaced, got %d, %d replacements, %q", status, count, kolabpad.Text())
+	}
+	if msg := readServerMsg(t, conn); msg.History == nil || msg.History.Operations[0].ID != protocol.SystemUserID {
+		t.Fatalf("Expected the replacement as a System edit, got %+v", msg)
+	}
+
+	status, count = replaceInDocument(t, ts, docID, userID, "", map[string]any{"find": `(\w+) (\w+)`, "replace": "$2 $1", "all": true, "regex": true})
+	if status != http.StatusOK || count != 2 || kolabpad.Text() != "bar baz v1 foo.2" {
+		t.Fatalf("Expected both word pairs swapped, got %d, %d replacements, %q", status, count, kolabpad.Text())
+	}
+	readServerMsg(t, conn) // Read History broadcast
+
+	// A literal find is not a pattern
+	if status, count := replaceInDocument(t, ts, docID, userID, "", map[string]any{"find": ".", "replace": "!", "all": true}); status != http.StatusOK || count != 1 || kolabpad.Text() != "bar baz v1 foo!2" {
+		t.Errorf("Expected one literal dot replaced, got %d, %d replacements, %q", status, count, kolabpad.Text())
+	}
+	if status, count := replaceInDocument(t, ts, docID, userID, "", map[string]any{"find": "missing", "replace": "x"}); status != http.StatusOK || count != 0 {
+		t.Errorf("Expected no replacements, got %d, %d", status, count)
+	}
+
+	for _, rep := range []map[string]any{
+		{"find": ""},
+		{"find": "(unclosed", "regex": true},
+		{"find": strings.Repeat("a", maxReplacePatternLength+1)},
+	} {
+		if status, _ := replaceInDocument(t, ts, docID, userID, "", rep); status != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %q, got %d", rep["find"], status)
+		}
+	}
+	if status, _ := replaceInDocument(t, ts, docID, userID+1, "", map[string]any{"find": "bar", "replace": "x"}); status != http.StatusForbidden {
+		t.Errorf("Expected 403 for a user not connected, got %d", status)
+	}
+
+	// System edits have no connection to hold history back for
+	kolabpad.mu.RLock()
+	_, pinned := kolabpad.watermarks[protocol.SystemUserID]
+	kolabpad.mu.RUnlock()
+	if pinned {
+		t.Error("Expected replacements not to leave a System watermark")
+	}
+}
+
+// TestReplacePasswordProtected tests that replacing in a password-protected
+// document takes a session or the password, even for a connected user.
+func TestReplacePasswordProtected(t *testing.T) {
+	server := NewServer(newMemStore(), testConfig())
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	docID := "replace-password"
+	conn := connectWebSocket(t, ts, docID, "")
+	userID := *readServerMsg(t, conn).Identity
+	sendClientMsg(t, conn, &protocol.ClientMsg{ClientInfo: &protocol.UserInfo{Name: "Test", Hue: 0}})
+	readServerMsg(t, conn) // Read UserInfo broadcast
+	sendClientMsg(t, conn, &protocol.ClientMsg{Edit: &protocol.EditMsg{Revision: 0, Operation: insertAt(0, 0, "secret")}})
+	readServerMsg(t, conn) // Read History broadcast
+	if status := setPassword(t, ts, docID, userID, "correct horse", ""); status != http.StatusNoContent {
+		t.Fatalf("Expected 204 setting the password, got %d", status)
+	}
+	doc, _ := server.state.documents.Load(docID)
+	kolabpad := doc.(*Document).Kolabpad
+
+	rep := map[string]any{"find": "secret", "replace": "public"}
+	if status, _ := replaceInDocument(t, ts, docID, userID, "", rep); status != http.StatusForbidden {
+		t.Errorf("Expected 403 without a session, got %d", status)
+	}
+	if status, _ := replaceInDocument(t, ts, docID, userID, "bogus", rep); status != http.StatusForbidden {
+		t.Errorf("Expected 403 with an invalid session, got %d", status)
+	}
+	if kolabpad.Text() != "secret" {
+		t.Fatalf("Expected rejected replacements to change nothing, got %q", kolabpad.Text())
+	}
+
+	_, session := passwordSessionFor(t, ts, docID, "correct horse")
+	if status, count := replaceInDocument(t, ts, docID, userID, session, rep); status != http.StatusOK || count != 1 || kolabpad.Text() != "public" {
+		t.Errorf("Expected the session to replace, got %d, %d replacements, %q", status, count, kolabpad.Text())
+	}
+}
+
+// TestReplacementSizeLimit tests that replacements growing the text past the
+// size limit are rejected, in both modes, before the result is built.
+func TestReplacementSizeLimit(t *testing.T) {
+	text := strings.Repeat("ab", 8)
+	for _, rep := range []replacement{
+		{Find: "a", Replace: "xyz", All: true},
+		{Find: "a", Replace: "$0$0$0", All: true, Regex: true},
+	} {
+		re, err := rep.compile()
+		if err != nil {
+			t.Fatalf("compile %+v failed: %v", rep, err)
+		}
+		if _, _, err := rep.apply(text, re, 20); !errors.Is(err, ErrDocumentTooLarge) {
+			t.Errorf("Expected %+v to exceed 20 bytes, got %v", rep, err)
+		}
+		if _, count, err := rep.apply(text, re, 32); err != nil || count != 8 {
+			t.Errorf("Expected %+v to fit 32 bytes with 8 replacements, got %d, %v", rep, count, err)
+		}
+	}
 }
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/shiv248/kolabpad/internal/protocol"
+	"github.com/shiv248/kolabpad/pkg/database"
+	"github.com/shiv248/kolabpad/pkg/logger"
+)
+
+const (
+	// maxShareLinks caps the share links per document.
+	maxShareLinks = 32
+
+	// maxShareLinkLabel caps share link labels, in characters.
+	maxShareLinkLabel = 64
+)
+
+// accessGrant records the share link a connection was admitted with.
+type accessGrant struct {
+	token string
+	kick  func() // Disconnects the connection
+}
+
+// GrantAccess records that userID was admitted with the share link token.
+// kick is called to disconnect it if the link is revoked. RemoveUser forgets
+// the grant.
+func (r *Kolabpad) GrantAccess(userID uint64, token string, kick func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.grants[userID] = accessGrant{token: token, kick: kick}
+}
+
+// RevokeAccess disconnects every connection admitted with the share link
+// token and returns how many there were. Connections admitted with other
+// links or the OTP are unaffected.
+func (r *Kolabpad) RevokeAccess(token string) int {
+	r.mu.Lock()
+	var kicks []func()
+	for userID, grant := range r.grants {
+		if grant.token == token {
+			kicks = append(kicks, grant.kick)
+			delete(r.grants, userID)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, kick := range kicks {
+		kick()
+	}
+	return len(kicks)
+}
+
+// authorizeOTP checks a provided ?otp= value against a document's OTP and its
+// share links. It returns the matching share link (nil for the OTP itself or
+// an unprotected document) and whether access is allowed. A share link token
+// also sets the role on unprotected documents, so a viewer link stays
+// view-only after protection is turned off.
+func (s *Server) authorizeOTP(docID, provided string, otp *string) (*database.ShareLink, bool) {
+	if otp != nil && provided == *otp {
+		return nil, true
+	}
+	if provided != "" && s.state.db != nil {
+		link, err := s.state.db.FindShareLink(docID, provided)
+		if err != nil {
+			logger.Error("Failed to look up share link for document %s: %v", docID, err)
+		} else if link != nil {
+			return link, true
+		}
+	}
+	return nil, otp == nil
+}
+
+// shareLinkResponse is the JSON form of a share link.
+type shareLinkResponse struct {
+	Token     string `json:"token"`
+	Label     string `json:"label"`
+	Role      string `json:"role"`
+	CreatedAt int64  `json:"created_at"` // Unix timestamp
+}
+
+func newShareLinkResponse(link database.ShareLink) shareLinkResponse {
+	return shareLinkResponse{Token: link.Token, Label: link.Label, Role: link.Role, CreatedAt: link.CreatedAt}
+}
+
+// handleListShareLinks returns a document's share links. Only clients holding
+// the document OTP may see them; the user ID and OTP come from the query
+// string (?user_id=&otp=).
+func (s *Server) handleListShareLinks(w http.ResponseWriter, r *http.Request, docID string) {
+	userID, err := strconv.ParseUint(r.URL.Query().Get("user_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "user_id required", http.StatusBadRequest)
+		return
+	}
+	if s.connectedDocument(w, r, docID, userID, "", r.URL.Query().Get("otp"), "list the share links of") == nil {
+		return
+	}
+
+	links, err := s.state.db.ShareLinks(docID)
+	if err != nil {
+		logger.Error("Failed to list share links: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := make([]shareLinkResponse, len(links))
+	for i, link := range links {
+		resp[i] = newShareLinkResponse(link)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]shareLinkResponse{
+		"links": resp,
+	})
+}
+
+// handleCreateShareLink creates a labeled share link for an OTP-protected
+// document. Its token works anywhere the OTP does, with the link's role.
+func (s *Server) handleCreateShareLink(w http.ResponseWriter, r *http.Request, docID string) {
+	var reqBody struct {
+		UserID   uint64 `json:"user_id"`
+		UserName string `json:"user_name"`
+		OTP      string `json:"otp"`
+		Label    string `json:"label"`
+		Role     string `json:"role"` // "editor" or "viewer"
+	}
+	if !decodeRequestBody(w, r, &reqBody) {
+		return
+	}
+	label := strings.TrimSpace(reqBody.Label)
+	if label == "" || utf8.RuneCountInString(label) > maxShareLinkLabel {
+		http.Error(w, fmt.Sprintf("label must be 1-%d characters", maxShareLinkLabel), http.StatusBadRequest)
+		return
+	}
+	if reqBody.Role != protocol.RoleEditor && reqBody.Role != protocol.RoleViewer {
+		http.Error(w, `role must be "editor" or "viewer"`, http.StatusBadRequest)
+		return
+	}
+
+	doc := s.connectedDocument(w, r, docID, reqBody.UserID, reqBody.UserName, reqBody.OTP, "create a share link for")
+	if doc == nil {
+		return
+	}
+	// Links on an unprotected document wouldn't keep anyone out
+	if doc.Kolabpad.GetOTP() == nil {
+		http.Error(w, "document is not OTP-protected", http.StatusBadRequest)
+		return
+	}
+
+	existing, err := s.state.db.ShareLinks(docID)
+	if err != nil {
+		logger.Error("Failed to list share links: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if len(existing) >= maxShareLinks {
+		http.Error(w, fmt.Sprintf("documents can have at most %d share links", maxShareLinks), http.StatusConflict)
+		return
+	}
+
+	link := database.ShareLink{
+		Token:     GenerateOTP(),
+		Label:     label,
+		Role:      reqBody.Role,
+		CreatedAt: time.Now().Unix(),
+	}
+	if err := s.state.db.CreateShareLink(docID, link); err != nil {
+		logger.Error("Failed to create share link: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	logger.Info("Share link %q (%s) created for document %s by user %d (%s)", label, link.Role, docID, reqBody.UserID, reqBody.UserName)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newShareLinkResponse(link))
+}
+
+// handleRevokeShareLink deletes a share link and disconnects the clients that
+// connected with it. Other links and the OTP keep working.
+func (s *Server) handleRevokeShareLink(w http.ResponseWriter, r *http.Request, docID string) {
+	var reqBody struct {
+		UserID   uint64 `json:"user_id"`
+		UserName string `json:"user_name"`
+		OTP      string `json:"otp"`
+		Token    string `json:"token"` // Link to revoke
+	}
+	if !decodeRequestBody(w, r, &reqBody) {
+		return
+	}
+
+	doc := s.connectedDocument(w, r, docID, reqBody.UserID, reqBody.UserName, reqBody.OTP, "revoke a share link of")
+	if doc == nil {
+		return
+	}
+
+	// CRITICAL: Delete from DB FIRST so no new connection can use the link
+	found, err := s.state.db.RevokeShareLink(docID, reqBody.Token)
+	if err != nil {
+		logger.Error("Failed to revoke share link: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "share link not found", http.StatusNotFound)
+		return
+	}
+
+	kicked := doc.Kolabpad.RevokeAccess(reqBody.Token)
+	logger.Info("Share link revoked for document %s by user %d (%s), %d connection(s) closed", docID, reqBody.UserID, reqBody.UserName, kicked)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/shiv248/kolabpad/pkg/database"
+	"github.com/shiv248/kolabpad/pkg/logger"
+)
+
+// snapshotMark records the last snapshot a persister took of its document.
+type snapshotMark struct {
+	at       time.Time
+	revision int
+}
+
+// takeSnapshot saves a copy of the document's text if Config.SnapshotInterval
+// has passed since mark and it has changed since, then prunes all but the
+// newest Config.SnapshotRetention. now is passed in so tests can simulate
+// time. Documents that couldn't be stored (see ErrStorageFull) aren't
+// snapshotted, since their snapshots would outlive them.
+func (s *Server) takeSnapshot(id string, kolabpad *Kolabpad, mark *snapshotMark, now time.Time) (bool, error) {
+	interval := s.state.config.SnapshotInterval
+	if interval <= 0 || now.Sub(mark.at) < interval {
+		return false, nil
+	}
+	revision := kolabpad.Revision()
+	if revision == mark.revision || kolabpad.StorageFull() {
+		return false, nil
+	}
+
+	text, language := kolabpad.Snapshot()
+	snap := database.Snapshot{CreatedAt: now.Unix(), Text: text, Language: language}
+	if err := s.state.db.StoreSnapshot(id, snap, max(s.state.config.SnapshotRetention, 1)); err != nil {
+		return false, err
+	}
+	*mark = snapshotMark{at: now, revision: revision}
+	return true, nil
+}
+
+// snapshotResponse is the JSON form of a snapshot, without its text.
+type snapshotResponse struct {
+	CreatedAt int64   `json:"created_at"` // Unix timestamp; identifies the snapshot
+	Size      int     `json:"size"`       // Text size in bytes
+	Language  *string `json:"language"`
+}
+
+// handleListSnapshots returns a document's snapshots, newest first. Like
+// share links, only clients connected with the document OTP may see them;
+// the user ID and OTP come from the query string (?user_id=&otp=).
+func (s *Server) handleListSnapshots(w http.ResponseWriter, r *http.Request, docID string) {
+	userID, err := strconv.ParseUint(r.URL.Query().Get("user_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "user_id required", http.StatusBadRequest)
+		return
+	}
+	if s.connectedDocument(w, r, docID, userID, "", r.URL.Query().Get("otp"), "list the snapshots of") == nil {
+		return
+	}
+
+	snaps, err := s.state.db.Snapshots(docID)
+	if err != nil {
+		logger.Error("Failed to list snapshots: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := make([]snapshotResponse, len(snaps))
+	for i, snap := range snaps {
+		resp[i] = snapshotResponse{CreatedAt: snap.CreatedAt, Size: snap.Size, Language: snap.Language}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]snapshotResponse{
+		"snapshots": resp,
+	})
+}
+
+// handleRestoreSnapshot replaces a document's text with a snapshot's. The
+// restore is an ordinary edit by the requesting user, so connected clients
+// converge on it and it can itself be undone by restoring a later snapshot.
+// The language is left as it is.
+func (s *Server) handleRestoreSnapshot(w http.ResponseWriter, r *http.Request, docID string) {
+	var reqBody struct {
+		UserID    uint64 `json:"user_id"`
+		UserName  string `json:"user_name"`
+		OTP       string `json:"otp"`        // Required if the document is protected
+		CreatedAt int64  `json:"created_at"` // Snapshot to restore
+	}
+	if !decodeRequestBody(w, r, &reqBody) {
+		return
+	}
+
+	doc := s.connectedDocument(w, r, docID, reqBody.UserID, reqBody.UserName, reqBody.OTP, "restore a snapshot of")
+	if doc == nil {
+		return
+	}
+
+	snap, err := s.state.db.LoadSnapshot(docID, reqBody.CreatedAt)
+	if err != nil {
+		logger.Error("Failed to load snapshot: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if snap == nil {
+		http.Error(w, "snapshot not found", http.StatusNotFound)
+		return
+	}
+
+	if err := doc.Kolabpad.ReplaceAll(snap.Text, reqBody.UserID); err != nil {
+		switch {
+		case errors.Is(err, ErrDraining), errors.Is(err, ErrKilled):
+			http.Error(w, "document is draining", http.StatusServiceUnavailable)
+		case errors.Is(err, ErrDocumentTooLarge), errors.Is(err, ErrLineLimit):
+			// The snapshot predates a tighter limit
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		default:
+			logger.Error("Failed to restore snapshot of document %s: %v", docID, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	logger.Info("Document %s restored to snapshot %d by user %d (%s)", docID, reqBody.CreatedAt, reqBody.UserID, reqBody.UserName)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/shiv248/kolabpad/pkg/database"
+	"github.com/shiv248/kolabpad/pkg/logger"
+)
+
+// Document writes that fail transiently (see database.IsTransient) are
+// retried with exponential backoff starting at storeRetryDelay, for at most
+// storeRetryBudget in total, so a busy database can't hold up shutdown.
+const (
+	storeRetryDelay  = 50 * time.Millisecond
+	storeRetryBudget = 2 * time.Second
+)
+
+// Store is the persistence backend the server depends on.
+// *database.Database is the production implementation.
+type Store interface {
+	// Load returns the stored document, or nil if it doesn't exist.
+	Load(id string) (*database.PersistedDocument, error)
+	// Exists reports whether a document is stored, without reading its text.
+	Exists(id string) (bool, error)
+	// ExistsCtx is Exists, bounded by ctx.
+	ExistsCtx(ctx context.Context, id string) (bool, error)
+	// GetOTP returns a document's OTP without reading its text; found is
+	// false if the document doesn't exist.
+	GetOTP(id string) (otp *string, found bool, err error)
+	// GetPasswordHash returns a document's password hash without reading its
+	// text, or nil if the document doesn't exist or has no password.
+	GetPasswordHash(id string) (*string, error)
+	// Store inserts or updates a document. ExpiryDays, MaxSize, PasswordHash
+	// and OwnerKey are only written on insert.
+	Store(doc *database.PersistedDocument) error
+	// StoreCtx is Store, bounded by ctx. The persister and shutdown use it so
+	// a hung database can't block them indefinitely.
+	StoreCtx(ctx context.Context, doc *database.PersistedDocument) error
+	// StoreIfNewer is StoreCtx for a document at revision, skipping the
+	// update (stored = false) if the document was stored at a later one.
+	// Flushes use it so one that finishes late can't undo a newer one.
+	StoreIfNewer(ctx context.Context, doc *database.PersistedDocument, revision int64) (stored bool, err error)
+	// Count returns the number of stored documents.
+	Count() (int, error)
+	// CountCtx is Count, bounded by ctx.
+	CountCtx(ctx context.Context) (int, error)
+	// Summary returns the stored documents' total text size and counts per
+	// language, without reading their text.
+	Summary() (database.Summary, error)
+	// IntegrityCheck verifies the database file, failing with
+	// database.ErrCorrupt if it is damaged. It may be slow.
+	IntegrityCheck() error
+	// Delete removes a document, its share links, snapshots and saved cursors;
+	// deleting a missing document is not an error.
+	Delete(id string) error
+	// Rename moves a document, its share links, snapshots and saved cursors
+	// to newID, failing with database.ErrExists if newID is stored.
+	Rename(id, newID string) error
+	// UpdateOTP sets the OTP of an existing document (nil disables protection).
+	UpdateOTP(id string, otp *string) error
+	// UpdateExpiry sets the expiry override of an existing document.
+	UpdateExpiry(id string, days *int) error
+	// UpdateMaxSize sets the size limit override of an existing document.
+	UpdateMaxSize(id string, size *int) error
+	// UpdatePassword sets the password hash of an existing document (nil removes it).
+	UpdatePassword(id string, hash *string) error
+	// UpdateOTPAsOwner sets the OTP of an existing document if ownerKey is
+	// its owner key or it has no owner, claiming it with claim (unless "")
+	// in the latter case. ok is false if the owner differs.
+	UpdateOTPAsOwner(id string, otp *string, ownerKey, claim string) (ok, claimed bool, err error)
+	// SwapOwnerKey replaces the owner key if it is oldKey (nil removes the owner).
+	SwapOwnerKey(id, oldKey string, newKey *string) (bool, error)
+	// CreateShareLink adds a share link to a document.
+	CreateShareLink(id string, link database.ShareLink) error
+	// ShareLinks returns a document's share links, oldest first.
+	ShareLinks(id string) ([]database.ShareLink, error)
+	// FindShareLink returns the document's share link with token, or nil.
+	FindShareLink(id, token string) (*database.ShareLink, error)
+	// RevokeShareLink deletes a share link, reporting whether it existed.
+	RevokeShareLink(id, token string) (bool, error)
+	// StoreSnapshot saves a snapshot of a document and deletes all but its
+	// newest keep snapshots.
+	StoreSnapshot(id string, snap database.Snapshot, keep int) error
+	// Snapshots returns a document's snapshots, newest first, without text.
+	Snapshots(id string) ([]database.Snapshot, error)
+	// LoadSnapshot returns the document's snapshot taken at createdAt, or nil.
+	LoadSnapshot(id string, createdAt int64) (*database.Snapshot, error)
+	// StoreCursors replaces a document's saved cursors.
+	StoreCursors(ctx context.Context, id string, cursors []database.SavedCursor) error
+	// LoadCursors returns a document's saved cursors.
+	LoadCursors(id string) ([]database.SavedCursor, error)
+	// Ping reports whether the backend is reachable.
+	Ping() error
+}
+
+var _ Store = (*database.Database)(nil)
+
+// storeWithRetry is db.StoreIfNewer, retrying transient failures such as a
+// busy or locked database. Other errors are returned at once; a transient one
+// is returned when the next retry would pass storeRetryBudget or ctx ends.
+func storeWithRetry(ctx context.Context, db Store, doc *database.PersistedDocument, revision int64) (bool, error) {
+	deadline := time.Now().Add(storeRetryBudget)
+	delay := storeRetryDelay
+	for attempt := 1; ; attempt++ {
+		stored, err := db.StoreIfNewer(ctx, doc, revision)
+		if err == nil || !database.IsTransient(err) || time.Now().Add(delay).After(deadline) {
+			return stored, err
+		}
+		logger.Debug("transient error storing document %s (attempt %d), retrying in %v: %v", doc.ID, attempt, delay, err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return stored, err
+		}
+		delay *= 2
+	}
+}
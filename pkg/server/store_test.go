@@ -0,0 +1,463 @@
+package server
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/shiv248/kolabpad/pkg/database"
+)
+
+// memStore is an in-memory Store for tests. It mirrors the SQLite semantics
+// the server relies on: Load of a missing document returns nil, Store only
+// writes ExpiryDays, PasswordHash and OwnerKey on insert, and updates of
+// missing documents are no-ops.
+type memStore struct {
+	mu    sync.Mutex
+	docs  map[string]database.PersistedDocument
+	links map[string][]database.ShareLink // By document ID
+	snaps map[string][]database.Snapshot  // By document ID, newest first
+	err   error                           // Returned by every call while set
+	stall chan struct{}                   // While set, StoreCtx hangs until it's closed or its context ends
+
+	curs map[string][]database.SavedCursor // By document ID
+
+	loads int // Number of Load calls, for checking paths that shouldn't read text
+
+	writeErrs []error // Returned by the next StoreIfNewer calls, one each
+	writes    int     // Number of StoreIfNewer calls
+}
+
+// newMemStore creates an empty in-memory store.
+func newMemStore() *memStore {
+	return &memStore{
+		docs:  make(map[string]database.PersistedDocument),
+		links: make(map[string][]database.ShareLink),
+		snaps: make(map[string][]database.Snapshot),
+		curs:  make(map[string][]database.SavedCursor),
+	}
+}
+
+// stallWrites makes StoreCtx hang like a wedged database until the returned
+// function is first called.
+func (m *memStore) stallWrites() (release func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stall := make(chan struct{})
+	m.stall = stall
+	return sync.OnceFunc(func() {
+		m.mu.Lock()
+		m.stall = nil
+		m.mu.Unlock()
+		close(stall)
+	})
+}
+
+// failWrites makes the next len(errs) StoreIfNewer calls fail with errs, in
+// order.
+func (m *memStore) failWrites(errs ...error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.writeErrs = append(m.writeErrs, errs...)
+}
+
+// writeCount returns the number of StoreIfNewer calls so far.
+func (m *memStore) writeCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.writes
+}
+
+// fail makes every subsequent call return err (nil restores normal behavior).
+func (m *memStore) fail(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.err = err
+}
+
+func (m *memStore) Load(id string) (*database.PersistedDocument, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.loads++
+	if m.err != nil {
+		return nil, m.err
+	}
+	doc, ok := m.docs[id]
+	if !ok {
+		return nil, nil
+	}
+	return &doc, nil
+}
+
+func (m *memStore) Exists(id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return false, m.err
+	}
+	_, ok := m.docs[id]
+	return ok, nil
+}
+
+func (m *memStore) ExistsCtx(ctx context.Context, id string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return m.Exists(id)
+}
+
+func (m *memStore) GetOTP(id string) (*string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return nil, false, m.err
+	}
+	doc, ok := m.docs[id]
+	if !ok {
+		return nil, false, nil
+	}
+	return doc.OTP, true, nil
+}
+
+func (m *memStore) GetPasswordHash(id string) (*string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	return m.docs[id].PasswordHash, nil
+}
+
+// loadCount returns the number of Load calls so far.
+func (m *memStore) loadCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.loads
+}
+
+func (m *memStore) Store(doc *database.PersistedDocument) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	stored := *doc
+	stored.Revision = 0
+	if existing, ok := m.docs[doc.ID]; ok {
+		stored.ExpiryDays = existing.ExpiryDays
+		stored.MaxSize = existing.MaxSize
+		stored.PasswordHash = existing.PasswordHash
+		stored.Revision = existing.Revision
+	}
+	m.docs[doc.ID] = stored
+	return nil
+}
+
+func (m *memStore) StoreCtx(ctx context.Context, doc *database.PersistedDocument) error {
+	m.mu.Lock()
+	stall := m.stall
+	m.mu.Unlock()
+	if stall != nil {
+		select {
+		case <-stall:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return m.Store(doc)
+}
+
+func (m *memStore) StoreIfNewer(ctx context.Context, doc *database.PersistedDocument, revision int64) (bool, error) {
+	m.mu.Lock()
+	stall := m.stall
+	m.mu.Unlock()
+	if stall != nil {
+		select {
+		case <-stall:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.writes++
+	if m.err != nil {
+		return false, m.err
+	}
+	if len(m.writeErrs) > 0 {
+		err := m.writeErrs[0]
+		m.writeErrs = m.writeErrs[1:]
+		return false, err
+	}
+	stored := *doc
+	stored.Revision = revision
+	if existing, ok := m.docs[doc.ID]; ok {
+		if revision < existing.Revision {
+			return false, nil
+		}
+		stored.ExpiryDays = existing.ExpiryDays
+		stored.MaxSize = existing.MaxSize
+		stored.PasswordHash = existing.PasswordHash
+	}
+	m.docs[doc.ID] = stored
+	return true, nil
+}
+
+func (m *memStore) Count() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return 0, m.err
+	}
+	return len(m.docs), nil
+}
+
+func (m *memStore) IntegrityCheck() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+func (m *memStore) CountCtx(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return m.Count()
+}
+
+func (m *memStore) Summary() (database.Summary, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return database.Summary{}, m.err
+	}
+	summary := database.Summary{Documents: len(m.docs), Languages: make(map[string]int)}
+	for _, doc := range m.docs {
+		summary.TextBytes += int64(len(doc.Text))
+		language := ""
+		if doc.Language != nil {
+			language = *doc.Language
+		}
+		summary.Languages[language]++
+	}
+	return summary, nil
+}
+
+func (m *memStore) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	delete(m.docs, id)
+	delete(m.links, id)
+	delete(m.snaps, id)
+	delete(m.curs, id)
+	return nil
+}
+
+func (m *memStore) Rename(id, newID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	if _, ok := m.docs[newID]; ok {
+		return database.ErrExists
+	}
+	if doc, ok := m.docs[id]; ok {
+		doc.ID = newID
+		m.docs[newID] = doc
+	}
+	m.links[newID], m.snaps[newID], m.curs[newID] = m.links[id], m.snaps[id], m.curs[id]
+	delete(m.docs, id)
+	delete(m.links, id)
+	delete(m.snaps, id)
+	delete(m.curs, id)
+	return nil
+}
+
+func (m *memStore) UpdateOTP(id string, otp *string) error {
+	return m.update(id, func(doc *database.PersistedDocument) { doc.OTP = otp })
+}
+
+func (m *memStore) UpdateExpiry(id string, days *int) error {
+	return m.update(id, func(doc *database.PersistedDocument) { doc.ExpiryDays = days })
+}
+
+func (m *memStore) UpdateMaxSize(id string, size *int) error {
+	return m.update(id, func(doc *database.PersistedDocument) { doc.MaxSize = size })
+}
+
+func (m *memStore) UpdatePassword(id string, hash *string) error {
+	return m.update(id, func(doc *database.PersistedDocument) { doc.PasswordHash = hash })
+}
+
+func (m *memStore) UpdateOTPAsOwner(id string, otp *string, ownerKey, claim string) (bool, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return false, false, m.err
+	}
+	doc, ok := m.docs[id]
+	if !ok || (doc.OwnerKey != nil && *doc.OwnerKey != ownerKey) {
+		return false, false, nil
+	}
+	claimed := doc.OwnerKey == nil && claim != ""
+	if claimed {
+		doc.OwnerKey = &claim
+	}
+	doc.OTP = otp
+	m.docs[id] = doc
+	return true, claimed, nil
+}
+
+func (m *memStore) SwapOwnerKey(id, oldKey string, newKey *string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return false, m.err
+	}
+	doc, ok := m.docs[id]
+	if !ok || doc.OwnerKey == nil || *doc.OwnerKey != oldKey {
+		return false, nil
+	}
+	doc.OwnerKey = newKey
+	m.docs[id] = doc
+	return true, nil
+}
+
+func (m *memStore) CreateShareLink(id string, link database.ShareLink) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.links[id] = append(m.links[id], link)
+	return nil
+}
+
+func (m *memStore) ShareLinks(id string) ([]database.ShareLink, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	return slices.Clone(m.links[id]), nil
+}
+
+func (m *memStore) FindShareLink(id, token string) (*database.ShareLink, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	for _, link := range m.links[id] {
+		if link.Token == token {
+			return &link, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *memStore) RevokeShareLink(id, token string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return false, m.err
+	}
+	links := m.links[id]
+	i := slices.IndexFunc(links, func(link database.ShareLink) bool { return link.Token == token })
+	if i < 0 {
+		return false, nil
+	}
+	m.links[id] = slices.Delete(links, i, i+1)
+	return true, nil
+}
+
+func (m *memStore) StoreSnapshot(id string, snap database.Snapshot, keep int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	snap.Size = len(snap.Text)
+	snaps := slices.DeleteFunc(m.snaps[id], func(s database.Snapshot) bool { return s.CreatedAt == snap.CreatedAt })
+	snaps = append(snaps, snap)
+	slices.SortFunc(snaps, func(a, b database.Snapshot) int { return int(b.CreatedAt - a.CreatedAt) })
+	m.snaps[id] = snaps[:min(len(snaps), keep)]
+	return nil
+}
+
+func (m *memStore) Snapshots(id string) ([]database.Snapshot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	snaps := slices.Clone(m.snaps[id])
+	for i := range snaps {
+		snaps[i].Text = ""
+	}
+	return snaps, nil
+}
+
+func (m *memStore) LoadSnapshot(id string, createdAt int64) (*database.Snapshot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	for _, snap := range m.snaps[id] {
+		if snap.CreatedAt == createdAt {
+			return &snap, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *memStore) StoreCursors(ctx context.Context, id string, cursors []database.SavedCursor) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.curs[id] = slices.Clone(cursors)
+	return nil
+}
+
+func (m *memStore) LoadCursors(id string) ([]database.SavedCursor, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	return slices.Clone(m.curs[id]), nil
+}
+
+func (m *memStore) Ping() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// update applies fn to an existing document.
+func (m *memStore) update(id string, fn func(*database.PersistedDocument)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	if doc, ok := m.docs[id]; ok {
+		fn(&doc)
+		m.docs[id] = doc
+	}
+	return nil
+}
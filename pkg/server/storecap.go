@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/shiv248/kolabpad/pkg/database"
+)
+
+// storedCountTTL is how long cappedStore trusts its document count before
+// counting again. Inserts it makes itself are counted as they happen, so the
+// refresh only picks up deletions and other writers.
+const storedCountTTL = time.Minute
+
+// ErrStorageFull is returned for writes that would add a document to a
+// database already holding Config.MaxStoredDocuments. Updates to documents
+// already stored still succeed.
+var ErrStorageFull = errors.New("document storage is full")
+
+// backend names the Store a cappedStore wraps; embedding Store directly
+// would clash with the Store method.
+type backend = Store
+
+// cappedStore wraps a Store to enforce Config.MaxStoredDocuments. The count
+// is cached, so writes cost an Exists lookup rather than a COUNT.
+type cappedStore struct {
+	backend
+	max int
+
+	mu      sync.Mutex
+	count   int
+	counted time.Time // Zero when the count must be refreshed
+}
+
+// newCappedStore limits db to max documents.
+func newCappedStore(db Store, max int) *cappedStore {
+	return &cappedStore{backend: db, max: max}
+}
+
+// Store inserts or updates doc, failing with ErrStorageFull if it's new and
+// the database is at its limit.
+func (c *cappedStore) Store(doc *database.PersistedDocument) error {
+	return c.StoreCtx(context.Background(), doc)
+}
+
+// StoreCtx is Store, bounded by ctx.
+func (c *cappedStore) StoreCtx(ctx context.Context, doc *database.PersistedDocument) error {
+	return c.store(ctx, doc.ID, func() error {
+		return c.backend.StoreCtx(ctx, doc)
+	})
+}
+
+// StoreIfNewer is StoreCtx for a document at revision (see Store).
+func (c *cappedStore) StoreIfNewer(ctx context.Context, doc *database.PersistedDocument, revision int64) (bool, error) {
+	var stored bool
+	err := c.store(ctx, doc.ID, func() error {
+		var err error
+		stored, err = c.backend.StoreIfNewer(ctx, doc, revision)
+		return err
+	})
+	return stored, err
+}
+
+// store runs write, which stores document id, if id is already stored or
+// there is room for another document.
+func (c *cappedStore) store(ctx context.Context, id string, write func() error) error {
+	exists, err := c.backend.ExistsCtx(ctx, id)
+	if err != nil {
+		return fmt.Errorf("check document: %w", err)
+	}
+	if exists {
+		return write()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counted.IsZero() || time.Since(c.counted) > storedCountTTL {
+		count, err := c.backend.CountCtx(ctx)
+		if err != nil {
+			return fmt.Errorf("count documents: %w", err)
+		}
+		c.count, c.counted = count, time.Now()
+	}
+	if c.count >= c.max {
+		return fmt.Errorf("%w: %d of %d documents stored", ErrStorageFull, c.count, c.max)
+	}
+	if err := write(); err != nil {
+		return err
+	}
+	c.count++
+	return nil
+}
+
+// Delete removes a document and marks the count for a refresh, since
+// deleting a missing document isn't an error and may not free a slot.
+func (c *cappedStore) Delete(id string) error {
+	err := c.backend.Delete(id)
+	c.mu.Lock()
+	c.counted = time.Time{}
+	c.mu.Unlock()
+	return err
+}
+
+// writeStoreError responds to a failed database write: 507 when storage is
+// full, so clients can tell it apart from an outage, and 500 otherwise.
+func writeStoreError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrStorageFull) {
+		http.Error(w, "document storage is full; this document can't be saved", http.StatusInsufficientStorage)
+		return
+	}
+	http.Error(w, "internal error", http.StatusInternalServerError)
+}
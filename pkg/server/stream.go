@@ -0,0 +1,191 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/shiv248/kolabpad/internal/protocol"
+	"github.com/shiv248/kolabpad/pkg/database"
+	"github.com/shiv248/kolabpad/pkg/logger"
+)
+
+// streamInterval is the shortest time between two document events on a
+// stream. Each event carries the full text, so a burst of edits is sent as
+// one event per interval rather than one per keystroke.
+const streamInterval = 250 * time.Millisecond
+
+// streamEvent is the data of a document event.
+type streamEvent struct {
+	Revision int     `json:"revision"`
+	Text     string  `json:"text"`
+	Language *string `json:"language"`
+}
+
+// watch subscribes a read-only stream to metadata broadcasts under a fresh
+// ID that is never registered as a user, so other clients don't see it. If
+// the stream was admitted with a share link, revoking the link calls kick.
+// Call the returned func when the stream ends.
+func (r *Kolabpad) watch(link *database.ShareLink, kick func()) (<-chan *protocol.ServerMsg, func()) {
+	id := r.NextUserID()
+	updates := r.Subscribe(id)
+	if link != nil {
+		r.GrantAccess(id, link.Token, kick)
+	}
+	return updates, func() {
+		r.mu.Lock()
+		delete(r.grants, id)
+		r.mu.Unlock()
+		r.Unsubscribe(id)
+		r.connections.Add(-1)
+	}
+}
+
+// handleStream serves a document as Server-Sent Events, for read-only embeds
+// that can't speak the WebSocket protocol: a document event with the full
+// text now, then another whenever it or the language changes, and a close
+// event when the stream ends on the server's side. Authorization is as for
+// /raw, except that the document must already exist. The stream also ends if
+// the document is protected with an OTP other than the one it was opened
+// with, or its share link is revoked.
+// Route: /api/document/{id}/stream
+func (s *Server) handleStream(w http.ResponseWriter, r *http.Request, docID string) {
+	if s.state.draining.Load() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	providedOTP := r.URL.Query().Get("otp")
+	var otp *string
+	if val, ok := s.state.documents.Load(docID); ok {
+		otp = val.(*Document).Kolabpad.GetOTP()
+	} else {
+		var found bool
+		if s.state.db != nil {
+			var err error
+			if otp, found, err = s.state.db.GetOTP(docID); err != nil {
+				logger.Error("Failed to load document %s for stream: %v", docID, err)
+				http.Error(w, "failed to load document", http.StatusInternalServerError)
+				return
+			}
+		}
+		if !found {
+			http.Error(w, "document not found", http.StatusNotFound)
+			return
+		}
+	}
+	link, ok := s.authorizeOTP(docID, providedOTP, otp)
+	if !ok {
+		http.Error(w, "Invalid or missing OTP", http.StatusUnauthorized)
+		return
+	}
+	if !s.authorizePassword(w, r, docID) {
+		return
+	}
+
+	doc := s.acquireDocument(docID)
+	defer s.releaseDocument(docID, doc)
+	kolabpad := doc.Kolabpad
+
+	ctx, cancel := context.WithCancelCause(r.Context())
+	defer cancel(nil)
+	updates, unwatch := kolabpad.watch(link, func() { cancel(errAccessRevoked) })
+	defer unwatch()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no") // Don't let nginx buffer events
+	rc := http.NewResponseController(w)
+	send := func(frame string) error {
+		// Like a WebSocket write: the base timeout, plus time for large frames
+		if timeout := s.state.config.WSWriteTimeout; timeout > 0 {
+			if throughput := s.state.config.WSWriteThroughput; throughput > 0 {
+				timeout += time.Duration(len(frame)) * time.Second / time.Duration(throughput)
+			}
+			rc.SetWriteDeadline(time.Now().Add(timeout))
+		}
+		if _, err := io.WriteString(w, frame); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	write := func(event string, data any) error {
+		payload, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		return send(fmt.Sprintf("event: %s\ndata: %s\n\n", event, payload))
+	}
+	closeWith := func(reason string) {
+		write("close", map[string]string{"reason": reason})
+	}
+
+	var heartbeat <-chan time.Time
+	if interval := s.state.config.WSHeartbeatInterval; interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+
+	logger.Info("Stream opened for document %s from %s", docID, s.clientIP(r))
+	defer logger.Info("Stream closed for document %s from %s", docID, s.clientIP(r))
+
+	sent, changed := -1, true
+	var lastSent time.Time
+	var wait <-chan time.Time // Set while an event waits out streamInterval
+	for {
+		notified := kolabpad.NotifyChannel()
+		if kolabpad.Killed() {
+			closeWith("shutdown")
+			return
+		}
+
+		if (changed || kolabpad.Revision() != sent) && wait == nil {
+			if d := streamInterval - time.Since(lastSent); d > 0 {
+				wait = time.After(d)
+			} else {
+				// Read together, so an edit landing in between can't mark
+				// its revision sent with the text from before it
+				text, language, revision := kolabpad.textAt()
+				if err := write("document", streamEvent{Revision: revision, Text: text, Language: language}); err != nil {
+					logger.Debug("Stream for document %s failed: %v", docID, err)
+					return
+				}
+				sent, changed, lastSent = revision, false, time.Now()
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if errors.Is(context.Cause(ctx), errAccessRevoked) {
+				closeWith("revoked")
+			}
+			return
+		case <-notified:
+		case <-wait:
+			wait = nil
+		case msg, ok := <-updates:
+			if !ok {
+				closeWith("shutdown")
+				return
+			}
+			if msg.Language != nil {
+				changed = true
+			}
+			if msg.OTP != nil && link == nil && msg.OTP.OTP != nil && *msg.OTP.OTP != providedOTP {
+				logger.Info("Stream for document %s closed: document was protected", docID)
+				closeWith("protected")
+				return
+			}
+		case <-heartbeat:
+			// SSE comment lines keep proxies from timing out an idle stream
+			if send(": ping\n\n") != nil {
+				return
+			}
+		}
+	}
+}
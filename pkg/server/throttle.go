@@ -0,0 +1,92 @@
+package server
+
+import (
+	"time"
+
+	"github.com/shiv248/kolabpad/internal/protocol"
+)
+
+// cursorThrottle limits how often one connection's cursor updates are
+// broadcast. An update arriving within interval of the last one applied is
+// held, replacing any held before it, and applied once the interval ends, so
+// other clients always end up with the latest position. It is only used
+// from the connection's main loop.
+type cursorThrottle struct {
+	interval time.Duration // 0 = every update is applied at once
+	last     time.Time     // When the last update was applied
+	pending  *protocol.CursorData
+	timer    *time.Timer // Running while an update is held
+}
+
+// offer returns data if it may be applied now; otherwise it holds data until
+// due fires and returns nil.
+func (t *cursorThrottle) offer(data protocol.CursorData, now time.Time) *protocol.CursorData {
+	if t.interval <= 0 || (t.pending == nil && now.Sub(t.last) >= t.interval) {
+		t.last = now
+		return &data
+	}
+	t.pending = &data
+	if t.timer == nil {
+		t.timer = time.NewTimer(t.interval - now.Sub(t.last))
+	}
+	return nil
+}
+
+// due returns a channel that fires when the held update may be applied, or
+// nil (which blocks forever in a select) if none is held.
+func (t *cursorThrottle) due() <-chan time.Time {
+	if t.timer == nil {
+		return nil
+	}
+	return t.timer.C
+}
+
+// take returns the held update, to be applied now that due has fired.
+func (t *cursorThrottle) take(now time.Time) *protocol.CursorData {
+	data := t.pending
+	t.pending, t.timer, t.last = nil, nil, now
+	return data
+}
+
+// reset discards any held update, counting now as when the last one was
+// applied, for an update applied without going through offer.
+func (t *cursorThrottle) reset(now time.Time) {
+	t.stop()
+	t.last = now
+}
+
+// stop discards any held update.
+func (t *cursorThrottle) stop() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.pending, t.timer = nil, nil
+}
+
+// tokenBucket allows bursts of up to perMinute events, refilling at
+// perMinute a minute. perMinute <= 0 allows everything.
+type tokenBucket struct {
+	perMinute int
+	tokens    float64
+	last      time.Time // Zero until the first event, when the bucket starts full
+}
+
+// allow reports whether an event at now is within the limit, using up a
+// token if so.
+func (b *tokenBucket) allow(now time.Time) bool {
+	if b.perMinute <= 0 {
+		return true
+	}
+	if b.last.IsZero() {
+		b.tokens = float64(b.perMinute)
+	} else {
+		b.tokens += now.Sub(b.last).Minutes() * float64(b.perMinute)
+		b.tokens = min(b.tokens, float64(b.perMinute))
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
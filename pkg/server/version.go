@@ -0,0 +1,44 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/shiv248/kolabpad/internal/protocol"
+)
+
+// Build information, injected at build time:
+//
+//	go build -ldflags "-X github.com/shiv248/kolabpad/pkg/server.Version=v1.2.0 \
+//	    -X github.com/shiv248/kolabpad/pkg/server.Commit=$(git rev-parse HEAD) \
+//	    -X github.com/shiv248/kolabpad/pkg/server.BuildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildTime = "unknown"
+)
+
+// VersionInfo identifies the running server build for /api/version.
+type VersionInfo struct {
+	Version         string `json:"version"`          // Release version ("dev" for local builds)
+	Commit          string `json:"commit"`           // Git commit the binary was built from
+	BuildTime       string `json:"build_time"`       // UTC build timestamp
+	ProtocolVersion int    `json:"protocol_version"` // WebSocket protocol revision (see protocol.Version)
+}
+
+// handleVersion returns the server's build and protocol versions.
+// Route: /api/version
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(VersionInfo{
+		Version:         Version,
+		Commit:          Commit,
+		BuildTime:       BuildTime,
+		ProtocolVersion: protocol.Version,
+	})
+}